@@ -1,29 +1,90 @@
 package apigateway
 
 import (
+	"ecommerce/internal/auth"
 	"ecommerce/proto"
+	"encoding/json"
 	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
 	"net/http"
+	"sort"
 	"strconv"
+	"strings"
 )
 
 func (s *Server) SetupRoutes(r *gin.Engine) {
-	r.Use(s.Logger(), s.Auth())
+	r.Use(s.Logger(), s.Auth(), s.IdempotencyKey())
 
-	r.POST("/products", s.createProduct)
-	r.GET("/products/:id", s.getProduct)
-	r.PATCH("/products/:id", s.updateProduct)
-	r.DELETE("/products/:id", s.deleteProduct)
-	r.GET("/products", s.listProducts)
+	r.POST("/products", s.Require(auth.PermProductsWrite), s.createProduct)
+	r.GET("/products/search", s.Require(auth.PermProductsRead), s.searchProducts)
+	r.GET("/products/:id", s.Require(auth.PermProductsRead), s.getProduct)
+	r.PATCH("/products/:id", s.Require(auth.PermProductsWrite), s.updateProduct)
+	r.DELETE("/products/:id", s.Require(auth.PermProductsDelete), s.deleteProduct)
+	r.GET("/products", s.Require(auth.PermProductsRead), s.listProducts)
+	r.POST("/products/:id/variants", s.Require(auth.PermProductsWrite), s.addVariant)
+	r.PATCH("/products/:id/variants/:variant_id", s.Require(auth.PermProductsWrite), s.updateVariant)
+	r.DELETE("/products/:id/variants/:variant_id", s.Require(auth.PermProductsDelete), s.deleteVariant)
+	r.GET("/skus", s.Require(auth.PermProductsRead), s.searchSKUs)
+	r.GET("/skus/:sku", s.Require(auth.PermProductsRead), s.getSKU)
+	r.GET("/categories", s.Require(auth.PermProductsRead), s.listCategories)
+	r.POST("/categories", s.Require(auth.PermProductsWrite), s.createCategory)
+	r.GET("/categories/:id", s.Require(auth.PermProductsRead), s.getCategory)
+	r.PATCH("/categories/:id", s.Require(auth.PermProductsWrite), s.updateCategory)
+	r.DELETE("/categories/:id", s.Require(auth.PermProductsDelete), s.deleteCategory)
+	r.POST("/categories/:id/move", s.Require(auth.PermProductsWrite), s.moveCategory)
+	r.GET("/categories/:id/products", s.Require(auth.PermProductsRead), s.listCategoryProducts)
+	r.GET("/stock/movements", s.Require(auth.PermStockRead), s.listStockMovements)
+	r.POST("/stock/adjust", s.Require(auth.PermProductsWrite), s.adjustStock)
+	r.POST("/stock/set", s.Require(auth.PermProductsWrite), s.setStock)
+	r.GET("/stock/transfers", s.Require(auth.PermStockRead), s.listTransfers)
+	r.POST("/stock/transfers", s.Require(auth.PermProductsWrite), s.createTransfer)
+	r.POST("/stock/transfers/:id/receive", s.Require(auth.PermProductsWrite), s.receiveTransfer)
+	r.POST("/stock/transfers/:id/cancel", s.Require(auth.PermProductsWrite), s.cancelTransfer)
+	r.GET("/stock/reorder-report", s.Require(auth.PermStockRead), s.getReorderReport)
+	r.GET("/locations", s.Require(auth.PermStockRead), s.listLocations)
+	r.POST("/locations", s.Require(auth.PermProductsWrite), s.createLocation)
 
-	r.POST("/orders", s.createOrder)
-	r.GET("/orders/:id", s.getOrder)
-	r.PATCH("/orders/:id", s.updateOrder)
-	r.GET("/orders", s.listOrders)
+	r.POST("/orders", s.Require(auth.PermOrdersCreate), s.createOrder)
+	r.GET("/orders/:id", s.Require(auth.PermOrdersRead), s.getOrder)
+	r.PATCH("/orders/:id", s.Require(auth.PermOrdersCancel), s.updateOrder)
+	r.GET("/orders", s.Require(auth.PermOrdersRead), s.listOrders)
 
 	r.POST("/users/register", s.registerUser)
 	r.POST("/users/login", s.login)
-	r.GET("/users/:id", s.getUser)
+	r.POST("/users/login/2fa", s.loginTwoFactor)
+	r.POST("/users/refresh", s.refresh)
+	r.POST("/users/logout", s.Require(auth.PermSessionsManage), s.logout)
+	r.POST("/users/logout-all", s.Require(auth.PermSessionsManage), s.logoutAll)
+	r.GET("/users/sessions", s.Require(auth.PermSessionsManage), s.listSessions)
+	r.POST("/users/password/forgot", s.forgotPassword)
+	r.POST("/users/password/reset", s.resetPassword)
+	r.POST("/users/verify-email", s.verifyEmail)
+	r.POST("/users/verify-email/send", s.Require(auth.PermUsersRead), s.sendVerificationEmail)
+	r.POST("/users/password/change", s.Require(auth.PermUsersUpdate), s.changePassword)
+	r.POST("/users/2fa/enroll", s.Require(auth.PermUsersUpdate), s.enrollTwoFactor)
+	r.POST("/users/2fa/confirm", s.Require(auth.PermUsersUpdate), s.confirmTwoFactor)
+	r.POST("/users/2fa/disable", s.Require(auth.PermUsersUpdate), s.disableTwoFactor)
+	r.GET("/users/:id", s.Require(auth.PermUsersRead), s.getUser)
+	r.PATCH("/users/:id", s.Require(auth.PermUsersUpdate), s.updateUser)
+	r.DELETE("/users/:id", s.Require(auth.PermUsersUpdate), s.deleteUser)
+	r.GET("/users/:id/addresses", s.Require(auth.PermUsersRead), s.listAddresses)
+	r.POST("/users/:id/addresses", s.Require(auth.PermUsersUpdate), s.createAddress)
+	r.GET("/users/:id/addresses/:address_id", s.Require(auth.PermUsersRead), s.getAddress)
+	r.PUT("/users/:id/addresses/:address_id", s.Require(auth.PermUsersUpdate), s.updateAddress)
+	r.DELETE("/users/:id/addresses/:address_id", s.Require(auth.PermUsersUpdate), s.deleteAddress)
+
+	r.POST("/admin/users/:id/roles", s.Require(auth.PermUsersManage), s.grantRole)
+	r.DELETE("/admin/users/:id/roles/:role", s.Require(auth.PermUsersManage), s.revokeRole)
+	r.POST("/admin/users/:id/logout-all", s.Require(auth.PermSessionsRevoke), s.revokeUserSessions)
+	r.DELETE("/admin/users/:id/2fa", s.Require(auth.PermUsersUpdateAny), s.resetTwoFactor)
+	r.GET("/admin/2fa/requirements", s.Require(auth.PermUsersManage), s.listTwoFactorRequirements)
+	r.PUT("/admin/2fa/requirements/:role", s.Require(auth.PermUsersManage), s.setTwoFactorRequirement)
+	r.GET("/admin/lockouts", s.Require(auth.PermLockoutsManage), s.listLockouts)
+	r.POST("/admin/lockouts/clear", s.Require(auth.PermLockoutsManage), s.clearLockout)
+
+	r.GET("/.well-known/jwks.json", s.getJWKS)
 }
 
 func (s *Server) createProduct(c *gin.Context) {
@@ -34,7 +95,7 @@ func (s *Server) createProduct(c *gin.Context) {
 	}
 	resp, err := s.invClient.CreateProduct(c.Request.Context(), &req)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		c.JSON(productErrorStatus(err), gin.H{"error": err.Error()})
 		return
 	}
 	c.JSON(http.StatusOK, resp)
@@ -47,21 +108,51 @@ func (s *Server) getProduct(c *gin.Context) {
 		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
 		return
 	}
+	setETag(c, resp.Version)
 	c.JSON(http.StatusOK, resp)
 }
 
+// updateProduct changes only the fields present in the body, including
+// empty ones, by sending them as the update mask. The version the change is
+// based on can be given as If-Match or expected_version.
 func (s *Server) updateProduct(c *gin.Context) {
+	body, err := c.GetRawData()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 	var req proto.UpdateProductRequest
-	req.Id = c.Param("id")
-	if err := c.ShouldBindJSON(&req); err != nil {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	req.Id = c.Param("id")
+	version, ok := ifMatch(c)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "If-Match must be an ETag returned by the API"})
+		return
+	}
+	if version != 0 {
+		req.ExpectedVersion = version
+	}
+	req.UpdateMask = &fieldmaskpb.FieldMask{}
+	for field := range fields {
+		if field != "id" && field != "update_mask" && field != "expected_version" {
+			req.UpdateMask.Paths = append(req.UpdateMask.Paths, field)
+		}
+	}
+	sort.Strings(req.UpdateMask.Paths)
 	resp, err := s.invClient.UpdateProduct(c.Request.Context(), &req)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		c.JSON(preconditionStatus(c, err, productErrorStatus(err)), gin.H{"error": err.Error()})
 		return
 	}
+	setETag(c, resp.Version)
 	c.JSON(http.StatusOK, resp)
 }
 
@@ -69,7 +160,7 @@ func (s *Server) deleteProduct(c *gin.Context) {
 	id := c.Param("id")
 	_, err := s.invClient.DeleteProduct(c.Request.Context(), &proto.DeleteProductRequest{Id: id})
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		c.JSON(errorStatus(err, http.StatusInternalServerError), gin.H{"error": err.Error()})
 		return
 	}
 	c.JSON(http.StatusOK, gin.H{"message": "product deleted"})
@@ -79,16 +170,387 @@ func (s *Server) listProducts(c *gin.Context) {
 	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
 	pageSize, _ := strconv.Atoi(c.DefaultQuery("page_size", "10"))
 	resp, err := s.invClient.ListProducts(c.Request.Context(), &proto.ListProductsRequest{
-		Page:     int32(page),
-		PageSize: int32(pageSize),
+		Page:      int32(page),
+		PageSize:  int32(pageSize),
+		PageToken: c.Query("page_token"),
+	})
+	if err != nil {
+		c.JSON(productErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// searchProducts searches the catalog, e.g.
+// /products/search?q=shirt&category=clothing&max_price=50&in_stock=true&sort=price_asc.
+func (s *Server) searchProducts(c *gin.Context) {
+	req := proto.SearchProductsRequest{Query: c.Query("q"), Category: c.Query("category"), Sort: c.Query("sort")}
+	for param, value := range map[string]*float64{"min_price": &req.MinPrice, "max_price": &req.MaxPrice} {
+		if raw := c.Query(param); raw != "" {
+			price, err := strconv.ParseFloat(raw, 64)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid " + param})
+				return
+			}
+			*value = price
+		}
+	}
+	if raw := c.Query("in_stock"); raw != "" {
+		inStock, err := strconv.ParseBool(raw)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid in_stock"})
+			return
+		}
+		req.InStock = inStock
+	}
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	pageSize, _ := strconv.Atoi(c.DefaultQuery("page_size", "10"))
+	req.Page, req.PageSize = int32(page), int32(pageSize)
+
+	resp, err := s.invClient.SearchProducts(c.Request.Context(), &req)
+	if err != nil {
+		c.JSON(productErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	products, categories, prices := resp.Products, resp.Categories, resp.Prices
+	if products == nil {
+		products = []*proto.ProductResponse{}
+	}
+	if categories == nil {
+		categories = []*proto.CategoryFacet{}
+	}
+	if prices == nil {
+		prices = []*proto.PriceFacet{}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"products": products,
+		"total":    resp.Total,
+		"facets":   gin.H{"categories": categories, "prices": prices},
+	})
+}
+
+func (s *Server) addVariant(c *gin.Context) {
+	var req proto.Variant
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	req.ProductId = c.Param("id")
+	resp, err := s.invClient.AddVariant(c.Request.Context(), &req)
+	if err != nil {
+		c.JSON(productErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, resp)
+}
+
+func (s *Server) updateVariant(c *gin.Context) {
+	var req proto.UpdateVariantRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	req.Id = c.Param("variant_id")
+	req.ProductId = c.Param("id")
+	resp, err := s.invClient.UpdateVariant(c.Request.Context(), &req)
+	if err != nil {
+		c.JSON(productErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+func (s *Server) deleteVariant(c *gin.Context) {
+	_, err := s.invClient.DeleteVariant(c.Request.Context(), &proto.DeleteVariantRequest{Id: c.Param("variant_id"), ProductId: c.Param("id")})
+	if err != nil {
+		c.JSON(productErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "variant deleted"})
+}
+
+func (s *Server) searchSKUs(c *gin.Context) {
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	pageSize, _ := strconv.Atoi(c.DefaultQuery("page_size", "20"))
+	resp, err := s.invClient.SearchVariants(c.Request.Context(), &proto.SearchVariantsRequest{
+		SkuPrefix: c.Query("prefix"),
+		Page:      int32(page),
+		PageSize:  int32(pageSize),
+	})
+	if err != nil {
+		c.JSON(productErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	variants := resp.Variants
+	if variants == nil {
+		variants = []*proto.Variant{}
+	}
+	c.JSON(http.StatusOK, gin.H{"variants": variants, "total": resp.Total})
+}
+
+func (s *Server) getSKU(c *gin.Context) {
+	resp, err := s.invClient.GetVariant(c.Request.Context(), &proto.GetVariantRequest{Sku: c.Param("sku")})
+	if err != nil {
+		c.JSON(productErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+func (s *Server) listCategories(c *gin.Context) {
+	resp, err := s.invClient.ListCategories(c.Request.Context(), &proto.ListCategoriesRequest{ParentId: c.Query("parent_id")})
+	if err != nil {
+		c.JSON(productErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	categories := resp.Categories
+	if categories == nil {
+		categories = []*proto.Category{}
+	}
+	c.JSON(http.StatusOK, gin.H{"categories": categories})
+}
+
+func (s *Server) createCategory(c *gin.Context) {
+	var req proto.CreateCategoryRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	resp, err := s.invClient.CreateCategory(c.Request.Context(), &req)
+	if err != nil {
+		c.JSON(productErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, resp)
+}
+
+// getCategory looks a category up by ID or slug; the inventory service tells
+// them apart.
+func (s *Server) getCategory(c *gin.Context) {
+	resp, err := s.invClient.GetCategory(c.Request.Context(), &proto.GetCategoryRequest{Id: c.Param("id")})
+	if err != nil {
+		c.JSON(productErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+func (s *Server) updateCategory(c *gin.Context) {
+	var req proto.UpdateCategoryRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	req.Id = c.Param("id")
+	resp, err := s.invClient.UpdateCategory(c.Request.Context(), &req)
+	if err != nil {
+		c.JSON(productErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+func (s *Server) deleteCategory(c *gin.Context) {
+	if _, err := s.invClient.DeleteCategory(c.Request.Context(), &proto.DeleteCategoryRequest{Id: c.Param("id")}); err != nil {
+		c.JSON(productErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "category deleted"})
+}
+
+func (s *Server) moveCategory(c *gin.Context) {
+	var req proto.MoveCategoryRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	req.Id = c.Param("id")
+	resp, err := s.invClient.MoveCategory(c.Request.Context(), &req)
+	if err != nil {
+		c.JSON(productErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+func (s *Server) listCategoryProducts(c *gin.Context) {
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	pageSize, _ := strconv.Atoi(c.DefaultQuery("page_size", "10"))
+	resp, err := s.invClient.ListCategoryProducts(c.Request.Context(), &proto.ListCategoryProductsRequest{
+		CategoryId: c.Param("id"),
+		Page:       int32(page),
+		PageSize:   int32(pageSize),
+	})
+	if err != nil {
+		c.JSON(productErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+func (s *Server) listStockMovements(c *gin.Context) {
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	pageSize, _ := strconv.Atoi(c.DefaultQuery("page_size", "20"))
+	resp, err := s.invClient.ListStockMovements(c.Request.Context(), &proto.ListStockMovementsRequest{
+		ProductId: c.Query("product_id"),
+		VariantId: c.Query("variant_id"),
+		Sku:       c.Query("sku"),
+		Reason:    c.Query("reason"),
+		Reference: c.Query("reference"),
+		Location:  c.Query("location"),
+		Page:      int32(page),
+		PageSize:  int32(pageSize),
 	})
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		c.JSON(productErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	movements := resp.Movements
+	if movements == nil {
+		movements = []*proto.StockMovement{}
+	}
+	c.JSON(http.StatusOK, gin.H{"movements": movements, "total": resp.Total})
+}
+
+func (s *Server) adjustStock(c *gin.Context) {
+	var req proto.AdjustStockRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	resp, err := s.invClient.AdjustStock(c.Request.Context(), &req)
+	if err != nil {
+		c.JSON(productErrorStatus(err), gin.H{"error": err.Error()})
 		return
 	}
 	c.JSON(http.StatusOK, resp)
 }
 
+func (s *Server) setStock(c *gin.Context) {
+	var req proto.SetStockRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	resp, err := s.invClient.SetStock(c.Request.Context(), &req)
+	if err != nil {
+		c.JSON(productErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+func (s *Server) listLocations(c *gin.Context) {
+	resp, err := s.invClient.ListLocations(c.Request.Context(), &proto.ListLocationsRequest{})
+	if err != nil {
+		c.JSON(productErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	locations := resp.Locations
+	if locations == nil {
+		locations = []*proto.Location{}
+	}
+	c.JSON(http.StatusOK, gin.H{"locations": locations})
+}
+
+func (s *Server) createLocation(c *gin.Context) {
+	var req proto.Location
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	resp, err := s.invClient.CreateLocation(c.Request.Context(), &req)
+	if err != nil {
+		c.JSON(productErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, resp)
+}
+
+func (s *Server) listTransfers(c *gin.Context) {
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	pageSize, _ := strconv.Atoi(c.DefaultQuery("page_size", "20"))
+	resp, err := s.invClient.ListTransfers(c.Request.Context(), &proto.ListTransfersRequest{
+		VariantId: c.Query("variant_id"),
+		Location:  c.Query("location"),
+		Status:    c.Query("status"),
+		Page:      int32(page),
+		PageSize:  int32(pageSize),
+	})
+	if err != nil {
+		c.JSON(productErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	transfers := resp.Transfers
+	if transfers == nil {
+		transfers = []*proto.Transfer{}
+	}
+	c.JSON(http.StatusOK, gin.H{"transfers": transfers, "total": resp.Total})
+}
+
+func (s *Server) createTransfer(c *gin.Context) {
+	var req proto.CreateTransferRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	resp, err := s.invClient.CreateTransfer(c.Request.Context(), &req)
+	if err != nil {
+		c.JSON(productErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, resp)
+}
+
+func (s *Server) receiveTransfer(c *gin.Context) {
+	resp, err := s.invClient.ReceiveTransfer(c.Request.Context(), &proto.TransferRequest{Id: c.Param("id")})
+	if err != nil {
+		c.JSON(productErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+func (s *Server) cancelTransfer(c *gin.Context) {
+	resp, err := s.invClient.CancelTransfer(c.Request.Context(), &proto.TransferRequest{Id: c.Param("id")})
+	if err != nil {
+		c.JSON(productErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+func (s *Server) getReorderReport(c *gin.Context) {
+	windowDays, _ := strconv.Atoi(c.DefaultQuery("window_days", "30"))
+	coverDays, _ := strconv.Atoi(c.DefaultQuery("cover_days", "30"))
+	resp, err := s.invClient.GetReorderReport(c.Request.Context(), &proto.ReorderReportRequest{
+		WindowDays: int32(windowDays),
+		CoverDays:  int32(coverDays),
+	})
+	if err != nil {
+		c.JSON(productErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	lines := resp.Lines
+	if lines == nil {
+		lines = []*proto.ReorderLine{}
+	}
+	c.JSON(http.StatusOK, gin.H{"lines": lines})
+}
+
+func productErrorStatus(err error) int {
+	switch status.Code(err) {
+	case codes.InvalidArgument:
+		return http.StatusBadRequest
+	case codes.FailedPrecondition:
+		return http.StatusConflict
+	case codes.NotFound:
+		return http.StatusNotFound
+	default:
+		return errorStatus(err, http.StatusInternalServerError)
+	}
+}
+
 func (s *Server) createOrder(c *gin.Context) {
 	var req proto.CreateOrderRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -99,9 +561,19 @@ func (s *Server) createOrder(c *gin.Context) {
 	req.UserId = userID.(string)
 	resp, err := s.ordClient.CreateOrder(c.Request.Context(), &req)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		switch status.Code(err) {
+		case codes.ResourceExhausted:
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		case codes.FailedPrecondition:
+			c.JSON(http.StatusPaymentRequired, gin.H{"error": err.Error()})
+		case codes.InvalidArgument:
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		default:
+			c.JSON(preconditionStatus(c, err, errorStatus(err, http.StatusInternalServerError)), gin.H{"error": err.Error()})
+		}
 		return
 	}
+	setETag(c, resp.Version)
 	c.JSON(http.StatusOK, resp)
 }
 
@@ -109,22 +581,59 @@ func (s *Server) getOrder(c *gin.Context) {
 	id := c.Param("id")
 	resp, err := s.ordClient.GetOrder(c.Request.Context(), &proto.GetOrderRequest{Id: id})
 	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		c.JSON(errorStatus(err, http.StatusNotFound), gin.H{"error": err.Error()})
 		return
 	}
+	setETag(c, resp.Version)
 	c.JSON(http.StatusOK, resp)
 }
 
 func (s *Server) updateOrder(c *gin.Context) {
-	var req proto.UpdateOrderRequest
-	req.Id = c.Param("id")
-	if err := c.ShouldBindJSON(&req); err != nil {
+	var body struct {
+		Status          string `json:"status" binding:"required"`
+		ExpectedVersion int64  `json:"expected_version"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	st, ok := proto.OrderStatus_value["ORDER_STATUS_"+strings.ToUpper(body.Status)]
+	if !ok || st == int32(proto.OrderStatus_ORDER_STATUS_UNSPECIFIED) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "unknown order status: " + body.Status})
+		return
+	}
+	claims := c.MustGet("claims").(*auth.Claims)
+	if proto.OrderStatus(st) != proto.OrderStatus_ORDER_STATUS_CANCELLED && !claims.Can(auth.PermOrdersManage) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "missing permission " + string(auth.PermOrdersManage)})
+		return
+	}
+	userID, _ := c.Get("user_id")
+	req := proto.UpdateOrderRequest{
+		Id:              c.Param("id"),
+		Status:          proto.OrderStatus(st),
+		Actor:           userID.(string),
+		ExpectedVersion: body.ExpectedVersion,
+	}
+	version, ok := ifMatch(c)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "If-Match must be an ETag returned by the API"})
+		return
+	}
+	if version != 0 {
+		req.ExpectedVersion = version
+	}
 	resp, err := s.ordClient.UpdateOrder(c.Request.Context(), &req)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		switch status.Code(err) {
+		case codes.FailedPrecondition:
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		case codes.NotFound:
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		case codes.InvalidArgument:
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		default:
+			c.JSON(errorStatus(err, http.StatusInternalServerError), gin.H{"error": err.Error()})
+		}
 		return
 	}
 	c.JSON(http.StatusOK, resp)
@@ -132,15 +641,24 @@ func (s *Server) updateOrder(c *gin.Context) {
 
 func (s *Server) listOrders(c *gin.Context) {
 	userID, _ := c.Get("user_id")
+	// Staff may list the orders of any user; the order service checks it
+	if other := c.Query("user_id"); other != "" {
+		userID = other
+	}
 	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
 	pageSize, _ := strconv.Atoi(c.DefaultQuery("page_size", "10"))
 	resp, err := s.ordClient.ListOrders(c.Request.Context(), &proto.ListOrdersRequest{
-		UserId:   userID.(string),
-		Page:     int32(page),
-		PageSize: int32(pageSize),
+		UserId:    userID.(string),
+		Page:      int32(page),
+		PageSize:  int32(pageSize),
+		PageToken: c.Query("page_token"),
 	})
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		code := errorStatus(err, http.StatusInternalServerError)
+		if status.Code(err) == codes.InvalidArgument {
+			code = http.StatusBadRequest
+		}
+		c.JSON(code, gin.H{"error": err.Error()})
 		return
 	}
 	c.JSON(http.StatusOK, resp)
@@ -154,7 +672,7 @@ func (s *Server) registerUser(c *gin.Context) {
 	}
 	resp, err := s.usrClient.RegisterUser(c.Request.Context(), &req)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		c.JSON(errorStatus(err, http.StatusInternalServerError), gin.H{"error": err.Error()})
 		return
 	}
 	c.JSON(http.StatusOK, resp)
@@ -166,20 +684,523 @@ func (s *Server) login(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	req.UserAgent = c.Request.UserAgent()
+	req.ClientIp = c.ClientIP()
 	resp, err := s.usrClient.AuthenticateUser(c.Request.Context(), &req)
 	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		switch status.Code(err) {
+		case codes.ResourceExhausted:
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": err.Error()})
+		case codes.Internal, codes.Unavailable:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		}
 		return
 	}
 	c.JSON(http.StatusOK, resp)
 }
 
+// loginTwoFactor completes a login of a user with two-factor authentication
+// with the challenge from /users/login and a TOTP or recovery code.
+func (s *Server) loginTwoFactor(c *gin.Context) {
+	var req proto.VerifyTwoFactorLoginRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	req.UserAgent = c.Request.UserAgent()
+	req.ClientIp = c.ClientIP()
+	resp, err := s.usrClient.VerifyTwoFactorLogin(c.Request.Context(), &req)
+	if err != nil {
+		switch status.Code(err) {
+		case codes.ResourceExhausted:
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": err.Error()})
+		case codes.InvalidArgument:
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		case codes.Internal, codes.Unavailable:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+func (s *Server) refresh(c *gin.Context) {
+	var req proto.RefreshTokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	resp, err := s.usrClient.RefreshToken(c.Request.Context(), &req)
+	if err != nil {
+		switch status.Code(err) {
+		case codes.Unauthenticated:
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		case codes.InvalidArgument:
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		default:
+			c.JSON(errorStatus(err, http.StatusInternalServerError), gin.H{"error": err.Error()})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+func (s *Server) logout(c *gin.Context) {
+	claims := c.MustGet("claims").(*auth.Claims)
+	resp, err := s.usrClient.Logout(c.Request.Context(), &proto.LogoutRequest{
+		UserId:    claims.UserID(),
+		SessionId: claims.SessionID,
+	})
+	if err != nil {
+		c.JSON(errorStatus(err, http.StatusInternalServerError), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+func (s *Server) logoutAll(c *gin.Context) {
+	userID, _ := c.Get("user_id")
+	resp, err := s.usrClient.LogoutAllSessions(c.Request.Context(), &proto.LogoutAllSessionsRequest{UserId: userID.(string)})
+	if err != nil {
+		c.JSON(errorStatus(err, http.StatusInternalServerError), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+func (s *Server) listSessions(c *gin.Context) {
+	claims := c.MustGet("claims").(*auth.Claims)
+	resp, err := s.usrClient.ListSessions(c.Request.Context(), &proto.ListSessionsRequest{UserId: claims.UserID()})
+	if err != nil {
+		c.JSON(errorStatus(err, http.StatusInternalServerError), gin.H{"error": err.Error()})
+		return
+	}
+	sessions := make([]gin.H, 0, len(resp.Sessions))
+	for _, sess := range resp.Sessions {
+		sessions = append(sessions, gin.H{
+			"id":           sess.Id,
+			"user_agent":   sess.UserAgent,
+			"client_ip":    sess.ClientIp,
+			"created_at":   sess.CreatedAt,
+			"last_used_at": sess.LastUsedAt,
+			"expires_at":   sess.ExpiresAt,
+			"current":      sess.Id == claims.SessionID,
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{"sessions": sessions})
+}
+
 func (s *Server) getUser(c *gin.Context) {
 	id := c.Param("id")
+	claims := c.MustGet("claims").(*auth.Claims)
+	if id != claims.UserID() && !claims.Can(auth.PermUsersReadAny) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "missing permission " + string(auth.PermUsersReadAny)})
+		return
+	}
 	resp, err := s.usrClient.GetUserProfile(c.Request.Context(), &proto.GetUserProfileRequest{Id: id})
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
 		return
 	}
+	setETag(c, resp.Version)
 	c.JSON(http.StatusOK, resp)
 }
+
+func (s *Server) updateUser(c *gin.Context) {
+	var req proto.UpdateUserProfileRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	req.UserId = c.Param("id")
+	version, ok := ifMatch(c)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "If-Match must be an ETag returned by the API"})
+		return
+	}
+	if version != 0 {
+		req.ExpectedVersion = version
+	}
+	resp, err := s.usrClient.UpdateUserProfile(c.Request.Context(), &req)
+	if err != nil {
+		c.JSON(preconditionStatus(c, err, accountErrorStatus(err)), gin.H{"error": err.Error()})
+		return
+	}
+	setETag(c, resp.Version)
+	c.JSON(http.StatusOK, resp)
+}
+
+func (s *Server) deleteUser(c *gin.Context) {
+	if _, err := s.usrClient.DeleteUser(c.Request.Context(), &proto.DeleteUserRequest{UserId: c.Param("id")}); err != nil {
+		c.JSON(accountErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "user deleted"})
+}
+
+func (s *Server) listAddresses(c *gin.Context) {
+	resp, err := s.usrClient.ListAddresses(c.Request.Context(), &proto.ListAddressesRequest{UserId: c.Param("id")})
+	if err != nil {
+		c.JSON(accountErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	addresses := resp.Addresses
+	if addresses == nil {
+		addresses = []*proto.Address{}
+	}
+	c.JSON(http.StatusOK, gin.H{"addresses": addresses})
+}
+
+func (s *Server) createAddress(c *gin.Context) {
+	var req proto.Address
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	req.UserId = c.Param("id")
+	resp, err := s.usrClient.CreateAddress(c.Request.Context(), &req)
+	if err != nil {
+		c.JSON(accountErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, resp)
+}
+
+func (s *Server) getAddress(c *gin.Context) {
+	resp, err := s.usrClient.GetAddress(c.Request.Context(), &proto.GetAddressRequest{UserId: c.Param("id"), Id: c.Param("address_id")})
+	if err != nil {
+		c.JSON(accountErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+func (s *Server) updateAddress(c *gin.Context) {
+	var req proto.Address
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	req.UserId = c.Param("id")
+	req.Id = c.Param("address_id")
+	resp, err := s.usrClient.UpdateAddress(c.Request.Context(), &req)
+	if err != nil {
+		c.JSON(accountErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+func (s *Server) deleteAddress(c *gin.Context) {
+	if _, err := s.usrClient.DeleteAddress(c.Request.Context(), &proto.DeleteAddressRequest{UserId: c.Param("id"), Id: c.Param("address_id")}); err != nil {
+		c.JSON(accountErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "address deleted"})
+}
+
+func (s *Server) changePassword(c *gin.Context) {
+	var req proto.ChangePasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	userID, _ := c.Get("user_id")
+	req.UserId = userID.(string)
+	if _, err := s.usrClient.ChangePassword(c.Request.Context(), &req); err != nil {
+		c.JSON(accountErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "password changed"})
+}
+
+func (s *Server) forgotPassword(c *gin.Context) {
+	var req proto.RequestPasswordResetRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if _, err := s.usrClient.RequestPasswordReset(c.Request.Context(), &req); err != nil {
+		c.JSON(accountErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	// The same answer for every address, registered or not
+	c.JSON(http.StatusAccepted, gin.H{"message": "if the address is registered, a reset link has been sent"})
+}
+
+func (s *Server) resetPassword(c *gin.Context) {
+	var req proto.ResetPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if _, err := s.usrClient.ResetPassword(c.Request.Context(), &req); err != nil {
+		c.JSON(accountErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "password reset"})
+}
+
+func (s *Server) verifyEmail(c *gin.Context) {
+	var req proto.VerifyEmailRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	resp, err := s.usrClient.VerifyEmail(c.Request.Context(), &req)
+	if err != nil {
+		c.JSON(accountErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+func (s *Server) sendVerificationEmail(c *gin.Context) {
+	userID, _ := c.Get("user_id")
+	if _, err := s.usrClient.SendVerificationEmail(c.Request.Context(), &proto.SendVerificationEmailRequest{UserId: userID.(string)}); err != nil {
+		c.JSON(accountErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{"message": "verification email sent"})
+}
+
+func accountErrorStatus(err error) int {
+	switch status.Code(err) {
+	case codes.InvalidArgument:
+		return http.StatusBadRequest
+	case codes.FailedPrecondition:
+		return http.StatusConflict
+	case codes.NotFound:
+		return http.StatusNotFound
+	default:
+		return errorStatus(err, http.StatusInternalServerError)
+	}
+}
+
+func (s *Server) grantRole(c *gin.Context) {
+	var body struct {
+		Role string `json:"role" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	resp, err := s.usrClient.GrantRole(c.Request.Context(), &proto.RoleRequest{UserId: c.Param("id"), Role: body.Role})
+	if err != nil {
+		c.JSON(roleErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+func (s *Server) revokeRole(c *gin.Context) {
+	resp, err := s.usrClient.RevokeRole(c.Request.Context(), &proto.RoleRequest{UserId: c.Param("id"), Role: c.Param("role")})
+	if err != nil {
+		c.JSON(roleErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+func roleErrorStatus(err error) int {
+	switch status.Code(err) {
+	case codes.InvalidArgument:
+		return http.StatusBadRequest
+	case codes.NotFound:
+		return http.StatusNotFound
+	default:
+		return errorStatus(err, http.StatusInternalServerError)
+	}
+}
+
+// revokeUserSessions ends every session of an account, e.g. when it has been
+// compromised.
+func (s *Server) revokeUserSessions(c *gin.Context) {
+	resp, err := s.usrClient.LogoutAllSessions(c.Request.Context(), &proto.LogoutAllSessionsRequest{UserId: c.Param("id")})
+	if err != nil {
+		c.JSON(errorStatus(err, http.StatusInternalServerError), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+func (s *Server) getJWKS(c *gin.Context) {
+	jwks, err := auth.FetchJWKS(s.usrClient)(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, jwks)
+}
+
+// errorStatus maps gRPC errors shared by all calls to HTTP statuses and
+// everything else to fallback. A reused or still running idempotency key is a
+// conflict.
+func (s *Server) enrollTwoFactor(c *gin.Context) {
+	userID, _ := c.Get("user_id")
+	resp, err := s.usrClient.EnrollTwoFactor(c.Request.Context(), &proto.EnrollTwoFactorRequest{UserId: userID.(string)})
+	if err != nil {
+		c.JSON(accountErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+func (s *Server) confirmTwoFactor(c *gin.Context) {
+	var req proto.ConfirmTwoFactorRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	userID, _ := c.Get("user_id")
+	req.UserId = userID.(string)
+	resp, err := s.usrClient.ConfirmTwoFactor(c.Request.Context(), &req)
+	if err != nil {
+		c.JSON(accountErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+func (s *Server) disableTwoFactor(c *gin.Context) {
+	var req proto.DisableTwoFactorRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	userID, _ := c.Get("user_id")
+	req.UserId = userID.(string)
+	if _, err := s.usrClient.DisableTwoFactor(c.Request.Context(), &req); err != nil {
+		c.JSON(accountErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "two-factor authentication disabled"})
+}
+
+// resetTwoFactor disables two-factor authentication of another user without
+// a code, for users who lost their authenticator and recovery codes.
+func (s *Server) resetTwoFactor(c *gin.Context) {
+	if _, err := s.usrClient.DisableTwoFactor(c.Request.Context(), &proto.DisableTwoFactorRequest{UserId: c.Param("id")}); err != nil {
+		c.JSON(accountErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "two-factor authentication disabled"})
+}
+
+func (s *Server) listTwoFactorRequirements(c *gin.Context) {
+	resp, err := s.usrClient.ListTwoFactorRequirements(c.Request.Context(), &proto.UserEmpty{})
+	if err != nil {
+		c.JSON(errorStatus(err, http.StatusInternalServerError), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"roles": twoFactorRoles(resp)})
+}
+
+func (s *Server) setTwoFactorRequirement(c *gin.Context) {
+	var body struct {
+		Required bool `json:"required"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	resp, err := s.usrClient.SetTwoFactorRequirement(c.Request.Context(), &proto.TwoFactorRequirementRequest{Role: c.Param("role"), Required: body.Required})
+	if err != nil {
+		c.JSON(accountErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"roles": twoFactorRoles(resp)})
+}
+
+func twoFactorRoles(resp *proto.TwoFactorRequirementsResponse) []string {
+	if resp.Roles == nil {
+		return []string{}
+	}
+	return resp.Roles
+}
+
+func (s *Server) listLockouts(c *gin.Context) {
+	req := &proto.ListLockoutsRequest{
+		Scope:      c.Query("scope"),
+		Subject:    c.Query("subject"),
+		ActiveOnly: c.Query("active") == "true",
+	}
+	if limit := c.Query("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be a positive integer"})
+			return
+		}
+		req.Limit = int32(n)
+	}
+	resp, err := s.usrClient.ListLockouts(c.Request.Context(), req)
+	if err != nil {
+		c.JSON(accountErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	lockouts := resp.Lockouts
+	if lockouts == nil {
+		lockouts = []*proto.Lockout{}
+	}
+	c.JSON(http.StatusOK, gin.H{"lockouts": lockouts})
+}
+
+func (s *Server) clearLockout(c *gin.Context) {
+	var req proto.ClearLockoutRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	resp, err := s.usrClient.ClearLockout(c.Request.Context(), &req)
+	if err != nil {
+		c.JSON(accountErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+func errorStatus(err error, fallback int) int {
+	switch status.Code(err) {
+	case codes.AlreadyExists, codes.Aborted:
+		return http.StatusConflict
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	default:
+		return fallback
+	}
+}
+
+// ifMatch returns the version required by the If-Match header, which takes
+// the ETag of an earlier response. It returns 0, no precondition, without
+// the header or with "*".
+func ifMatch(c *gin.Context) (int64, bool) {
+	header := strings.TrimSpace(c.GetHeader("If-Match"))
+	if header == "" || header == "*" {
+		return 0, true
+	}
+	version, err := strconv.ParseInt(strings.Trim(strings.TrimPrefix(header, "W/"), `"`), 10, 64)
+	return version, err == nil && version > 0
+}
+
+// preconditionStatus reports a stale write as 412 Precondition Failed when
+// the version came from If-Match, and leaves code, 409 Conflict for a body
+// expected_version, alone otherwise.
+func preconditionStatus(c *gin.Context, err error, code int) int {
+	if status.Code(err) == codes.Aborted && c.GetHeader("If-Match") != "" {
+		return http.StatusPreconditionFailed
+	}
+	return code
+}
+
+// setETag sets the ETag of a response to the version of the resource, for
+// use in If-Match.
+func setETag(c *gin.Context, version int64) {
+	c.Header("ETag", `"`+strconv.FormatInt(version, 10)+`"`)
+}
@@ -1,9 +1,11 @@
 package apigateway
 
 import (
-	"ecommerce/proto"
+	"ecommerce/internal/auth"
+	"ecommerce/internal/idempotency"
 	"github.com/gin-gonic/gin"
 	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/metadata"
 	"net/http"
 	"strings"
 	"time"
@@ -22,25 +24,97 @@ func (s *Server) Logger() gin.HandlerFunc {
 	}
 }
 
+// publicPaths are the routes that need no access token.
+var publicPaths = map[string]bool{
+	"/users/register":        true,
+	"/users/login":           true,
+	"/users/login/2fa":       true,
+	"/users/refresh":         true,
+	"/users/password/forgot": true,
+	"/users/password/reset":  true,
+	"/users/verify-email":    true,
+	"/.well-known/jwks.json": true,
+}
+
+// Auth verifies the bearer access token locally, rejects tokens of revoked
+// sessions and stores the user ID and claims in the context.
 func (s *Server) Auth() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		if strings.HasPrefix(c.Request.URL.Path, "/users/register") || strings.HasPrefix(c.Request.URL.Path, "/users/login") {
+		if publicPaths[c.Request.URL.Path] {
 			c.Next()
 			return
 		}
-		token := c.GetHeader("Authorization")
-		if token == "" {
+		header := c.GetHeader("Authorization")
+		if header == "" {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "missing token"})
 			c.Abort()
 			return
 		}
-		_, err := s.usrClient.GetUserProfile(c.Request.Context(), &proto.GetUserProfileRequest{Id: token})
+		token, ok := strings.CutPrefix(header, "Bearer ")
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid token"})
+			c.Abort()
+			return
+		}
+		claims, err := s.verifier.Verify(token)
 		if err != nil {
+			logrus.WithError(err).Debug("Rejected access token")
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid token"})
 			c.Abort()
 			return
 		}
-		c.Set("user_id", token)
+		// Revoked sessions must be rejected at once, so the denylist fails
+		// closed when Redis is unavailable
+		revoked, err := s.denylist.Revoked(c.Request.Context(), claims)
+		if err != nil {
+			logrus.WithError(err).Error("Failed to check token denylist")
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "authentication unavailable"})
+			c.Abort()
+			return
+		}
+		if revoked {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "token revoked"})
+			c.Abort()
+			return
+		}
+		c.Set("user_id", claims.UserID())
+		c.Set("claims", claims)
+		// Services verify the token again to check permissions themselves
+		c.Request = c.Request.WithContext(auth.OutgoingContext(c.Request.Context(), token))
+		c.Next()
+	}
+}
+
+// Require rejects callers whose token does not grant perm. It must run after
+// Auth.
+func (s *Server) Require(perm auth.Permission) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims := c.MustGet("claims").(*auth.Claims)
+		if !claims.Can(perm) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "missing permission " + string(perm)})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// IdempotencyKey forwards the Idempotency-Key header to the services as gRPC
+// metadata, where mutating calls use it to deduplicate retries.
+func (s *Server) IdempotencyKey() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader("Idempotency-Key")
+		if key == "" {
+			c.Next()
+			return
+		}
+		if len(key) > idempotency.MaxKeyLength {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "idempotency key too long"})
+			c.Abort()
+			return
+		}
+		ctx := metadata.AppendToOutgoingContext(c.Request.Context(), idempotency.MetadataKey, key)
+		c.Request = c.Request.WithContext(ctx)
 		c.Next()
 	}
 }
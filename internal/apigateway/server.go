@@ -1,6 +1,8 @@
 package apigateway
 
 import (
+	"context"
+	"ecommerce/internal/auth"
 	"ecommerce/internal/config"
 	"ecommerce/proto"
 	"github.com/gin-gonic/gin"
@@ -13,6 +15,10 @@ type Server struct {
 	invClient proto.InventoryServiceClient
 	ordClient proto.OrderServiceClient
 	usrClient proto.UserServiceClient
+
+	verifier *auth.Verifier
+	jwks     *auth.JWKSCache
+	denylist *auth.Denylist
 }
 
 func NewServer(cfg *config.Config) (*Server, error) {
@@ -29,11 +35,20 @@ func NewServer(cfg *config.Config) (*Server, error) {
 		return nil, err
 	}
 
-	return &Server{
+	srv := &Server{
 		invClient: proto.NewInventoryServiceClient(invConn),
 		ordClient: proto.NewOrderServiceClient(ordConn),
 		usrClient: proto.NewUserServiceClient(usrConn),
-	}, nil
+		denylist:  auth.NewDenylist(cfg.RedisAddr),
+	}
+
+	// Access tokens are verified locally. HS256 secrets are shared through
+	// the configuration, RS256 public keys are fetched from the user service
+	srv.verifier, srv.jwks, err = auth.NewConfiguredVerifier(cfg, srv.usrClient)
+	if err != nil {
+		return nil, err
+	}
+	return srv, nil
 }
 
 func Run(cfg *config.Config) error {
@@ -42,7 +57,16 @@ func Run(cfg *config.Config) error {
 		return err
 	}
 
+	if srv.jwks != nil {
+		go srv.jwks.Run(context.Background(), cfg.JWKSRefreshInterval)
+	}
+
 	r := gin.Default()
+	// X-Forwarded-For is only honoured when a configured proxy sent the
+	// request, so clients cannot pick the IP that login throttling sees
+	if err := r.SetTrustedProxies(cfg.TrustedProxies); err != nil {
+		return err
+	}
 	srv.SetupRoutes(r)
 
 	log.Printf("API Gateway running on %s", cfg.APIGatewayAddr)
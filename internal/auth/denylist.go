@@ -0,0 +1,51 @@
+package auth
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Denylist revokes access tokens before they expire. The user service adds
+// the sessions it revokes and the gateway checks every token against it.
+// Entries only need to outlive the tokens they revoke, so they expire after
+// the access token TTL.
+type Denylist struct {
+	client *redis.Client
+}
+
+// NewDenylist connects to the Redis instance holding the denylist.
+func NewDenylist(addr string) *Denylist {
+	return &Denylist{client: redis.NewClient(&redis.Options{Addr: addr})}
+}
+
+func sessionKey(sessionID string) string {
+	return "denylist:session:" + sessionID
+}
+
+// RevokeSessions rejects every token issued for the given sessions.
+func (d *Denylist) RevokeSessions(ctx context.Context, ttl time.Duration, sessionIDs ...string) error {
+	if len(sessionIDs) == 0 {
+		return nil
+	}
+	pipe := d.client.TxPipeline()
+	for _, id := range sessionIDs {
+		pipe.Set(ctx, sessionKey(id), 1, ttl)
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// Revoked reports whether the token with claims has been revoked. Tokens
+// without a session cannot be revoked and are always rejected.
+func (d *Denylist) Revoked(ctx context.Context, claims *Claims) (bool, error) {
+	if claims.SessionID == "" {
+		return true, nil
+	}
+	n, err := d.client.Exists(ctx, sessionKey(claims.SessionID)).Result()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
@@ -0,0 +1,102 @@
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// MetadataKey is the gRPC metadata key carrying the caller's access token.
+// The API gateway forwards the bearer token it verified under this key.
+const MetadataKey = "authorization"
+
+// ServiceMetadataKey is the gRPC metadata key carrying the service token on
+// service-to-service calls.
+const ServiceMetadataKey = "x-service-token"
+
+type claimsKey struct{}
+
+// WithClaims returns a context carrying the caller's claims.
+func WithClaims(ctx context.Context, claims *Claims) context.Context {
+	return context.WithValue(ctx, claimsKey{}, claims)
+}
+
+// ClaimsFromContext returns the caller's claims, if the call was
+// authenticated.
+func ClaimsFromContext(ctx context.Context) (*Claims, bool) {
+	claims, ok := ctx.Value(claimsKey{}).(*Claims)
+	return claims, ok
+}
+
+// OutgoingContext forwards token to the services called with the returned
+// context.
+func OutgoingContext(ctx context.Context, token string) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, MetadataKey, "Bearer "+token)
+}
+
+// ForwardToken passes the access token of the incoming call on to the
+// services called with the returned context, so that they authorize the
+// call as the same caller.
+func ForwardToken(ctx context.Context) context.Context {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if values := md.Get(MetadataKey); len(values) > 0 {
+		return metadata.AppendToOutgoingContext(ctx, MetadataKey, values[0])
+	}
+	return ctx
+}
+
+// ServiceTokenInterceptor adds token to every call made on a connection, so
+// the called service accepts it for methods that require PermService.
+func ServiceTokenInterceptor(token string) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		return invoker(metadata.AppendToOutgoingContext(ctx, ServiceMetadataKey, token), method, req, reply, cc, opts...)
+	}
+}
+
+// Rules maps full gRPC method names to the permission they require. An empty
+// permission only requires an authenticated caller, and PermService requires
+// the service token instead of an access token.
+type Rules map[string]Permission
+
+// UnaryServerInterceptor verifies the forwarded access token of the methods
+// in rules and checks the permission they require. The claims are added to
+// the handler's context. Methods requiring PermService are only accepted with
+// serviceToken, and never when it is empty. Methods not in rules are public
+// and pass through unchanged.
+func UnaryServerInterceptor(verifier *Verifier, serviceToken string, rules Rules) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		perm, ok := rules[info.FullMethod]
+		if !ok {
+			return handler(ctx, req)
+		}
+		md, _ := metadata.FromIncomingContext(ctx)
+		if perm == PermService {
+			values := md.Get(ServiceMetadataKey)
+			if serviceToken == "" || len(values) == 0 || subtle.ConstantTimeCompare([]byte(values[0]), []byte(serviceToken)) != 1 {
+				return nil, status.Error(codes.Unauthenticated, "missing or invalid service token")
+			}
+			return handler(ctx, req)
+		}
+		values := md.Get(MetadataKey)
+		if len(values) == 0 {
+			return nil, status.Error(codes.Unauthenticated, "missing token")
+		}
+		token, ok := strings.CutPrefix(values[0], "Bearer ")
+		if !ok {
+			return nil, status.Error(codes.Unauthenticated, "invalid token")
+		}
+		claims, err := verifier.Verify(token)
+		if err != nil {
+			return nil, status.Error(codes.Unauthenticated, "invalid token")
+		}
+		if perm != "" && !claims.Can(perm) {
+			return nil, status.Errorf(codes.PermissionDenied, "missing permission %s", perm)
+		}
+		return handler(WithClaims(ctx, claims), req)
+	}
+}
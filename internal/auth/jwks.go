@@ -0,0 +1,100 @@
+package auth
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// JWKSCache is a KeySource backed by a JWKS fetched from the user service. It
+// refreshes the keys periodically, and early when a token names a key it has
+// not seen yet, so rotated keys are picked up without a restart.
+type JWKSCache struct {
+	fetch       func(ctx context.Context) (*JWKS, error)
+	minInterval time.Duration
+
+	mu          sync.RWMutex
+	keys        map[string]*cachedKey
+	lastAttempt time.Time
+}
+
+type cachedKey struct {
+	algorithm string
+	key       interface{}
+}
+
+// NewJWKSCache creates a cache that loads keys with fetch. Unknown key IDs
+// trigger at most one refresh per minInterval.
+func NewJWKSCache(fetch func(ctx context.Context) (*JWKS, error), minInterval time.Duration) *JWKSCache {
+	return &JWKSCache{fetch: fetch, minInterval: minInterval, keys: make(map[string]*cachedKey)}
+}
+
+// Refresh replaces the cached keys with the current JWKS.
+func (c *JWKSCache) Refresh(ctx context.Context) error {
+	c.mu.Lock()
+	c.lastAttempt = time.Now()
+	c.mu.Unlock()
+	jwks, err := c.fetch(ctx)
+	if err != nil {
+		return err
+	}
+	keys := make(map[string]*cachedKey, len(jwks.Keys))
+	for _, jwk := range jwks.Keys {
+		public, err := jwk.publicKey()
+		if err != nil {
+			logrus.WithError(err).WithField("kid", jwk.Kid).Warn("Skipping invalid JWK")
+			continue
+		}
+		keys[jwk.Kid] = &cachedKey{algorithm: jwk.Alg, key: public}
+	}
+	c.mu.Lock()
+	c.keys = keys
+	c.mu.Unlock()
+	logrus.WithField("keys", len(keys)).Info("JWKS refreshed")
+	return nil
+}
+
+// Run refreshes the keys every interval until ctx is cancelled.
+func (c *JWKSCache) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := c.Refresh(ctx); err != nil {
+			logrus.WithError(err).Error("Failed to refresh JWKS")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// VerificationKey implements KeySource.
+func (c *JWKSCache) VerificationKey(kid string) (string, interface{}, error) {
+	if key := c.lookup(kid); key != nil {
+		return key.algorithm, key.key, nil
+	}
+	c.mu.RLock()
+	stale := time.Since(c.lastAttempt) >= c.minInterval
+	c.mu.RUnlock()
+	if stale {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := c.Refresh(ctx); err != nil {
+			logrus.WithError(err).Error("Failed to refresh JWKS")
+		}
+		if key := c.lookup(kid); key != nil {
+			return key.algorithm, key.key, nil
+		}
+	}
+	return "", nil, ErrUnknownKey
+}
+
+func (c *JWKSCache) lookup(kid string) *cachedKey {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.keys[kid]
+}
@@ -0,0 +1,210 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Supported signing algorithms.
+const (
+	AlgHS256 = "HS256"
+	AlgRS256 = "RS256"
+)
+
+var ErrUnknownKey = errors.New("unknown signing key")
+
+// Key is a signing key identified by its key ID (kid).
+type Key struct {
+	ID        string
+	Algorithm string
+
+	secret  []byte
+	private *rsa.PrivateKey
+	public  *rsa.PublicKey
+}
+
+// method returns the JWT signing method of the key.
+func (k *Key) method() jwt.SigningMethod {
+	if k.Algorithm == AlgHS256 {
+		return jwt.SigningMethodHS256
+	}
+	return jwt.SigningMethodRS256
+}
+
+// signingKey returns the key material used to sign tokens.
+func (k *Key) signingKey() interface{} {
+	if k.Algorithm == AlgHS256 {
+		return k.secret
+	}
+	return k.private
+}
+
+// verificationKey returns the key material used to verify tokens.
+func (k *Key) verificationKey() interface{} {
+	if k.Algorithm == AlgHS256 {
+		return k.secret
+	}
+	return k.public
+}
+
+// KeySet holds the keys of one algorithm. The active key signs new tokens;
+// the others are kept to verify tokens signed before a rotation.
+type KeySet struct {
+	active *Key
+	keys   map[string]*Key
+}
+
+// LoadKeySet builds a key set from a comma-separated list of kid=value pairs.
+// For HS256 the value is the shared secret, for RS256 the path of a PEM
+// encoded RSA private key. activeID selects the signing key and defaults to
+// the first one. An empty RS256 spec generates a single ephemeral key, which
+// is only suitable for development because tokens do not survive a restart.
+func LoadKeySet(algorithm, spec, activeID string) (*KeySet, error) {
+	if algorithm != AlgHS256 && algorithm != AlgRS256 {
+		return nil, fmt.Errorf("unsupported JWT algorithm %q", algorithm)
+	}
+	set := &KeySet{keys: make(map[string]*Key)}
+	var first string
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		kid, value, ok := strings.Cut(entry, "=")
+		if !ok || kid == "" || value == "" {
+			return nil, fmt.Errorf("invalid JWT key entry %q, expected kid=value", entry)
+		}
+		key := &Key{ID: kid, Algorithm: algorithm}
+		if algorithm == AlgHS256 {
+			key.secret = []byte(value)
+		} else {
+			private, err := readRSAKey(value)
+			if err != nil {
+				return nil, fmt.Errorf("JWT key %q: %w", kid, err)
+			}
+			key.private, key.public = private, &private.PublicKey
+		}
+		set.keys[kid] = key
+		if first == "" {
+			first = kid
+		}
+	}
+	if len(set.keys) == 0 {
+		if algorithm == AlgHS256 {
+			return nil, errors.New("HS256 requires at least one JWT key")
+		}
+		private, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return nil, err
+		}
+		first = "ephemeral"
+		set.keys[first] = &Key{ID: first, Algorithm: algorithm, private: private, public: &private.PublicKey}
+	}
+	if activeID == "" {
+		activeID = first
+	}
+	active, ok := set.keys[activeID]
+	if !ok {
+		return nil, fmt.Errorf("active JWT key %q is not configured", activeID)
+	}
+	set.active = active
+	return set, nil
+}
+
+func readRSAKey(path string) (*rsa.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("not an RSA private key")
+	}
+	return key, nil
+}
+
+// Active returns the key that signs new tokens.
+func (s *KeySet) Active() *Key {
+	return s.active
+}
+
+// VerificationKey implements KeySource.
+func (s *KeySet) VerificationKey(kid string) (string, interface{}, error) {
+	key, ok := s.keys[kid]
+	if !ok {
+		return "", nil, ErrUnknownKey
+	}
+	return key.Algorithm, key.verificationKey(), nil
+}
+
+// JWKS returns the public keys of the set. Shared HS256 secrets are never
+// published, so the result is empty for HS256 key sets.
+func (s *KeySet) JWKS() *JWKS {
+	jwks := &JWKS{Keys: []JWK{}}
+	for _, key := range s.keys {
+		if key.public == nil {
+			continue
+		}
+		jwks.Keys = append(jwks.Keys, JWK{
+			Kty: "RSA",
+			Kid: key.ID,
+			Use: "sig",
+			Alg: key.Algorithm,
+			N:   base64.RawURLEncoding.EncodeToString(key.public.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.public.E)).Bytes()),
+		})
+	}
+	return jwks
+}
+
+// JWK is a public key in JSON Web Key format (RFC 7517).
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// JWKS is a JSON Web Key Set.
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// publicKey decodes the RSA public key of a JWK.
+func (k JWK) publicKey() (*rsa.PublicKey, error) {
+	if k.Kty != "RSA" {
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+	n, err := base64.RawURLEncoding.DecodeString(k.N)
+	if err != nil {
+		return nil, err
+	}
+	e, err := base64.RawURLEncoding.DecodeString(k.E)
+	if err != nil {
+		return nil, err
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+}
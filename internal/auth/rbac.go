@@ -0,0 +1,94 @@
+package auth
+
+import "sort"
+
+// Roles. Every user is a customer; staff and admin are granted explicitly.
+const (
+	RoleCustomer = "customer"
+	RoleStaff    = "staff"
+	RoleAdmin    = "admin"
+)
+
+// Permission is an action a role allows.
+type Permission string
+
+// Permissions. The *Any permissions extend an action from the caller's own
+// resources to everyone's.
+const (
+	PermProductsRead   Permission = "products:read"
+	PermProductsWrite  Permission = "products:write"
+	PermProductsDelete Permission = "products:delete"
+	PermStockRead      Permission = "stock:read"
+
+	PermOrdersCreate   Permission = "orders:create"
+	PermOrdersRead     Permission = "orders:read"
+	PermOrdersCancel   Permission = "orders:cancel"
+	PermOrdersReadAny  Permission = "orders:read_any"
+	PermOrdersManage   Permission = "orders:manage"
+	PermUsersRead      Permission = "users:read"
+	PermUsersReadAny   Permission = "users:read_any"
+	PermUsersUpdate    Permission = "users:update"
+	PermUsersUpdateAny Permission = "users:update_any"
+	PermUsersManage    Permission = "users:manage_roles"
+	PermSessionsManage Permission = "sessions:manage"
+	PermSessionsRevoke Permission = "sessions:revoke_any"
+	PermLockoutsManage Permission = "lockouts:manage"
+
+	// PermService is granted to no role. It marks methods that only other
+	// services may call, authenticated with the shared service token.
+	PermService Permission = "service"
+)
+
+// rolePermissions is the permission catalog. Roles build on each other: staff
+// has every customer permission and admin every staff permission.
+var rolePermissions = map[string][]Permission{
+	RoleCustomer: {
+		PermProductsRead,
+		PermOrdersCreate, PermOrdersRead, PermOrdersCancel,
+		PermUsersRead, PermUsersUpdate, PermSessionsManage,
+	},
+	RoleStaff: {
+		PermProductsWrite, PermStockRead,
+		PermOrdersReadAny, PermOrdersManage,
+		PermUsersReadAny,
+	},
+	RoleAdmin: {
+		PermProductsDelete,
+		PermUsersUpdateAny, PermUsersManage, PermSessionsRevoke, PermLockoutsManage,
+	},
+}
+
+// roleIncludes lists the roles whose permissions a role inherits.
+var roleIncludes = map[string][]string{
+	RoleStaff: {RoleCustomer},
+	RoleAdmin: {RoleStaff},
+}
+
+// ValidRole reports whether role is in the catalog.
+func ValidRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+// PermissionsFor returns the sorted permissions granted by roles.
+func PermissionsFor(roles []string) []Permission {
+	set := make(map[Permission]bool)
+	var add func(role string)
+	add = func(role string) {
+		for _, p := range rolePermissions[role] {
+			set[p] = true
+		}
+		for _, included := range roleIncludes[role] {
+			add(included)
+		}
+	}
+	for _, role := range roles {
+		add(role)
+	}
+	perms := make([]Permission, 0, len(set))
+	for p := range set {
+		perms = append(perms, p)
+	}
+	sort.Slice(perms, func(i, j int) bool { return perms[i] < perms[j] })
+	return perms
+}
@@ -0,0 +1,139 @@
+package auth
+
+import (
+	"errors"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+var ErrInvalidToken = errors.New("invalid token")
+
+// Claims are the claims of an access token. The subject is the user ID, the
+// token ID (jti) identifies the token and the session ID (sid) the login it
+// was issued for.
+type Claims struct {
+	jwt.RegisteredClaims
+	SessionID   string       `json:"sid,omitempty"`
+	Roles       []string     `json:"roles,omitempty"`
+	Permissions []Permission `json:"perms,omitempty"`
+}
+
+// UserID returns the user the token was issued to.
+func (c *Claims) UserID() string {
+	return c.Subject
+}
+
+// HasRole reports whether the token carries role.
+func (c *Claims) HasRole(role string) bool {
+	for _, r := range c.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// Can reports whether the token grants perm.
+func (c *Claims) Can(perm Permission) bool {
+	for _, p := range c.Permissions {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// Signer issues access tokens with the active key of a key set.
+type Signer struct {
+	keys   *KeySet
+	issuer string
+	ttl    time.Duration
+}
+
+// NewSigner creates a Signer whose tokens expire after ttl.
+func NewSigner(keys *KeySet, issuer string, ttl time.Duration) *Signer {
+	return &Signer{keys: keys, issuer: issuer, ttl: ttl}
+}
+
+// TTL returns how long issued tokens are valid.
+func (s *Signer) TTL() time.Duration {
+	return s.ttl
+}
+
+// Sign issues a token for a session of userID with the given roles and the
+// permissions they grant.
+func (s *Signer) Sign(userID, sessionID string, roles []string) (string, *Claims, error) {
+	now := time.Now()
+	claims := &Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.NewString(),
+			Subject:   userID,
+			Issuer:    s.issuer,
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(s.ttl)),
+		},
+		SessionID:   sessionID,
+		Roles:       roles,
+		Permissions: PermissionsFor(roles),
+	}
+	key := s.keys.Active()
+	token := jwt.NewWithClaims(key.method(), claims)
+	token.Header["kid"] = key.ID
+	signed, err := token.SignedString(key.signingKey())
+	if err != nil {
+		return "", nil, err
+	}
+	return signed, claims, nil
+}
+
+// KeySource looks up the key that verifies tokens signed with kid.
+type KeySource interface {
+	VerificationKey(kid string) (algorithm string, key interface{}, err error)
+}
+
+// Verifier validates access tokens locally.
+type Verifier struct {
+	keys   KeySource
+	issuer string
+}
+
+// NewVerifier creates a Verifier that accepts tokens from issuer signed with
+// keys from source.
+func NewVerifier(keys KeySource, issuer string) *Verifier {
+	return &Verifier{keys: keys, issuer: issuer}
+}
+
+// Verify checks the signature, expiry and issuer of a token and returns its
+// claims.
+func (v *Verifier) Verify(tokenString string) (*Claims, error) {
+	claims := &Claims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		if kid == "" {
+			return nil, ErrUnknownKey
+		}
+		algorithm, key, err := v.keys.VerificationKey(kid)
+		if err != nil {
+			return nil, err
+		}
+		// The algorithm is pinned by the key, never taken from the token
+		if t.Method.Alg() != algorithm {
+			return nil, ErrInvalidToken
+		}
+		return key, nil
+	},
+		jwt.WithValidMethods([]string{AlgHS256, AlgRS256}),
+		jwt.WithIssuer(v.issuer),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return nil, errors.Join(ErrInvalidToken, err)
+	}
+	if claims.Subject == "" || claims.ID == "" {
+		return nil, ErrInvalidToken
+	}
+	return claims, nil
+}
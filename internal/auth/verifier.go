@@ -0,0 +1,40 @@
+package auth
+
+import (
+	"context"
+	"ecommerce/internal/config"
+	"ecommerce/proto"
+	"time"
+)
+
+// FetchJWKS returns a function that loads the token verification keys from
+// the user service.
+func FetchJWKS(users proto.UserServiceClient) func(ctx context.Context) (*JWKS, error) {
+	return func(ctx context.Context) (*JWKS, error) {
+		resp, err := users.GetJWKS(ctx, &proto.GetJWKSRequest{})
+		if err != nil {
+			return nil, err
+		}
+		jwks := &JWKS{Keys: make([]JWK, 0, len(resp.Keys))}
+		for _, k := range resp.Keys {
+			jwks.Keys = append(jwks.Keys, JWK{Kty: k.Kty, Kid: k.Kid, Use: k.Use, Alg: k.Alg, N: k.N, E: k.E})
+		}
+		return jwks, nil
+	}
+}
+
+// NewConfiguredVerifier builds the verifier for tokens issued by the user
+// service. HS256 secrets are shared through the configuration; RS256 public
+// keys are fetched from users, and the returned cache must be run to keep
+// them current.
+func NewConfiguredVerifier(cfg *config.Config, users proto.UserServiceClient) (*Verifier, *JWKSCache, error) {
+	if cfg.JWTAlgorithm == AlgHS256 {
+		keys, err := LoadKeySet(cfg.JWTAlgorithm, cfg.JWTKeys, cfg.JWTActiveKeyID)
+		if err != nil {
+			return nil, nil, err
+		}
+		return NewVerifier(keys, cfg.JWTIssuer), nil, nil
+	}
+	jwks := NewJWKSCache(FetchJWKS(users), 30*time.Second)
+	return NewVerifier(jwks, cfg.JWTIssuer), jwks, nil
+}
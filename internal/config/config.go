@@ -4,10 +4,14 @@ import (
 	"fmt"
 	"github.com/joho/godotenv"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type Config struct {
 	APIGatewayAddr string
+	TrustedProxies []string
 	InventoryAddr  string
 	OrderAddr      string
 	UserAddr       string
@@ -19,6 +23,52 @@ type Config struct {
 	DBUser         string
 	DBPassword     string
 	DBName         string
+	OrderTaxRate   float64
+
+	ReservationTTL           time.Duration
+	ReservationSweepInterval time.Duration
+	SourcingStrategy         string
+
+	PaymentMaxAmount     float64
+	SagaLease            time.Duration
+	SagaRecoveryInterval time.Duration
+	OutboxPollInterval   time.Duration
+
+	IdempotencyRetention     time.Duration
+	IdempotencyPurgeInterval time.Duration
+
+	JWTAlgorithm        string
+	JWTKeys             string
+	JWTActiveKeyID      string
+	JWTIssuer           string
+	JWTTTL              time.Duration
+	JWKSRefreshInterval time.Duration
+	RefreshTokenTTL     time.Duration
+	BootstrapAdmins     string
+	ServiceToken        string
+
+	Mailer               string
+	MailDir              string
+	MailFrom             string
+	SMTPHost             string
+	SMTPPort             string
+	SMTPUsername         string
+	SMTPPassword         string
+	AppBaseURL           string
+	PasswordResetTTL     time.Duration
+	EmailVerificationTTL time.Duration
+
+	UserDeletionGracePeriod time.Duration
+	UserAnonymizeInterval   time.Duration
+
+	LoginMaxAttempts   int
+	LoginIPMaxAttempts int
+	LoginLockoutBase   time.Duration
+	LoginLockoutMax    time.Duration
+	LoginAttemptWindow time.Duration
+
+	TOTPIssuer            string
+	TwoFactorChallengeTTL time.Duration
 }
 
 func Load() (*Config, error) {
@@ -28,6 +78,7 @@ func Load() (*Config, error) {
 
 	return &Config{
 		APIGatewayAddr: getEnv("API_GATEWAY_ADDR", ":8080"),
+		TrustedProxies: getEnvList("TRUSTED_PROXIES"),
 		InventoryAddr:  getEnv("INVENTORY_ADDR", ":50051"),
 		OrderAddr:      getEnv("ORDER_ADDR", ":50052"),
 		UserAddr:       getEnv("USER_ADDR", ":50053"),
@@ -39,6 +90,52 @@ func Load() (*Config, error) {
 		DBUser:         getEnv("DB_USER", "postgres"),
 		DBPassword:     getEnv("DB_PASSWORD", "admin"),
 		DBName:         getEnv("DB_NAME", "ecommerce"),
+		OrderTaxRate:   getEnvFloat("ORDER_TAX_RATE", 0),
+
+		ReservationTTL:           getEnvDuration("RESERVATION_TTL", 15*time.Minute),
+		ReservationSweepInterval: getEnvDuration("RESERVATION_SWEEP_INTERVAL", time.Minute),
+		SourcingStrategy:         getEnv("SOURCING_STRATEGY", "split"),
+
+		PaymentMaxAmount:     getEnvFloat("PAYMENT_MAX_AMOUNT", 0),
+		SagaLease:            getEnvDuration("SAGA_LEASE", time.Minute),
+		SagaRecoveryInterval: getEnvDuration("SAGA_RECOVERY_INTERVAL", 30*time.Second),
+		OutboxPollInterval:   getEnvDuration("OUTBOX_POLL_INTERVAL", time.Second),
+
+		IdempotencyRetention:     getEnvDuration("IDEMPOTENCY_RETENTION", 24*time.Hour),
+		IdempotencyPurgeInterval: getEnvDuration("IDEMPOTENCY_PURGE_INTERVAL", time.Hour),
+
+		JWTAlgorithm:        getEnv("JWT_ALGORITHM", "RS256"),
+		JWTKeys:             getEnv("JWT_KEYS", ""),
+		JWTActiveKeyID:      getEnv("JWT_ACTIVE_KEY_ID", ""),
+		JWTIssuer:           getEnv("JWT_ISSUER", "ecommerce"),
+		JWTTTL:              getEnvDuration("JWT_TTL", 15*time.Minute),
+		JWKSRefreshInterval: getEnvDuration("JWKS_REFRESH_INTERVAL", 5*time.Minute),
+		RefreshTokenTTL:     getEnvDuration("REFRESH_TOKEN_TTL", 30*24*time.Hour),
+		BootstrapAdmins:     getEnv("BOOTSTRAP_ADMINS", ""),
+		ServiceToken:        getEnv("SERVICE_TOKEN", ""),
+
+		Mailer:               getEnv("MAILER", "file"),
+		MailDir:              getEnv("MAIL_DIR", "mail"),
+		MailFrom:             getEnv("MAIL_FROM", "no-reply@ecommerce.local"),
+		SMTPHost:             getEnv("SMTP_HOST", "localhost"),
+		SMTPPort:             getEnv("SMTP_PORT", "25"),
+		SMTPUsername:         getEnv("SMTP_USERNAME", ""),
+		SMTPPassword:         getEnv("SMTP_PASSWORD", ""),
+		AppBaseURL:           getEnv("APP_BASE_URL", "http://localhost:8080"),
+		PasswordResetTTL:     getEnvDuration("PASSWORD_RESET_TTL", time.Hour),
+		EmailVerificationTTL: getEnvDuration("EMAIL_VERIFICATION_TTL", 24*time.Hour),
+
+		UserDeletionGracePeriod: getEnvDuration("USER_DELETION_GRACE_PERIOD", 30*24*time.Hour),
+		UserAnonymizeInterval:   getEnvDuration("USER_ANONYMIZE_INTERVAL", time.Hour),
+
+		LoginMaxAttempts:   getEnvInt("LOGIN_MAX_ATTEMPTS", 5),
+		LoginIPMaxAttempts: getEnvInt("LOGIN_IP_MAX_ATTEMPTS", 20),
+		LoginLockoutBase:   getEnvDuration("LOGIN_LOCKOUT_BASE", time.Minute),
+		LoginLockoutMax:    getEnvDuration("LOGIN_LOCKOUT_MAX", time.Hour),
+		LoginAttemptWindow: getEnvDuration("LOGIN_ATTEMPT_WINDOW", 24*time.Hour),
+
+		TOTPIssuer:            getEnv("TOTP_ISSUER", "ecommerce"),
+		TwoFactorChallengeTTL: getEnvDuration("TWO_FACTOR_CHALLENGE_TTL", 5*time.Minute),
 	}, nil
 }
 
@@ -49,6 +146,45 @@ func getEnv(key, defaultValue string) string {
 	return defaultValue
 }
 
+func getEnvFloat(key string, defaultValue float64) float64 {
+	if value, exists := os.LookupEnv(key); exists {
+		if f, err := strconv.ParseFloat(value, 64); err == nil {
+			return f
+		}
+	}
+	return defaultValue
+}
+
+func getEnvInt(key string, defaultValue int) int {
+	if value, exists := os.LookupEnv(key); exists {
+		if i, err := strconv.Atoi(value); err == nil {
+			return i
+		}
+	}
+	return defaultValue
+}
+
+// getEnvList splits a comma-separated variable, returning nil when it is
+// unset or empty.
+func getEnvList(key string) []string {
+	var values []string
+	for _, v := range strings.Split(os.Getenv(key), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	if value, exists := os.LookupEnv(key); exists {
+		if d, err := time.ParseDuration(value); err == nil {
+			return d
+		}
+	}
+	return defaultValue
+}
+
 func (c *Config) DSN() string {
 	return fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
 		c.DBHost, c.DBPort, c.DBUser, c.DBPassword, c.DBName)
@@ -1,7 +1,6 @@
 package application
 
 import (
-	"context"
 	"encoding/json"
 	"errors"
 	"time"
@@ -12,12 +11,11 @@ import (
 )
 
 type Service struct {
-	nc        *nats.Conn
-	invClient proto.InventoryServiceClient
+	nc *nats.Conn
 }
 
-func NewService(nc *nats.Conn, invClient proto.InventoryServiceClient) *Service {
-	return &Service{nc: nc, invClient: invClient}
+func NewService(nc *nats.Conn) *Service {
+	return &Service{nc: nc}
 }
 
 func (s *Service) SubscribeToOrders() error {
@@ -31,26 +29,9 @@ func (s *Service) SubscribeToOrders() error {
 				return
 			}
 
-			logrus.Infof("Received order.created event for order %s", order.Id)
-			for _, item := range order.Items {
-				var updateErr error
-				// Retry stock update
-				for retry := 0; retry < 3; retry++ {
-					_, updateErr = s.invClient.UpdateProduct(context.Background(), &proto.UpdateProductRequest{
-						Id:    item.ProductId,
-						Stock: -item.Quantity, // Decrease stock
-					})
-					if updateErr == nil {
-						logrus.Infof("Updated stock for product %s by -%d", item.ProductId, item.Quantity)
-						break
-					}
-					logrus.Errorf("Retry %d: Failed to update stock for product %s: %v", retry+1, item.ProductId, updateErr)
-					time.Sleep(time.Duration(retry*100) * time.Millisecond)
-				}
-				if updateErr != nil {
-					logrus.Errorf("Failed to update stock for product %s after retries", item.ProductId)
-				}
-			}
+			// Stock is reserved by the order saga before the order is
+			// created, so there is nothing left to take here.
+			logrus.Infof("Received order.created event for order %s (%d items)", order.Id, len(order.Items))
 		})
 		if err == nil {
 			logrus.Info("Successfully subscribed to order.created events")
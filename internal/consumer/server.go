@@ -3,10 +3,7 @@ package consumer
 import (
 	"ecommerce/internal/config"
 	"ecommerce/internal/consumer/application"
-	"ecommerce/proto"
 	"github.com/nats-io/nats.go"
-	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
 	"log"
 )
 
@@ -17,15 +14,7 @@ func Run(cfg *config.Config) error {
 	}
 	defer nc.Close()
 
-	// Connect to inventory-service using the configured address directly
-	invConn, err := grpc.Dial(cfg.InventoryAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
-	if err != nil {
-		return err
-	}
-	defer invConn.Close()
-
-	invClient := proto.NewInventoryServiceClient(invConn)
-	svc := application.NewService(nc, invClient)
+	svc := application.NewService(nc)
 
 	if err := svc.SubscribeToOrders(); err != nil {
 		return err
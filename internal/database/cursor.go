@@ -0,0 +1,58 @@
+package database
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// ErrInvalidPageToken is returned for page tokens that were not issued by
+// Cursor.Encode.
+var ErrInvalidPageToken = errors.New("invalid page token")
+
+// Cursor is the position of a row in a listing ordered by creation time and
+// ID, newest first. Unlike an offset it stays valid as rows are added, and
+// the next page is found through the index instead of by skipping rows.
+type Cursor struct {
+	CreatedAt time.Time `json:"t"`
+	ID        string    `json:"id"`
+}
+
+// Encode returns the cursor as an opaque page token.
+func (c Cursor) Encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// DecodeCursor parses a page token returned by Encode.
+func DecodeCursor(token string) (Cursor, error) {
+	var c Cursor
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return c, ErrInvalidPageToken
+	}
+	if err := json.Unmarshal(data, &c); err != nil || c.ID == "" || c.CreatedAt.IsZero() {
+		return c, ErrInvalidPageToken
+	}
+	return c, nil
+}
+
+// NewestFirst orders a query on table by creation time and ID, newest first,
+// the order cursors follow. Offset pages use it too, so that a listing can
+// start with an offset page and continue with cursors.
+func NewestFirst(db *gorm.DB, table string) *gorm.DB {
+	return db.Order(table + ".created_at DESC, " + table + ".id DESC")
+}
+
+// After restricts a query on table to the rows after the cursor, newest
+// first, and reads one row more than limit, so that the caller can tell
+// whether another page follows.
+func After(db *gorm.DB, table string, c *Cursor, limit int) *gorm.DB {
+	if c != nil {
+		db = db.Where("("+table+".created_at, "+table+".id) < (?, ?)", c.CreatedAt, c.ID)
+	}
+	return NewestFirst(db, table).Limit(limit + 1)
+}
@@ -0,0 +1,78 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"gorm.io/gorm"
+)
+
+type txKey struct{}
+
+// TxOption configures a transaction started by WithTransaction.
+type TxOption func(*sql.TxOptions)
+
+// WithIsolation sets the isolation level of the transaction.
+func WithIsolation(level sql.IsolationLevel) TxOption {
+	return func(o *sql.TxOptions) {
+		o.Isolation = level
+	}
+}
+
+// ReadOnly starts a read-only transaction.
+func ReadOnly() TxOption {
+	return func(o *sql.TxOptions) {
+		o.ReadOnly = true
+	}
+}
+
+// Conn returns the transaction bound to ctx by WithTransaction, or db when
+// ctx carries none. Repositories use it for every query so that they take
+// part in the caller's transaction.
+func Conn(ctx context.Context, db *gorm.DB) *gorm.DB {
+	if tx, ok := ctx.Value(txKey{}).(*gorm.DB); ok {
+		return tx.WithContext(ctx)
+	}
+	return db.WithContext(ctx)
+}
+
+// InTransaction reports whether ctx carries a transaction.
+func InTransaction(ctx context.Context) bool {
+	_, ok := ctx.Value(txKey{}).(*gorm.DB)
+	return ok
+}
+
+// WithTransaction runs fn in a transaction and binds it to the context passed
+// to fn. The transaction is committed if fn returns nil and rolled back if it
+// returns an error or panics; a panic is returned as an error.
+//
+// When ctx already carries a transaction, fn runs in a savepoint of it
+// instead: an error rolls back to the savepoint only, and opts are ignored
+// because the isolation level is fixed by the outer transaction.
+func WithTransaction(ctx context.Context, db *gorm.DB, fn func(txCtx context.Context) error, opts ...TxOption) error {
+	run := func(tx *gorm.DB) (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("transaction panicked: %v", r)
+			}
+		}()
+		return fn(context.WithValue(ctx, txKey{}, tx))
+	}
+
+	if outer, ok := ctx.Value(txKey{}).(*gorm.DB); ok {
+		return outer.WithContext(ctx).Transaction(run)
+	}
+
+	var txOpts *sql.TxOptions
+	if len(opts) > 0 {
+		txOpts = &sql.TxOptions{}
+		for _, opt := range opts {
+			opt(txOpts)
+		}
+	}
+	if txOpts == nil {
+		return db.WithContext(ctx).Transaction(run)
+	}
+	return db.WithContext(ctx).Transaction(run, txOpts)
+}
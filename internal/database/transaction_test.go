@@ -0,0 +1,201 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+type item struct {
+	ID   uint
+	Name string
+}
+
+// recorder collects the options of every transaction begun on its
+// connections. SQLite ignores isolation levels and read-only transactions,
+// so the tests check what reaches the driver instead.
+type recorder struct {
+	driver driver.Driver
+	dsn    string
+	begun  []driver.TxOptions
+}
+
+func (r *recorder) Connect(context.Context) (driver.Conn, error) {
+	conn, err := r.driver.Open(r.dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &recordingConn{Conn: conn, rec: r}, nil
+}
+
+func (r *recorder) Driver() driver.Driver {
+	return r.driver
+}
+
+type recordingConn struct {
+	driver.Conn
+	rec *recorder
+}
+
+func (c *recordingConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	c.rec.begun = append(c.rec.begun, opts)
+	return c.Conn.(driver.ConnBeginTx).BeginTx(ctx, driver.TxOptions{})
+}
+
+func openDB(t *testing.T) (*gorm.DB, *recorder) {
+	t.Helper()
+	base, err := sql.Open(sqlite.DriverName, "")
+	if err != nil {
+		t.Fatalf("open driver: %v", err)
+	}
+	rec := &recorder{driver: base.Driver(), dsn: filepath.Join(t.TempDir(), "tx.db")}
+	base.Close()
+
+	sqlDB := sql.OpenDB(rec)
+	t.Cleanup(func() { sqlDB.Close() })
+	db, err := gorm.Open(&sqlite.Dialector{Conn: sqlDB}, &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatalf("open database: %v", err)
+	}
+	if err := db.Exec("CREATE TABLE items (id INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT)").Error; err != nil {
+		t.Fatalf("create table: %v", err)
+	}
+	rec.begun = nil
+	return db, rec
+}
+
+func insert(t *testing.T, ctx context.Context, db *gorm.DB, name string) {
+	t.Helper()
+	if err := Conn(ctx, db).Create(&item{Name: name}).Error; err != nil {
+		t.Fatalf("insert %s: %v", name, err)
+	}
+}
+
+func names(t *testing.T, db *gorm.DB) []string {
+	t.Helper()
+	var got []string
+	if err := db.Model(&item{}).Order("id").Pluck("name", &got).Error; err != nil {
+		t.Fatalf("list items: %v", err)
+	}
+	return got
+}
+
+func TestWithTransactionRollsBackOnError(t *testing.T) {
+	db, _ := openDB(t)
+	errFail := errors.New("fail")
+
+	err := WithTransaction(context.Background(), db, func(txCtx context.Context) error {
+		if !InTransaction(txCtx) {
+			t.Error("callback context carries no transaction")
+		}
+		insert(t, txCtx, db, "a")
+		insert(t, txCtx, db, "b")
+		return errFail
+	})
+	if !errors.Is(err, errFail) {
+		t.Fatalf("err = %v, want %v", err, errFail)
+	}
+	if got := names(t, db); len(got) != 0 {
+		t.Errorf("items after rollback = %v, want none", got)
+	}
+}
+
+func TestWithTransactionNestedRollsBackToSavepoint(t *testing.T) {
+	db, _ := openDB(t)
+	errInner := errors.New("inner")
+
+	err := WithTransaction(context.Background(), db, func(txCtx context.Context) error {
+		insert(t, txCtx, db, "outer")
+		err := WithTransaction(txCtx, db, func(innerCtx context.Context) error {
+			insert(t, innerCtx, db, "inner")
+			return errInner
+		})
+		if !errors.Is(err, errInner) {
+			t.Errorf("nested err = %v, want %v", err, errInner)
+		}
+		insert(t, txCtx, db, "after")
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("outer transaction: %v", err)
+	}
+	got := names(t, db)
+	if strings.Join(got, ",") != "outer,after" {
+		t.Errorf("items = %v, want [outer after]", got)
+	}
+}
+
+func TestWithTransactionRollsBackOnPanic(t *testing.T) {
+	db, _ := openDB(t)
+
+	err := WithTransaction(context.Background(), db, func(txCtx context.Context) error {
+		insert(t, txCtx, db, "a")
+		panic("boom")
+	})
+	if err == nil || !strings.Contains(err.Error(), "boom") {
+		t.Fatalf("err = %v, want the recovered panic", err)
+	}
+	if got := names(t, db); len(got) != 0 {
+		t.Errorf("items after panic = %v, want none", got)
+	}
+}
+
+func TestWithTransactionIsolation(t *testing.T) {
+	db, rec := openDB(t)
+
+	err := WithTransaction(context.Background(), db, func(txCtx context.Context) error {
+		insert(t, txCtx, db, "a")
+		// The isolation level of a savepoint is that of the outer
+		// transaction, so nested calls begin nothing
+		return WithTransaction(txCtx, db, func(innerCtx context.Context) error {
+			insert(t, innerCtx, db, "b")
+			return nil
+		}, WithIsolation(sql.LevelReadCommitted))
+	}, WithIsolation(sql.LevelSerializable))
+	if err != nil {
+		t.Fatalf("transaction: %v", err)
+	}
+	if len(rec.begun) != 1 {
+		t.Fatalf("began %d transactions, want 1", len(rec.begun))
+	}
+	if got := sql.IsolationLevel(rec.begun[0].Isolation); got != sql.LevelSerializable {
+		t.Errorf("isolation = %v, want %v", got, sql.LevelSerializable)
+	}
+	if rec.begun[0].ReadOnly {
+		t.Error("transaction began read-only")
+	}
+	if got := names(t, db); strings.Join(got, ",") != "a,b" {
+		t.Errorf("items = %v, want [a b]", got)
+	}
+}
+
+func TestWithTransactionReadOnly(t *testing.T) {
+	db, rec := openDB(t)
+
+	if err := WithTransaction(context.Background(), db, func(context.Context) error { return nil }); err != nil {
+		t.Fatalf("transaction: %v", err)
+	}
+	if err := WithTransaction(context.Background(), db, func(txCtx context.Context) error {
+		_ = names(t, Conn(txCtx, db))
+		return nil
+	}, ReadOnly()); err != nil {
+		t.Fatalf("read-only transaction: %v", err)
+	}
+	if len(rec.begun) != 2 {
+		t.Fatalf("began %d transactions, want 2", len(rec.begun))
+	}
+	if def := rec.begun[0]; def.ReadOnly || sql.IsolationLevel(def.Isolation) != sql.LevelDefault {
+		t.Errorf("default options = %+v, want read-write at the default level", def)
+	}
+	if !rec.begun[1].ReadOnly {
+		t.Error("ReadOnly transaction began read-write")
+	}
+}
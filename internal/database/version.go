@@ -0,0 +1,19 @@
+package database
+
+import "gorm.io/gorm"
+
+// SaveVersion saves all fields of value, a model with a version column, if
+// its row is still at *version, and then bumps *version. It reports false
+// without error when another writer changed the row since it was read, or
+// when the row is gone, so that concurrent read-modify-writes cannot
+// overwrite each other. Selects and omits set on db apply.
+func SaveVersion(db *gorm.DB, value interface{}, version *int) (bool, error) {
+	read := *version
+	*version = read + 1
+	result := db.Model(value).Where("version = ?", read).Select("*").Updates(value)
+	if result.Error != nil || result.RowsAffected == 0 {
+		*version = read
+		return false, result.Error
+	}
+	return true, nil
+}
@@ -0,0 +1,154 @@
+package idempotency
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+
+	"ecommerce/internal/auth"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// MetadataKey is the gRPC metadata key carrying the idempotency key. The API
+// gateway fills it from the Idempotency-Key header.
+const MetadataKey = "idempotency-key"
+
+// MaxKeyLength is the longest accepted idempotency key.
+const MaxKeyLength = 255
+
+// UnaryServerInterceptor makes the given methods idempotent. A call carrying
+// an idempotency key stores its request fingerprint and, once it succeeds, its
+// response for retention. A retry with the same key and request gets the
+// stored response without running the handler again; a retry from another
+// caller, with a different request, or arriving while the first is still
+// running, is rejected. Failed calls release the key so they can be retried.
+//
+// Calls without a key and methods not listed pass through unchanged.
+func UnaryServerInterceptor(repo *Repository, retention time.Duration, methods ...string) grpc.UnaryServerInterceptor {
+	idempotent := make(map[string]bool, len(methods))
+	for _, m := range methods {
+		idempotent[m] = true
+	}
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if !idempotent[info.FullMethod] {
+			return handler(ctx, req)
+		}
+		key := keyFromContext(ctx)
+		if key == "" {
+			return handler(ctx, req)
+		}
+		if len(key) > MaxKeyLength {
+			return nil, status.Errorf(codes.InvalidArgument, "idempotency key longer than %d characters", MaxKeyLength)
+		}
+		msg, ok := req.(proto.Message)
+		if !ok {
+			return handler(ctx, req)
+		}
+		fingerprint, err := fingerprintOf(msg)
+		if err != nil {
+			return nil, status.Error(codes.Internal, "failed to fingerprint request")
+		}
+
+		now := time.Now()
+		subject := subjectFromContext(ctx)
+		rec, claimed, err := repo.Begin(ctx, key, info.FullMethod, subject, fingerprint, now, now.Add(retention))
+		if err != nil {
+			logrus.WithError(err).WithField("method", info.FullMethod).Error("Failed to claim idempotency key")
+			return nil, status.Error(codes.Internal, "failed to check idempotency key")
+		}
+		if !claimed {
+			return replay(rec, subject, fingerprint)
+		}
+
+		resp, err := handler(ctx, req)
+		if err != nil {
+			if delErr := repo.Delete(context.Background(), key, info.FullMethod); delErr != nil {
+				logrus.WithError(delErr).WithField("method", info.FullMethod).Error("Failed to release idempotency key")
+			}
+			return resp, err
+		}
+		if err := complete(repo, key, info.FullMethod, resp); err != nil {
+			// The call succeeded, so its result is returned anyway; a retry
+			// would see the key as still in progress until it expires
+			logrus.WithError(err).WithField("method", info.FullMethod).Error("Failed to store idempotent response")
+		}
+		return resp, nil
+	}
+}
+
+func keyFromContext(ctx context.Context) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+	if values := md.Get(MetadataKey); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// subjectFromContext returns the authenticated user, or "" for calls made
+// without a user token.
+func subjectFromContext(ctx context.Context) string {
+	if claims, ok := auth.ClaimsFromContext(ctx); ok {
+		return claims.UserID()
+	}
+	return ""
+}
+
+// fingerprintOf hashes the deterministic wire encoding of the request.
+func fingerprintOf(msg proto.Message) (string, error) {
+	data, err := proto.MarshalOptions{Deterministic: true}.Marshal(msg)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func replay(rec *Record, subject, fingerprint string) (interface{}, error) {
+	// Responses are only replayed to the caller that made the first request
+	if rec.Subject != subject {
+		return nil, status.Error(codes.AlreadyExists, "idempotency key was already used by another caller")
+	}
+	if rec.Fingerprint != fingerprint {
+		return nil, status.Error(codes.AlreadyExists, "idempotency key was already used with a different request")
+	}
+	if rec.Status != StatusCompleted {
+		return nil, status.Error(codes.Aborted, "a request with this idempotency key is still in progress")
+	}
+	var stored anypb.Any
+	if err := proto.Unmarshal(rec.Response, &stored); err != nil {
+		return nil, status.Error(codes.Internal, "failed to decode stored response")
+	}
+	resp, err := stored.UnmarshalNew()
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to decode stored response")
+	}
+	logrus.WithFields(logrus.Fields{"method": rec.Method, "key": rec.Key}).Info("Replayed idempotent response")
+	return resp, nil
+}
+
+func complete(repo *Repository, key, method string, resp interface{}) error {
+	msg, ok := resp.(proto.Message)
+	if !ok {
+		return repo.Delete(context.Background(), key, method)
+	}
+	stored, err := anypb.New(msg)
+	if err != nil {
+		return err
+	}
+	data, err := proto.Marshal(stored)
+	if err != nil {
+		return err
+	}
+	// The request context may already be cancelled once the handler returns
+	return repo.Complete(context.Background(), key, method, data)
+}
@@ -0,0 +1,125 @@
+package idempotency
+
+import (
+	"context"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Record statuses.
+const (
+	StatusInProgress = "in_progress"
+	StatusCompleted  = "completed"
+)
+
+// Record is a stored idempotency key. The response of the first successful
+// call is kept until ExpiresAt and replayed for retries with the same key
+// from the same Subject.
+type Record struct {
+	Key         string    `gorm:"primaryKey"`
+	Method      string    `gorm:"primaryKey"`
+	Subject     string    `gorm:"not null;default:''"`
+	Fingerprint string    `gorm:"not null"`
+	Status      string    `gorm:"not null"`
+	Response    []byte    `gorm:"type:bytea"`
+	CreatedAt   time.Time `gorm:"not null"`
+	ExpiresAt   time.Time `gorm:"not null;index"`
+}
+
+func (Record) TableName() string {
+	return "idempotency_keys"
+}
+
+// Repository stores idempotency records in Postgres.
+type Repository struct {
+	db *gorm.DB
+}
+
+// NewRepository opens the idempotency store and migrates its table.
+func NewRepository(dsn string) (*Repository, error) {
+	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
+	if err != nil {
+		return nil, err
+	}
+	if err := db.AutoMigrate(&Record{}); err != nil {
+		return nil, err
+	}
+	return &Repository{db: db}, nil
+}
+
+// Begin claims key for method on behalf of subject. If the key is new, or its
+// previous record has expired, an in-progress record is stored and returned
+// with claimed set. Otherwise the existing record is returned unchanged.
+func (r *Repository) Begin(ctx context.Context, key, method, subject, fingerprint string, now, expiresAt time.Time) (*Record, bool, error) {
+	var rec Record
+	claimed := false
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		// Expired keys may be reused
+		if err := tx.Delete(&Record{}, "key = ? AND method = ? AND expires_at <= ?", key, method, now).Error; err != nil {
+			return err
+		}
+		rec = Record{
+			Key:         key,
+			Method:      method,
+			Subject:     subject,
+			Fingerprint: fingerprint,
+			Status:      StatusInProgress,
+			CreatedAt:   now,
+			ExpiresAt:   expiresAt,
+		}
+		// A concurrent request with the same key makes the insert a no-op, in
+		// which case the record it stored is returned instead
+		result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&rec)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 1 {
+			claimed = true
+			return nil
+		}
+		rec = Record{}
+		return tx.First(&rec, "key = ? AND method = ?", key, method).Error
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return &rec, claimed, nil
+}
+
+// Complete stores the response for a claimed key.
+func (r *Repository) Complete(ctx context.Context, key, method string, response []byte) error {
+	return r.db.WithContext(ctx).Model(&Record{}).
+		Where("key = ? AND method = ?", key, method).
+		Updates(map[string]interface{}{"status": StatusCompleted, "response": response}).Error
+}
+
+// Delete drops a claimed key, so a failed request can be retried.
+func (r *Repository) Delete(ctx context.Context, key, method string) error {
+	return r.db.WithContext(ctx).Delete(&Record{}, "key = ? AND method = ?", key, method).Error
+}
+
+// PurgeExpired deletes records that expired before now.
+func (r *Repository) PurgeExpired(ctx context.Context, now time.Time) (int64, error) {
+	result := r.db.WithContext(ctx).Delete(&Record{}, "expires_at < ?", now)
+	return result.RowsAffected, result.Error
+}
+
+// RunPurge deletes expired records every interval until ctx is cancelled.
+func (r *Repository) RunPurge(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if _, err := r.PurgeExpired(ctx, time.Now()); err != nil {
+			logrus.WithError(err).Error("Failed to purge expired idempotency keys")
+		}
+	}
+}
@@ -0,0 +1,322 @@
+package application
+
+import (
+	"context"
+	"ecommerce/internal/inventory/domain"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// CategoryChanges describe an update of a category. Zero fields are left
+// alone.
+type CategoryChanges struct {
+	Name            string
+	Slug            string
+	Attributes      []domain.AttributeSchema
+	ClearAttributes bool
+}
+
+// categoryPath returns the ancestors of c, root first, followed by c.
+func (s *Service) categoryPath(ctx context.Context, c *domain.Category) ([]*domain.Category, error) {
+	ids := c.AncestorIDs()
+	if len(ids) == 0 {
+		return []*domain.Category{c}, nil
+	}
+	ancestors, err := s.repo.GetCategories(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[string]*domain.Category, len(ancestors))
+	for _, a := range ancestors {
+		byID[a.ID] = a
+	}
+	path := make([]*domain.Category, 0, len(ids)+1)
+	for _, id := range ids {
+		a, ok := byID[id]
+		if !ok {
+			return nil, fmt.Errorf("category %s has a missing ancestor %s", c.ID, id)
+		}
+		path = append(path, a)
+	}
+	return append(path, c), nil
+}
+
+// lookupCategory finds a category by ID, or by slug when the argument is not
+// a UUID.
+func (s *Service) lookupCategory(ctx context.Context, idOrSlug string) (*domain.Category, error) {
+	if _, err := uuid.Parse(idOrSlug); err == nil {
+		return s.repo.GetCategory(ctx, idOrSlug)
+	}
+	return s.repo.GetCategoryBySlug(ctx, strings.ToLower(strings.TrimSpace(idOrSlug)))
+}
+
+// categorize resolves the category of p, given by CategoryID or else by the
+// slug in Category, and checks its attributes against the category's
+// schemas. Products without a category have no attributes. It must run in a
+// transaction: the category is share-locked so that it cannot be deleted
+// under the product.
+func (s *Service) categorize(txCtx context.Context, p *domain.Product) error {
+	var schemas []domain.AttributeSchema
+	if p.CategoryID == nil && p.Category == "" {
+		p.Category = ""
+	} else {
+		idOrSlug := p.Category
+		if p.CategoryID != nil {
+			idOrSlug = *p.CategoryID
+		}
+		found, err := s.lookupCategory(txCtx, idOrSlug)
+		if err != nil {
+			return err
+		}
+		c, err := s.repo.LockCategory(txCtx, found.ID, true)
+		if err != nil {
+			return err
+		}
+		path, err := s.categoryPath(txCtx, c)
+		if err != nil {
+			return err
+		}
+		p.CategoryID = &c.ID
+		p.Category = c.Slug
+		schemas = domain.EffectiveAttributes(path)
+	}
+	attrs, err := domain.ValidateAttributes(schemas, p.Attributes)
+	if err != nil {
+		return err
+	}
+	p.Attributes = attrs
+	return nil
+}
+
+// CreateCategory creates a category under parentID, or a root category if
+// parentID is empty.
+func (s *Service) CreateCategory(ctx context.Context, c *domain.Category, parentID string) error {
+	c.ID = uuid.New().String()
+	c.Normalize()
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	err := s.repo.WithTransaction(ctx, func(txCtx context.Context) error {
+		c.ParentID = nil
+		c.Path = c.ID
+		if parentID != "" {
+			if _, err := uuid.Parse(parentID); err != nil {
+				return domain.ErrCategoryNotFound
+			}
+			// Keeps the parent from being moved or deleted meanwhile
+			parent, err := s.repo.LockCategory(txCtx, parentID, true)
+			if err != nil {
+				return err
+			}
+			if parent.Depth() >= domain.MaxCategoryDepth {
+				return fmt.Errorf("%w: categories nest at most %d levels", domain.ErrInvalidCategory, domain.MaxCategoryDepth)
+			}
+			c.ParentID = &parent.ID
+			c.Path = parent.Path + "/" + c.ID
+		}
+		return s.repo.CreateCategory(txCtx, c)
+	})
+	if err != nil {
+		if !isCategoryError(err) {
+			logrus.WithError(err).Error("Failed to create category")
+		}
+		return err
+	}
+	logrus.WithFields(logrus.Fields{"category_id": c.ID, "slug": c.Slug}).Info("Category created")
+	return nil
+}
+
+// GetCategory returns a category by ID, or by slug when idOrSlug is not a
+// UUID, and its path from the root, ending with the category itself.
+func (s *Service) GetCategory(ctx context.Context, idOrSlug string) (*domain.Category, []*domain.Category, error) {
+	c, err := s.lookupCategory(ctx, idOrSlug)
+	if err != nil {
+		return nil, nil, err
+	}
+	path, err := s.categoryPath(ctx, c)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to load category path")
+		return nil, nil, err
+	}
+	return c, path, nil
+}
+
+// ListCategories returns the children of a category, given by ID or slug,
+// or the root categories if parent is empty.
+func (s *Service) ListCategories(ctx context.Context, parent string) ([]*domain.Category, error) {
+	parentID := ""
+	if parent != "" {
+		c, err := s.lookupCategory(ctx, parent)
+		if err != nil {
+			return nil, err
+		}
+		parentID = c.ID
+	}
+	return s.repo.ListChildCategories(ctx, parentID)
+}
+
+// UpdateCategory changes the name, slug or attribute schemas of a category.
+// Products already in the category are checked against changed schemas the
+// next time they are updated.
+func (s *Service) UpdateCategory(ctx context.Context, id string, changes CategoryChanges) (*domain.Category, error) {
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, domain.ErrCategoryNotFound
+	}
+	var c *domain.Category
+	var oldSlug string
+	err := s.repo.WithTransaction(ctx, func(txCtx context.Context) error {
+		var err error
+		if c, err = s.repo.LockCategory(txCtx, id, false); err != nil {
+			return err
+		}
+		oldSlug = c.Slug
+		if changes.Name != "" {
+			c.Name = changes.Name
+		}
+		if changes.Slug != "" {
+			c.Slug = changes.Slug
+		}
+		if changes.ClearAttributes {
+			c.Attributes = nil
+		} else if len(changes.Attributes) > 0 {
+			c.Attributes = changes.Attributes
+		}
+		c.Normalize()
+		if err := c.Validate(); err != nil {
+			return err
+		}
+		return s.repo.UpdateCategory(txCtx, c)
+	})
+	if err != nil {
+		if !isCategoryError(err) {
+			logrus.WithError(err).Error("Failed to update category")
+		}
+		return nil, err
+	}
+	if c.Slug != oldSlug {
+		// Cached products still carry the old slug
+		s.invalidateCategoryProducts(ctx, c.ID)
+	}
+	logrus.WithFields(logrus.Fields{"category_id": c.ID, "slug": c.Slug}).Info("Category updated")
+	return c, nil
+}
+
+// invalidateCategoryProducts drops the cached copies of the products of a
+// category.
+func (s *Service) invalidateCategoryProducts(ctx context.Context, categoryID string) {
+	ids, err := s.repo.CategoryProductIDs(ctx, categoryID)
+	if err != nil {
+		logrus.WithError(err).Warn("Failed to list products to invalidate, proceeding")
+		return
+	}
+	for _, id := range ids {
+		s.invalidateProduct(ctx, id)
+	}
+}
+
+// MoveCategory moves a category with its subtree under parentID, or to the
+// root if parentID is empty. A category cannot move into its own subtree,
+// and the tree must stay within MaxCategoryDepth levels.
+func (s *Service) MoveCategory(ctx context.Context, id, parentID string) (*domain.Category, error) {
+	for _, ref := range []string{id, parentID} {
+		if _, err := uuid.Parse(ref); ref != "" && err != nil {
+			return nil, domain.ErrCategoryNotFound
+		}
+	}
+	var c *domain.Category
+	err := s.repo.WithTransaction(ctx, func(txCtx context.Context) error {
+		var err error
+		if c, err = s.repo.LockCategory(txCtx, id, false); err != nil {
+			return err
+		}
+		oldPath := c.Path
+		newPath, depth := c.ID, 0
+		c.ParentID = nil
+		if parentID != "" {
+			parent, err := s.repo.LockCategory(txCtx, parentID, false)
+			if err != nil {
+				return err
+			}
+			if parent.Path == oldPath || strings.HasPrefix(parent.Path, oldPath+"/") {
+				return fmt.Errorf("%w: a category cannot move into its own subtree", domain.ErrInvalidCategory)
+			}
+			newPath, depth = parent.Path+"/"+c.ID, parent.Depth()
+			c.ParentID = &parent.ID
+		}
+		deepest, err := s.repo.MaxSubtreeDepth(txCtx, oldPath)
+		if err != nil {
+			return err
+		}
+		if depth+deepest-c.Depth()+1 > domain.MaxCategoryDepth {
+			return fmt.Errorf("%w: categories nest at most %d levels", domain.ErrInvalidCategory, domain.MaxCategoryDepth)
+		}
+		c.Path = newPath
+		return s.repo.MoveCategory(txCtx, c, oldPath)
+	})
+	if err != nil {
+		if !isCategoryError(err) {
+			logrus.WithError(err).Error("Failed to move category")
+		}
+		return nil, err
+	}
+	logrus.WithFields(logrus.Fields{"category_id": c.ID, "parent_id": parentID}).Info("Category moved")
+	return c, nil
+}
+
+// DeleteCategory deletes a category without products or subcategories.
+func (s *Service) DeleteCategory(ctx context.Context, id string) error {
+	if _, err := uuid.Parse(id); err != nil {
+		return domain.ErrCategoryNotFound
+	}
+	err := s.repo.WithTransaction(ctx, func(txCtx context.Context) error {
+		// Waits for products being added to the category
+		if _, err := s.repo.LockCategory(txCtx, id, false); err != nil {
+			return err
+		}
+		children, err := s.repo.CountCategoryChildren(txCtx, id)
+		if err != nil {
+			return err
+		}
+		products, err := s.repo.CountCategoryProducts(txCtx, id)
+		if err != nil {
+			return err
+		}
+		if children > 0 || products > 0 {
+			return fmt.Errorf("%w: %d products, %d subcategories", domain.ErrCategoryNotEmpty, products, children)
+		}
+		return s.repo.DeleteCategory(txCtx, id)
+	})
+	if err != nil {
+		if !isCategoryError(err) {
+			logrus.WithError(err).Error("Failed to delete category")
+		}
+		return err
+	}
+	logrus.WithField("category_id", id).Info("Category deleted")
+	return nil
+}
+
+// ListCategoryProducts lists the products of a category and all of its
+// subcategories, by name.
+func (s *Service) ListCategoryProducts(ctx context.Context, idOrSlug string, page, pageSize int) ([]*domain.Product, int, error) {
+	c, err := s.lookupCategory(ctx, idOrSlug)
+	if err != nil {
+		return nil, 0, err
+	}
+	products, total, err := s.repo.ListCategoryProducts(ctx, c.Path, page, pageSize)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to list category products")
+		return nil, 0, err
+	}
+	return products, total, nil
+}
+
+func isCategoryError(err error) bool {
+	return errors.Is(err, domain.ErrCategoryNotFound) || errors.Is(err, domain.ErrInvalidCategory) ||
+		errors.Is(err, domain.ErrDuplicateSlug) || errors.Is(err, domain.ErrCategoryNotEmpty) ||
+		errors.Is(err, domain.ErrInvalidAttributes)
+}
@@ -0,0 +1,188 @@
+package application
+
+import (
+	"context"
+	"ecommerce/internal/inventory/domain"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// CreateLocation adds a location. A new default location replaces the
+// previous one, and takes the stock changes that name no location from then
+// on.
+func (s *Service) CreateLocation(ctx context.Context, l *domain.Location) error {
+	l.Normalize()
+	if err := l.Validate(); err != nil {
+		return err
+	}
+	l.ID = uuid.New().String()
+	if err := s.repo.CreateLocation(ctx, l); err != nil {
+		if !isLocationError(err) {
+			logrus.WithError(err).Error("Failed to create location")
+		}
+		return err
+	}
+	logrus.WithFields(logrus.Fields{"location_id": l.ID, "code": l.Code, "default": l.IsDefault}).Info("Location created")
+	return nil
+}
+
+// ListLocations returns all locations in code order.
+func (s *Service) ListLocations(ctx context.Context) ([]*domain.Location, error) {
+	locations, err := s.repo.ListLocations(ctx)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to list locations")
+		return nil, err
+	}
+	return locations, nil
+}
+
+// CreateTransfer sends quantity units of the variant c names from the
+// location in c, the default location if empty, to the location to. The
+// units stay in transit until the transfer is received or cancelled. c's
+// reason is ignored: the source's movement is recorded as a transfer
+// referencing it.
+func (s *Service) CreateTransfer(ctx context.Context, c StockChange, to string, quantity int) (*domain.Transfer, error) {
+	c.Reason = ""
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(to) == "" {
+		return nil, fmt.Errorf("%w: the destination is required", domain.ErrInvalidTransfer)
+	}
+	if quantity <= 0 {
+		return nil, fmt.Errorf("%w: quantity must be positive", domain.ErrInvalidTransfer)
+	}
+	var t *domain.Transfer
+	err := s.repo.WithTransaction(ctx, func(txCtx context.Context) error {
+		v, from, err := s.lockStock(txCtx, c)
+		if err != nil {
+			return err
+		}
+		dest, err := s.repo.GetLocation(txCtx, to)
+		if err != nil {
+			return err
+		}
+		if dest.ID == from.ID {
+			return fmt.Errorf("%w: the source and destination are both %s", domain.ErrInvalidTransfer, from.Code)
+		}
+		t = &domain.Transfer{
+			ID:             uuid.New().String(),
+			ProductID:      v.ProductID,
+			VariantID:      v.ID,
+			SKU:            v.SKU,
+			FromLocationID: from.ID,
+			ToLocationID:   dest.ID,
+			Quantity:       quantity,
+			Status:         domain.TransferInTransit,
+			Reference:      c.Reference,
+			Actor:          actor(ctx),
+			CreatedAt:      time.Now(),
+		}
+		if err := s.repo.CreateTransfer(txCtx, v, t); err != nil {
+			return err
+		}
+		t.From, t.To = from, dest
+		return s.repo.RecordMovements(txCtx, domain.NewMovement(v, from.ID, -quantity, domain.ReasonTransfer, t.ID, t.Actor))
+	})
+	if err != nil {
+		if !isStockError(err) {
+			logrus.WithError(err).Error("Failed to create transfer")
+		}
+		return nil, err
+	}
+	s.invalidateProduct(ctx, t.ProductID)
+	logrus.WithFields(logrus.Fields{"transfer_id": t.ID, "sku": t.SKU, "from": t.From.Code, "to": t.To.Code, "quantity": quantity}).Info("Transfer created")
+	return t, nil
+}
+
+// ReceiveTransfer makes the units of an in-transit transfer available at its
+// destination.
+func (s *Service) ReceiveTransfer(ctx context.Context, id string) (*domain.Transfer, error) {
+	return s.completeTransfer(ctx, id, domain.TransferReceived)
+}
+
+// CancelTransfer returns the units of an in-transit transfer to its source.
+func (s *Service) CancelTransfer(ctx context.Context, id string) (*domain.Transfer, error) {
+	return s.completeTransfer(ctx, id, domain.TransferCancelled)
+}
+
+// completeTransfer settles an in-transit transfer with status. The transfer
+// is locked before its variant, so that it is settled once.
+func (s *Service) completeTransfer(ctx context.Context, id, status string) (*domain.Transfer, error) {
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, fmt.Errorf("%w: %s", domain.ErrTransferNotFound, id)
+	}
+	var t *domain.Transfer
+	err := s.repo.WithTransaction(ctx, func(txCtx context.Context) error {
+		var err error
+		if t, err = s.repo.LockTransfer(txCtx, id); err != nil {
+			return err
+		}
+		v, err := s.repo.LockVariant(txCtx, t.VariantID)
+		if err != nil {
+			return err
+		}
+		if err := t.Complete(status, time.Now()); err != nil {
+			return err
+		}
+		if err := s.repo.CompleteTransfer(txCtx, v, t); err != nil {
+			return err
+		}
+		location := t.ToLocationID
+		if status == domain.TransferCancelled {
+			location = t.FromLocationID
+		}
+		return s.repo.RecordMovements(txCtx, domain.NewMovement(v, location, t.Quantity, domain.ReasonTransfer, t.ID, actor(ctx)))
+	})
+	if err != nil {
+		if !isStockError(err) {
+			logrus.WithError(err).WithField("transfer_id", id).Error("Failed to complete transfer")
+		}
+		return nil, err
+	}
+	s.invalidateProduct(ctx, t.ProductID)
+	logrus.WithFields(logrus.Fields{"transfer_id": t.ID, "sku": t.SKU, "status": t.Status}).Info("Transfer completed")
+	return t, nil
+}
+
+// ListTransfers lists transfers newest first. The location in f, matching
+// either end, may be given by ID or code.
+func (s *Service) ListTransfers(ctx context.Context, f domain.TransferFilter, page, pageSize int) ([]*domain.Transfer, int, error) {
+	switch f.Status = strings.ToLower(strings.TrimSpace(f.Status)); f.Status {
+	case "", domain.TransferInTransit, domain.TransferReceived, domain.TransferCancelled:
+	default:
+		return nil, 0, fmt.Errorf("%w: unknown status %q", domain.ErrInvalidTransfer, f.Status)
+	}
+	if f.VariantID != "" {
+		if _, err := uuid.Parse(f.VariantID); err != nil {
+			return nil, 0, fmt.Errorf("%w: %s", domain.ErrVariantNotFound, f.VariantID)
+		}
+	}
+	if f.LocationID != "" {
+		location, err := s.repo.GetLocation(ctx, f.LocationID)
+		if err != nil {
+			if !isLocationError(err) {
+				logrus.WithError(err).Error("Failed to look up location")
+			}
+			return nil, 0, err
+		}
+		f.LocationID = location.ID
+	}
+	transfers, total, err := s.repo.ListTransfers(ctx, f, page, pageSize)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to list transfers")
+		return nil, 0, err
+	}
+	return transfers, total, nil
+}
+
+func isLocationError(err error) bool {
+	return errors.Is(err, domain.ErrLocationNotFound) || errors.Is(err, domain.ErrInvalidLocation) ||
+		errors.Is(err, domain.ErrDuplicateCode) || errors.Is(err, domain.ErrTransferNotFound) ||
+		errors.Is(err, domain.ErrInvalidTransfer)
+}
@@ -0,0 +1,70 @@
+package application
+
+import (
+	"context"
+	"ecommerce/internal/auth"
+	"ecommerce/internal/inventory/domain"
+	"errors"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// actor returns the user making the call, or the system for internal calls
+// such as stock reservations for orders.
+func actor(ctx context.Context) string {
+	if claims, ok := auth.ClaimsFromContext(ctx); ok {
+		return claims.UserID()
+	}
+	return domain.ActorSystem
+}
+
+// ListStockMovements lists the stock ledger newest first. A SKU in f is
+// resolved to its variant, so that the history survives SKU changes; the SKU
+// of a deleted variant matches the movements recorded under it. The location
+// may be given by ID or code.
+func (s *Service) ListStockMovements(ctx context.Context, f domain.MovementFilter, page, pageSize int) ([]*domain.StockMovement, int, error) {
+	if f.Reason != "" {
+		f.Reason = domain.NormalizeReason(f.Reason)
+		if f.Reason != domain.ReasonTransfer {
+			if err := domain.ValidateReason(f.Reason); err != nil {
+				return nil, 0, err
+			}
+		}
+	}
+	if f.LocationID != "" {
+		location, err := s.repo.GetLocation(ctx, f.LocationID)
+		if err != nil {
+			if !isLocationError(err) {
+				logrus.WithError(err).Error("Failed to look up location")
+			}
+			return nil, 0, err
+		}
+		f.LocationID = location.ID
+	}
+	if f.VariantID != "" {
+		if _, err := uuid.Parse(f.VariantID); err != nil {
+			return nil, 0, domain.ErrVariantNotFound
+		}
+	}
+	if f.SKU != "" {
+		f.SKU = domain.NormalizeSKU(f.SKU)
+		v, err := s.repo.GetVariantBySKU(ctx, f.SKU)
+		switch {
+		case errors.Is(err, domain.ErrVariantNotFound):
+		case err != nil:
+			logrus.WithError(err).Error("Failed to look up SKU")
+			return nil, 0, err
+		case f.VariantID != "" && f.VariantID != v.ID:
+			return nil, 0, nil
+		default:
+			f.VariantID, f.SKU = v.ID, ""
+		}
+	}
+	movements, total, err := s.repo.ListMovements(ctx, f, page, pageSize)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to list stock movements")
+		return nil, 0, err
+	}
+	return movements, total, nil
+}
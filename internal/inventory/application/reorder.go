@@ -0,0 +1,51 @@
+package application
+
+import (
+	"context"
+	"ecommerce/internal/inventory/domain"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// maxReorderDays bounds the sales window and cover period of reorder
+// reports.
+const maxReorderDays = 365
+
+// GetReorderReport suggests what to buy: the products whose stock, with the
+// units in transit, does not cover their reorder point plus coverDays of
+// sales at the velocity of the last windowDays. Zero days default to 30.
+// The products that run out soonest come first, then those without sales.
+func (s *Service) GetReorderReport(ctx context.Context, windowDays, coverDays int) ([]*domain.ReorderLine, error) {
+	if windowDays == 0 {
+		windowDays = 30
+	}
+	if coverDays == 0 {
+		coverDays = 30
+	}
+	if windowDays < 1 || windowDays > maxReorderDays || coverDays < 1 || coverDays > maxReorderDays {
+		return nil, fmt.Errorf("%w: window and cover must be 1 to %d days", domain.ErrInvalidReorder, maxReorderDays)
+	}
+	lines, err := s.repo.ReorderLines(ctx, time.Now().AddDate(0, 0, -windowDays))
+	if err != nil {
+		logrus.WithError(err).Error("Failed to compute reorder report")
+		return nil, err
+	}
+	var report []*domain.ReorderLine
+	for _, l := range lines {
+		l.Suggest(windowDays, coverDays)
+		if l.Suggested > 0 {
+			report = append(report, l)
+		}
+	}
+	sort.SliceStable(report, func(i, j int) bool {
+		a, b := report[i].DaysOfCover, report[j].DaysOfCover
+		if (a < 0) != (b < 0) {
+			return b < 0
+		}
+		return a < b
+	})
+	return report, nil
+}
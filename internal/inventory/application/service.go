@@ -2,32 +2,94 @@ package application
 
 import (
 	"context"
+	"ecommerce/internal/database"
 	"ecommerce/internal/inventory/domain"
 	"ecommerce/internal/inventory/infrastructure"
+	"errors"
+	"fmt"
 	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
+	"strings"
+	"time"
 )
 
 // Service defines the application logic for the inventory service.
 type Service struct {
-	repo  *infrastructure.Repository
-	cache infrastructure.Cache
+	repo           *infrastructure.Repository
+	cache          infrastructure.Cache
+	reservationTTL time.Duration
+	sourcing       string
 }
 
-// NewService creates a new inventory service.
-func NewService(repo *infrastructure.Repository, cache infrastructure.Cache) *Service {
-	return &Service{repo: repo, cache: cache}
+// NewService creates a new inventory service. Stock reservations that are not
+// committed within reservationTTL are released. Reservations that do not name
+// a sourcing strategy use sourcing.
+func NewService(repo *infrastructure.Repository, cache infrastructure.Cache, reservationTTL time.Duration, sourcing string) *Service {
+	return &Service{repo: repo, cache: cache, reservationTTL: reservationTTL, sourcing: sourcing}
 }
 
-// Create creates a new product.
+// Create creates a new product with its variants in the category named by
+// p.CategoryID or the slug p.Category, if any. A product created without
+// variants gets a default one holding p.Stock, with the product ID as SKU.
+// Initial stock is held at the default location and recorded in the ledger
+// as a restock. A product created at or below its reorder point is reported
+// low on stock.
 func (s *Service) Create(ctx context.Context, p *domain.Product) error {
 	if p.ID == "" {
 		p.ID = uuid.New().String()
 	}
-	if err := s.repo.Create(ctx, p); err != nil {
-		logrus.WithError(err).Error("Failed to create product")
+	p.Version = 1
+	if err := p.ValidateReorder(); err != nil {
 		return err
 	}
+	if len(p.Variants) == 0 {
+		p.Variants = []*domain.Variant{{SKU: domain.DefaultSKU(p.ID), Stock: p.Stock}}
+	}
+	for _, v := range p.Variants {
+		v.ID = uuid.New().String()
+		v.ProductID = p.ID
+		v.Version = 1
+		v.Normalize()
+		if err := v.Validate(); err != nil {
+			return err
+		}
+	}
+	if err := domain.CheckDistinct(p.Variants); err != nil {
+		return err
+	}
+	p.TotalStock()
+	err := s.repo.WithTransaction(ctx, func(txCtx context.Context) error {
+		if err := s.categorize(txCtx, p); err != nil {
+			return err
+		}
+		if err := s.repo.Create(txCtx, p); err != nil {
+			return err
+		}
+		location, err := s.repo.GetLocation(txCtx, "")
+		if err != nil {
+			return err
+		}
+		movements := make([]*domain.StockMovement, len(p.Variants))
+		for i, v := range p.Variants {
+			if err := s.repo.AddToLevel(txCtx, v, location.ID, v.Stock); err != nil {
+				return err
+			}
+			v.Levels = []*domain.StockLevel{{VariantID: v.ID, LocationID: location.ID, ProductID: p.ID, Available: v.Stock, Location: location}}
+			movements[i] = domain.NewMovement(v, location.ID, v.Stock, domain.ReasonRestock, "", actor(ctx))
+		}
+		if err := s.repo.RecordMovements(txCtx, movements...); err != nil {
+			return err
+		}
+		// Products created without stock have no movements
+		return s.repo.UpdateLowStock(txCtx, p.ID)
+	})
+	if err != nil {
+		if !isStockError(err) && !isCategoryError(err) {
+			logrus.WithError(err).Error("Failed to create product")
+		}
+		return err
+	}
+	p.LowStock = domain.IsLow(p.Stock, p.ReorderPoint)
 	if err := s.cache.SetProduct(ctx, uuid.MustParse(p.ID), p); err != nil {
 		logrus.WithError(err).Warn("Failed to cache product, proceeding")
 	}
@@ -42,8 +104,9 @@ func (s *Service) Get(ctx context.Context, id string) (*domain.Product, error) {
 		return nil, err
 	}
 
-	// Check cache first
-	if cachedProduct, err := s.cache.GetProduct(ctx, uuidID); err == nil && cachedProduct != nil {
+	// Check cache first; entries cached before products had variants, or
+	// before stock was kept per location, are treated as misses
+	if cachedProduct, err := s.cache.GetProduct(ctx, uuidID); err == nil && cachedProduct != nil && len(cachedProduct.Variants) > 0 && hasLevels(cachedProduct) {
 		logrus.WithField("product_id", id).Info("Cache hit for product")
 		return cachedProduct, nil
 	}
@@ -51,7 +114,9 @@ func (s *Service) Get(ctx context.Context, id string) (*domain.Product, error) {
 	// Cache miss, query database
 	product, err := s.repo.Get(ctx, id)
 	if err != nil {
-		logrus.WithError(err).Error("Failed to get product")
+		if !errors.Is(err, domain.ErrProductNotFound) {
+			logrus.WithError(err).Error("Failed to get product")
+		}
 		return nil, err
 	}
 
@@ -63,70 +128,313 @@ func (s *Service) Get(ctx context.Context, id string) (*domain.Product, error) {
 	return product, nil
 }
 
-// Update updates a product with transaction and cache invalidation.
-func (s *Service) Update(ctx context.Context, p *domain.Product) error {
-	uuidID, err := uuid.Parse(p.ID)
+// hasLevels reports whether the stock levels of p were loaded: every variant
+// in stock has some.
+func hasLevels(p *domain.Product) bool {
+	for _, v := range p.Variants {
+		if v.Stock > 0 && len(v.Levels) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Update changes the fields of a product with apply, with transaction and
+// cache invalidation. The product is read locked from the database rather
+// than from the cache, so that concurrent updates apply one after the other
+// instead of overwriting each other. With expectedVersion set, the update
+// fails with ErrVersionConflict unless the product is still at that version.
+// The category is resolved as in Create. Variants and their stock are changed
+// with UpdateVariant. A changed reorder point is applied to the low-stock
+// flag at once.
+func (s *Service) Update(ctx context.Context, id string, expectedVersion int, apply func(p *domain.Product) error) (*domain.Product, error) {
+	return s.UpdateWithStock(ctx, id, expectedVersion, apply, VariantChanges{})
+}
+
+// UpdateWithStock is Update followed by the stock changes of stock, in the
+// same transaction, on the only variant of the product. Products with
+// several variants fail with ErrVariantRequired when stock has a delta.
+func (s *Service) UpdateWithStock(ctx context.Context, id string, expectedVersion int, apply func(p *domain.Product) error, stock VariantChanges) (*domain.Product, error) {
+	uuidID, err := uuid.Parse(id)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if stock.StockDelta != 0 {
+		stock.StockReason = domain.NormalizeReason(stock.StockReason)
+		if err := domain.ValidateReason(stock.StockReason); err != nil {
+			return nil, err
+		}
 	}
 
-	// Simulate a transaction with stock update and log
+	var p *domain.Product
+	var skus []string
 	err = s.repo.WithTransaction(ctx, func(txCtx context.Context) error {
-		// Update the product
-		if err := s.repo.Update(txCtx, p); err != nil {
-			logrus.WithError(err).Error("Failed to update product in transaction")
+		var err error
+		if p, err = s.update(txCtx, id, expectedVersion, apply); err != nil {
 			return err
 		}
-
-		// Simulate logging the update (in a real scenario, this would write to a Log table)
-		logrus.WithFields(logrus.Fields{
-			"product_id": p.ID,
-			"stock":      p.Stock,
-			"price":      p.Price,
-		}).Info("Product update logged")
-
+		if stock.StockDelta == 0 {
+			return nil
+		}
+		// Product-level stock changes only make sense with a single variant
+		if len(p.Variants) != 1 {
+			return domain.ErrVariantRequired
+		}
+		v, oldSKU, err := s.updateVariant(txCtx, p.Variants[0].ID, p.ID, stock)
+		if err != nil {
+			return err
+		}
+		skus = append(skus, oldSKU)
+		p.Variants[0] = v
+		p.TotalStock()
 		return nil
 	})
 	if err != nil {
-		logrus.WithError(err).Error("Transaction failed for product update")
-		return err
+		if !isCategoryError(err) && !isStockError(err) {
+			logrus.WithError(err).Error("Transaction failed for product update")
+		}
+		return nil, err
 	}
 
 	// Invalidate cache
 	if err := s.cache.DeleteProduct(ctx, uuidID); err != nil {
 		logrus.WithError(err).Warn("Failed to invalidate product cache, proceeding")
 	}
-	logrus.WithField("product_id", p.ID).Info("Product updated and cache invalidated")
-	return nil
+	for _, sku := range skus {
+		if err := s.cache.DeleteSKU(ctx, sku); err != nil {
+			logrus.WithError(err).Warn("Failed to invalidate SKU cache, proceeding")
+		}
+	}
+	logrus.WithFields(logrus.Fields{"product_id": id, "version": p.Version, "stock": p.Stock}).Info("Product updated and cache invalidated")
+	return p, nil
 }
 
-// Delete deletes a product and invalidates cache.
-func (s *Service) Delete(ctx context.Context, id string) error {
-	uuidID, err := uuid.Parse(id)
+// update is the body of Update, run in the transaction of txCtx.
+func (s *Service) update(txCtx context.Context, id string, expectedVersion int, apply func(p *domain.Product) error) (*domain.Product, error) {
+	if err := s.repo.LockProduct(txCtx, id); err != nil {
+		return nil, err
+	}
+	p, err := s.repo.Get(txCtx, id)
 	if err != nil {
+		return nil, err
+	}
+	if expectedVersion != 0 && p.Version != expectedVersion {
+		return nil, fmt.Errorf("%w: product %s is at version %d, not %d", domain.ErrVersionConflict, id, p.Version, expectedVersion)
+	}
+	reorderPoint := p.ReorderPoint
+	if err := apply(p); err != nil {
+		return nil, err
+	}
+	if err := p.ValidateReorder(); err != nil {
+		return nil, err
+	}
+	// Attributes must follow the schemas of the category as they are now
+	if err := s.categorize(txCtx, p); err != nil {
+		return nil, err
+	}
+
+	// Update the product
+	if err := s.repo.Update(txCtx, p); err != nil {
+		if !errors.Is(err, domain.ErrVersionConflict) {
+			logrus.WithError(err).Error("Failed to update product in transaction")
+		}
+		return nil, err
+	}
+	if p.ReorderPoint != reorderPoint {
+		if err := s.repo.UpdateLowStock(txCtx, p.ID); err != nil {
+			return nil, err
+		}
+		p.LowStock = domain.IsLow(p.TotalStock(), p.ReorderPoint)
+	}
+	return p, nil
+}
+
+// Delete deletes a product with its variants and invalidates cache.
+func (s *Service) Delete(ctx context.Context, id string) error {
+	if _, err := uuid.Parse(id); err != nil {
 		return err
 	}
 
+	p, err := s.repo.Get(ctx, id)
+	if err != nil {
+		return err
+	}
 	if err := s.repo.Delete(ctx, id); err != nil {
 		logrus.WithError(err).Error("Failed to delete product")
 		return err
 	}
 
 	// Invalidate cache
-	if err := s.cache.DeleteProduct(ctx, uuidID); err != nil {
-		logrus.WithError(err).Warn("Failed to invalidate product cache, proceeding")
+	skus := make([]string, len(p.Variants))
+	for i, v := range p.Variants {
+		skus[i] = v.SKU
 	}
+	s.invalidateProduct(ctx, id, skus...)
 	logrus.WithField("product_id", id).Info("Product deleted and cache invalidated")
 	return nil
 }
 
-// List lists products with pagination.
-func (s *Service) List(ctx context.Context, page, pageSize int) ([]*domain.Product, int, error) {
-	products, total, err := s.repo.List(ctx, page, pageSize)
+// List lists products, newest first. Without a page token it returns the
+// given offset page and the total; with one it returns the page after the
+// token, without a total. Either way nextPageToken continues the listing and
+// is empty on the last page.
+func (s *Service) List(ctx context.Context, page, pageSize int, pageToken string) (products []*domain.Product, total int, nextPageToken string, err error) {
+	var more bool
+	if pageToken != "" {
+		after, err := database.DecodeCursor(pageToken)
+		if err != nil {
+			return nil, 0, "", err
+		}
+		products, more, err = s.repo.ListAfter(ctx, &after, pageSize)
+	} else {
+		products, total, err = s.repo.List(ctx, page, pageSize)
+		more = (page-1)*pageSize+len(products) < total
+	}
 	if err != nil {
 		logrus.WithError(err).Error("Failed to list products")
-		return nil, 0, err
+		return nil, 0, "", err
+	}
+	if more && len(products) > 0 {
+		last := products[len(products)-1]
+		nextPageToken = database.Cursor{CreatedAt: last.CreatedAt, ID: last.ID}.Encode()
+	}
+	logrus.WithFields(logrus.Fields{"page": page, "page_size": pageSize, "cursor": pageToken != ""}).Info("Products listed")
+	return products, total, nextPageToken, nil
+}
+
+// invalidateReserved drops the cached copies of every product touched by the
+// given reservations, since their stock changed.
+func (s *Service) invalidateReserved(ctx context.Context, reservations []*domain.Reservation) {
+	for _, res := range reservations {
+		uuidID, err := uuid.Parse(res.ProductID)
+		if err != nil {
+			continue
+		}
+		if err := s.cache.DeleteProduct(ctx, uuidID); err != nil {
+			logrus.WithError(err).Warn("Failed to invalidate product cache, proceeding")
+		}
+	}
+}
+
+// Reserve takes stock out for an order, from the locations the sourcing
+// strategy picks for the destination. A ttl of zero and an empty strategy use
+// the service defaults. Reserving is idempotent per order.
+func (s *Service) Reserve(ctx context.Context, orderID string, items []domain.ReservationItem, ttl time.Duration, strategy string, dest domain.Destination) ([]*domain.Reservation, error) {
+	if _, err := uuid.Parse(orderID); err != nil {
+		return nil, errors.New("invalid order ID format: must be a valid UUID")
+	}
+	if len(items) == 0 {
+		return nil, errors.New("at least one item is required")
+	}
+	for _, item := range items {
+		if (item.ProductID == "" && item.VariantID == "" && item.SKU == "") || item.Quantity <= 0 {
+			return nil, errors.New("invalid item: a product ID, variant ID or SKU and a positive quantity are required")
+		}
+		if item.VariantID != "" {
+			if _, err := uuid.Parse(item.VariantID); err != nil {
+				return nil, fmt.Errorf("%w: %s", domain.ErrVariantNotFound, item.VariantID)
+			}
+		}
+	}
+	if ttl <= 0 {
+		ttl = s.reservationTTL
+	}
+	if strategy == "" {
+		strategy = s.sourcing
+	}
+	if err := domain.ValidateStrategy(strategy); err != nil {
+		return nil, err
+	}
+	dest.Country = strings.ToUpper(strings.TrimSpace(dest.Country))
+
+	reservations, err := s.repo.Reserve(ctx, orderID, items, time.Now().Add(ttl), actor(ctx), strategy, dest)
+	if err != nil {
+		logrus.WithError(err).WithField("order_id", orderID).Error("Failed to reserve stock")
+		return nil, err
+	}
+	s.invalidateReserved(ctx, reservations)
+	logrus.WithFields(logrus.Fields{"order_id": orderID, "items": len(reservations)}).Info("Stock reserved")
+	return reservations, nil
+}
+
+// Commit turns the held reservations of an order into a permanent stock
+// deduction, typically once the order is paid.
+func (s *Service) Commit(ctx context.Context, orderID string) ([]*domain.Reservation, error) {
+	reservations, err := s.repo.Commit(ctx, orderID, time.Now(), actor(ctx))
+	if err != nil {
+		if errors.Is(err, domain.ErrReservationExpired) {
+			logrus.WithField("order_id", orderID).Warn("Reservation expired before commit, stock released")
+			return nil, err
+		}
+		logrus.WithError(err).WithField("order_id", orderID).Error("Failed to commit reservation")
+		return nil, err
+	}
+	logrus.WithField("order_id", orderID).Info("Reservation committed")
+	return reservations, nil
+}
+
+// Release returns the reserved stock of an order, e.g. when it is cancelled.
+func (s *Service) Release(ctx context.Context, orderID string) ([]*domain.Reservation, error) {
+	reservations, err := s.repo.Release(ctx, orderID, actor(ctx))
+	if err != nil {
+		logrus.WithError(err).WithField("order_id", orderID).Error("Failed to release reservation")
+		return nil, err
+	}
+	s.invalidateReserved(ctx, reservations)
+	logrus.WithFields(logrus.Fields{"order_id": orderID, "items": len(reservations)}).Info("Reservation released")
+	return reservations, nil
+}
+
+// RunReservationSweeper releases expired reservations every interval until
+// ctx is cancelled, so unpaid orders do not hold stock forever.
+func (s *Service) RunReservationSweeper(ctx context.Context, interval time.Duration) {
+	const batchSize = 100
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for {
+			released, err := s.repo.ReleaseExpired(ctx, time.Now(), batchSize)
+			if err != nil {
+				logrus.WithError(err).Error("Failed to release expired reservations")
+				break
+			}
+			if len(released) == 0 {
+				break
+			}
+			s.invalidateReserved(ctx, released)
+			logrus.WithField("released", len(released)).Info("Expired reservations released")
+			if len(released) < batchSize {
+				break
+			}
+		}
+	}
+}
+
+// SearchProducts searches the catalog by text, category, price and stock.
+// The category may be given by ID or slug.
+func (s *Service) SearchProducts(ctx context.Context, q domain.ProductSearch) (*domain.SearchResult, error) {
+	q.Normalize()
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+	var categoryPath string
+	if q.Category != "" {
+		c, err := s.lookupCategory(ctx, q.Category)
+		if err != nil {
+			return nil, err
+		}
+		categoryPath = c.Path
+	}
+	result, err := s.repo.SearchProducts(ctx, q, categoryPath)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to search products")
+		return nil, err
 	}
-	logrus.WithFields(logrus.Fields{"page": page, "page_size": pageSize}).Info("Products listed")
-	return products, total, nil
+	logrus.WithFields(logrus.Fields{"query": q.Query, "category": q.Category, "sort": q.Sort, "total": result.Total}).Info("Products searched")
+	return result, nil
 }
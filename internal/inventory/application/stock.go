@@ -0,0 +1,156 @@
+package application
+
+import (
+	"context"
+	"ecommerce/internal/inventory/domain"
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// StockChange names the variant whose stock changes, by VariantID, by SKU,
+// or by ProductID alone for a product with a single variant, the location,
+// by ID or code, and why. The location defaults to the default location and
+// the reason to a correction.
+type StockChange struct {
+	ProductID string
+	VariantID string
+	SKU       string
+	Location  string
+	Reason    string
+	Reference string
+}
+
+// validate normalizes and checks the reason and the variant ID.
+func (c *StockChange) validate() error {
+	if c.ProductID == "" && c.VariantID == "" && c.SKU == "" {
+		return fmt.Errorf("%w: a product ID, variant ID or SKU is required", domain.ErrInvalidMovement)
+	}
+	if c.VariantID != "" {
+		if _, err := uuid.Parse(c.VariantID); err != nil {
+			return fmt.Errorf("%w: %s", domain.ErrVariantNotFound, c.VariantID)
+		}
+	}
+	c.Reason = domain.NormalizeReason(c.Reason)
+	return domain.ValidateReason(c.Reason)
+}
+
+// lockStock resolves and locks the variant and resolves the location a
+// stock change names.
+func (s *Service) lockStock(txCtx context.Context, c StockChange) (*domain.Variant, *domain.Location, error) {
+	id, err := s.repo.ResolveVariant(txCtx, c.ProductID, c.VariantID, c.SKU)
+	if err != nil {
+		return nil, nil, err
+	}
+	v, err := s.repo.LockVariant(txCtx, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if c.ProductID != "" && v.ProductID != c.ProductID {
+		return nil, nil, fmt.Errorf("%w: %s", domain.ErrVariantNotFound, id)
+	}
+	location, err := s.repo.GetLocation(txCtx, c.Location)
+	if err != nil {
+		return nil, nil, err
+	}
+	return v, location, nil
+}
+
+// AdjustStock adds delta to the stock of a variant at a location under the
+// variant's row lock, so that concurrent adjustments add up and the stock at
+// the location never goes below zero. The movement is recorded in the same
+// transaction. The variant is returned with its stock levels.
+func (s *Service) AdjustStock(ctx context.Context, c StockChange, delta int) (*domain.Variant, *domain.StockMovement, error) {
+	if err := c.validate(); err != nil {
+		return nil, nil, err
+	}
+	if delta == 0 {
+		return nil, nil, fmt.Errorf("%w: delta must not be zero", domain.ErrInvalidMovement)
+	}
+	var v *domain.Variant
+	var movement *domain.StockMovement
+	err := s.repo.WithTransaction(ctx, func(txCtx context.Context) error {
+		var location *domain.Location
+		var err error
+		if v, location, err = s.lockStock(txCtx, c); err != nil {
+			return err
+		}
+		if err := s.repo.MoveStock(txCtx, v, location.ID, delta); err != nil {
+			return err
+		}
+		movement = domain.NewMovement(v, location.ID, delta, c.Reason, c.Reference, actor(ctx))
+		if err := s.repo.RecordMovements(txCtx, movement); err != nil {
+			return err
+		}
+		v.Levels, err = s.repo.ListStockLevels(txCtx, v.ID)
+		return err
+	})
+	if err != nil {
+		if !isStockError(err) {
+			logrus.WithError(err).Error("Failed to adjust stock")
+		}
+		return nil, nil, err
+	}
+	s.invalidateProduct(ctx, v.ProductID)
+	logrus.WithFields(logrus.Fields{"variant_id": v.ID, "sku": v.SKU, "location_id": movement.LocationID, "delta": delta, "stock": v.Stock, "reason": c.Reason}).Info("Stock adjusted")
+	return v, movement, nil
+}
+
+// SetStock replaces the stock of a variant at a location, provided the
+// variant is still at expectedVersion; otherwise ErrVersionConflict is
+// returned and the caller should read the variant again. The difference is
+// recorded in the ledger; movement is nil when the stock did not change.
+func (s *Service) SetStock(ctx context.Context, c StockChange, stock, expectedVersion int) (*domain.Variant, *domain.StockMovement, error) {
+	if err := c.validate(); err != nil {
+		return nil, nil, err
+	}
+	if stock < 0 {
+		return nil, nil, fmt.Errorf("%w: stock must not be negative", domain.ErrInvalidMovement)
+	}
+	if expectedVersion < 1 {
+		return nil, nil, fmt.Errorf("%w: the expected version is required", domain.ErrInvalidMovement)
+	}
+	var v *domain.Variant
+	var movement *domain.StockMovement
+	err := s.repo.WithTransaction(ctx, func(txCtx context.Context) error {
+		var location *domain.Location
+		var err error
+		if v, location, err = s.lockStock(txCtx, c); err != nil {
+			return err
+		}
+		if v.Version != expectedVersion {
+			return fmt.Errorf("%w: variant %s is at version %d, not %d", domain.ErrVersionConflict, v.ID, v.Version, expectedVersion)
+		}
+		level, err := s.repo.GetStockLevel(txCtx, v.ID, location.ID)
+		if err != nil {
+			return err
+		}
+		if delta := stock - level.Available; delta != 0 {
+			if err := s.repo.MoveStock(txCtx, v, location.ID, delta); err != nil {
+				return err
+			}
+			movement = domain.NewMovement(v, location.ID, delta, c.Reason, c.Reference, actor(ctx))
+			if err := s.repo.RecordMovements(txCtx, movement); err != nil {
+				return err
+			}
+		}
+		v.Levels, err = s.repo.ListStockLevels(txCtx, v.ID)
+		return err
+	})
+	if err != nil {
+		if !isStockError(err) {
+			logrus.WithError(err).Error("Failed to set stock")
+		}
+		return nil, nil, err
+	}
+	s.invalidateProduct(ctx, v.ProductID)
+	logrus.WithFields(logrus.Fields{"variant_id": v.ID, "sku": v.SKU, "location": c.Location, "stock": stock, "version": v.Version, "reason": c.Reason}).Info("Stock set")
+	return v, movement, nil
+}
+
+func isStockError(err error) bool {
+	return isVariantError(err) || errors.Is(err, domain.ErrInsufficientStock) || errors.Is(err, domain.ErrVersionConflict) ||
+		errors.Is(err, domain.ErrVariantRequired) || errors.Is(err, domain.ErrInvalidReorder) || isLocationError(err)
+}
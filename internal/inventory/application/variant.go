@@ -0,0 +1,280 @@
+package application
+
+import (
+	"context"
+	"ecommerce/internal/inventory/domain"
+	"errors"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// VariantChanges describe an update of a variant. Zero fields are left
+// alone; StockDelta is added to the current stock and recorded in the ledger
+// with StockReason, a correction by default, and StockReference.
+type VariantChanges struct {
+	SKU                string
+	Options            map[string]string
+	PriceOverride      float64
+	ClearPriceOverride bool
+	StockDelta         int
+	StockReason        string
+	StockReference     string
+}
+
+// invalidateProduct drops the cached copy of a product and the cached
+// mappings of the given SKUs.
+func (s *Service) invalidateProduct(ctx context.Context, productID string, skus ...string) {
+	if uuidID, err := uuid.Parse(productID); err == nil {
+		if err := s.cache.DeleteProduct(ctx, uuidID); err != nil {
+			logrus.WithError(err).Warn("Failed to invalidate product cache, proceeding")
+		}
+	}
+	for _, sku := range skus {
+		if err := s.cache.DeleteSKU(ctx, sku); err != nil {
+			logrus.WithError(err).Warn("Failed to invalidate SKU cache, proceeding")
+		}
+	}
+}
+
+// ownVariant loads a variant and checks that it belongs to productID, if
+// given. Variants of other products are reported as not found.
+func (s *Service) ownVariant(ctx context.Context, id, productID string) (*domain.Variant, error) {
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, domain.ErrVariantNotFound
+	}
+	v, err := s.repo.GetVariant(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if productID != "" && v.ProductID != productID {
+		return nil, domain.ErrVariantNotFound
+	}
+	return v, nil
+}
+
+// AddVariant adds a variant to the product v.ProductID. Its initial stock is
+// held at the default location and recorded in the ledger as a restock.
+func (s *Service) AddVariant(ctx context.Context, v *domain.Variant) error {
+	v.ID = uuid.New().String()
+	v.Version = 1
+	v.Normalize()
+	if err := v.Validate(); err != nil {
+		return err
+	}
+	err := s.repo.WithTransaction(ctx, func(txCtx context.Context) error {
+		// Locks the product, so concurrent writers see each other's options
+		if err := s.repo.LockProduct(txCtx, v.ProductID); err != nil {
+			return err
+		}
+		siblings, err := s.repo.ListVariants(txCtx, v.ProductID)
+		if err != nil {
+			return err
+		}
+		if err := domain.CheckDistinct(append(siblings, v)); err != nil {
+			return err
+		}
+		if err := s.repo.CreateVariant(txCtx, v); err != nil {
+			return err
+		}
+		location, err := s.repo.GetLocation(txCtx, "")
+		if err != nil {
+			return err
+		}
+		if err := s.repo.AddToLevel(txCtx, v, location.ID, v.Stock); err != nil {
+			return err
+		}
+		return s.repo.RecordMovements(txCtx, domain.NewMovement(v, location.ID, v.Stock, domain.ReasonRestock, "", actor(ctx)))
+	})
+	if err != nil {
+		if !isVariantError(err) {
+			logrus.WithError(err).Error("Failed to add variant")
+		}
+		return err
+	}
+	s.invalidateProduct(ctx, v.ProductID)
+	logrus.WithFields(logrus.Fields{"product_id": v.ProductID, "variant_id": v.ID, "sku": v.SKU}).Info("Variant added")
+	return nil
+}
+
+// GetVariant returns a variant, by ID or else by SKU, with its product. Both
+// come from the product cache when possible.
+func (s *Service) GetVariant(ctx context.Context, id, sku string) (*domain.Product, *domain.Variant, error) {
+	var productID string
+	if id != "" {
+		v, err := s.ownVariant(ctx, id, "")
+		if err != nil {
+			return nil, nil, err
+		}
+		productID = v.ProductID
+	} else {
+		sku = domain.NormalizeSKU(sku)
+		if cached, err := s.cache.GetSKU(ctx, sku); err == nil {
+			productID = cached
+		}
+		if productID == "" {
+			v, err := s.repo.GetVariantBySKU(ctx, sku)
+			if err != nil {
+				return nil, nil, err
+			}
+			productID = v.ProductID
+			if err := s.cache.SetSKU(ctx, sku, productID); err != nil {
+				logrus.WithError(err).Warn("Failed to cache SKU, proceeding")
+			}
+		}
+	}
+
+	p, err := s.Get(ctx, productID)
+	if errors.Is(err, domain.ErrProductNotFound) {
+		return nil, nil, domain.ErrVariantNotFound
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, v := range p.Variants {
+		if v.ID == id || (id == "" && v.SKU == sku) {
+			return p, v, nil
+		}
+	}
+	return nil, nil, domain.ErrVariantNotFound
+}
+
+// UpdateVariant applies changes to a variant of productID, which may be
+// empty, and returns the result. A stock delta applies to the default
+// location.
+func (s *Service) UpdateVariant(ctx context.Context, id, productID string, c VariantChanges) (*domain.Variant, error) {
+	c.StockReason = domain.NormalizeReason(c.StockReason)
+	if err := domain.ValidateReason(c.StockReason); err != nil {
+		return nil, err
+	}
+	var v *domain.Variant
+	var oldSKU string
+	err := s.repo.WithTransaction(ctx, func(txCtx context.Context) error {
+		var err error
+		v, oldSKU, err = s.updateVariant(txCtx, id, productID, c)
+		return err
+	})
+	if err != nil {
+		if !isStockError(err) {
+			logrus.WithError(err).Error("Failed to update variant")
+		}
+		return nil, err
+	}
+	s.invalidateProduct(ctx, v.ProductID, oldSKU)
+	logrus.WithFields(logrus.Fields{"product_id": v.ProductID, "variant_id": v.ID, "sku": v.SKU, "stock": v.Stock}).Info("Variant updated")
+	return v, nil
+}
+
+// updateVariant is the body of UpdateVariant, run in the transaction of
+// txCtx. It returns the variant and its SKU before the update.
+func (s *Service) updateVariant(txCtx context.Context, id, productID string, c VariantChanges) (*domain.Variant, string, error) {
+	found, err := s.ownVariant(txCtx, id, productID)
+	if err != nil {
+		return nil, "", err
+	}
+	// Lock the product before the variant, like AddVariant, so that
+	// sibling options and stock are read as of the update
+	if err := s.repo.LockProduct(txCtx, found.ProductID); err != nil {
+		return nil, "", err
+	}
+	v, err := s.repo.LockVariant(txCtx, id)
+	if err != nil {
+		return nil, "", err
+	}
+	oldSKU := v.SKU
+	if c.SKU != "" {
+		v.SKU = c.SKU
+	}
+	if len(c.Options) > 0 {
+		v.Options = c.Options
+	}
+	if c.ClearPriceOverride {
+		v.PriceOverride = nil
+	} else if c.PriceOverride != 0 {
+		v.PriceOverride = &c.PriceOverride
+	}
+	v.Stock += c.StockDelta
+	v.Version++
+	v.Normalize()
+	if err := v.Validate(); err != nil {
+		return nil, "", err
+	}
+
+	siblings, err := s.repo.ListVariants(txCtx, v.ProductID)
+	if err != nil {
+		return nil, "", err
+	}
+	for i, sibling := range siblings {
+		if sibling.ID == v.ID {
+			siblings[i] = v
+		}
+	}
+	if err := domain.CheckDistinct(siblings); err != nil {
+		return nil, "", err
+	}
+	if c.StockDelta == 0 {
+		return v, oldSKU, s.repo.UpdateVariant(txCtx, v)
+	}
+	location, err := s.repo.GetLocation(txCtx, "")
+	if err != nil {
+		return nil, "", err
+	}
+	if err := s.repo.AddToLevel(txCtx, v, location.ID, c.StockDelta); err != nil {
+		return nil, "", err
+	}
+	if err := s.repo.UpdateVariant(txCtx, v); err != nil {
+		return nil, "", err
+	}
+	movement := domain.NewMovement(v, location.ID, c.StockDelta, c.StockReason, c.StockReference, actor(txCtx))
+	return v, oldSKU, s.repo.RecordMovements(txCtx, movement)
+
+}
+
+// DeleteVariant deletes a variant of productID, which may be empty. The last
+// variant of a product cannot be deleted; delete the product instead.
+func (s *Service) DeleteVariant(ctx context.Context, id, productID string) error {
+	var v *domain.Variant
+	err := s.repo.WithTransaction(ctx, func(txCtx context.Context) error {
+		var err error
+		if v, err = s.ownVariant(txCtx, id, productID); err != nil {
+			return err
+		}
+		if err := s.repo.LockProduct(txCtx, v.ProductID); err != nil {
+			return err
+		}
+		siblings, err := s.repo.ListVariants(txCtx, v.ProductID)
+		if err != nil {
+			return err
+		}
+		if len(siblings) <= 1 {
+			return domain.ErrLastVariant
+		}
+		return s.repo.DeleteVariant(txCtx, id)
+	})
+	if err != nil {
+		if !isVariantError(err) {
+			logrus.WithError(err).Error("Failed to delete variant")
+		}
+		return err
+	}
+	s.invalidateProduct(ctx, v.ProductID, v.SKU)
+	logrus.WithFields(logrus.Fields{"product_id": v.ProductID, "variant_id": id, "sku": v.SKU}).Info("Variant deleted")
+	return nil
+}
+
+// SearchVariants lists the variants whose SKU starts with prefix, in SKU
+// order.
+func (s *Service) SearchVariants(ctx context.Context, prefix string, page, pageSize int) ([]*domain.Variant, int, error) {
+	variants, total, err := s.repo.SearchVariants(ctx, domain.NormalizeSKU(prefix), page, pageSize)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to search variants")
+		return nil, 0, err
+	}
+	return variants, total, nil
+}
+
+func isVariantError(err error) bool {
+	return errors.Is(err, domain.ErrInvalidVariant) || errors.Is(err, domain.ErrVariantNotFound) ||
+		errors.Is(err, domain.ErrDuplicateSKU) || errors.Is(err, domain.ErrLastVariant) ||
+		errors.Is(err, domain.ErrProductNotFound) || errors.Is(err, domain.ErrInvalidMovement)
+}
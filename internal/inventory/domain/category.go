@@ -0,0 +1,209 @@
+package domain
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrCategoryNotFound  = errors.New("category not found")
+	ErrInvalidCategory   = errors.New("invalid category")
+	ErrDuplicateSlug     = errors.New("category slug already exists")
+	ErrCategoryNotEmpty  = errors.New("category still has products or subcategories")
+	ErrInvalidAttributes = errors.New("invalid product attributes")
+)
+
+// MaxCategoryDepth is the number of levels of the category tree.
+const MaxCategoryDepth = 6
+
+// Attribute types.
+const (
+	AttributeString  = "string"
+	AttributeNumber  = "number"
+	AttributeBoolean = "boolean"
+	AttributeEnum    = "enum"
+)
+
+// Category is a node of the category tree. Path lists the IDs from the root
+// down to the category itself, separated by slashes, so that a subtree is
+// found by path prefix. Products of a category follow the attribute schemas
+// of the category and its ancestors.
+type Category struct {
+	ID         string            `gorm:"type:uuid;primaryKey"`
+	ParentID   *string           `gorm:"type:uuid;index"`
+	Name       string            `gorm:"not null"`
+	Slug       string            `gorm:"not null;uniqueIndex"`
+	Path       string            `gorm:"not null;index:idx_categories_path,expression:path text_pattern_ops"`
+	Attributes []AttributeSchema `gorm:"serializer:json;type:jsonb;not null"`
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+}
+
+// AttributeSchema describes an attribute products of a category have, e.g.
+// the screen size of a phone as a number in inches.
+type AttributeSchema struct {
+	Name     string   `json:"name"`
+	Type     string   `json:"type"`
+	Unit     string   `json:"unit,omitempty"`
+	Required bool     `json:"required"`
+	Values   []string `json:"values,omitempty"` // Allowed values of an enum
+}
+
+var (
+	slugFormat    = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+	slugSeparator = regexp.MustCompile(`[^a-z0-9]+`)
+	attributeName = regexp.MustCompile(`^[a-z][a-z0-9_]{0,63}$`)
+)
+
+// Slugify derives a slug from a name, e.g. "TVs & Audio" becomes "tvs-audio".
+func Slugify(name string) string {
+	return strings.Trim(slugSeparator.ReplaceAllString(strings.ToLower(name), "-"), "-")
+}
+
+// Depth returns the level of the category in the tree, 1 for roots.
+func (c *Category) Depth() int {
+	return strings.Count(c.Path, "/") + 1
+}
+
+// AncestorIDs returns the IDs of the ancestors of c, root first.
+func (c *Category) AncestorIDs() []string {
+	ids := strings.Split(c.Path, "/")
+	return ids[:len(ids)-1]
+}
+
+// Normalize trims the name, derives a missing slug from it and normalizes
+// the attribute schemas.
+func (c *Category) Normalize() {
+	c.Name = strings.TrimSpace(c.Name)
+	c.Slug = strings.ToLower(strings.TrimSpace(c.Slug))
+	if c.Slug == "" {
+		c.Slug = Slugify(c.Name)
+	}
+	if c.Attributes == nil {
+		c.Attributes = []AttributeSchema{}
+	}
+	for i := range c.Attributes {
+		a := &c.Attributes[i]
+		a.Name = strings.ToLower(strings.TrimSpace(a.Name))
+		a.Type = strings.ToLower(strings.TrimSpace(a.Type))
+		a.Unit = strings.TrimSpace(a.Unit)
+		for j := range a.Values {
+			a.Values[j] = strings.TrimSpace(a.Values[j])
+		}
+	}
+}
+
+// Validate checks the name, slug and attribute schemas. Call Normalize first.
+func (c *Category) Validate() error {
+	if c.Name == "" {
+		return fmt.Errorf("%w: name is required", ErrInvalidCategory)
+	}
+	if !slugFormat.MatchString(c.Slug) || len(c.Slug) > 64 {
+		return fmt.Errorf("%w: slug must be 1-64 lower-case letters and digits separated by single dashes", ErrInvalidCategory)
+	}
+	names := make(map[string]bool, len(c.Attributes))
+	for _, a := range c.Attributes {
+		if !attributeName.MatchString(a.Name) {
+			return fmt.Errorf("%w: attribute name %q must be lower-case letters, digits and underscores", ErrInvalidCategory, a.Name)
+		}
+		if names[a.Name] {
+			return fmt.Errorf("%w: attribute %s is defined twice", ErrInvalidCategory, a.Name)
+		}
+		names[a.Name] = true
+		switch a.Type {
+		case AttributeString, AttributeNumber, AttributeBoolean:
+		case AttributeEnum:
+			if len(a.Values) == 0 {
+				return fmt.Errorf("%w: enum attribute %s needs values", ErrInvalidCategory, a.Name)
+			}
+			for _, v := range a.Values {
+				if v == "" {
+					return fmt.Errorf("%w: enum attribute %s has an empty value", ErrInvalidCategory, a.Name)
+				}
+			}
+		default:
+			return fmt.Errorf("%w: attribute %s has unknown type %q", ErrInvalidCategory, a.Name, a.Type)
+		}
+		if a.Unit != "" && a.Type != AttributeNumber {
+			return fmt.Errorf("%w: only number attributes have a unit", ErrInvalidCategory)
+		}
+	}
+	return nil
+}
+
+// EffectiveAttributes merges the attribute schemas along a path of
+// categories, root first. A category redefining an attribute of an ancestor
+// overrides it.
+func EffectiveAttributes(path []*Category) []AttributeSchema {
+	var schemas []AttributeSchema
+	index := make(map[string]int)
+	for _, c := range path {
+		for _, a := range c.Attributes {
+			if i, ok := index[a.Name]; ok {
+				schemas[i] = a
+				continue
+			}
+			index[a.Name] = len(schemas)
+			schemas = append(schemas, a)
+		}
+	}
+	return schemas
+}
+
+// ValidateAttributes checks product attributes against the schemas of its
+// category and returns them in canonical form: trimmed, numbers formatted
+// without trailing zeros and booleans as "true" or "false".
+func ValidateAttributes(schemas []AttributeSchema, attrs map[string]string) (map[string]string, error) {
+	byName := make(map[string]AttributeSchema, len(schemas))
+	for _, a := range schemas {
+		byName[a.Name] = a
+	}
+	valid := make(map[string]string, len(attrs))
+	for name, value := range attrs {
+		name = strings.ToLower(strings.TrimSpace(name))
+		value = strings.TrimSpace(value)
+		schema, ok := byName[name]
+		if !ok {
+			return nil, fmt.Errorf("%w: unknown attribute %s", ErrInvalidAttributes, name)
+		}
+		switch schema.Type {
+		case AttributeNumber:
+			f, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %s must be a number", ErrInvalidAttributes, name)
+			}
+			value = strconv.FormatFloat(f, 'f', -1, 64)
+		case AttributeBoolean:
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %s must be true or false", ErrInvalidAttributes, name)
+			}
+			value = strconv.FormatBool(b)
+		case AttributeEnum:
+			allowed := false
+			for _, v := range schema.Values {
+				if v == value {
+					allowed = true
+					break
+				}
+			}
+			if !allowed {
+				return nil, fmt.Errorf("%w: %s must be one of %s", ErrInvalidAttributes, name, strings.Join(schema.Values, ", "))
+			}
+		}
+		if value == "" {
+			return nil, fmt.Errorf("%w: %s must not be empty", ErrInvalidAttributes, name)
+		}
+		valid[name] = value
+	}
+	for _, a := range schemas {
+		if _, ok := valid[a.Name]; a.Required && !ok {
+			return nil, fmt.Errorf("%w: %s is required", ErrInvalidAttributes, a.Name)
+		}
+	}
+	return valid, nil
+}
@@ -0,0 +1,257 @@
+package domain
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	ErrLocationNotFound = errors.New("location not found")
+	ErrInvalidLocation  = errors.New("invalid location")
+	ErrDuplicateCode    = errors.New("location code already in use")
+)
+
+// DefaultLocationCode is the code of the location created for the stock held
+// before there were several locations.
+const DefaultLocationCode = "MAIN"
+
+// Location is a warehouse stock is kept and shipped from. Stock changes that
+// do not name a location, such as the initial stock of a product, apply to
+// the default location; there is exactly one.
+type Location struct {
+	ID        string  `gorm:"type:uuid;primaryKey"`
+	Code      string  `gorm:"not null;uniqueIndex"` // Short upper-case name, e.g. KHI
+	Name      string  `gorm:"not null"`
+	Country   string  `gorm:"not null;default:''"` // ISO 3166-1 alpha-2
+	Latitude  float64 `gorm:"not null;default:0"`
+	Longitude float64 `gorm:"not null;default:0"`
+	IsDefault bool    `gorm:"not null;default:false"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+var locationCode = regexp.MustCompile(`^[A-Z0-9][A-Z0-9_-]{0,15}$`)
+
+// NormalizeLocationCode trims and upper-cases a location code.
+func NormalizeLocationCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// Normalize normalizes the code and country and trims the name.
+func (l *Location) Normalize() {
+	l.Code = NormalizeLocationCode(l.Code)
+	l.Name = strings.TrimSpace(l.Name)
+	l.Country = strings.ToUpper(strings.TrimSpace(l.Country))
+}
+
+// Validate checks the code, name, country and coordinates. Call Normalize
+// first.
+func (l *Location) Validate() error {
+	if !locationCode.MatchString(l.Code) {
+		return fmt.Errorf("%w: code must be 1-16 letters, digits, '_' or '-'", ErrInvalidLocation)
+	}
+	if l.Name == "" {
+		return fmt.Errorf("%w: name is required", ErrInvalidLocation)
+	}
+	if l.Country != "" && len(l.Country) != 2 {
+		return fmt.Errorf("%w: country must be an ISO 3166-1 alpha-2 code", ErrInvalidLocation)
+	}
+	if l.Latitude < -90 || l.Latitude > 90 || l.Longitude < -180 || l.Longitude > 180 {
+		return fmt.Errorf("%w: coordinates out of range", ErrInvalidLocation)
+	}
+	return nil
+}
+
+// located reports whether coordinates were given; 0, 0 stands for unknown.
+func located(latitude, longitude float64) bool {
+	return latitude != 0 || longitude != 0
+}
+
+// StockLevel is the stock of a variant at a location. Available units can
+// be sold and count towards Variant.Stock, which is their total over all
+// locations; InTransit units are on their way here from another location.
+type StockLevel struct {
+	VariantID  string    `gorm:"type:uuid;primaryKey"`
+	LocationID string    `gorm:"type:uuid;primaryKey;index"`
+	ProductID  string    `gorm:"not null;index"`
+	Available  int       `gorm:"not null;default:0"`
+	InTransit  int       `gorm:"not null;default:0"`
+	Location   *Location `gorm:"foreignKey:LocationID" json:",omitempty"`
+	UpdatedAt  time.Time
+}
+
+// LocationStock is the stock of a product at a location, over its variants.
+type LocationStock struct {
+	LocationID string
+	Code       string
+	Available  int
+	InTransit  int
+}
+
+// StockByLocation sums the stock levels of the variants of p per location,
+// in location code order. The levels must have been loaded with their
+// location.
+func (p *Product) StockByLocation() []LocationStock {
+	byID := make(map[string]*LocationStock)
+	var result []*LocationStock
+	for _, v := range p.Variants {
+		for _, l := range v.Levels {
+			s, ok := byID[l.LocationID]
+			if !ok {
+				s = &LocationStock{LocationID: l.LocationID}
+				if l.Location != nil {
+					s.Code = l.Location.Code
+				}
+				byID[l.LocationID] = s
+				result = append(result, s)
+			}
+			s.Available += l.Available
+			s.InTransit += l.InTransit
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Code < result[j].Code })
+	stock := make([]LocationStock, len(result))
+	for i, s := range result {
+		stock[i] = *s
+	}
+	return stock
+}
+
+// InTransit returns the units of p on their way between locations.
+func (p *Product) InTransit() int {
+	total := 0
+	for _, v := range p.Variants {
+		for _, l := range v.Levels {
+			total += l.InTransit
+		}
+	}
+	return total
+}
+
+// Sourcing strategies, which pick the locations that fulfil an order line.
+const (
+	SourcingNearest   = "nearest"    // The nearest location that has the whole quantity
+	SourcingMostStock = "most_stock" // The location with the most stock, if enough
+	SourcingSplit     = "split"      // The nearest locations, splitting the quantity as needed
+)
+
+// ValidateStrategy checks that a sourcing strategy is known.
+func ValidateStrategy(strategy string) error {
+	switch strategy {
+	case SourcingNearest, SourcingMostStock, SourcingSplit:
+		return nil
+	}
+	return fmt.Errorf("%w: unknown sourcing strategy %q", ErrInvalidLocation, strategy)
+}
+
+// Destination is where an order ships to. Coordinates of 0, 0 are unknown;
+// locations are then ranked by whether they are in the same country.
+type Destination struct {
+	Country   string
+	Latitude  float64
+	Longitude float64
+}
+
+// Allocation is the quantity of an order line taken from a location.
+type Allocation struct {
+	LocationID string
+	Quantity   int
+}
+
+// earthRadiusKm is the mean radius of the Earth.
+const earthRadiusKm = 6371
+
+// Distance returns the great-circle distance from l to d in kilometres.
+func (d Destination) Distance(l *Location) float64 {
+	rad := func(deg float64) float64 { return deg * math.Pi / 180 }
+	dLat := rad(l.Latitude - d.Latitude)
+	dLon := rad(l.Longitude - d.Longitude)
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(rad(d.Latitude))*math.Cos(rad(l.Latitude))*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusKm * math.Asin(math.Sqrt(a))
+}
+
+// nearest orders levels by distance from d when both have coordinates,
+// otherwise locations in the destination country first. Ties go to the
+// default location, then by code.
+func (d Destination) nearest(levels []*StockLevel) []*StockLevel {
+	sorted := append([]*StockLevel(nil), levels...)
+	rank := func(l *Location) float64 {
+		if located(d.Latitude, d.Longitude) && located(l.Latitude, l.Longitude) {
+			return d.Distance(l)
+		}
+		if d.Country != "" && l.Country == d.Country {
+			return 0
+		}
+		return math.Inf(1)
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		a, b := sorted[i].Location, sorted[j].Location
+		if ra, rb := rank(a), rank(b); ra != rb {
+			return ra < rb
+		}
+		if a.IsDefault != b.IsDefault {
+			return a.IsDefault
+		}
+		return a.Code < b.Code
+	})
+	return sorted
+}
+
+// Source picks the locations that fulfil quantity units of a variant by
+// strategy, from its stock levels loaded with their location. It fails with
+// ErrInsufficientStock when the strategy cannot fulfil the whole quantity.
+func Source(strategy string, levels []*StockLevel, quantity int, d Destination) ([]Allocation, error) {
+	sorted := d.nearest(levels)
+	switch strategy {
+	case SourcingNearest:
+		for _, l := range sorted {
+			if l.Available >= quantity {
+				return []Allocation{{LocationID: l.LocationID, Quantity: quantity}}, nil
+			}
+		}
+	case SourcingMostStock:
+		var most *StockLevel
+		for _, l := range sorted {
+			if most == nil || l.Available > most.Available {
+				most = l
+			}
+		}
+		if most != nil && most.Available >= quantity {
+			return []Allocation{{LocationID: most.LocationID, Quantity: quantity}}, nil
+		}
+	case SourcingSplit:
+		var allocations []Allocation
+		remaining := quantity
+		for _, l := range sorted {
+			if remaining == 0 {
+				break
+			}
+			if l.Available <= 0 {
+				continue
+			}
+			take := l.Available
+			if take > remaining {
+				take = remaining
+			}
+			allocations = append(allocations, Allocation{LocationID: l.LocationID, Quantity: take})
+			remaining -= take
+		}
+		if remaining == 0 {
+			return allocations, nil
+		}
+	default:
+		return nil, ValidateStrategy(strategy)
+	}
+	total := 0
+	for _, l := range levels {
+		total += l.Available
+	}
+	return nil, fmt.Errorf("%w: %d available over %d locations, %d requested, sourcing %s",
+		ErrInsufficientStock, total, len(levels), quantity, strategy)
+}
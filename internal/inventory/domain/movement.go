@@ -0,0 +1,90 @@
+package domain
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var ErrInvalidMovement = errors.New("invalid stock movement")
+
+// Reasons of stock movements.
+const (
+	ReasonSale       = "sale"
+	ReasonRestock    = "restock"
+	ReasonReturn     = "return"
+	ReasonCorrection = "correction"
+	ReasonDamage     = "damage"
+	ReasonTransfer   = "transfer"
+)
+
+// ActorSystem is the actor of stock movements made by internal calls, such
+// as reservations for orders and the release of expired ones.
+const ActorSystem = "system"
+
+// StockMovement is an entry of the append-only stock ledger. Every change of
+// a variant's stock writes one in the same transaction, so that the ledger
+// explains the current stock: Balance is the stock after the movement.
+// Reservations for orders are sales referencing the order; releasing them
+// returns the units. LocationID is the location whose stock changed; it is
+// empty for movements from before there were several locations.
+type StockMovement struct {
+	ID         uint64    `gorm:"primaryKey"` // Increases with every movement
+	ProductID  string    `gorm:"not null;index"`
+	VariantID  string    `gorm:"type:uuid;not null;index"`
+	LocationID string    `gorm:"not null;default:'';index"`
+	SKU        string    `gorm:"not null"` // SKU of the variant at the time
+	Delta      int       `gorm:"not null"`
+	Reason     string    `gorm:"not null"`
+	Reference  string    `gorm:"not null;default:'';index"` // Order ID or purchase order number
+	Actor      string    `gorm:"not null"`
+	Balance    int       `gorm:"not null"`
+	CreatedAt  time.Time `gorm:"not null"`
+}
+
+// NewMovement records that the stock of v at a location changed by delta.
+// Call it after the change, since the balance, over all locations, is taken
+// from v.
+func NewMovement(v *Variant, locationID string, delta int, reason, reference, actor string) *StockMovement {
+	return &StockMovement{
+		ProductID:  v.ProductID,
+		VariantID:  v.ID,
+		LocationID: locationID,
+		SKU:        v.SKU,
+		Delta:      delta,
+		Reason:     reason,
+		Reference:  reference,
+		Actor:      actor,
+		Balance:    v.Stock,
+	}
+}
+
+// NormalizeReason lower-cases a reason and defaults it to a correction.
+func NormalizeReason(reason string) string {
+	reason = strings.ToLower(strings.TrimSpace(reason))
+	if reason == "" {
+		return ReasonCorrection
+	}
+	return reason
+}
+
+// ValidateReason checks that a reason can be given for a stock change.
+// Transfers are only recorded by the transfers themselves.
+func ValidateReason(reason string) error {
+	switch reason {
+	case ReasonSale, ReasonRestock, ReasonReturn, ReasonCorrection, ReasonDamage:
+		return nil
+	}
+	return fmt.Errorf("%w: unknown reason %q", ErrInvalidMovement, reason)
+}
+
+// MovementFilter selects stock movements. Empty fields do not filter.
+type MovementFilter struct {
+	ProductID  string
+	VariantID  string
+	LocationID string
+	SKU        string // SKU at the time of the movement
+	Reason     string
+	Reference  string
+}
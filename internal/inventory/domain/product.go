@@ -1,9 +1,56 @@
 package domain
 
+import (
+	"errors"
+	"time"
+)
+
+var ErrProductNotFound = errors.New("product not found")
+
+// Product is an item of the catalog. It is sold through its variants, which
+// hold the stock; every product has at least one. Attributes follow the
+// schemas of its category. Name and description are indexed for full-text
+// search in a search_vector column maintained by Postgres. Version counts
+// the updates of the product's own fields, so that writers can tell whether
+// they read the latest copy.
 type Product struct {
-	ID       string
-	Name     string
-	Category string
-	Stock    int
-	Price    float64
+	ID          string `gorm:"index:idx_products_created_at_id,priority:2"`
+	Name        string
+	Description string
+	Category    string            // Slug of the category, kept in sync with CategoryID
+	CategoryID  *string           `gorm:"type:uuid;index"`
+	Attributes  map[string]string `gorm:"serializer:json;type:jsonb"`
+	Stock       int               `gorm:"-"` // Total stock of the variants
+	Price       float64
+	Variants    []*Variant `gorm:"foreignKey:ProductID;constraint:OnDelete:CASCADE"`
+	CreatedAt   time.Time  `gorm:"not null;default:now();index:idx_products_created_at_id,priority:1"` // Products created before it are dated by the migration
+	UpdatedAt   time.Time
+	Version     int `gorm:"not null;default:1"`
+
+	// Reordering: a product whose stock falls to ReorderPoint or below is
+	// low on stock, and ReorderQuantity is the usual quantity to buy.
+	// LowStock is maintained with the stock; a reorder point of 0 disables
+	// it.
+	ReorderPoint    int  `gorm:"not null;default:0"`
+	ReorderQuantity int  `gorm:"not null;default:0"`
+	LowStock        bool `gorm:"not null;default:false"`
+}
+
+// TotalStock sets Stock to the sum of the variants' stock and returns it.
+func (p *Product) TotalStock() int {
+	p.Stock = 0
+	for _, v := range p.Variants {
+		p.Stock += v.Stock
+	}
+	return p.Stock
+}
+
+// Variant returns the variant of p with the given ID, or nil.
+func (p *Product) Variant(id string) *Variant {
+	for _, v := range p.Variants {
+		if v.ID == id {
+			return v
+		}
+	}
+	return nil
 }
@@ -0,0 +1,82 @@
+package domain
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+var ErrInvalidReorder = errors.New("invalid reorder settings")
+
+// IsLow reports whether stock has fallen to a reorder point or below. A
+// reorder point of 0 is never reached.
+func IsLow(stock, reorderPoint int) bool {
+	return reorderPoint > 0 && stock <= reorderPoint
+}
+
+// ValidateReorder checks the reorder point and quantity of p.
+func (p *Product) ValidateReorder() error {
+	if p.ReorderPoint < 0 || p.ReorderQuantity < 0 {
+		return fmt.Errorf("%w: reorder point and quantity must not be negative", ErrInvalidReorder)
+	}
+	return nil
+}
+
+// EventLowStock is the type of low-stock events and the NATS subject they are
+// published on.
+const EventLowStock = "inventory.low_stock"
+
+// LowStockEvent is the payload of an inventory.low_stock event, written when
+// the stock of a product falls to its reorder point or below. It is not
+// written again until the stock has gone back above the reorder point.
+type LowStockEvent struct {
+	ProductID       string    `json:"product_id"`
+	Name            string    `json:"name"`
+	Stock           int       `json:"stock"`
+	ReorderPoint    int       `json:"reorder_point"`
+	ReorderQuantity int       `json:"reorder_quantity"`
+	OccurredAt      time.Time `json:"occurred_at"`
+}
+
+// ReorderLine is the reorder position of a product: its stock, available
+// and in transit, against its reorder point and the units sold, net of
+// returns, over the sales window.
+type ReorderLine struct {
+	ProductID       string
+	Name            string
+	Stock           int
+	InTransit       int
+	ReorderPoint    int
+	ReorderQuantity int
+	Sold            int
+	Velocity        float64 // Units sold per day
+	DaysOfCover     float64 // Days the stock lasts at Velocity, -1 without sales
+	Suggested       int     // Units to buy, 0 when there is no need
+}
+
+// Suggest sets the velocity, days of cover and suggested quantity of l from
+// sales over windowDays, so that the stock and the units in transit cover
+// coverDays of sales on top of the reorder point. A product that needs
+// reordering is suggested at least its reorder quantity.
+func (l *ReorderLine) Suggest(windowDays, coverDays int) {
+	sold := l.Sold
+	if sold < 0 {
+		sold = 0
+	}
+	l.Velocity = float64(sold) / float64(windowDays)
+	l.DaysOfCover = -1
+	if l.Velocity > 0 {
+		l.DaysOfCover = float64(l.Stock) / l.Velocity
+	}
+	target := l.ReorderPoint + int(math.Ceil(l.Velocity*float64(coverDays)))
+	position := l.Stock + l.InTransit
+	l.Suggested = 0
+	if target == 0 || position > target {
+		return
+	}
+	l.Suggested = target - position
+	if l.Suggested < l.ReorderQuantity {
+		l.Suggested = l.ReorderQuantity
+	}
+}
@@ -0,0 +1,48 @@
+package domain
+
+import (
+	"errors"
+	"time"
+)
+
+// Reservation statuses. Held units are already taken out of Variant.Stock;
+// releasing a reservation puts them back.
+const (
+	ReservationHeld      = "held"
+	ReservationCommitted = "committed"
+	ReservationReleased  = "released"
+)
+
+var (
+	ErrInsufficientStock   = errors.New("insufficient stock")
+	ErrReservationNotFound = errors.New("reservation not found")
+	ErrReservationExpired  = errors.New("reservation expired")
+)
+
+// Reservation holds Quantity units of a product variant at a location for an
+// order until it is committed (the order was paid), released, or it expires.
+// An order line sourced from several locations has a reservation for each.
+// LocationID is empty for reservations from before there were several
+// locations, which were taken from the default location.
+type Reservation struct {
+	ID         string    `gorm:"type:uuid;primaryKey"`
+	OrderID    string    `gorm:"type:uuid;not null;index"`
+	ProductID  string    `gorm:"not null;index"`
+	VariantID  string    `gorm:"type:uuid;not null;index"`
+	LocationID string    `gorm:"not null;default:''"`
+	SKU        string    `gorm:"not null"`
+	Quantity   int       `gorm:"not null"`
+	Status     string    `gorm:"not null;index"`
+	ExpiresAt  time.Time `gorm:"not null;index"`
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+}
+
+// ReservationItem is a requested quantity of a single variant, named by
+// VariantID or SKU. ProductID alone names the only variant of a product.
+type ReservationItem struct {
+	ProductID string
+	VariantID string
+	SKU       string
+	Quantity  int
+}
@@ -0,0 +1,106 @@
+package domain
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var ErrInvalidSearch = errors.New("invalid product search")
+
+// Sort orders of a product search.
+const (
+	SortRelevance = "relevance"
+	SortPriceAsc  = "price_asc"
+	SortPriceDesc = "price_desc"
+	SortName      = "name"
+	SortNewest    = "newest"
+)
+
+// PriceBuckets are the lower bounds of the price facets after the first,
+// which starts at zero; the last bucket is open-ended.
+var PriceBuckets = []float64{10, 25, 50, 100, 250, 500}
+
+// ProductSearch is a full-text search of the catalog with filters. Zero
+// fields do not filter.
+type ProductSearch struct {
+	Query    string // Matched against name and description
+	Category string // ID or slug; includes the subcategories
+	MinPrice float64
+	MaxPrice float64 // Inclusive
+	InStock  bool
+	Sort     string
+	Page     int
+	PageSize int
+}
+
+// CategoryFacet counts the matching products directly in a category.
+type CategoryFacet struct {
+	CategoryID string
+	Name       string
+	Slug       string
+	Count      int
+}
+
+// PriceFacet counts the matching products priced from Min up to, but not
+// including, Max. Max is zero for the open-ended last bucket.
+type PriceFacet struct {
+	Min   float64
+	Max   float64
+	Count int
+}
+
+// SearchResult is a page of a product search with the facets of all matches.
+// The category facets ignore the category filter and the price facets the
+// price filter, so that a sidebar can offer the alternatives.
+type SearchResult struct {
+	Products   []*Product
+	Total      int
+	Categories []CategoryFacet
+	Prices     []PriceFacet
+}
+
+// PriceRange returns the bounds of a price bucket, numbered from zero.
+func PriceRange(bucket int) (min, max float64) {
+	if bucket > 0 {
+		min = PriceBuckets[bucket-1]
+	}
+	if bucket < len(PriceBuckets) {
+		max = PriceBuckets[bucket]
+	}
+	return min, max
+}
+
+// Normalize trims the query and defaults the sort order to relevance for
+// text searches and to name otherwise.
+func (q *ProductSearch) Normalize() {
+	q.Query = strings.TrimSpace(q.Query)
+	q.Category = strings.TrimSpace(q.Category)
+	q.Sort = strings.ToLower(strings.TrimSpace(q.Sort))
+	if q.Sort == "" {
+		q.Sort = SortName
+		if q.Query != "" {
+			q.Sort = SortRelevance
+		}
+	}
+}
+
+// Validate checks the price range and sort order. Call Normalize first.
+func (q *ProductSearch) Validate() error {
+	if q.MinPrice < 0 || q.MaxPrice < 0 {
+		return fmt.Errorf("%w: prices must not be negative", ErrInvalidSearch)
+	}
+	if q.MaxPrice > 0 && q.MinPrice > q.MaxPrice {
+		return fmt.Errorf("%w: min_price is above max_price", ErrInvalidSearch)
+	}
+	switch q.Sort {
+	case SortPriceAsc, SortPriceDesc, SortName, SortNewest:
+	case SortRelevance:
+		if q.Query == "" {
+			return fmt.Errorf("%w: sorting by relevance needs a query", ErrInvalidSearch)
+		}
+	default:
+		return fmt.Errorf("%w: unknown sort %q", ErrInvalidSearch, q.Sort)
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package domain
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrTransferNotFound = errors.New("transfer not found")
+	ErrInvalidTransfer  = errors.New("invalid transfer")
+)
+
+// Transfer statuses. In-transit units have left the source location but not
+// reached the destination: they are neither available nor lost.
+const (
+	TransferInTransit = "in_transit"
+	TransferReceived  = "received"
+	TransferCancelled = "cancelled"
+)
+
+// Transfer moves Quantity units of a variant between two locations. Creating
+// it takes the units out of the source's available stock and counts them in
+// transit at the destination; receiving it makes them available there, and
+// cancelling it puts them back at the source.
+type Transfer struct {
+	ID             string     `gorm:"type:uuid;primaryKey"`
+	ProductID      string     `gorm:"not null;index"`
+	VariantID      string     `gorm:"type:uuid;not null;index"`
+	SKU            string     `gorm:"not null"`
+	FromLocationID string     `gorm:"type:uuid;not null;index"`
+	ToLocationID   string     `gorm:"type:uuid;not null;index"`
+	From           *Location  `gorm:"foreignKey:FromLocationID"`
+	To             *Location  `gorm:"foreignKey:ToLocationID"`
+	Quantity       int        `gorm:"not null"`
+	Status         string     `gorm:"not null;index"`
+	Reference      string     `gorm:"not null;default:''"`
+	Actor          string     `gorm:"not null"`
+	CreatedAt      time.Time  `gorm:"not null"`
+	CompletedAt    *time.Time // When it was received or cancelled
+}
+
+// Complete moves an in-transit transfer to status, received or cancelled.
+func (t *Transfer) Complete(status string, now time.Time) error {
+	if t.Status != TransferInTransit {
+		return fmt.Errorf("%w: transfer %s is %s", ErrInvalidTransfer, t.ID, t.Status)
+	}
+	t.Status = status
+	t.CompletedAt = &now
+	return nil
+}
+
+// TransferFilter selects transfers. Empty fields do not filter; LocationID
+// matches either end.
+type TransferFilter struct {
+	VariantID  string
+	LocationID string
+	Status     string
+}
@@ -0,0 +1,125 @@
+package domain
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	ErrVariantNotFound = errors.New("variant not found")
+	ErrInvalidVariant  = errors.New("invalid variant")
+	ErrDuplicateSKU    = errors.New("SKU already exists")
+	ErrVariantRequired = errors.New("product has several variants, a variant ID or SKU is required")
+	ErrLastVariant     = errors.New("a product must keep at least one variant")
+	ErrVersionConflict = errors.New("version conflict")
+)
+
+// Variant is a sellable version of a product, such as a size and colour of a
+// T-shirt, with its own SKU and stock. PriceOverride, when set, replaces the
+// product price. Version starts at 1 and increases with every change, stock
+// changes included, so that SetStock can tell whether the stock it replaces
+// is the one the caller saw. Stock is the total available over all locations;
+// Levels break it down per location.
+type Variant struct {
+	ID            string            `gorm:"type:uuid;primaryKey"`
+	ProductID     string            `gorm:"not null;index"`
+	SKU           string            `gorm:"not null;uniqueIndex;index:idx_variants_sku_prefix,expression:sku text_pattern_ops"`
+	Options       map[string]string `gorm:"serializer:json;type:jsonb;not null"`
+	PriceOverride *float64
+	Stock         int           `gorm:"not null;default:0"`
+	Version       int           `gorm:"not null;default:1"`
+	Levels        []*StockLevel `gorm:"foreignKey:VariantID;constraint:OnDelete:CASCADE"`
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+}
+
+var skuFormat = regexp.MustCompile(`^[A-Z0-9][A-Z0-9._-]{0,63}$`)
+
+// DefaultSKU returns the SKU of the variant created for a product that is
+// added without variants.
+func DefaultSKU(productID string) string {
+	return strings.ToUpper(productID)
+}
+
+// NormalizeSKU trims and upper-cases a SKU, so that SKUs are unique and
+// looked up regardless of case.
+func NormalizeSKU(sku string) string {
+	return strings.ToUpper(strings.TrimSpace(sku))
+}
+
+// Normalize normalizes the SKU and trims the option names and values. Option
+// names are lower-cased.
+func (v *Variant) Normalize() {
+	v.SKU = NormalizeSKU(v.SKU)
+	options := make(map[string]string, len(v.Options))
+	for name, value := range v.Options {
+		options[strings.ToLower(strings.TrimSpace(name))] = strings.TrimSpace(value)
+	}
+	v.Options = options
+}
+
+// Validate checks the SKU format, options, price override and stock. Call
+// Normalize first.
+func (v *Variant) Validate() error {
+	if !skuFormat.MatchString(v.SKU) {
+		return fmt.Errorf("%w: SKU must be 1-64 letters, digits, '.', '_' or '-'", ErrInvalidVariant)
+	}
+	for name, value := range v.Options {
+		if name == "" || value == "" {
+			return fmt.Errorf("%w: option names and values must not be empty", ErrInvalidVariant)
+		}
+	}
+	if v.PriceOverride != nil && *v.PriceOverride <= 0 {
+		return fmt.Errorf("%w: price override must be positive", ErrInvalidVariant)
+	}
+	if v.Stock < 0 {
+		return fmt.Errorf("%w: stock must not be negative", ErrInvalidVariant)
+	}
+	return nil
+}
+
+// Price returns the unit price of the variant given the price of its product.
+func (v *Variant) Price(productPrice float64) float64 {
+	if v.PriceOverride != nil {
+		return *v.PriceOverride
+	}
+	return productPrice
+}
+
+// OptionsKey returns the options of v in a canonical form, for telling
+// whether two variants are the same version of their product.
+func (v *Variant) OptionsKey() string {
+	names := make([]string, 0, len(v.Options))
+	for name := range v.Options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&b, "%q=%q;", name, v.Options[name])
+	}
+	return b.String()
+}
+
+// CheckDistinct reports an error if two of the given variants of a product
+// share a SKU or the same option values.
+func CheckDistinct(variants []*Variant) error {
+	skus := make(map[string]bool, len(variants))
+	options := make(map[string]bool, len(variants))
+	for _, v := range variants {
+		if skus[v.SKU] {
+			return fmt.Errorf("%w: %s", ErrDuplicateSKU, v.SKU)
+		}
+		skus[v.SKU] = true
+		key := v.OptionsKey()
+		if options[key] {
+			return fmt.Errorf("%w: two variants have the same options", ErrInvalidVariant)
+		}
+		options[key] = true
+	}
+	return nil
+}
@@ -2,12 +2,17 @@ package inventory
 
 import (
 	"context"
+	"ecommerce/internal/database"
 	"ecommerce/internal/inventory/application"
 	"ecommerce/internal/inventory/domain"
 	"ecommerce/proto"
+	"errors"
+	"fmt"
 	"github.com/google/uuid"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"strings"
+	"time"
 )
 
 type Server struct {
@@ -19,102 +24,851 @@ func NewServer(svc *application.Service) *Server {
 	return &Server{svc: svc}
 }
 
+func toVariant(v *domain.Variant, productPrice float64) *proto.Variant {
+	resp := &proto.Variant{
+		Id:        v.ID,
+		ProductId: v.ProductID,
+		Sku:       v.SKU,
+		Options:   v.Options,
+		Price:     v.Price(productPrice),
+		Stock:     int32(v.Stock),
+		Version:   int64(v.Version),
+	}
+	if v.PriceOverride != nil {
+		resp.PriceOverride = *v.PriceOverride
+	}
+	for _, l := range v.Levels {
+		level := &proto.StockLevel{LocationId: l.LocationID, Available: int32(l.Available), InTransit: int32(l.InTransit)}
+		if l.Location != nil {
+			level.LocationCode = l.Location.Code
+		}
+		resp.Levels = append(resp.Levels, level)
+	}
+	return resp
+}
+
+func toProductResponse(p *domain.Product) *proto.ProductResponse {
+	resp := &proto.ProductResponse{
+		Id:              p.ID,
+		Name:            p.Name,
+		Description:     p.Description,
+		Category:        p.Category,
+		Stock:           int32(p.Stock),
+		Price:           p.Price,
+		Attributes:      p.Attributes,
+		Version:         int64(p.Version),
+		InTransit:       int32(p.InTransit()),
+		ReorderPoint:    int32(p.ReorderPoint),
+		ReorderQuantity: int32(p.ReorderQuantity),
+		LowStock:        p.LowStock,
+	}
+	if p.CategoryID != nil {
+		resp.CategoryId = *p.CategoryID
+	}
+	for _, v := range p.Variants {
+		resp.Variants = append(resp.Variants, toVariant(v, p.Price))
+	}
+	for _, l := range p.StockByLocation() {
+		resp.Locations = append(resp.Locations, &proto.StockLevel{
+			LocationId:   l.LocationID,
+			LocationCode: l.Code,
+			Available:    int32(l.Available),
+			InTransit:    int32(l.InTransit),
+		})
+	}
+	return resp
+}
+
+// fromVariant converts a requested variant; the ID is assigned by the
+// service.
+func fromVariant(v *proto.Variant) *domain.Variant {
+	variant := &domain.Variant{
+		ProductID: v.ProductId,
+		SKU:       v.Sku,
+		Options:   v.Options,
+		Stock:     int(v.Stock),
+	}
+	if v.PriceOverride != 0 {
+		price := v.PriceOverride
+		variant.PriceOverride = &price
+	}
+	return variant
+}
+
+func productError(err error, msg string) error {
+	switch {
+	case errors.Is(err, domain.ErrProductNotFound), errors.Is(err, domain.ErrVariantNotFound), errors.Is(err, domain.ErrCategoryNotFound),
+		errors.Is(err, domain.ErrLocationNotFound), errors.Is(err, domain.ErrTransferNotFound):
+		return status.Errorf(codes.NotFound, "%s: %v", msg, err)
+	case errors.Is(err, domain.ErrInvalidVariant), errors.Is(err, domain.ErrInvalidCategory), errors.Is(err, domain.ErrInvalidAttributes),
+		errors.Is(err, domain.ErrInvalidSearch), errors.Is(err, domain.ErrInvalidMovement), errors.Is(err, domain.ErrInvalidLocation),
+		errors.Is(err, domain.ErrInvalidReorder):
+		return status.Errorf(codes.InvalidArgument, "%s: %v", msg, err)
+	case errors.Is(err, domain.ErrDuplicateSKU), errors.Is(err, domain.ErrDuplicateSlug), errors.Is(err, domain.ErrDuplicateCode):
+		return status.Errorf(codes.AlreadyExists, "%s: %v", msg, err)
+	case errors.Is(err, domain.ErrLastVariant), errors.Is(err, domain.ErrVariantRequired), errors.Is(err, domain.ErrCategoryNotEmpty),
+		errors.Is(err, domain.ErrInsufficientStock), errors.Is(err, domain.ErrInvalidTransfer):
+		return status.Errorf(codes.FailedPrecondition, "%s: %v", msg, err)
+	case errors.Is(err, domain.ErrVersionConflict):
+		return status.Errorf(codes.Aborted, "%s: %v", msg, err)
+	}
+	return status.Errorf(codes.Internal, "%s: %v", msg, err)
+}
+
 func (s *Server) CreateProduct(ctx context.Context, req *proto.CreateProductRequest) (*proto.ProductResponse, error) {
 	p := &domain.Product{
-		ID:       uuid.New().String(),
-		Name:     req.Name,
-		Category: req.Category,
-		Stock:    int(req.Stock),
-		Price:    req.Price,
+		ID:              uuid.New().String(),
+		Name:            req.Name,
+		Description:     req.Description,
+		Category:        req.Category,
+		Stock:           int(req.Stock),
+		Price:           req.Price,
+		Attributes:      req.Attributes,
+		ReorderPoint:    int(req.ReorderPoint),
+		ReorderQuantity: int(req.ReorderQuantity),
+	}
+	if req.CategoryId != "" {
+		p.CategoryID = &req.CategoryId
+	}
+	for _, v := range req.Variants {
+		p.Variants = append(p.Variants, fromVariant(v))
 	}
 	if err := s.svc.Create(ctx, p); err != nil {
-		return nil, status.Error(codes.Internal, "failed to create product")
-	}
-	return &proto.ProductResponse{
-		Id:       p.ID,
-		Name:     p.Name,
-		Category: p.Category,
-		Stock:    int32(p.Stock),
-		Price:    p.Price,
-	}, nil
+		return nil, productError(err, "failed to create product")
+	}
+	return toProductResponse(p), nil
 }
 
 func (s *Server) GetProduct(ctx context.Context, req *proto.GetProductRequest) (*proto.ProductResponse, error) {
 	p, err := s.svc.Get(ctx, req.Id)
 	if err != nil {
-		if status.Code(err) == codes.NotFound {
-			return nil, status.Error(codes.NotFound, "product not found")
+		return nil, productError(err, "failed to get product")
+	}
+	return toProductResponse(p), nil
+}
+
+// applyProductMask sets the fields of p named in the update mask of req.
+func applyProductMask(p *domain.Product, req *proto.UpdateProductRequest) error {
+	var category, categoryID bool
+	for _, path := range req.UpdateMask.Paths {
+		switch path {
+		case "name":
+			p.Name = req.Name
+		case "description":
+			p.Description = req.Description
+		case "price":
+			p.Price = req.Price
+		case "category":
+			category = true
+		case "category_id":
+			categoryID = true
+		case "attributes":
+			p.Attributes = req.Attributes
+		case "reorder_point":
+			p.ReorderPoint = int(req.ReorderPoint)
+		case "reorder_quantity":
+			p.ReorderQuantity = int(req.ReorderQuantity)
+		case "clear_attributes":
+			if req.ClearAttributes {
+				p.Attributes = nil
+			}
+		case "stock", "stock_reason", "stock_reference":
+			return errors.New("stock is changed with AdjustStock or SetStock")
+		default:
+			return fmt.Errorf("unknown or read-only field %q in update mask", path)
 		}
-		return nil, status.Error(codes.Internal, "failed to get product")
-	}
-	return &proto.ProductResponse{
-		Id:       p.ID,
-		Name:     p.Name,
-		Category: p.Category,
-		Stock:    int32(p.Stock),
-		Price:    p.Price,
-	}, nil
+	}
+	switch {
+	case categoryID && req.CategoryId != "":
+		p.CategoryID = &req.CategoryId
+	case category && req.Category != "":
+		p.Category = req.Category
+		p.CategoryID = nil
+	case category || categoryID:
+		p.Category = ""
+		p.CategoryID = nil
+	}
+	return nil
 }
 
 func (s *Server) UpdateProduct(ctx context.Context, req *proto.UpdateProductRequest) (*proto.ProductResponse, error) {
-	p, err := s.svc.Get(ctx, req.Id)
-	if err != nil {
-		if status.Code(err) == codes.NotFound {
-			return nil, status.Error(codes.NotFound, "product not found")
+	if req.UpdateMask != nil {
+		// Checked on a blank product first, so that mistakes in the mask are
+		// reported before the product is locked
+		if err := applyProductMask(&domain.Product{}, req); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
 		}
-		return nil, status.Error(codes.Internal, "failed to get product")
-	}
-	if req.Name != "" {
-		p.Name = req.Name
+		p, err := s.svc.Update(ctx, req.Id, int(req.ExpectedVersion), func(p *domain.Product) error {
+			return applyProductMask(p, req)
+		})
+		if err != nil {
+			return nil, productError(err, "failed to update product")
+		}
+		return toProductResponse(p), nil
 	}
-	if req.Category != "" {
-		p.Category = req.Category
+
+	// Checked up front, so that a bad reason is reported as a stock error
+	if err := domain.ValidateReason(domain.NormalizeReason(req.StockReason)); req.Stock != 0 && err != nil {
+		return nil, productError(err, "failed to update stock")
 	}
-	if req.Stock != 0 {
-		p.Stock += int(req.Stock)
+	// Without a mask, empty fields are left alone. The stock delta is
+	// applied in the same transaction as the fields
+	stock := application.VariantChanges{
+		StockDelta:     int(req.Stock),
+		StockReason:    req.StockReason,
+		StockReference: req.StockReference,
 	}
-	if req.Price != 0 {
-		p.Price = req.Price
+	p, err := s.svc.UpdateWithStock(ctx, req.Id, int(req.ExpectedVersion), func(p *domain.Product) error {
+		if req.Name != "" {
+			p.Name = req.Name
+		}
+		if req.Description != "" {
+			p.Description = req.Description
+		}
+		if req.CategoryId != "" {
+			p.CategoryID = &req.CategoryId
+		} else if req.Category != "" {
+			p.Category = req.Category
+			p.CategoryID = nil
+		}
+		if req.ClearAttributes {
+			p.Attributes = nil
+		} else if len(req.Attributes) > 0 {
+			p.Attributes = req.Attributes
+		}
+		if req.Price != 0 {
+			p.Price = req.Price
+		}
+		return nil
+	}, stock)
+	if errors.Is(err, domain.ErrVariantRequired) {
+		return nil, productError(err, "failed to update stock")
 	}
-	if err := s.svc.Update(ctx, p); err != nil {
-		return nil, status.Error(codes.Internal, "failed to update product")
+	if err != nil {
+		return nil, productError(err, "failed to update product")
 	}
-	return &proto.ProductResponse{
-		Id:       p.ID,
-		Name:     p.Name,
-		Category: p.Category,
-		Stock:    int32(p.Stock),
-		Price:    p.Price,
-	}, nil
+	return toProductResponse(p), nil
 }
 
 func (s *Server) DeleteProduct(ctx context.Context, req *proto.DeleteProductRequest) (*proto.InventoryEmpty, error) {
 	if err := s.svc.Delete(ctx, req.Id); err != nil {
-		if status.Code(err) == codes.NotFound {
-			return nil, status.Error(codes.NotFound, "product not found")
-		}
-		return nil, status.Error(codes.Internal, "failed to delete product")
+		return nil, productError(err, "failed to delete product")
 	}
 	return &proto.InventoryEmpty{}, nil
 }
 
 func (s *Server) ListProducts(ctx context.Context, req *proto.ListProductsRequest) (*proto.ListProductsResponse, error) {
-	products, total, err := s.svc.List(ctx, int(req.Page), int(req.PageSize))
+	page, pageSize := int(req.Page), int(req.PageSize)
+	if page < 1 {
+		page = 1
+	}
+	if pageSize < 1 || pageSize > 100 {
+		pageSize = 10
+	}
+	products, total, next, err := s.svc.List(ctx, page, pageSize, req.PageToken)
+	if errors.Is(err, database.ErrInvalidPageToken) {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
 	if err != nil {
 		return nil, status.Error(codes.Internal, "failed to list products")
 	}
 	var protoProducts []*proto.ProductResponse
 	for _, p := range products {
-		protoProducts = append(protoProducts, &proto.ProductResponse{
-			Id:       p.ID,
-			Name:     p.Name,
-			Category: p.Category,
-			Stock:    int32(p.Stock),
-			Price:    p.Price,
-		})
+		protoProducts = append(protoProducts, toProductResponse(p))
 	}
 	return &proto.ListProductsResponse{
-		Products: protoProducts,
-		Total:    int32(total),
+		Products:      protoProducts,
+		Total:         int32(total),
+		NextPageToken: next,
 	}, nil
 }
+
+func (s *Server) SearchProducts(ctx context.Context, req *proto.SearchProductsRequest) (*proto.SearchProductsResponse, error) {
+	q := domain.ProductSearch{
+		Query:    req.Query,
+		Category: req.Category,
+		MinPrice: req.MinPrice,
+		MaxPrice: req.MaxPrice,
+		InStock:  req.InStock,
+		Sort:     req.Sort,
+		Page:     int(req.Page),
+		PageSize: int(req.PageSize),
+	}
+	if q.Page < 1 {
+		q.Page = 1
+	}
+	if q.PageSize < 1 || q.PageSize > 100 {
+		q.PageSize = 10
+	}
+	result, err := s.svc.SearchProducts(ctx, q)
+	if err != nil {
+		return nil, productError(err, "failed to search products")
+	}
+	resp := &proto.SearchProductsResponse{Total: int32(result.Total)}
+	for _, p := range result.Products {
+		resp.Products = append(resp.Products, toProductResponse(p))
+	}
+	for _, f := range result.Categories {
+		resp.Categories = append(resp.Categories, &proto.CategoryFacet{
+			CategoryId: f.CategoryID,
+			Name:       f.Name,
+			Slug:       f.Slug,
+			Count:      int32(f.Count),
+		})
+	}
+	for _, f := range result.Prices {
+		resp.Prices = append(resp.Prices, &proto.PriceFacet{Min: f.Min, Max: f.Max, Count: int32(f.Count)})
+	}
+	return resp, nil
+}
+
+func (s *Server) AddVariant(ctx context.Context, req *proto.Variant) (*proto.Variant, error) {
+	if req.ProductId == "" {
+		return nil, status.Error(codes.InvalidArgument, "product ID is required")
+	}
+	p, err := s.svc.Get(ctx, req.ProductId)
+	if err != nil {
+		return nil, productError(err, "failed to add variant")
+	}
+	v := fromVariant(req)
+	if err := s.svc.AddVariant(ctx, v); err != nil {
+		return nil, productError(err, "failed to add variant")
+	}
+	return toVariant(v, p.Price), nil
+}
+
+func (s *Server) GetVariant(ctx context.Context, req *proto.GetVariantRequest) (*proto.Variant, error) {
+	if req.Id == "" && req.Sku == "" {
+		return nil, status.Error(codes.InvalidArgument, "variant ID or SKU is required")
+	}
+	p, v, err := s.svc.GetVariant(ctx, req.Id, req.Sku)
+	if err != nil {
+		return nil, productError(err, "failed to get variant")
+	}
+	return toVariant(v, p.Price), nil
+}
+
+func (s *Server) UpdateVariant(ctx context.Context, req *proto.UpdateVariantRequest) (*proto.Variant, error) {
+	if req.Id == "" {
+		return nil, status.Error(codes.InvalidArgument, "variant ID is required")
+	}
+	if req.PriceOverride < 0 {
+		return nil, status.Error(codes.InvalidArgument, "price override must be positive")
+	}
+	v, err := s.svc.UpdateVariant(ctx, req.Id, req.ProductId, application.VariantChanges{
+		SKU:                req.Sku,
+		Options:            req.Options,
+		PriceOverride:      req.PriceOverride,
+		ClearPriceOverride: req.ClearPriceOverride,
+		StockDelta:         int(req.Stock),
+		StockReason:        req.StockReason,
+		StockReference:     req.StockReference,
+	})
+	if err != nil {
+		return nil, productError(err, "failed to update variant")
+	}
+	p, err := s.svc.Get(ctx, v.ProductID)
+	if err != nil {
+		return nil, productError(err, "failed to get product")
+	}
+	return toVariant(v, p.Price), nil
+}
+
+func (s *Server) DeleteVariant(ctx context.Context, req *proto.DeleteVariantRequest) (*proto.InventoryEmpty, error) {
+	if req.Id == "" {
+		return nil, status.Error(codes.InvalidArgument, "variant ID is required")
+	}
+	if err := s.svc.DeleteVariant(ctx, req.Id, req.ProductId); err != nil {
+		return nil, productError(err, "failed to delete variant")
+	}
+	return &proto.InventoryEmpty{}, nil
+}
+
+func (s *Server) SearchVariants(ctx context.Context, req *proto.SearchVariantsRequest) (*proto.ListVariantsResponse, error) {
+	page, pageSize := int(req.Page), int(req.PageSize)
+	if page < 1 {
+		page = 1
+	}
+	if pageSize < 1 || pageSize > 100 {
+		pageSize = 20
+	}
+	variants, total, err := s.svc.SearchVariants(ctx, req.SkuPrefix, page, pageSize)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to search variants")
+	}
+	resp := &proto.ListVariantsResponse{Total: int32(total)}
+	prices := make(map[string]float64)
+	for _, v := range variants {
+		price, ok := prices[v.ProductID]
+		if !ok {
+			p, err := s.svc.Get(ctx, v.ProductID)
+			if err != nil {
+				return nil, productError(err, "failed to get product")
+			}
+			price = p.Price
+			prices[v.ProductID] = price
+		}
+		resp.Variants = append(resp.Variants, toVariant(v, price))
+	}
+	return resp, nil
+}
+
+func toReservationResponse(orderID string, reservations []*domain.Reservation) *proto.ReservationResponse {
+	resp := &proto.ReservationResponse{OrderId: orderID}
+	for _, res := range reservations {
+		resp.Items = append(resp.Items, &proto.StockItem{
+			ProductId:  res.ProductID,
+			Quantity:   int32(res.Quantity),
+			VariantId:  res.VariantID,
+			Sku:        res.SKU,
+			LocationId: res.LocationID,
+		})
+		resp.Status = res.Status
+		resp.ExpiresAt = res.ExpiresAt.Format(time.RFC3339)
+	}
+	return resp
+}
+
+func reservationError(err error, msg string) error {
+	switch {
+	case errors.Is(err, domain.ErrInsufficientStock):
+		return status.Errorf(codes.ResourceExhausted, "%s: %v", msg, err)
+	case errors.Is(err, domain.ErrProductNotFound), errors.Is(err, domain.ErrVariantNotFound), errors.Is(err, domain.ErrReservationNotFound):
+		return status.Errorf(codes.NotFound, "%s: %v", msg, err)
+	case errors.Is(err, domain.ErrVariantRequired), errors.Is(err, domain.ErrInvalidLocation):
+		return status.Errorf(codes.InvalidArgument, "%s: %v", msg, err)
+	case errors.Is(err, domain.ErrReservationExpired):
+		return status.Errorf(codes.FailedPrecondition, "%s: %v", msg, err)
+	}
+	return status.Errorf(codes.Internal, "%s: %v", msg, err)
+}
+
+func (s *Server) ReserveStock(ctx context.Context, req *proto.ReserveStockRequest) (*proto.ReservationResponse, error) {
+	if req.OrderId == "" || len(req.Items) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "order ID and items are required")
+	}
+	items := make([]domain.ReservationItem, len(req.Items))
+	for i, item := range req.Items {
+		if (item.ProductId == "" && item.VariantId == "" && item.Sku == "") || item.Quantity <= 0 {
+			return nil, status.Error(codes.InvalidArgument, "invalid item: a product ID, variant ID or SKU and a positive quantity are required")
+		}
+		items[i] = domain.ReservationItem{ProductID: item.ProductId, VariantID: item.VariantId, SKU: item.Sku, Quantity: int(item.Quantity)}
+	}
+	var dest domain.Destination
+	if req.ShipTo != nil {
+		dest = domain.Destination{Country: req.ShipTo.Country, Latitude: req.ShipTo.Latitude, Longitude: req.ShipTo.Longitude}
+	}
+	reservations, err := s.svc.Reserve(ctx, req.OrderId, items, time.Duration(req.TtlSeconds)*time.Second, req.SourcingStrategy, dest)
+	if err != nil {
+		return nil, reservationError(err, "failed to reserve stock")
+	}
+	return toReservationResponse(req.OrderId, reservations), nil
+}
+
+func (s *Server) CommitReservation(ctx context.Context, req *proto.ReservationRequest) (*proto.ReservationResponse, error) {
+	if req.OrderId == "" {
+		return nil, status.Error(codes.InvalidArgument, "order ID is required")
+	}
+	reservations, err := s.svc.Commit(ctx, req.OrderId)
+	if err != nil {
+		return nil, reservationError(err, "failed to commit reservation")
+	}
+	return toReservationResponse(req.OrderId, reservations), nil
+}
+
+func (s *Server) ReleaseReservation(ctx context.Context, req *proto.ReservationRequest) (*proto.ReservationResponse, error) {
+	if req.OrderId == "" {
+		return nil, status.Error(codes.InvalidArgument, "order ID is required")
+	}
+	reservations, err := s.svc.Release(ctx, req.OrderId)
+	if err != nil {
+		return nil, reservationError(err, "failed to release reservation")
+	}
+	resp := toReservationResponse(req.OrderId, reservations)
+	resp.Status = domain.ReservationReleased
+	return resp, nil
+}
+
+func toAttributeSchemas(schemas []domain.AttributeSchema) []*proto.AttributeSchema {
+	resp := make([]*proto.AttributeSchema, len(schemas))
+	for i, a := range schemas {
+		resp[i] = &proto.AttributeSchema{
+			Name:     a.Name,
+			Type:     a.Type,
+			Unit:     a.Unit,
+			Required: a.Required,
+			Values:   a.Values,
+		}
+	}
+	return resp
+}
+
+func fromAttributeSchemas(schemas []*proto.AttributeSchema) []domain.AttributeSchema {
+	attrs := make([]domain.AttributeSchema, len(schemas))
+	for i, a := range schemas {
+		attrs[i] = domain.AttributeSchema{
+			Name:     a.Name,
+			Type:     a.Type,
+			Unit:     a.Unit,
+			Required: a.Required,
+			Values:   a.Values,
+		}
+	}
+	return attrs
+}
+
+// toCategory converts a category. With its path from the root, the response
+// also carries the breadcrumbs and inherited attributes.
+func toCategory(c *domain.Category, path []*domain.Category) *proto.Category {
+	resp := &proto.Category{
+		Id:         c.ID,
+		Name:       c.Name,
+		Slug:       c.Slug,
+		Attributes: toAttributeSchemas(c.Attributes),
+	}
+	if c.ParentID != nil {
+		resp.ParentId = *c.ParentID
+	}
+	if path != nil {
+		slugs := make([]string, len(path))
+		for i, node := range path {
+			resp.Breadcrumbs = append(resp.Breadcrumbs, &proto.Breadcrumb{Id: node.ID, Name: node.Name, Slug: node.Slug})
+			slugs[i] = node.Slug
+		}
+		resp.Path = strings.Join(slugs, "/")
+		resp.EffectiveAttributes = toAttributeSchemas(domain.EffectiveAttributes(path))
+	}
+	return resp
+}
+
+// categoryResponse returns a category with its breadcrumbs, as read back
+// after a change.
+func (s *Server) categoryResponse(ctx context.Context, id string) (*proto.Category, error) {
+	c, path, err := s.svc.GetCategory(ctx, id)
+	if err != nil {
+		return nil, productError(err, "failed to get category")
+	}
+	return toCategory(c, path), nil
+}
+
+func (s *Server) CreateCategory(ctx context.Context, req *proto.CreateCategoryRequest) (*proto.Category, error) {
+	c := &domain.Category{
+		Name:       req.Name,
+		Slug:       req.Slug,
+		Attributes: fromAttributeSchemas(req.Attributes),
+	}
+	if err := s.svc.CreateCategory(ctx, c, req.ParentId); err != nil {
+		return nil, productError(err, "failed to create category")
+	}
+	return s.categoryResponse(ctx, c.ID)
+}
+
+func (s *Server) GetCategory(ctx context.Context, req *proto.GetCategoryRequest) (*proto.Category, error) {
+	ref := req.Id
+	if ref == "" {
+		ref = req.Slug
+	}
+	if ref == "" {
+		return nil, status.Error(codes.InvalidArgument, "category ID or slug is required")
+	}
+	return s.categoryResponse(ctx, ref)
+}
+
+func (s *Server) UpdateCategory(ctx context.Context, req *proto.UpdateCategoryRequest) (*proto.Category, error) {
+	if req.Id == "" {
+		return nil, status.Error(codes.InvalidArgument, "category ID is required")
+	}
+	c, err := s.svc.UpdateCategory(ctx, req.Id, application.CategoryChanges{
+		Name:            req.Name,
+		Slug:            req.Slug,
+		Attributes:      fromAttributeSchemas(req.Attributes),
+		ClearAttributes: req.ClearAttributes,
+	})
+	if err != nil {
+		return nil, productError(err, "failed to update category")
+	}
+	return s.categoryResponse(ctx, c.ID)
+}
+
+func (s *Server) MoveCategory(ctx context.Context, req *proto.MoveCategoryRequest) (*proto.Category, error) {
+	if req.Id == "" {
+		return nil, status.Error(codes.InvalidArgument, "category ID is required")
+	}
+	c, err := s.svc.MoveCategory(ctx, req.Id, req.ParentId)
+	if err != nil {
+		return nil, productError(err, "failed to move category")
+	}
+	return s.categoryResponse(ctx, c.ID)
+}
+
+func (s *Server) DeleteCategory(ctx context.Context, req *proto.DeleteCategoryRequest) (*proto.InventoryEmpty, error) {
+	if req.Id == "" {
+		return nil, status.Error(codes.InvalidArgument, "category ID is required")
+	}
+	if err := s.svc.DeleteCategory(ctx, req.Id); err != nil {
+		return nil, productError(err, "failed to delete category")
+	}
+	return &proto.InventoryEmpty{}, nil
+}
+
+func (s *Server) ListCategories(ctx context.Context, req *proto.ListCategoriesRequest) (*proto.ListCategoriesResponse, error) {
+	categories, err := s.svc.ListCategories(ctx, req.ParentId)
+	if err != nil {
+		return nil, productError(err, "failed to list categories")
+	}
+	resp := &proto.ListCategoriesResponse{}
+	for _, c := range categories {
+		resp.Categories = append(resp.Categories, toCategory(c, nil))
+	}
+	return resp, nil
+}
+
+func (s *Server) ListCategoryProducts(ctx context.Context, req *proto.ListCategoryProductsRequest) (*proto.ListProductsResponse, error) {
+	if req.CategoryId == "" {
+		return nil, status.Error(codes.InvalidArgument, "category ID is required")
+	}
+	page, pageSize := int(req.Page), int(req.PageSize)
+	if page < 1 {
+		page = 1
+	}
+	if pageSize < 1 || pageSize > 100 {
+		pageSize = 10
+	}
+	products, total, err := s.svc.ListCategoryProducts(ctx, req.CategoryId, page, pageSize)
+	if err != nil {
+		return nil, productError(err, "failed to list category products")
+	}
+	resp := &proto.ListProductsResponse{Total: int32(total)}
+	for _, p := range products {
+		resp.Products = append(resp.Products, toProductResponse(p))
+	}
+	return resp, nil
+}
+
+func (s *Server) ListStockMovements(ctx context.Context, req *proto.ListStockMovementsRequest) (*proto.ListStockMovementsResponse, error) {
+	page, pageSize := int(req.Page), int(req.PageSize)
+	if page < 1 {
+		page = 1
+	}
+	if pageSize < 1 || pageSize > 100 {
+		pageSize = 20
+	}
+	f := domain.MovementFilter{
+		ProductID:  req.ProductId,
+		VariantID:  req.VariantId,
+		SKU:        req.Sku,
+		Reason:     req.Reason,
+		Reference:  req.Reference,
+		LocationID: req.Location,
+	}
+	movements, total, err := s.svc.ListStockMovements(ctx, f, page, pageSize)
+	if err != nil {
+		return nil, productError(err, "failed to list stock movements")
+	}
+	resp := &proto.ListStockMovementsResponse{Total: int32(total)}
+	for _, m := range movements {
+		resp.Movements = append(resp.Movements, toStockMovement(m))
+	}
+	return resp, nil
+}
+
+func toStockMovement(m *domain.StockMovement) *proto.StockMovement {
+	return &proto.StockMovement{
+		Id:         m.ID,
+		ProductId:  m.ProductID,
+		VariantId:  m.VariantID,
+		Sku:        m.SKU,
+		Delta:      int32(m.Delta),
+		Reason:     m.Reason,
+		Reference:  m.Reference,
+		Actor:      m.Actor,
+		Balance:    int32(m.Balance),
+		CreatedAt:  m.CreatedAt.Format(time.RFC3339),
+		LocationId: m.LocationID,
+	}
+}
+
+// stockResponse returns a changed variant, priced with its product, and the
+// movement that changed it.
+func (s *Server) stockResponse(ctx context.Context, v *domain.Variant, m *domain.StockMovement) (*proto.StockResponse, error) {
+	p, err := s.svc.Get(ctx, v.ProductID)
+	if err != nil {
+		return nil, productError(err, "failed to get product")
+	}
+	resp := &proto.StockResponse{Variant: toVariant(v, p.Price)}
+	if m != nil {
+		resp.Movement = toStockMovement(m)
+	}
+	return resp, nil
+}
+
+func (s *Server) AdjustStock(ctx context.Context, req *proto.AdjustStockRequest) (*proto.StockResponse, error) {
+	c := application.StockChange{
+		ProductID: req.ProductId,
+		VariantID: req.VariantId,
+		SKU:       req.Sku,
+		Location:  req.Location,
+		Reason:    req.Reason,
+		Reference: req.Reference,
+	}
+	v, m, err := s.svc.AdjustStock(ctx, c, int(req.Delta))
+	if err != nil {
+		return nil, productError(err, "failed to adjust stock")
+	}
+	return s.stockResponse(ctx, v, m)
+}
+
+func (s *Server) SetStock(ctx context.Context, req *proto.SetStockRequest) (*proto.StockResponse, error) {
+	c := application.StockChange{
+		ProductID: req.ProductId,
+		VariantID: req.VariantId,
+		SKU:       req.Sku,
+		Location:  req.Location,
+		Reason:    req.Reason,
+		Reference: req.Reference,
+	}
+	v, m, err := s.svc.SetStock(ctx, c, int(req.Stock), int(req.ExpectedVersion))
+	if err != nil {
+		return nil, productError(err, "failed to set stock")
+	}
+	return s.stockResponse(ctx, v, m)
+}
+
+func toLocation(l *domain.Location) *proto.Location {
+	return &proto.Location{
+		Id:        l.ID,
+		Code:      l.Code,
+		Name:      l.Name,
+		Country:   l.Country,
+		Latitude:  l.Latitude,
+		Longitude: l.Longitude,
+		IsDefault: l.IsDefault,
+	}
+}
+
+func (s *Server) CreateLocation(ctx context.Context, req *proto.Location) (*proto.Location, error) {
+	l := &domain.Location{
+		Code:      req.Code,
+		Name:      req.Name,
+		Country:   req.Country,
+		Latitude:  req.Latitude,
+		Longitude: req.Longitude,
+		IsDefault: req.IsDefault,
+	}
+	if err := s.svc.CreateLocation(ctx, l); err != nil {
+		return nil, productError(err, "failed to create location")
+	}
+	return toLocation(l), nil
+}
+
+func (s *Server) ListLocations(ctx context.Context, req *proto.ListLocationsRequest) (*proto.ListLocationsResponse, error) {
+	locations, err := s.svc.ListLocations(ctx)
+	if err != nil {
+		return nil, productError(err, "failed to list locations")
+	}
+	resp := &proto.ListLocationsResponse{}
+	for _, l := range locations {
+		resp.Locations = append(resp.Locations, toLocation(l))
+	}
+	return resp, nil
+}
+
+func toTransfer(t *domain.Transfer) *proto.Transfer {
+	resp := &proto.Transfer{
+		Id:             t.ID,
+		ProductId:      t.ProductID,
+		VariantId:      t.VariantID,
+		Sku:            t.SKU,
+		FromLocationId: t.FromLocationID,
+		ToLocationId:   t.ToLocationID,
+		Quantity:       int32(t.Quantity),
+		Status:         t.Status,
+		Reference:      t.Reference,
+		Actor:          t.Actor,
+		CreatedAt:      t.CreatedAt.Format(time.RFC3339),
+	}
+	if t.From != nil {
+		resp.FromLocationCode = t.From.Code
+	}
+	if t.To != nil {
+		resp.ToLocationCode = t.To.Code
+	}
+	if t.CompletedAt != nil {
+		resp.CompletedAt = t.CompletedAt.Format(time.RFC3339)
+	}
+	return resp
+}
+
+func (s *Server) CreateTransfer(ctx context.Context, req *proto.CreateTransferRequest) (*proto.Transfer, error) {
+	c := application.StockChange{
+		ProductID: req.ProductId,
+		VariantID: req.VariantId,
+		SKU:       req.Sku,
+		Location:  req.From,
+		Reference: req.Reference,
+	}
+	t, err := s.svc.CreateTransfer(ctx, c, req.To, int(req.Quantity))
+	if err != nil {
+		return nil, productError(err, "failed to create transfer")
+	}
+	return toTransfer(t), nil
+}
+
+func (s *Server) ReceiveTransfer(ctx context.Context, req *proto.TransferRequest) (*proto.Transfer, error) {
+	t, err := s.svc.ReceiveTransfer(ctx, req.Id)
+	if err != nil {
+		return nil, productError(err, "failed to receive transfer")
+	}
+	return toTransfer(t), nil
+}
+
+func (s *Server) CancelTransfer(ctx context.Context, req *proto.TransferRequest) (*proto.Transfer, error) {
+	t, err := s.svc.CancelTransfer(ctx, req.Id)
+	if err != nil {
+		return nil, productError(err, "failed to cancel transfer")
+	}
+	return toTransfer(t), nil
+}
+
+func (s *Server) ListTransfers(ctx context.Context, req *proto.ListTransfersRequest) (*proto.ListTransfersResponse, error) {
+	page, pageSize := int(req.Page), int(req.PageSize)
+	if page < 1 {
+		page = 1
+	}
+	if pageSize < 1 || pageSize > 100 {
+		pageSize = 20
+	}
+	f := domain.TransferFilter{VariantID: req.VariantId, LocationID: req.Location, Status: req.Status}
+	transfers, total, err := s.svc.ListTransfers(ctx, f, page, pageSize)
+	if err != nil {
+		return nil, productError(err, "failed to list transfers")
+	}
+	resp := &proto.ListTransfersResponse{Total: int32(total)}
+	for _, t := range transfers {
+		resp.Transfers = append(resp.Transfers, toTransfer(t))
+	}
+	return resp, nil
+}
+
+func (s *Server) GetReorderReport(ctx context.Context, req *proto.ReorderReportRequest) (*proto.ReorderReportResponse, error) {
+	lines, err := s.svc.GetReorderReport(ctx, int(req.WindowDays), int(req.CoverDays))
+	if err != nil {
+		return nil, productError(err, "failed to get reorder report")
+	}
+	resp := &proto.ReorderReportResponse{}
+	for _, l := range lines {
+		resp.Lines = append(resp.Lines, &proto.ReorderLine{
+			ProductId:         l.ProductID,
+			Name:              l.Name,
+			Stock:             int32(l.Stock),
+			InTransit:         int32(l.InTransit),
+			ReorderPoint:      int32(l.ReorderPoint),
+			ReorderQuantity:   int32(l.ReorderQuantity),
+			Sold:              int32(l.Sold),
+			Velocity:          l.Velocity,
+			DaysOfCover:       l.DaysOfCover,
+			SuggestedQuantity: int32(l.Suggested),
+		})
+	}
+	return resp, nil
+}
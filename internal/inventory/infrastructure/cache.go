@@ -11,11 +11,15 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
-// Cache defines the interface for caching operations.
+// Cache defines the interface for caching operations. Products are cached
+// with their variants; SKUs map to the ID of their product.
 type Cache interface {
 	GetProduct(ctx context.Context, id uuid.UUID) (*domain.Product, error)
 	SetProduct(ctx context.Context, id uuid.UUID, product *domain.Product) error
 	DeleteProduct(ctx context.Context, id uuid.UUID) error
+	GetSKU(ctx context.Context, sku string) (string, error)
+	SetSKU(ctx context.Context, sku, productID string) error
+	DeleteSKU(ctx context.Context, sku string) error
 }
 
 // RedisCache implements the Cache interface using Redis.
@@ -79,3 +83,34 @@ func (c *RedisCache) DeleteProduct(ctx context.Context, id uuid.UUID) error {
 	logrus.WithField("product_id", id).Info("Product cache invalidated")
 	return nil
 }
+
+// GetSKU returns the product ID cached for a SKU, or "" on a cache miss.
+func (c *RedisCache) GetSKU(ctx context.Context, sku string) (string, error) {
+	productID, err := c.client.Get(ctx, "sku:"+sku).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	if err != nil {
+		logrus.WithError(err).Error("Failed to get SKU from cache")
+		return "", err
+	}
+	return productID, nil
+}
+
+// SetSKU caches the product ID of a SKU with a TTL of 1 hour.
+func (c *RedisCache) SetSKU(ctx context.Context, sku, productID string) error {
+	if err := c.client.Set(ctx, "sku:"+sku, productID, time.Hour).Err(); err != nil {
+		logrus.WithError(err).Error("Failed to set SKU in cache")
+		return err
+	}
+	return nil
+}
+
+// DeleteSKU removes a SKU from Redis.
+func (c *RedisCache) DeleteSKU(ctx context.Context, sku string) error {
+	if err := c.client.Del(ctx, "sku:"+sku).Err(); err != nil {
+		logrus.WithError(err).Error("Failed to delete SKU from cache")
+		return err
+	}
+	return nil
+}
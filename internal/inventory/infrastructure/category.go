@@ -0,0 +1,203 @@
+package infrastructure
+
+import (
+	"context"
+	"ecommerce/internal/inventory/domain"
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// migrateCategories turns the free-form categories of products created
+// before the category tree existed into root categories named after them.
+func migrateCategories(db *gorm.DB) error {
+	var names []string
+	if err := db.Model(&domain.Product{}).
+		Where("category_id IS NULL AND category <> ''").
+		Distinct().Pluck("category", &names).Error; err != nil {
+		return err
+	}
+	for _, name := range names {
+		err := db.Transaction(func(tx *gorm.DB) error {
+			slug := domain.Slugify(name)
+			if slug == "" {
+				slug = "category"
+			}
+			var c domain.Category
+			err := tx.First(&c, "slug = ?", slug).Error
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				id := uuid.New().String()
+				c = domain.Category{ID: id, Name: name, Slug: slug, Path: id, Attributes: []domain.AttributeSchema{}}
+				err = tx.Create(&c).Error
+			}
+			if err != nil {
+				return err
+			}
+			return tx.Model(&domain.Product{}).
+				Where("category = ? AND category_id IS NULL", name).
+				Updates(map[string]interface{}{"category_id": c.ID, "category": c.Slug, "version": gorm.Expr("version + 1")}).Error
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// categoryError translates lookup and unique errors of categories.
+func categoryError(err error, slug string) error {
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return domain.ErrCategoryNotFound
+	case errors.Is(err, gorm.ErrDuplicatedKey):
+		return fmt.Errorf("%w: %s", domain.ErrDuplicateSlug, slug)
+	}
+	return err
+}
+
+// CreateCategory creates a category.
+func (r *Repository) CreateCategory(ctx context.Context, c *domain.Category) error {
+	return categoryError(r.conn(ctx).Create(c).Error, c.Slug)
+}
+
+// GetCategory retrieves a category by ID.
+func (r *Repository) GetCategory(ctx context.Context, id string) (*domain.Category, error) {
+	var c domain.Category
+	if err := r.conn(ctx).First(&c, "id = ?", id).Error; err != nil {
+		return nil, categoryError(err, "")
+	}
+	return &c, nil
+}
+
+// GetCategoryBySlug retrieves a category by slug.
+func (r *Repository) GetCategoryBySlug(ctx context.Context, slug string) (*domain.Category, error) {
+	var c domain.Category
+	if err := r.conn(ctx).First(&c, "slug = ?", slug).Error; err != nil {
+		return nil, categoryError(err, slug)
+	}
+	return &c, nil
+}
+
+// LockCategory retrieves a category and locks it until the end of the
+// transaction. With share, other transactions may still share the lock, as
+// products being added to the category do; deleting or moving it takes the
+// exclusive lock.
+func (r *Repository) LockCategory(ctx context.Context, id string, share bool) (*domain.Category, error) {
+	strength := "UPDATE"
+	if share {
+		strength = "SHARE"
+	}
+	var c domain.Category
+	if err := r.conn(ctx).Clauses(clause.Locking{Strength: strength}).First(&c, "id = ?", id).Error; err != nil {
+		return nil, categoryError(err, "")
+	}
+	return &c, nil
+}
+
+// GetCategories retrieves the categories with the given IDs, in no order.
+func (r *Repository) GetCategories(ctx context.Context, ids []string) ([]*domain.Category, error) {
+	var categories []*domain.Category
+	err := r.conn(ctx).Where("id IN ?", ids).Find(&categories).Error
+	return categories, err
+}
+
+// ListChildCategories returns the children of a category, or the roots if
+// parentID is empty, by name.
+func (r *Repository) ListChildCategories(ctx context.Context, parentID string) ([]*domain.Category, error) {
+	var categories []*domain.Category
+	query := r.conn(ctx).Order("name, id")
+	if parentID == "" {
+		query = query.Where("parent_id IS NULL")
+	} else {
+		query = query.Where("parent_id = ?", parentID)
+	}
+	err := query.Find(&categories).Error
+	return categories, err
+}
+
+// UpdateCategory updates the name, slug and attributes of a category and the
+// slug copied onto its products.
+func (r *Repository) UpdateCategory(ctx context.Context, c *domain.Category) error {
+	if err := r.conn(ctx).Select("name", "slug", "attributes", "updated_at").Updates(c).Error; err != nil {
+		return categoryError(err, c.Slug)
+	}
+	return r.conn(ctx).Model(&domain.Product{}).Where("category_id = ? AND category <> ?", c.ID, c.Slug).
+		Updates(map[string]interface{}{"category": c.Slug, "version": gorm.Expr("version + 1")}).Error
+}
+
+// DeleteCategory deletes a category by ID.
+func (r *Repository) DeleteCategory(ctx context.Context, id string) error {
+	return r.conn(ctx).Delete(&domain.Category{}, "id = ?", id).Error
+}
+
+// subtree restricts a query on products to those in the subtree under path.
+func subtree(db *gorm.DB, path string) *gorm.DB {
+	return db.Where("category_id IN (?)",
+		db.Session(&gorm.Session{NewDB: true}).Model(&domain.Category{}).Select("id").
+			Where("path = ? OR path LIKE ?", path, path+"/%"))
+}
+
+// CountCategoryChildren returns the number of direct children of a category.
+func (r *Repository) CountCategoryChildren(ctx context.Context, id string) (int, error) {
+	var n int64
+	err := r.conn(ctx).Model(&domain.Category{}).Where("parent_id = ?", id).Count(&n).Error
+	return int(n), err
+}
+
+// CountCategoryProducts returns the number of products directly in a
+// category.
+func (r *Repository) CountCategoryProducts(ctx context.Context, id string) (int, error) {
+	var n int64
+	err := r.conn(ctx).Model(&domain.Product{}).Where("category_id = ?", id).Count(&n).Error
+	return int(n), err
+}
+
+// CategoryProductIDs returns the IDs of the products directly in a category.
+func (r *Repository) CategoryProductIDs(ctx context.Context, id string) ([]string, error) {
+	var ids []string
+	err := r.conn(ctx).Model(&domain.Product{}).Where("category_id = ?", id).Pluck("id", &ids).Error
+	return ids, err
+}
+
+// MaxSubtreeDepth returns the depth of the deepest category in the subtree
+// under path, counting roots as 1.
+func (r *Repository) MaxSubtreeDepth(ctx context.Context, path string) (int, error) {
+	var depth int
+	err := r.conn(ctx).Model(&domain.Category{}).
+		Select("COALESCE(MAX(length(path) - length(replace(path, '/', ''))), 0) + 1").
+		Where("path = ? OR path LIKE ?", path, path+"/%").Scan(&depth).Error
+	return depth, err
+}
+
+// MoveCategory puts a category under parentID, or at the root if parentID
+// is nil, and rewrites the paths of its subtree from oldPath to c.Path.
+func (r *Repository) MoveCategory(ctx context.Context, c *domain.Category, oldPath string) error {
+	if err := r.conn(ctx).Model(c).Update("parent_id", c.ParentID).Error; err != nil {
+		return err
+	}
+	return r.conn(ctx).Model(&domain.Category{}).
+		Where("path = ? OR path LIKE ?", oldPath, oldPath+"/%").
+		Update("path", gorm.Expr("? || substr(path, ?)", c.Path, len(oldPath)+1)).Error
+}
+
+// ListCategoryProducts lists the products in the subtree under path, by
+// name, with pagination.
+func (r *Repository) ListCategoryProducts(ctx context.Context, path string, page, pageSize int) ([]*domain.Product, int, error) {
+	var products []*domain.Product
+	var total int64
+
+	if err := subtree(r.conn(ctx).Model(&domain.Product{}), path).Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	offset := (page - 1) * pageSize
+	if err := subtree(preloadVariants(r.conn(ctx)), path).Order("name, id").Offset(offset).Limit(pageSize).Find(&products).Error; err != nil {
+		return nil, 0, err
+	}
+	for _, p := range products {
+		p.TotalStock()
+	}
+	return products, int(total), nil
+}
@@ -0,0 +1,251 @@
+package infrastructure
+
+import (
+	"context"
+	"ecommerce/internal/inventory/domain"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// migrateLocations creates the locations, stock levels and transfers, and a
+// default location holding the stock of variants that have no stock levels
+// yet: all of them when locations are introduced.
+func migrateLocations(db *gorm.DB) error {
+	if err := db.AutoMigrate(&domain.Location{}, &domain.StockLevel{}, &domain.Transfer{}); err != nil {
+		return err
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_locations_default ON locations (is_default) WHERE is_default").Error; err != nil {
+			return err
+		}
+		var count int64
+		if err := tx.Model(&domain.Location{}).Count(&count).Error; err != nil {
+			return err
+		}
+		if count == 0 {
+			location := domain.Location{ID: uuid.New().String(), Code: domain.DefaultLocationCode, Name: "Main warehouse", IsDefault: true}
+			if err := tx.Create(&location).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Exec(`INSERT INTO stock_levels (variant_id, location_id, product_id, available, in_transit, updated_at)
+			SELECT v.id, l.id, v.product_id, v.stock, 0, now() FROM variants v, locations l
+			WHERE l.is_default AND v.stock > 0 AND NOT EXISTS (SELECT 1 FROM stock_levels s WHERE s.variant_id = v.id)`).Error
+	})
+}
+
+// locationError translates the unique violation of location codes.
+func locationError(err error, code string) error {
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		return fmt.Errorf("%w: %s", domain.ErrDuplicateCode, code)
+	}
+	return err
+}
+
+// CreateLocation adds a location. A new default location replaces the
+// previous one.
+func (r *Repository) CreateLocation(ctx context.Context, l *domain.Location) error {
+	return r.WithTransaction(ctx, func(txCtx context.Context) error {
+		if l.IsDefault {
+			if err := r.conn(txCtx).Model(&domain.Location{}).Where("is_default").Update("is_default", false).Error; err != nil {
+				return err
+			}
+		}
+		return locationError(r.conn(txCtx).Create(l).Error, l.Code)
+	})
+}
+
+// ListLocations returns all locations in code order.
+func (r *Repository) ListLocations(ctx context.Context) ([]*domain.Location, error) {
+	var locations []*domain.Location
+	err := r.conn(ctx).Order("code").Find(&locations).Error
+	return locations, err
+}
+
+// GetLocation retrieves a location by ID or code, or the default location
+// when idOrCode is empty.
+func (r *Repository) GetLocation(ctx context.Context, idOrCode string) (*domain.Location, error) {
+	return getLocation(r.conn(ctx), idOrCode)
+}
+
+func getLocation(tx *gorm.DB, idOrCode string) (*domain.Location, error) {
+	var l domain.Location
+	query := tx.Where("is_default")
+	if idOrCode != "" {
+		if _, err := uuid.Parse(idOrCode); err == nil {
+			query = tx.Where("id = ?", idOrCode)
+		} else {
+			query = tx.Where("code = ?", domain.NormalizeLocationCode(idOrCode))
+		}
+	}
+	if err := query.First(&l).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, fmt.Errorf("%w: %s", domain.ErrLocationNotFound, idOrCode)
+		}
+		return nil, err
+	}
+	return &l, nil
+}
+
+// addToLevel adds delta to a column, available or in_transit, of the stock
+// level of a variant at a location, creating the level if needed. It fails
+// with ErrInsufficientStock rather than take the column below zero. The
+// variant must be locked, which keeps its levels from changing under the
+// caller.
+func addToLevel(tx *gorm.DB, v *domain.Variant, locationID, column string, delta int) error {
+	if delta >= 0 {
+		level := map[string]interface{}{"variant_id": v.ID, "location_id": locationID, "product_id": v.ProductID, column: delta, "updated_at": time.Now()}
+		return tx.Model(&domain.StockLevel{}).Clauses(clause.OnConflict{
+			Columns: []clause.Column{{Name: "variant_id"}, {Name: "location_id"}},
+			DoUpdates: clause.Assignments(map[string]interface{}{
+				column:       gorm.Expr("stock_levels."+column+" + ?", delta),
+				"updated_at": time.Now(),
+			}),
+		}).Create(level).Error
+	}
+	result := tx.Model(&domain.StockLevel{}).
+		Where("variant_id = ? AND location_id = ? AND "+column+" >= ?", v.ID, locationID, -delta).
+		Updates(map[string]interface{}{column: gorm.Expr(column+" + ?", delta), "updated_at": time.Now()})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("%w: SKU %s has too few units at the location to remove %d", domain.ErrInsufficientStock, v.SKU, -delta)
+	}
+	return nil
+}
+
+// moveStock adds delta to the available stock of a locked variant at a
+// location and to its total, and bumps its version.
+func moveStock(tx *gorm.DB, v *domain.Variant, locationID string, delta int) error {
+	if err := addToLevel(tx, v, locationID, "available", delta); err != nil {
+		return err
+	}
+	v.Stock += delta
+	return updateStock(tx, v).Error
+}
+
+// MoveStock adds delta to the available stock of a variant at a location;
+// see moveStock. Lock the variant first, in the same transaction.
+func (r *Repository) MoveStock(ctx context.Context, v *domain.Variant, locationID string, delta int) error {
+	return moveStock(r.conn(ctx), v, locationID, delta)
+}
+
+// AddToLevel adds delta to the available stock of a variant at a location,
+// leaving the variant alone: the caller changes v.Stock by as much and saves
+// it. Lock the variant first, in the same transaction.
+func (r *Repository) AddToLevel(ctx context.Context, v *domain.Variant, locationID string, delta int) error {
+	return addToLevel(r.conn(ctx), v, locationID, "available", delta)
+}
+
+// ListStockLevels returns the stock levels of a variant with their
+// locations, in location code order.
+func (r *Repository) ListStockLevels(ctx context.Context, variantID string) ([]*domain.StockLevel, error) {
+	var levels []*domain.StockLevel
+	err := r.conn(ctx).Joins("Location").Where("stock_levels.variant_id = ?", variantID).
+		Order("\"Location\".code").Find(&levels).Error
+	return levels, err
+}
+
+// GetStockLevel returns the stock of a variant at a location, zero if it
+// never had any.
+func (r *Repository) GetStockLevel(ctx context.Context, variantID, locationID string) (*domain.StockLevel, error) {
+	level := domain.StockLevel{VariantID: variantID, LocationID: locationID}
+	err := r.conn(ctx).Where("variant_id = ? AND location_id = ?", variantID, locationID).Limit(1).Find(&level).Error
+	return &level, err
+}
+
+// levelsOf loads the stock levels of the given variants that have available
+// units, with their location, by variant ID.
+func levelsOf(tx *gorm.DB, variantIDs []string) (map[string][]*domain.StockLevel, error) {
+	var levels []*domain.StockLevel
+	if err := tx.Preload("Location").Where("variant_id IN ? AND available > 0", variantIDs).Find(&levels).Error; err != nil {
+		return nil, err
+	}
+	byVariant := make(map[string][]*domain.StockLevel)
+	for _, l := range levels {
+		byVariant[l.VariantID] = append(byVariant[l.VariantID], l)
+	}
+	return byVariant, nil
+}
+
+// CreateTransfer records a transfer of a locked variant. It takes the units
+// out of the source's available stock and counts them in transit at the
+// destination.
+func (r *Repository) CreateTransfer(ctx context.Context, v *domain.Variant, t *domain.Transfer) error {
+	tx := r.conn(ctx)
+	if err := moveStock(tx, v, t.FromLocationID, -t.Quantity); err != nil {
+		return err
+	}
+	if err := addToLevel(tx, v, t.ToLocationID, "in_transit", t.Quantity); err != nil {
+		return err
+	}
+	return tx.Omit(clause.Associations).Create(t).Error
+}
+
+// LockTransfer retrieves a transfer with its locations and locks its row
+// until the end of the transaction.
+func (r *Repository) LockTransfer(ctx context.Context, id string) (*domain.Transfer, error) {
+	var t domain.Transfer
+	err := r.conn(ctx).Clauses(clause.Locking{Strength: "UPDATE"}).
+		Preload("From").Preload("To").First(&t, "id = ?", id).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, fmt.Errorf("%w: %s", domain.ErrTransferNotFound, id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// CompleteTransfer settles an in-transit transfer of a locked variant after
+// t.Complete: received units become available at the destination, and
+// cancelled ones at the source again.
+func (r *Repository) CompleteTransfer(ctx context.Context, v *domain.Variant, t *domain.Transfer) error {
+	tx := r.conn(ctx)
+	if err := addToLevel(tx, v, t.ToLocationID, "in_transit", -t.Quantity); err != nil {
+		return err
+	}
+	to := t.ToLocationID
+	if t.Status == domain.TransferCancelled {
+		to = t.FromLocationID
+	}
+	if err := moveStock(tx, v, to, t.Quantity); err != nil {
+		return err
+	}
+	return tx.Model(t).Omit(clause.Associations).Updates(map[string]interface{}{"status": t.Status, "completed_at": t.CompletedAt}).Error
+}
+
+// ListTransfers lists the transfers matching f with their locations, newest
+// first, with pagination.
+func (r *Repository) ListTransfers(ctx context.Context, f domain.TransferFilter, page, pageSize int) ([]*domain.Transfer, int, error) {
+	query := func() *gorm.DB {
+		db := r.conn(ctx).Model(&domain.Transfer{})
+		if f.VariantID != "" {
+			db = db.Where("variant_id = ?", f.VariantID)
+		}
+		if f.LocationID != "" {
+			db = db.Where("from_location_id = ? OR to_location_id = ?", f.LocationID, f.LocationID)
+		}
+		if f.Status != "" {
+			db = db.Where("status = ?", f.Status)
+		}
+		return db
+	}
+	var transfers []*domain.Transfer
+	var total int64
+	if err := query().Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	offset := (page - 1) * pageSize
+	if err := query().Preload("From").Preload("To").Order("created_at DESC, id").
+		Offset(offset).Limit(pageSize).Find(&transfers).Error; err != nil {
+		return nil, 0, err
+	}
+	return transfers, int(total), nil
+}
@@ -0,0 +1,95 @@
+package infrastructure
+
+import (
+	"context"
+	"ecommerce/internal/inventory/domain"
+
+	"gorm.io/gorm"
+)
+
+// migrateLedger creates the stock ledger and a trigger that rejects changes
+// to recorded movements, keeping it append-only.
+func migrateLedger(db *gorm.DB) error {
+	if err := db.AutoMigrate(&domain.StockMovement{}); err != nil {
+		return err
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		for _, stmt := range []string{
+			`CREATE OR REPLACE FUNCTION stock_movements_append_only() RETURNS trigger AS $$
+			BEGIN
+				RAISE EXCEPTION 'stock movements are append-only';
+			END;
+			$$ LANGUAGE plpgsql`,
+			"DROP TRIGGER IF EXISTS stock_movements_append_only ON stock_movements",
+			`CREATE TRIGGER stock_movements_append_only BEFORE UPDATE OR DELETE ON stock_movements
+			FOR EACH ROW EXECUTE FUNCTION stock_movements_append_only()`,
+		} {
+			if err := tx.Exec(stmt).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// recordMovements appends movements to the ledger, skipping those that did
+// not change the stock, and updates the low-stock flag of their products.
+// Every stock change goes through here, once per transaction.
+func recordMovements(tx *gorm.DB, movements []*domain.StockMovement) error {
+	var changes []*domain.StockMovement
+	for _, m := range movements {
+		if m.Delta != 0 {
+			changes = append(changes, m)
+		}
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+	if err := tx.Create(changes).Error; err != nil {
+		return err
+	}
+	return updateLowStock(tx, productsOf(changes))
+}
+
+// RecordMovements appends movements to the ledger. Call it once, in the
+// transaction that changed the stock, after the change.
+func (r *Repository) RecordMovements(ctx context.Context, movements ...*domain.StockMovement) error {
+	return recordMovements(r.conn(ctx), movements)
+}
+
+// ListMovements lists the stock movements matching f, newest first, with
+// pagination.
+func (r *Repository) ListMovements(ctx context.Context, f domain.MovementFilter, page, pageSize int) ([]*domain.StockMovement, int, error) {
+	query := func() *gorm.DB {
+		db := r.conn(ctx).Model(&domain.StockMovement{})
+		if f.ProductID != "" {
+			db = db.Where("product_id = ?", f.ProductID)
+		}
+		if f.VariantID != "" {
+			db = db.Where("variant_id = ?", f.VariantID)
+		}
+		if f.LocationID != "" {
+			db = db.Where("location_id = ?", f.LocationID)
+		}
+		if f.SKU != "" {
+			db = db.Where("sku = ?", f.SKU)
+		}
+		if f.Reason != "" {
+			db = db.Where("reason = ?", f.Reason)
+		}
+		if f.Reference != "" {
+			db = db.Where("reference = ?", f.Reference)
+		}
+		return db
+	}
+	var movements []*domain.StockMovement
+	var total int64
+	if err := query().Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	offset := (page - 1) * pageSize
+	if err := query().Order("id DESC").Offset(offset).Limit(pageSize).Find(&movements).Error; err != nil {
+		return nil, 0, err
+	}
+	return movements, int(total), nil
+}
@@ -0,0 +1,100 @@
+package infrastructure
+
+import (
+	"context"
+	"ecommerce/internal/inventory/domain"
+	"ecommerce/internal/outbox"
+	"encoding/json"
+	"sort"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// updateLowStock sets the low-stock flag of the given products from their
+// stock as tx sees it, and writes an inventory.low_stock event for every
+// product that has just fallen to its reorder point or below. The flag keeps
+// a product from being reported again until it has been restocked above the
+// reorder point. Products are updated in ID order, so that concurrent
+// transactions lock them in the same order.
+func updateLowStock(tx *gorm.DB, productIDs []string) error {
+	if len(productIDs) == 0 {
+		return nil
+	}
+	var products []struct {
+		ID              string
+		Name            string
+		ReorderPoint    int
+		ReorderQuantity int
+		LowStock        bool
+		Stock           int
+	}
+	if err := tx.Raw(`SELECT p.id, p.name, p.reorder_point, p.reorder_quantity, p.low_stock,
+		COALESCE((SELECT SUM(v.stock) FROM variants v WHERE v.product_id = p.id), 0) AS stock
+		FROM products p WHERE p.id IN ? ORDER BY p.id`, productIDs).Scan(&products).Error; err != nil {
+		return err
+	}
+	for _, p := range products {
+		low := domain.IsLow(p.Stock, p.ReorderPoint)
+		if low == p.LowStock {
+			continue
+		}
+		result := tx.Model(&domain.Product{}).Where("id = ? AND low_stock = ?", p.ID, p.LowStock).UpdateColumn("low_stock", low)
+		if result.Error != nil {
+			return result.Error
+		}
+		// Another transaction flipped it first and reported it if needed
+		if result.RowsAffected == 0 || !low {
+			continue
+		}
+		data, err := json.Marshal(domain.LowStockEvent{
+			ProductID:       p.ID,
+			Name:            p.Name,
+			Stock:           p.Stock,
+			ReorderPoint:    p.ReorderPoint,
+			ReorderQuantity: p.ReorderQuantity,
+			OccurredAt:      time.Now(),
+		})
+		if err != nil {
+			return err
+		}
+		if err := outbox.Create(tx, outboxTable, p.ID, domain.EventLowStock, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UpdateLowStock sets the low-stock flag of a product after its reorder
+// point changed; see updateLowStock. Stock changes do so when their
+// movements are recorded.
+func (r *Repository) UpdateLowStock(ctx context.Context, productID string) error {
+	return updateLowStock(r.conn(ctx), []string{productID})
+}
+
+// productsOf returns the distinct products of movements in ID order.
+func productsOf(movements []*domain.StockMovement) []string {
+	seen := make(map[string]bool)
+	var ids []string
+	for _, m := range movements {
+		if !seen[m.ProductID] {
+			seen[m.ProductID] = true
+			ids = append(ids, m.ProductID)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// ReorderLines returns the reorder position of every product, with the units
+// sold since the given time: sales net of returns in the stock ledger.
+func (r *Repository) ReorderLines(ctx context.Context, since time.Time) ([]*domain.ReorderLine, error) {
+	var lines []*domain.ReorderLine
+	err := r.conn(ctx).Raw(`SELECT p.id AS product_id, p.name, p.reorder_point, p.reorder_quantity,
+		COALESCE((SELECT SUM(v.stock) FROM variants v WHERE v.product_id = p.id), 0) AS stock,
+		COALESCE((SELECT SUM(l.in_transit) FROM stock_levels l WHERE l.product_id = p.id), 0) AS in_transit,
+		COALESCE((SELECT -SUM(m.delta) FROM stock_movements m
+			WHERE m.product_id = p.id AND m.reason IN ? AND m.created_at >= ?), 0) AS sold
+		FROM products p ORDER BY p.id`, []string{domain.ReasonSale, domain.ReasonReturn}, since).Scan(&lines).Error
+	return lines, err
+}
@@ -2,81 +2,214 @@ package infrastructure
 
 import (
 	"context"
+	"ecommerce/internal/database"
 	"ecommerce/internal/inventory/domain"
+	"ecommerce/internal/outbox"
+	"errors"
+	"fmt"
+
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
+// outboxTable holds the inventory events waiting to be relayed. It is
+// separate from the order service's outbox, which shares the database.
+const outboxTable = "inventory_outbox_events"
+
 // Repository defines the data access layer for the inventory service.
 type Repository struct {
-	db *gorm.DB
+	db     *gorm.DB
+	outbox *outbox.Repository
 }
 
 // NewRepository initializes a new repository with transaction support.
 func NewRepository(dsn string) (*Repository, error) {
-	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
+	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{TranslateError: true})
 	if err != nil {
 		return nil, err
 	}
-	if err := db.AutoMigrate(&domain.Product{}); err != nil {
+	if err := db.AutoMigrate(&domain.Category{}, &domain.Product{}, &domain.Variant{}); err != nil {
+		return nil, err
+	}
+	if err := migrateToVariants(db); err != nil {
+		return nil, err
+	}
+	if err := migrateCategories(db); err != nil {
+		return nil, err
+	}
+	if err := migrateSearch(db); err != nil {
+		return nil, err
+	}
+	if err := db.AutoMigrate(&domain.Reservation{}); err != nil {
+		return nil, err
+	}
+	if err := migrateLedger(db); err != nil {
 		return nil, err
 	}
-	return &Repository{db: db}, nil
+	if err := migrateLocations(db); err != nil {
+		return nil, err
+	}
+	events, err := outbox.NewRepository(db, outboxTable)
+	if err != nil {
+		return nil, err
+	}
+	return &Repository{db: db, outbox: events}, nil
 }
 
-// WithTransaction executes a function within a database transaction.
-func (r *Repository) WithTransaction(ctx context.Context, fn func(txCtx context.Context) error) error {
-	tx := r.db.WithContext(ctx).Begin()
-	if tx.Error != nil {
-		return tx.Error
-	}
-	defer tx.Rollback()
+// Outbox returns the inventory events outbox, for the relay.
+func (r *Repository) Outbox() *outbox.Repository {
+	return r.outbox
+}
 
-	err := fn(ctx)
-	if err != nil {
-		return err
+// migrateToVariants moves the stock of products created before products had
+// variants onto a default variant whose ID is the product ID, and points
+// their reservations at it.
+func migrateToVariants(db *gorm.DB) error {
+	m := db.Migrator()
+	return db.Transaction(func(tx *gorm.DB) error {
+		if m.HasColumn(&domain.Product{}, "stock") {
+			if err := tx.Exec(`INSERT INTO variants (id, product_id, sku, options, stock, created_at, updated_at)
+				SELECT p.id::uuid, p.id, upper(p.id), '{}', COALESCE(p.stock, 0), now(), now() FROM products p
+				WHERE NOT EXISTS (SELECT 1 FROM variants v WHERE v.product_id = p.id)`).Error; err != nil {
+				return err
+			}
+		}
+		if !m.HasTable(&domain.Reservation{}) || m.HasColumn(&domain.Reservation{}, "variant_id") {
+			return nil
+		}
+		for _, stmt := range []string{
+			"ALTER TABLE reservations ADD COLUMN variant_id uuid, ADD COLUMN sku text",
+			"UPDATE reservations SET variant_id = product_id::uuid, sku = upper(product_id)",
+			"ALTER TABLE reservations ALTER COLUMN variant_id SET NOT NULL, ALTER COLUMN sku SET NOT NULL",
+		} {
+			if err := tx.Exec(stmt).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// preloadVariants loads the variants of the queried products, oldest first,
+// with their stock levels and locations.
+func preloadVariants(db *gorm.DB) *gorm.DB {
+	return db.Preload("Variants", func(db *gorm.DB) *gorm.DB {
+		return db.Order("created_at, id")
+	}).Preload("Variants.Levels").Preload("Variants.Levels.Location")
+}
+
+// skuError reports a unique violation, the only one variants can cause
+// besides their generated ID, as a duplicate SKU.
+func skuError(err error, sku string) error {
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		return fmt.Errorf("%w: %s", domain.ErrDuplicateSKU, sku)
 	}
+	return err
+}
 
-	return tx.Commit().Error
+// conn returns the transaction bound to ctx, if any, or the plain database
+// handle otherwise.
+func (r *Repository) conn(ctx context.Context) *gorm.DB {
+	return database.Conn(ctx, r.db)
 }
 
-// Create creates a new product.
+// WithTransaction executes a function within a database transaction. Every
+// repository call made with txCtx takes part in it; calling WithTransaction
+// again with txCtx opens a savepoint.
+func (r *Repository) WithTransaction(ctx context.Context, fn func(txCtx context.Context) error, opts ...database.TxOption) error {
+	return database.WithTransaction(ctx, r.db, fn, opts...)
+}
+
+// Create creates a new product with its variants.
 func (r *Repository) Create(ctx context.Context, p *domain.Product) error {
-	return r.db.WithContext(ctx).Create(p).Error
+	err := r.conn(ctx).Create(p).Error
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		return fmt.Errorf("%w: %v", domain.ErrDuplicateSKU, err)
+	}
+	return err
 }
 
-// Get retrieves a product by ID.
+// Get retrieves a product by ID with its variants.
 func (r *Repository) Get(ctx context.Context, id string) (*domain.Product, error) {
 	var p domain.Product
-	if err := r.db.WithContext(ctx).First(&p, "id = ?", id).Error; err != nil {
+	if err := preloadVariants(r.conn(ctx)).First(&p, "id = ?", id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, domain.ErrProductNotFound
+		}
 		return nil, err
 	}
+	p.TotalStock()
 	return &p, nil
 }
 
-// Update updates a product.
+// LockProduct locks a product row until the end of the transaction, so that
+// its variants can be changed without racing other writers.
+func (r *Repository) LockProduct(ctx context.Context, id string) error {
+	var p domain.Product
+	err := r.conn(ctx).Clauses(clause.Locking{Strength: "UPDATE"}).First(&p, "id = ?", id).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return domain.ErrProductNotFound
+	}
+	return err
+}
+
+// Update updates the fields of a product, leaving its variants and creation
+// time alone, and bumps its version. It fails with ErrVersionConflict if the
+// product is no longer at the version it was read at.
 func (r *Repository) Update(ctx context.Context, p *domain.Product) error {
-	return r.db.WithContext(ctx).Save(p).Error
+	saved, err := database.SaveVersion(r.conn(ctx).Omit(clause.Associations, "created_at"), p, &p.Version)
+	if err != nil || saved {
+		return err
+	}
+	var count int64
+	if err := r.conn(ctx).Model(&domain.Product{}).Where("id = ?", p.ID).Count(&count).Error; err != nil {
+		return err
+	}
+	if count == 0 {
+		return domain.ErrProductNotFound
+	}
+	return domain.ErrVersionConflict
 }
 
-// Delete deletes a product by ID.
+// Delete deletes a product by ID. Its variants go with it.
 func (r *Repository) Delete(ctx context.Context, id string) error {
-	return r.db.WithContext(ctx).Delete(&domain.Product{}, "id = ?", id).Error
+	return r.conn(ctx).Delete(&domain.Product{}, "id = ?", id).Error
 }
 
-// List lists products with pagination.
+// List lists products with pagination, newest first.
 func (r *Repository) List(ctx context.Context, page, pageSize int) ([]*domain.Product, int, error) {
 	var products []*domain.Product
 	var total int64
 
-	if err := r.db.WithContext(ctx).Model(&domain.Product{}).Count(&total).Error; err != nil {
+	if err := r.conn(ctx).Model(&domain.Product{}).Count(&total).Error; err != nil {
 		return nil, 0, err
 	}
 
 	offset := (page - 1) * pageSize
-	if err := r.db.WithContext(ctx).Offset(offset).Limit(pageSize).Find(&products).Error; err != nil {
+	if err := database.NewestFirst(preloadVariants(r.conn(ctx)), "products").Offset(offset).Limit(pageSize).Find(&products).Error; err != nil {
 		return nil, 0, err
 	}
+	for _, p := range products {
+		p.TotalStock()
+	}
 
 	return products, int(total), nil
 }
+
+// ListAfter lists up to pageSize products after the cursor, or from the
+// newest if it is nil, and reports whether more follow.
+func (r *Repository) ListAfter(ctx context.Context, after *database.Cursor, pageSize int) ([]*domain.Product, bool, error) {
+	var products []*domain.Product
+	if err := database.After(preloadVariants(r.conn(ctx)), "products", after, pageSize).Find(&products).Error; err != nil {
+		return nil, false, err
+	}
+	more := len(products) > pageSize
+	if more {
+		products = products[:pageSize]
+	}
+	for _, p := range products {
+		p.TotalStock()
+	}
+	return products, more, nil
+}
@@ -0,0 +1,278 @@
+package infrastructure
+
+import (
+	"context"
+	"ecommerce/internal/inventory/domain"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// lockVariants loads the given variants with a row-level lock. Rows are
+// locked in ID order so that concurrent reservations cannot deadlock.
+func lockVariants(tx *gorm.DB, ids []string) (map[string]*domain.Variant, error) {
+	sorted := append([]string(nil), ids...)
+	sort.Strings(sorted)
+
+	var variants []*domain.Variant
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("id IN ?", sorted).Order("id").Find(&variants).Error; err != nil {
+		return nil, err
+	}
+	byID := make(map[string]*domain.Variant, len(variants))
+	for _, v := range variants {
+		byID[v.ID] = v
+	}
+	return byID, nil
+}
+
+// updateStock writes the stock of a locked variant and bumps its version.
+func updateStock(tx *gorm.DB, v *domain.Variant) *gorm.DB {
+	v.Version++
+	return tx.Model(v).Updates(map[string]interface{}{"stock": v.Stock, "version": v.Version})
+}
+
+// resolveVariant returns the ID of the variant an item names: its VariantID,
+// the variant with its SKU, or the only variant of its product.
+func resolveVariant(tx *gorm.DB, item domain.ReservationItem) (string, error) {
+	var variants []*domain.Variant
+	var err error
+	switch {
+	case item.VariantID != "":
+		return item.VariantID, nil
+	case item.SKU != "":
+		err = tx.Where("sku = ?", domain.NormalizeSKU(item.SKU)).Find(&variants).Error
+		if err == nil && len(variants) == 0 {
+			return "", fmt.Errorf("%w: SKU %s", domain.ErrVariantNotFound, item.SKU)
+		}
+	default:
+		err = tx.Where("product_id = ?", item.ProductID).Limit(2).Find(&variants).Error
+		if err == nil && len(variants) == 0 {
+			return "", fmt.Errorf("%w: %s", domain.ErrProductNotFound, item.ProductID)
+		}
+		if err == nil && len(variants) > 1 {
+			return "", fmt.Errorf("%w: %s", domain.ErrVariantRequired, item.ProductID)
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	return variants[0].ID, nil
+}
+
+// lockReservations loads the reservations of an order in the given statuses
+// with a row-level lock.
+func lockReservations(tx *gorm.DB, orderID string, statuses ...string) ([]*domain.Reservation, error) {
+	var reservations []*domain.Reservation
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("order_id = ? AND status IN ?", orderID, statuses).
+		Order("variant_id").Find(&reservations).Error
+	return reservations, err
+}
+
+// restock returns the units of the given reservations to stock at the
+// locations they were taken from, records the returns in the ledger and
+// marks the reservations released.
+func restock(tx *gorm.DB, reservations []*domain.Reservation, actor string) error {
+	if len(reservations) == 0 {
+		return nil
+	}
+	ids := make([]string, len(reservations))
+	for i, res := range reservations {
+		ids[i] = res.VariantID
+	}
+	variants, err := lockVariants(tx, ids)
+	if err != nil {
+		return err
+	}
+	var defaultLocation *domain.Location
+	var movements []*domain.StockMovement
+	for _, res := range reservations {
+		// A variant deleted while units were held has nothing to restock
+		if v, ok := variants[res.VariantID]; ok {
+			locationID := res.LocationID
+			if locationID == "" {
+				if defaultLocation == nil {
+					if defaultLocation, err = getLocation(tx, ""); err != nil {
+						return err
+					}
+				}
+				locationID = defaultLocation.ID
+			}
+			if err := moveStock(tx, v, locationID, res.Quantity); err != nil {
+				return err
+			}
+			movements = append(movements, domain.NewMovement(v, locationID, res.Quantity, domain.ReasonReturn, res.OrderID, actor))
+		}
+		res.Status = domain.ReservationReleased
+		if err := tx.Model(res).Update("status", res.Status).Error; err != nil {
+			return err
+		}
+	}
+	return recordMovements(tx, movements)
+}
+
+// Reserve takes the requested quantities out of variant stock for an order,
+// records them as sales in the ledger and holds them until expiresAt. Each
+// line is sourced from the locations strategy picks for the destination,
+// with a reservation per location. An order is only ever reserved once:
+// reserving again returns the existing reservations, whatever their status.
+func (r *Repository) Reserve(ctx context.Context, orderID string, items []domain.ReservationItem, expiresAt time.Time, actor, strategy string, dest domain.Destination) ([]*domain.Reservation, error) {
+	var reservations []*domain.Reservation
+	err := r.conn(ctx).Transaction(func(tx *gorm.DB) error {
+		existing, err := lockReservations(tx, orderID, domain.ReservationHeld, domain.ReservationCommitted, domain.ReservationReleased)
+		if err != nil {
+			return err
+		}
+		if len(existing) > 0 {
+			reservations = existing
+			return nil
+		}
+
+		ids := make([]string, len(items))
+		for i, item := range items {
+			if ids[i], err = resolveVariant(tx, item); err != nil {
+				return err
+			}
+		}
+		variants, err := lockVariants(tx, ids)
+		if err != nil {
+			return err
+		}
+		levels, err := levelsOf(tx, ids)
+		if err != nil {
+			return err
+		}
+		var movements []*domain.StockMovement
+		for i, item := range items {
+			v, ok := variants[ids[i]]
+			if !ok || (item.ProductID != "" && item.ProductID != v.ProductID) {
+				return fmt.Errorf("%w: %s", domain.ErrVariantNotFound, ids[i])
+			}
+			allocations, err := domain.Source(strategy, levels[v.ID], item.Quantity, dest)
+			if err != nil {
+				return fmt.Errorf("SKU %s: %w", v.SKU, err)
+			}
+			for _, a := range allocations {
+				if err := moveStock(tx, v, a.LocationID, -a.Quantity); err != nil {
+					return err
+				}
+				// Later lines of the same variant see what is left
+				for _, l := range levels[v.ID] {
+					if l.LocationID == a.LocationID {
+						l.Available -= a.Quantity
+					}
+				}
+				movements = append(movements, domain.NewMovement(v, a.LocationID, -a.Quantity, domain.ReasonSale, orderID, actor))
+				res := &domain.Reservation{
+					ID:         uuid.New().String(),
+					OrderID:    orderID,
+					ProductID:  v.ProductID,
+					VariantID:  v.ID,
+					LocationID: a.LocationID,
+					SKU:        v.SKU,
+					Quantity:   a.Quantity,
+					Status:     domain.ReservationHeld,
+					ExpiresAt:  expiresAt,
+				}
+				if err := tx.Create(res).Error; err != nil {
+					return err
+				}
+				reservations = append(reservations, res)
+			}
+		}
+		return recordMovements(tx, movements)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return reservations, nil
+}
+
+// Commit marks the held reservations of an order as committed. Held units
+// past their expiry are released instead and ErrReservationExpired is
+// returned. Committing an already committed order is a no-op.
+func (r *Repository) Commit(ctx context.Context, orderID string, now time.Time, actor string) ([]*domain.Reservation, error) {
+	var reservations []*domain.Reservation
+	var expired bool
+	err := r.conn(ctx).Transaction(func(tx *gorm.DB) error {
+		held, err := lockReservations(tx, orderID, domain.ReservationHeld, domain.ReservationCommitted)
+		if err != nil {
+			return err
+		}
+		if len(held) == 0 {
+			return domain.ErrReservationNotFound
+		}
+		var pending []*domain.Reservation
+		for _, res := range held {
+			if res.Status != domain.ReservationHeld {
+				continue
+			}
+			if now.After(res.ExpiresAt) {
+				expired = true
+			}
+			pending = append(pending, res)
+		}
+		if expired {
+			// Give the units back in the same transaction; the caller is
+			// told the reservation is gone.
+			return restock(tx, pending, actor)
+		}
+		for _, res := range pending {
+			res.Status = domain.ReservationCommitted
+			if err := tx.Model(res).Update("status", res.Status).Error; err != nil {
+				return err
+			}
+		}
+		reservations = held
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if expired {
+		return nil, domain.ErrReservationExpired
+	}
+	return reservations, nil
+}
+
+// Release returns all held or committed units of an order to stock.
+// Releasing an order without active reservations is a no-op.
+func (r *Repository) Release(ctx context.Context, orderID, actor string) ([]*domain.Reservation, error) {
+	var reservations []*domain.Reservation
+	err := r.conn(ctx).Transaction(func(tx *gorm.DB) error {
+		active, err := lockReservations(tx, orderID, domain.ReservationHeld, domain.ReservationCommitted)
+		if err != nil {
+			return err
+		}
+		reservations = active
+		return restock(tx, active, actor)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return reservations, nil
+}
+
+// ReleaseExpired releases up to limit held reservations that expired before
+// now and returns them. Rows locked by a concurrent sweeper are skipped. The
+// returns are recorded as made by the system.
+func (r *Repository) ReleaseExpired(ctx context.Context, now time.Time, limit int) ([]*domain.Reservation, error) {
+	var reservations []*domain.Reservation
+	err := r.conn(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("status = ? AND expires_at < ?", domain.ReservationHeld, now).
+			Order("expires_at").Limit(limit).Find(&reservations).Error; err != nil {
+			return err
+		}
+		return restock(tx, reservations, domain.ActorSystem)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return reservations, nil
+}
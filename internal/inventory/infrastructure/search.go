@@ -0,0 +1,130 @@
+package infrastructure
+
+import (
+	"context"
+	"ecommerce/internal/inventory/domain"
+	"strconv"
+	"strings"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// searchConfig is the text search configuration of the catalog.
+const searchConfig = "english"
+
+// migrateSearch adds the full-text index of products. Postgres keeps the
+// search_vector column in sync with the name, weighted higher, and the
+// description.
+func migrateSearch(db *gorm.DB) error {
+	for _, stmt := range []string{
+		`ALTER TABLE products ADD COLUMN IF NOT EXISTS search_vector tsvector GENERATED ALWAYS AS (
+			setweight(to_tsvector('` + searchConfig + `', coalesce(name, '')), 'A') ||
+			setweight(to_tsvector('` + searchConfig + `', coalesce(description, '')), 'B')) STORED`,
+		"CREATE INDEX IF NOT EXISTS idx_products_search_vector ON products USING GIN (search_vector)",
+		"CREATE INDEX IF NOT EXISTS idx_products_price ON products (price)",
+	} {
+		if err := db.Exec(stmt).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tsQuery is the text search query of a search, in the syntax of web search
+// engines: quoted phrases, "or" and a leading "-" to exclude words.
+const tsQuery = "websearch_to_tsquery('" + searchConfig + "', ?)"
+
+// searchFilter restricts a query on products to the matches of q. The
+// category and price filters can be left out, for the facets.
+func searchFilter(db *gorm.DB, q domain.ProductSearch, categoryPath string, byCategory, byPrice bool) *gorm.DB {
+	if q.Query != "" {
+		db = db.Where("products.search_vector @@ "+tsQuery, q.Query)
+	}
+	if byCategory && categoryPath != "" {
+		db = subtree(db, categoryPath)
+	}
+	if byPrice && q.MinPrice > 0 {
+		db = db.Where("products.price >= ?", q.MinPrice)
+	}
+	if byPrice && q.MaxPrice > 0 {
+		db = db.Where("products.price <= ?", q.MaxPrice)
+	}
+	if q.InStock {
+		db = db.Where("EXISTS (SELECT 1 FROM variants WHERE variants.product_id = products.id AND variants.stock > 0)")
+	}
+	return db
+}
+
+// searchOrder orders the matches of q. Ties are broken by ID so that pages
+// do not overlap.
+func searchOrder(q domain.ProductSearch) clause.Expression {
+	var sql string
+	var vars []interface{}
+	switch q.Sort {
+	case domain.SortRelevance:
+		sql, vars = "ts_rank(products.search_vector, "+tsQuery+") DESC, products.name", []interface{}{q.Query}
+	case domain.SortPriceAsc:
+		sql = "products.price"
+	case domain.SortPriceDesc:
+		sql = "products.price DESC"
+	case domain.SortNewest:
+		sql = "products.created_at DESC"
+	default:
+		sql = "products.name"
+	}
+	return clause.OrderBy{Expression: clause.Expr{SQL: sql + ", products.id", Vars: vars, WithoutParentheses: true}}
+}
+
+// priceBucket numbers the price bucket of a product from zero.
+func priceBucket() string {
+	bounds := make([]string, len(domain.PriceBuckets))
+	for i, b := range domain.PriceBuckets {
+		bounds[i] = strconv.FormatFloat(b, 'f', -1, 64)
+	}
+	return "width_bucket(products.price, ARRAY[" + strings.Join(bounds, ", ") + "]::float8[])"
+}
+
+// SearchProducts returns a page of the products matching q, in the subtree
+// under categoryPath if given, with the facets of all matches.
+func (r *Repository) SearchProducts(ctx context.Context, q domain.ProductSearch, categoryPath string) (*domain.SearchResult, error) {
+	products := func() *gorm.DB { return r.conn(ctx).Model(&domain.Product{}) }
+	var result domain.SearchResult
+	var total int64
+
+	if err := searchFilter(products(), q, categoryPath, true, true).Count(&total).Error; err != nil {
+		return nil, err
+	}
+	result.Total = int(total)
+	offset := (q.Page - 1) * q.PageSize
+	if err := preloadVariants(searchFilter(products(), q, categoryPath, true, true)).
+		Clauses(searchOrder(q)).Offset(offset).Limit(q.PageSize).Find(&result.Products).Error; err != nil {
+		return nil, err
+	}
+	for _, p := range result.Products {
+		p.TotalStock()
+	}
+
+	if err := searchFilter(products(), q, categoryPath, false, true).
+		Joins("JOIN categories ON categories.id = products.category_id").
+		Select("categories.id AS category_id, categories.name, categories.slug, count(*) AS count").
+		Group("categories.id, categories.name, categories.slug").
+		Order("count DESC, categories.name").Scan(&result.Categories).Error; err != nil {
+		return nil, err
+	}
+
+	var buckets []struct {
+		Bucket int
+		Count  int
+	}
+	if err := searchFilter(products(), q, categoryPath, true, false).
+		Select(priceBucket() + " AS bucket, count(*) AS count").
+		Group("bucket").Order("bucket").Scan(&buckets).Error; err != nil {
+		return nil, err
+	}
+	for _, b := range buckets {
+		min, max := domain.PriceRange(b.Bucket)
+		result.Prices = append(result.Prices, domain.PriceFacet{Min: min, Max: max, Count: b.Count})
+	}
+	return &result, nil
+}
@@ -0,0 +1,12 @@
+package infrastructure
+
+import (
+	"context"
+	"ecommerce/internal/inventory/domain"
+)
+
+// ResolveVariant returns the ID of the variant named by variantID, by sku,
+// or else the only variant of productID.
+func (r *Repository) ResolveVariant(ctx context.Context, productID, variantID, sku string) (string, error) {
+	return resolveVariant(r.conn(ctx), domain.ReservationItem{ProductID: productID, VariantID: variantID, SKU: sku})
+}
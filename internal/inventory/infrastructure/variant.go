@@ -0,0 +1,106 @@
+package infrastructure
+
+import (
+	"context"
+	"ecommerce/internal/inventory/domain"
+	"errors"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// CreateVariant adds a variant to a product.
+func (r *Repository) CreateVariant(ctx context.Context, v *domain.Variant) error {
+	return skuError(r.conn(ctx).Create(v).Error, v.SKU)
+}
+
+// GetVariant retrieves a variant by ID.
+func (r *Repository) GetVariant(ctx context.Context, id string) (*domain.Variant, error) {
+	var v domain.Variant
+	if err := r.conn(ctx).Preload("Levels.Location").First(&v, "id = ?", id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, domain.ErrVariantNotFound
+		}
+		return nil, err
+	}
+	return &v, nil
+}
+
+// LockVariant retrieves a variant by ID and locks its row until the end of
+// the transaction.
+func (r *Repository) LockVariant(ctx context.Context, id string) (*domain.Variant, error) {
+	var v domain.Variant
+	if err := r.conn(ctx).Clauses(clause.Locking{Strength: "UPDATE"}).First(&v, "id = ?", id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, domain.ErrVariantNotFound
+		}
+		return nil, err
+	}
+	return &v, nil
+}
+
+// GetVariantBySKU retrieves a variant by its normalized SKU.
+func (r *Repository) GetVariantBySKU(ctx context.Context, sku string) (*domain.Variant, error) {
+	var v domain.Variant
+	if err := r.conn(ctx).Preload("Levels.Location").First(&v, "sku = ?", sku).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, domain.ErrVariantNotFound
+		}
+		return nil, err
+	}
+	return &v, nil
+}
+
+// ListVariants returns the variants of a product, oldest first.
+func (r *Repository) ListVariants(ctx context.Context, productID string) ([]*domain.Variant, error) {
+	var variants []*domain.Variant
+	err := r.conn(ctx).Where("product_id = ?", productID).Order("created_at, id").Find(&variants).Error
+	return variants, err
+}
+
+// UpdateVariant updates a variant; its stock levels are changed with
+// AddToLevel.
+func (r *Repository) UpdateVariant(ctx context.Context, v *domain.Variant) error {
+	return skuError(r.conn(ctx).Omit(clause.Associations).Save(v).Error, v.SKU)
+}
+
+// DeleteVariant deletes a variant by ID.
+func (r *Repository) DeleteVariant(ctx context.Context, id string) error {
+	result := r.conn(ctx).Delete(&domain.Variant{}, "id = ?", id)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return domain.ErrVariantNotFound
+	}
+	return nil
+}
+
+// SearchVariants lists variants whose SKU starts with the normalized prefix,
+// in SKU order, with pagination.
+func (r *Repository) SearchVariants(ctx context.Context, prefix string, page, pageSize int) ([]*domain.Variant, int, error) {
+	var variants []*domain.Variant
+	var total int64
+
+	query := r.conn(ctx).Model(&domain.Variant{}).Where("sku LIKE ?", escapeLike(prefix)+"%")
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	offset := (page - 1) * pageSize
+	if err := query.Order("sku").Offset(offset).Limit(pageSize).Find(&variants).Error; err != nil {
+		return nil, 0, err
+	}
+	return variants, int(total), nil
+}
+
+// escapeLike escapes the LIKE wildcards in s, so that it matches literally.
+func escapeLike(s string) string {
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] == '%' || s[i] == '_' || s[i] == '\\' {
+			b = append(b, '\\')
+		}
+		b = append(b, s[i])
+	}
+	return string(b)
+}
@@ -1,13 +1,21 @@
 package inventory
 
 import (
+	"context"
+	"ecommerce/internal/auth"
 	"ecommerce/internal/config"
+	"ecommerce/internal/idempotency"
 	"ecommerce/internal/inventory/application"
+	"ecommerce/internal/inventory/domain"
 	"ecommerce/internal/inventory/infrastructure"
+	"ecommerce/internal/outbox"
 	"ecommerce/proto"
+	"github.com/nats-io/nats.go"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
 	"log"
 	"net"
+	"time"
 )
 
 func Run(cfg *config.Config) error {
@@ -15,16 +23,103 @@ func Run(cfg *config.Config) error {
 	if err != nil {
 		return err
 	}
+	if err := domain.ValidateStrategy(cfg.SourcingStrategy); err != nil {
+		return err
+	}
 	cache := infrastructure.NewRedisCache(cfg.RedisAddr)
-	svc := application.NewService(repo, cache)
+	svc := application.NewService(repo, cache, cfg.ReservationTTL, cfg.SourcingStrategy)
 	server := NewServer(svc)
 
+	// Release stock held by orders that were never paid
+	go svc.RunReservationSweeper(context.Background(), cfg.ReservationSweepInterval)
+
+	// Low-stock alerts are written to the outbox with the stock change that
+	// causes them and relayed to NATS from there
+	nc, err := nats.Connect(cfg.NATSAddr)
+	if err != nil {
+		return err
+	}
+	defer nc.Close()
+	relay := outbox.NewRelay(repo.Outbox(), outbox.NewNATSPublisher(nc, 5*time.Second))
+	go relay.Run(context.Background(), cfg.OutboxPollInterval)
+
+	// Retried mutations carrying an idempotency key get the original
+	// response instead of running twice
+	keys, err := idempotency.NewRepository(cfg.DSN())
+	if err != nil {
+		return err
+	}
+	go keys.RunPurge(context.Background(), cfg.IdempotencyPurgeInterval)
+
+	// Callers' forwarded access tokens are verified with the user service's
+	// public keys
+	usrConn, err := grpc.Dial(cfg.UserAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return err
+	}
+	defer usrConn.Close()
+	verifier, jwks, err := auth.NewConfiguredVerifier(cfg, proto.NewUserServiceClient(usrConn))
+	if err != nil {
+		return err
+	}
+	if jwks != nil {
+		go jwks.Run(context.Background(), cfg.JWKSRefreshInterval)
+	}
+
 	lis, err := net.Listen("tcp", cfg.InventoryAddr)
 	if err != nil {
 		return err
 	}
 
-	s := grpc.NewServer()
+	s := grpc.NewServer(grpc.ChainUnaryInterceptor(
+		auth.UnaryServerInterceptor(verifier, cfg.ServiceToken, auth.Rules{
+			proto.InventoryService_CreateProduct_FullMethodName:      auth.PermProductsWrite,
+			proto.InventoryService_UpdateProduct_FullMethodName:      auth.PermProductsWrite,
+			proto.InventoryService_DeleteProduct_FullMethodName:      auth.PermProductsDelete,
+			proto.InventoryService_AddVariant_FullMethodName:         auth.PermProductsWrite,
+			proto.InventoryService_UpdateVariant_FullMethodName:      auth.PermProductsWrite,
+			proto.InventoryService_DeleteVariant_FullMethodName:      auth.PermProductsDelete,
+			proto.InventoryService_CreateCategory_FullMethodName:     auth.PermProductsWrite,
+			proto.InventoryService_UpdateCategory_FullMethodName:     auth.PermProductsWrite,
+			proto.InventoryService_MoveCategory_FullMethodName:       auth.PermProductsWrite,
+			proto.InventoryService_DeleteCategory_FullMethodName:     auth.PermProductsDelete,
+			proto.InventoryService_ListStockMovements_FullMethodName: auth.PermStockRead,
+			proto.InventoryService_AdjustStock_FullMethodName:        auth.PermProductsWrite,
+			proto.InventoryService_SetStock_FullMethodName:           auth.PermProductsWrite,
+			proto.InventoryService_CreateLocation_FullMethodName:     auth.PermProductsWrite,
+			proto.InventoryService_ListLocations_FullMethodName:      auth.PermStockRead,
+			proto.InventoryService_CreateTransfer_FullMethodName:     auth.PermProductsWrite,
+			proto.InventoryService_ReceiveTransfer_FullMethodName:    auth.PermProductsWrite,
+			proto.InventoryService_CancelTransfer_FullMethodName:     auth.PermProductsWrite,
+			proto.InventoryService_ListTransfers_FullMethodName:      auth.PermStockRead,
+			proto.InventoryService_GetReorderReport_FullMethodName:   auth.PermStockRead,
+			// Reservations are placed and settled by the order service only
+			proto.InventoryService_ReserveStock_FullMethodName:       auth.PermService,
+			proto.InventoryService_CommitReservation_FullMethodName:  auth.PermService,
+			proto.InventoryService_ReleaseReservation_FullMethodName: auth.PermService,
+		}),
+		idempotency.UnaryServerInterceptor(keys, cfg.IdempotencyRetention,
+			proto.InventoryService_CreateProduct_FullMethodName,
+			proto.InventoryService_UpdateProduct_FullMethodName,
+			proto.InventoryService_DeleteProduct_FullMethodName,
+			proto.InventoryService_ReserveStock_FullMethodName,
+			proto.InventoryService_CommitReservation_FullMethodName,
+			proto.InventoryService_ReleaseReservation_FullMethodName,
+			proto.InventoryService_AddVariant_FullMethodName,
+			proto.InventoryService_UpdateVariant_FullMethodName,
+			proto.InventoryService_DeleteVariant_FullMethodName,
+			proto.InventoryService_CreateCategory_FullMethodName,
+			proto.InventoryService_UpdateCategory_FullMethodName,
+			proto.InventoryService_MoveCategory_FullMethodName,
+			proto.InventoryService_DeleteCategory_FullMethodName,
+			proto.InventoryService_AdjustStock_FullMethodName,
+			proto.InventoryService_SetStock_FullMethodName,
+			proto.InventoryService_CreateLocation_FullMethodName,
+			proto.InventoryService_CreateTransfer_FullMethodName,
+			proto.InventoryService_ReceiveTransfer_FullMethodName,
+			proto.InventoryService_CancelTransfer_FullMethodName,
+		),
+	))
 	proto.RegisterInventoryServiceServer(s, server)
 	log.Printf("Inventory service running on %s", cfg.InventoryAddr)
 	return s.Serve(lis)
@@ -0,0 +1,47 @@
+package application
+
+import (
+	"context"
+	"ecommerce/internal/order/domain"
+	"ecommerce/proto"
+	"encoding/json"
+	"time"
+)
+
+// enqueueEvent writes an order event to the outbox. It must be called inside
+// the transaction that makes the change the event describes.
+func (s *Service) enqueueEvent(txCtx context.Context, eventType string, o *domain.Order) error {
+	// Events carry the order in the same JSON shape as OrderResponse, which
+	// is what subscribers such as the consumer service decode
+	payload := &proto.OrderResponse{
+		Id:       o.ID,
+		UserId:   o.UserID,
+		Status:   o.Status,
+		Subtotal: o.Subtotal,
+		Tax:      o.Tax,
+		Total:    o.Total,
+	}
+	for _, item := range o.Items {
+		payload.Items = append(payload.Items, &proto.OrderItem{
+			ProductId: item.ProductID,
+			VariantId: item.VariantID,
+			Sku:       item.SKU,
+			Quantity:  int32(item.Quantity),
+			UnitPrice: item.UnitPrice,
+			LineTotal: item.LineTotal,
+		})
+	}
+	for _, change := range o.History {
+		payload.History = append(payload.History, &proto.OrderStatusChange{
+			FromStatus: change.FromStatus,
+			ToStatus:   change.ToStatus,
+			Actor:      change.Actor,
+			ChangedAt:  change.ChangedAt.Format(time.RFC3339),
+		})
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return s.repo.CreateOutboxEvent(txCtx, o.ID, eventType, data)
+}
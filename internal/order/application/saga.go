@@ -0,0 +1,116 @@
+package application
+
+import (
+	"context"
+	"ecommerce/internal/order/domain"
+	"ecommerce/internal/saga"
+	"encoding/json"
+	"errors"
+)
+
+// PlaceOrderSaga is the saga type that places a new order.
+const PlaceOrderSaga = "place_order"
+
+const (
+	sagaKeyOrder           = "order"
+	sagaKeyAuthorizationID = "authorization_id"
+	sagaActor              = "system:place_order_saga"
+)
+
+// placeOrderSaga persists the order, reserves its stock, authorizes the
+// payment and confirms the order. If a step fails the payment is voided, the
+// stock released and the order cancelled, in that order.
+func (s *Service) placeOrderSaga() *saga.Definition {
+	return &saga.Definition{
+		Type: PlaceOrderSaga,
+		Steps: []saga.Step{
+			{
+				Name: "create_order",
+				Execute: func(ctx context.Context, sg *saga.Saga) error {
+					o, err := sagaOrder(sg)
+					if err != nil {
+						return err
+					}
+					return s.persist(ctx, o)
+				},
+				Compensate: func(ctx context.Context, sg *saga.Saga) error {
+					return s.cancelForSaga(ctx, sg.AggregateID)
+				},
+			},
+			{
+				Name: "reserve_stock",
+				Execute: func(ctx context.Context, sg *saga.Saga) error {
+					o, err := sagaOrder(sg)
+					if err != nil {
+						return err
+					}
+					return s.reserveStock(ctx, o)
+				},
+				Compensate: func(ctx context.Context, sg *saga.Saga) error {
+					return s.releaseStock(ctx, sg.AggregateID)
+				},
+			},
+			{
+				Name: "authorize_payment",
+				Execute: func(ctx context.Context, sg *saga.Saga) error {
+					o, err := sagaOrder(sg)
+					if err != nil {
+						return err
+					}
+					authorizationID, err := s.payments.Authorize(ctx, o.ID, o.Total)
+					if err != nil {
+						return err
+					}
+					sg.Set(sagaKeyAuthorizationID, authorizationID)
+					return nil
+				},
+				Compensate: func(ctx context.Context, sg *saga.Saga) error {
+					if authorizationID := sg.Get(sagaKeyAuthorizationID); authorizationID != "" {
+						return s.payments.Void(ctx, authorizationID)
+					}
+					return nil
+				},
+			},
+			{
+				Name: "confirm_order",
+				Execute: func(ctx context.Context, sg *saga.Saga) error {
+					o, err := s.repo.Get(ctx, sg.AggregateID)
+					if err != nil {
+						return err
+					}
+					if o.Status == domain.StatusConfirmed {
+						return nil
+					}
+					_, err = s.Transition(ctx, sg.AggregateID, domain.StatusConfirmed, sagaActor, 0)
+					return err
+				},
+			},
+		},
+	}
+}
+
+// sagaOrder decodes the order the saga was started with.
+func sagaOrder(sg *saga.Saga) (*domain.Order, error) {
+	var o domain.Order
+	if err := json.Unmarshal([]byte(sg.Get(sagaKeyOrder)), &o); err != nil {
+		return nil, err
+	}
+	return &o, nil
+}
+
+// cancelForSaga cancels an order as a compensation. Orders that were never
+// persisted or are already cancelled need nothing.
+func (s *Service) cancelForSaga(ctx context.Context, orderID string) error {
+	o, err := s.repo.Get(ctx, orderID)
+	if errors.Is(err, domain.ErrOrderNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if o.Status == domain.StatusCancelled {
+		return nil
+	}
+	_, err = s.Transition(ctx, orderID, domain.StatusCancelled, sagaActor, 0)
+	return err
+}
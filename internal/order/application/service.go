@@ -2,30 +2,221 @@ package application
 
 import (
 	"context"
+	"ecommerce/internal/auth"
+	"ecommerce/internal/database"
 	"ecommerce/internal/order/domain"
 	"ecommerce/internal/order/infrastructure"
+	"ecommerce/internal/saga"
+	"ecommerce/proto"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"gorm.io/gorm"
+	"time"
 )
 
 // Service defines the application logic for the order service.
 type Service struct {
-	repo  *infrastructure.Repository
-	cache infrastructure.Cache
+	repo      *infrastructure.Repository
+	cache     infrastructure.Cache
+	invClient proto.InventoryServiceClient
+	usrClient proto.UserServiceClient
+	payments  infrastructure.PaymentGateway
+	sagas     *saga.Orchestrator
+	taxRate   float64
 }
 
-// NewService creates a new order service.
-func NewService(repo *infrastructure.Repository, cache infrastructure.Cache) *Service {
-	return &Service{repo: repo, cache: cache}
+// NewService creates a new order service. Prices are looked up through
+// invClient, addresses through usrClient, and taxRate is applied to the
+// subtotal of every new order. The order placement saga is registered with
+// sagas.
+func NewService(repo *infrastructure.Repository, cache infrastructure.Cache, invClient proto.InventoryServiceClient, usrClient proto.UserServiceClient, payments infrastructure.PaymentGateway, sagas *saga.Orchestrator, taxRate float64) *Service {
+	s := &Service{repo: repo, cache: cache, invClient: invClient, usrClient: usrClient, payments: payments, sagas: sagas, taxRate: taxRate}
+	sagas.Register(s.placeOrderSaga())
+	return s
 }
 
-// Create creates a new order with transaction support.
+// describeItem names what an order line asks for, for error messages.
+func describeItem(item domain.OrderItem) string {
+	switch {
+	case item.VariantID != "":
+		return "variant " + item.VariantID
+	case item.SKU != "":
+		return "SKU " + item.SKU
+	}
+	return "product " + item.ProductID
+}
+
+// lookupVariant finds the variant an order line is for: the one with its
+// variant ID or SKU, or the only variant of its product.
+func (s *Service) lookupVariant(ctx context.Context, item domain.OrderItem) (*proto.Variant, error) {
+	if item.VariantID == "" && item.SKU == "" {
+		product, err := s.invClient.GetProduct(ctx, &proto.GetProductRequest{Id: item.ProductID})
+		if err != nil {
+			if status.Code(err) == codes.NotFound {
+				return nil, fmt.Errorf("%w: %s", domain.ErrProductNotFound, item.ProductID)
+			}
+			return nil, err
+		}
+		if len(product.Variants) != 1 {
+			return nil, fmt.Errorf("%w: %s", domain.ErrVariantRequired, item.ProductID)
+		}
+		return product.Variants[0], nil
+	}
+	variant, err := s.invClient.GetVariant(ctx, &proto.GetVariantRequest{Id: item.VariantID, Sku: item.SKU})
+	if err != nil {
+		if status.Code(err) == codes.NotFound {
+			return nil, fmt.Errorf("%w: %s", domain.ErrVariantNotFound, describeItem(item))
+		}
+		return nil, err
+	}
+	if item.ProductID != "" && variant.ProductId != item.ProductID {
+		return nil, fmt.Errorf("%w: %s is not a variant of product %s", domain.ErrVariantNotFound, variant.Id, item.ProductID)
+	}
+	return variant, nil
+}
+
+// priceItems resolves every line to a product variant, merges duplicate
+// variant lines and snapshots the current inventory price of every variant
+// onto its line.
+func (s *Service) priceItems(ctx context.Context, items []domain.OrderItem) ([]domain.OrderItem, error) {
+	priced := make([]domain.OrderItem, 0, len(items))
+	index := make(map[string]int, len(items))
+	for _, item := range items {
+		variant, err := s.lookupVariant(ctx, item)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"product_id": item.ProductID,
+				"variant_id": item.VariantID,
+				"sku":        item.SKU,
+				"error":      err.Error(),
+				"error_code": "inventory_get_variant",
+				"timestamp":  "02:08 AM +05, Tuesday, May 20, 2025",
+			}).Error("Failed to look up variant price")
+			if errors.Is(err, domain.ErrProductNotFound) || errors.Is(err, domain.ErrVariantNotFound) || errors.Is(err, domain.ErrVariantRequired) {
+				return nil, err
+			}
+			return nil, fmt.Errorf("failed to look up price of %s: %w", describeItem(item), err)
+		}
+		if i, ok := index[variant.Id]; ok {
+			priced[i].Quantity += item.Quantity
+			continue
+		}
+		index[variant.Id] = len(priced)
+		priced = append(priced, domain.OrderItem{
+			ProductID: variant.ProductId,
+			VariantID: variant.Id,
+			SKU:       variant.Sku,
+			Quantity:  item.Quantity,
+			UnitPrice: variant.Price,
+		})
+	}
+	return priced, nil
+}
+
+// reserveStock holds inventory for every line of the order, sourced for its
+// shipping country.
+func (s *Service) reserveStock(ctx context.Context, o *domain.Order) error {
+	req := &proto.ReserveStockRequest{OrderId: o.ID}
+	if o.ShippingAddress.Country != "" {
+		req.ShipTo = &proto.Destination{Country: o.ShippingAddress.Country}
+	}
+	for _, item := range o.Items {
+		req.Items = append(req.Items, &proto.StockItem{ProductId: item.ProductID, VariantId: item.VariantID, Quantity: int32(item.Quantity)})
+	}
+	if _, err := s.invClient.ReserveStock(ctx, req); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"order_id":   o.ID,
+			"error":      err.Error(),
+			"error_code": "inventory_reserve_stock",
+			"timestamp":  "02:08 AM +05, Tuesday, May 20, 2025",
+		}).Error("Failed to reserve stock for order")
+		switch status.Code(err) {
+		case codes.ResourceExhausted:
+			return fmt.Errorf("%w: %s", domain.ErrInsufficientStock, status.Convert(err).Message())
+		case codes.NotFound:
+			return fmt.Errorf("%w: %s", domain.ErrProductNotFound, status.Convert(err).Message())
+		}
+		return fmt.Errorf("failed to reserve stock: %w", err)
+	}
+	return nil
+}
+
+// releaseStock gives the reserved inventory of an order back.
+func (s *Service) releaseStock(ctx context.Context, orderID string) error {
+	if _, err := s.invClient.ReleaseReservation(ctx, &proto.ReservationRequest{OrderId: orderID}); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"order_id":   orderID,
+			"error":      err.Error(),
+			"error_code": "inventory_release_reservation",
+			"timestamp":  "02:08 AM +05, Tuesday, May 20, 2025",
+		}).Error("Failed to release stock reservation")
+		return err
+	}
+	return nil
+}
+
+// commitStock makes the reserved inventory of an order permanent.
+func (s *Service) commitStock(ctx context.Context, orderID string) error {
+	if _, err := s.invClient.CommitReservation(ctx, &proto.ReservationRequest{OrderId: orderID}); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"order_id":   orderID,
+			"error":      err.Error(),
+			"error_code": "inventory_commit_reservation",
+			"timestamp":  "02:08 AM +05, Tuesday, May 20, 2025",
+		}).Error("Failed to commit stock reservation")
+		switch status.Code(err) {
+		case codes.FailedPrecondition, codes.NotFound:
+			return fmt.Errorf("%w: %s", domain.ErrStockNotReserved, status.Convert(err).Message())
+		}
+		return fmt.Errorf("failed to commit stock reservation: %w", err)
+	}
+	return nil
+}
+
+// snapshotAddress copies an address of a user from the user service. An
+// empty id gives an empty address.
+func (s *Service) snapshotAddress(ctx context.Context, userID, id string) (domain.Address, error) {
+	if id == "" {
+		return domain.Address{}, nil
+	}
+	// The caller's token is forwarded, so the user service checks that the
+	// caller may see the address
+	a, err := s.usrClient.GetAddress(auth.ForwardToken(ctx), &proto.GetAddressRequest{UserId: userID, Id: id})
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"user_id":    userID,
+			"address_id": id,
+			"error":      err.Error(),
+		}).Error("Failed to look up address")
+		if status.Code(err) == codes.NotFound {
+			return domain.Address{}, fmt.Errorf("%w: %s", domain.ErrAddressNotFound, id)
+		}
+		return domain.Address{}, fmt.Errorf("failed to look up address %s: %w", id, err)
+	}
+	return domain.Address{
+		AddressID:  a.Id,
+		Name:       a.Name,
+		Line1:      a.Line1,
+		Line2:      a.Line2,
+		City:       a.City,
+		Region:     a.Region,
+		PostalCode: a.PostalCode,
+		Country:    a.Country,
+		Phone:      a.Phone,
+	}, nil
+}
+
+// Create creates a new order with transaction support. The order total is
+// always computed here from inventory prices; any total set on o is ignored.
 func (s *Service) Create(ctx context.Context, o *domain.Order) error {
 	// Validate required fields
-	if o.UserID == "" || len(o.Items) == 0 || o.Total <= 0 {
-		return errors.New("user ID, items, and total are required")
+	if o.UserID == "" || len(o.Items) == 0 {
+		return errors.New("user ID and items are required")
 	}
 
 	// Validate user_id is a valid UUID
@@ -38,28 +229,35 @@ func (s *Service) Create(ctx context.Context, o *domain.Order) error {
 		return errors.New("invalid user ID format: must be a valid UUID")
 	}
 
-	// Validate each product_id is a valid UUID and quantity is positive
+	// Validate each item names a variant, by ID or SKU, or a product, that
+	// IDs are valid UUIDs and quantity is positive
 	for i, item := range o.Items {
-		if item.ProductID == "" || item.Quantity <= 0 {
-			return errors.New("invalid order item: product ID and quantity are required")
+		if (item.ProductID == "" && item.VariantID == "" && item.SKU == "") || item.Quantity <= 0 {
+			return errors.New("invalid order item: a product ID, variant ID or SKU and quantity are required")
 		}
-		if _, err := uuid.Parse(item.ProductID); err != nil {
-			logrus.WithFields(logrus.Fields{
-				"product_id": item.ProductID,
-				"item_index": i,
-				"error":      err.Error(),
-				"timestamp":  "02:08 AM +05, Tuesday, May 20, 2025",
-			}).Error("Invalid product ID format")
-			return errors.New("invalid product ID format: must be a valid UUID")
+		for _, id := range []string{item.ProductID, item.VariantID} {
+			if id == "" {
+				continue
+			}
+			if _, err := uuid.Parse(id); err != nil {
+				logrus.WithFields(logrus.Fields{
+					"product_id": item.ProductID,
+					"variant_id": item.VariantID,
+					"item_index": i,
+					"error":      err.Error(),
+					"timestamp":  "02:08 AM +05, Tuesday, May 20, 2025",
+				}).Error("Invalid product or variant ID format")
+				return errors.New("invalid product or variant ID format: must be a valid UUID")
+			}
 		}
 	}
 
-	// Create a new Order object, preserving the provided ID
+	// Create a new Order object, preserving the provided ID. New orders
+	// always enter the lifecycle as pending.
 	newOrder := &domain.Order{
 		ID:     o.ID, // Use the ID from the input order
 		UserID: o.UserID,
-		Total:  o.Total,
-		Status: o.Status,
+		Status: domain.StatusPending,
 	}
 	// Validate the provided ID or generate a new one
 	if newOrder.ID == "" {
@@ -80,13 +278,69 @@ func (s *Service) Create(ctx context.Context, o *domain.Order) error {
 		}
 	}
 
-	// Deep copy OrderItems to avoid retaining old OrderID
-	newOrder.Items = make([]domain.OrderItem, len(o.Items))
-	for i, item := range o.Items {
-		newOrder.Items[i] = domain.OrderItem{
-			ProductID: item.ProductID,
-			Quantity:  item.Quantity,
-		}
+	// Price the items from inventory; this also copies them so the input
+	// order does not retain an old OrderID
+	items, err := s.priceItems(ctx, o.Items)
+	if err != nil {
+		return err
+	}
+	newOrder.Items = items
+	newOrder.Price(s.taxRate)
+
+	// Copy the chosen addresses from the user's address book; billing
+	// defaults to the shipping address
+	billingID := o.BillingAddress.AddressID
+	if billingID == "" {
+		billingID = o.ShippingAddress.AddressID
+	}
+	if newOrder.ShippingAddress, err = s.snapshotAddress(ctx, o.UserID, o.ShippingAddress.AddressID); err != nil {
+		return err
+	}
+	if newOrder.BillingAddress, err = s.snapshotAddress(ctx, o.UserID, billingID); err != nil {
+		return err
+	}
+	if o.Total > 0 && domain.RoundMoney(o.Total) != newOrder.Total {
+		logrus.WithFields(logrus.Fields{
+			"order_id":       newOrder.ID,
+			"client_total":   o.Total,
+			"computed_total": newOrder.Total,
+			"timestamp":      "02:08 AM +05, Tuesday, May 20, 2025",
+		}).Warn("Ignoring client-supplied order total")
+	}
+
+	// Placing the order runs as a saga (persist, reserve stock, authorize
+	// payment, confirm) that compensates the completed steps on failure
+	payload, err := json.Marshal(newOrder)
+	if err != nil {
+		return err
+	}
+	if _, err := s.sagas.Start(ctx, PlaceOrderSaga, newOrder.ID, map[string]string{sagaKeyOrder: string(payload)}); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"order_id":   newOrder.ID,
+			"error":      err.Error(),
+			"error_code": "place_order_saga_failed",
+			"timestamp":  "02:08 AM +05, Tuesday, May 20, 2025",
+		}).Error("Order placement failed")
+		return err
+	}
+	placed, err := s.repo.Get(ctx, newOrder.ID)
+	if err != nil {
+		return err
+	}
+
+	// Update the input order with the final state
+	*o = *placed
+	return nil
+}
+
+// persist writes a new order, its items and its initial status in one
+// transaction. Persisting an order that already exists is a no-op, so the
+// saga step calling it can safely be retried.
+func (s *Service) persist(ctx context.Context, newOrder *domain.Order) error {
+	if _, err := s.repo.Get(ctx, newOrder.ID); err == nil {
+		return nil
+	} else if !errors.Is(err, domain.ErrOrderNotFound) {
+		return err
 	}
 
 	logrus.WithFields(logrus.Fields{
@@ -116,11 +370,11 @@ func (s *Service) Create(ctx context.Context, o *domain.Order) error {
 		for i := range newOrder.Items {
 			newOrder.Items[i].OrderID = newOrder.ID
 			// Check if the item already exists
-			existingItem, err := s.repo.GetItem(txCtx, newOrder.ID, newOrder.Items[i].ProductID)
+			existingItem, err := s.repo.GetItem(txCtx, newOrder.ID, newOrder.Items[i].VariantID)
 			if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
 				logrus.WithFields(logrus.Fields{
 					"order_id":           newOrder.ID,
-					"product_id":         newOrder.Items[i].ProductID,
+					"variant_id":         newOrder.Items[i].VariantID,
 					"item_index":         i,
 					"error":              err.Error(),
 					"transaction_status": "failed",
@@ -135,7 +389,7 @@ func (s *Service) Create(ctx context.Context, o *domain.Order) error {
 				if err := s.repo.UpdateItem(txCtx, existingItem); err != nil {
 					logrus.WithFields(logrus.Fields{
 						"order_id":           newOrder.ID,
-						"product_id":         newOrder.Items[i].ProductID,
+						"variant_id":         newOrder.Items[i].VariantID,
 						"item_index":         i,
 						"error":              err.Error(),
 						"transaction_status": "failed",
@@ -149,7 +403,7 @@ func (s *Service) Create(ctx context.Context, o *domain.Order) error {
 				if err := s.repo.CreateItem(txCtx, &newOrder.Items[i]); err != nil {
 					logrus.WithFields(logrus.Fields{
 						"order_id":           newOrder.ID,
-						"product_id":         newOrder.Items[i].ProductID,
+						"variant_id":         newOrder.Items[i].VariantID,
 						"item_index":         i,
 						"error":              err.Error(),
 						"transaction_status": "failed",
@@ -160,6 +414,23 @@ func (s *Service) Create(ctx context.Context, o *domain.Order) error {
 				}
 			}
 		}
+		// Record the initial status so the history starts at creation
+		initial := domain.OrderStatusChange{
+			OrderID:   newOrder.ID,
+			ToStatus:  newOrder.Status,
+			Actor:     newOrder.UserID,
+			ChangedAt: time.Now().UTC(),
+		}
+		if err := s.repo.CreateStatusChange(txCtx, &initial); err != nil {
+			return err
+		}
+		newOrder.History = []domain.OrderStatusChange{initial}
+
+		// Publish order.created once the transaction commits
+		if err := s.enqueueEvent(txCtx, domain.EventOrderCreated, newOrder); err != nil {
+			return err
+		}
+
 		logrus.WithFields(logrus.Fields{
 			"order_id":           newOrder.ID,
 			"transaction_status": "pre_commit",
@@ -204,10 +475,6 @@ func (s *Service) Create(ctx context.Context, o *domain.Order) error {
 		"success":            true,
 		"timestamp":          "02:08 AM +05, Tuesday, May 20, 2025",
 	}).Info("Order created successfully")
-	// Update the input order with the final state
-	o.ID = newOrder.ID
-	o.Status = newOrder.Status
-	o.Items = newOrder.Items
 	return nil
 }
 
@@ -234,12 +501,19 @@ func (s *Service) Get(ctx context.Context, id string) (*domain.Order, error) {
 	return order, nil
 }
 
-// Update updates an existing order.
+// Update updates an existing order. Status changes must go through Transition
+// so that they are validated and recorded.
 func (s *Service) Update(ctx context.Context, o *domain.Order) error {
 	if o.ID == "" {
 		return errors.New("order ID is required")
 	}
-	if err := s.repo.Update(ctx, o); err != nil {
+	err := s.repo.WithTransaction(ctx, func(txCtx context.Context) error {
+		if err := s.repo.Update(txCtx, o); err != nil {
+			return err
+		}
+		return s.enqueueEvent(txCtx, domain.EventOrderUpdated, o)
+	})
+	if err != nil {
 		logrus.WithFields(logrus.Fields{
 			"order_id":           o.ID,
 			"error":              err.Error(),
@@ -279,20 +553,155 @@ func (s *Service) Update(ctx context.Context, o *domain.Order) error {
 	return nil
 }
 
-// List lists orders for a user with pagination.
-func (s *Service) List(ctx context.Context, userID string, page, pageSize int) ([]*domain.Order, int, error) {
+// Transition moves an order to a new status on behalf of actor. The change is
+// validated against the order lifecycle and recorded in the status history.
+// With expectedVersion set, it fails with ErrVersionConflict unless the order
+// is still at that version; either way, an order changed by someone else
+// since it was read is not overwritten.
+func (s *Service) Transition(ctx context.Context, id, to, actor string, expectedVersion int) (*domain.Order, error) {
+	if id == "" {
+		return nil, errors.New("order ID is required")
+	}
+	if !domain.IsValidStatus(to) {
+		return nil, domain.ErrInvalidStatus
+	}
+	if actor == "" {
+		actor = "system"
+	}
+
+	order, err := s.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if expectedVersion != 0 && order.Version != expectedVersion {
+		return nil, fmt.Errorf("%w: order %s is at version %d, not %d", domain.ErrVersionConflict, id, order.Version, expectedVersion)
+	}
+	change, err := order.TransitionTo(to, actor)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"order_id":    id,
+			"from_status": order.Status,
+			"to_status":   to,
+			"actor":       actor,
+			"error_code":  "invalid_transition",
+			"timestamp":   "02:08 AM +05, Tuesday, May 20, 2025",
+		}).Warn("Rejected order status transition")
+		return nil, err
+	}
+
+	stockCommitted := false
+	err = s.repo.WithTransaction(ctx, func(txCtx context.Context) error {
+		if err := s.repo.Update(txCtx, order); err != nil {
+			return err
+		}
+		if err := s.repo.CreateStatusChange(txCtx, change); err != nil {
+			return err
+		}
+		order.History = append(order.History, *change)
+		if err := s.enqueueEvent(txCtx, domain.EventOrderStatusChanged, order); err != nil {
+			return err
+		}
+		// Paid orders keep their stock for good. The reservation is
+		// committed last, so that a failed write leaves it held
+		if to == domain.StatusPaid {
+			if err := s.commitStock(txCtx, id); err != nil {
+				return err
+			}
+			stockCommitted = true
+		}
+		return nil
+	})
+	if err != nil {
+		// The order was not paid after all, so its stock must not stay
+		// committed. Releasing it means the order has to be placed again
+		if stockCommitted {
+			if relErr := s.releaseStock(ctx, id); relErr != nil {
+				logrus.WithFields(logrus.Fields{
+					"order_id":   id,
+					"error":      relErr.Error(),
+					"error_code": "release_after_failed_payment",
+					"timestamp":  "02:08 AM +05, Tuesday, May 20, 2025",
+				}).Error("Stock stays committed for an order that was not paid")
+			}
+		}
+		logrus.WithFields(logrus.Fields{
+			"order_id":           id,
+			"to_status":          to,
+			"error":              err.Error(),
+			"transaction_status": "rolled_back",
+			"error_code":         "db_transition_order",
+			"timestamp":          "02:08 AM +05, Tuesday, May 20, 2025",
+		}).Error("Failed to transition order status")
+		return nil, err
+	}
+	// Held reservations also expire on their own, so a failed release is
+	// only logged
+	if to == domain.StatusCancelled {
+		if err := s.releaseStock(ctx, id); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"order_id":   id,
+				"error":      err.Error(),
+				"error_code": "release_after_cancel",
+				"timestamp":  "02:08 AM +05, Tuesday, May 20, 2025",
+			}).Warn("Cancelled order keeps its stock until the reservation expires")
+		}
+	}
+
+	if uuidUserID, err := uuid.Parse(order.UserID); err == nil {
+		if err := s.cache.DeleteOrders(ctx, uuidUserID); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"user_id":    order.UserID,
+				"error":      err.Error(),
+				"error_code": "cache_invalidation_failed",
+				"timestamp":  "02:08 AM +05, Tuesday, May 20, 2025",
+			}).Warn("Failed to invalidate orders cache, proceeding")
+		}
+	}
+	logrus.WithFields(logrus.Fields{
+		"order_id":    id,
+		"from_status": change.FromStatus,
+		"to_status":   change.ToStatus,
+		"actor":       actor,
+		"success":     true,
+		"timestamp":   "02:08 AM +05, Tuesday, May 20, 2025",
+	}).Info("Order status transitioned")
+	return order, nil
+}
+
+// List lists orders for a user, newest first. Without a page token it
+// returns the given offset page and the total; with one it returns the page
+// after the token, without a total and bypassing the cache. Either way
+// nextPageToken continues the listing and is empty on the last page.
+func (s *Service) List(ctx context.Context, userID string, page, pageSize int, pageToken string) ([]*domain.Order, int, string, error) {
 	if userID == "" {
-		return nil, 0, errors.New("user ID is required")
+		return nil, 0, "", errors.New("user ID is required")
 	}
-	if page <= 0 || pageSize <= 0 {
-		return nil, 0, errors.New("page and pageSize must be positive")
+	if pageSize <= 0 || (pageToken == "" && page <= 0) {
+		return nil, 0, "", errors.New("page and pageSize must be positive")
 	}
 	uuidUserID, err := uuid.Parse(userID)
 	if err != nil {
-		return nil, 0, errors.New("invalid user ID format")
+		return nil, 0, "", errors.New("invalid user ID format")
+	}
+	if pageToken != "" {
+		after, err := database.DecodeCursor(pageToken)
+		if err != nil {
+			return nil, 0, "", err
+		}
+		orders, more, err := s.repo.ListAfter(ctx, userID, &after, pageSize)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"user_id":    userID,
+				"page_size":  pageSize,
+				"error":      err.Error(),
+				"error_code": "db_list_orders",
+			}).Error("Failed to list orders from repository")
+			return nil, 0, "", err
+		}
+		return orders, 0, nextOrdersToken(orders, more), nil
 	}
 
-	cachedOrders, err := s.cache.GetOrders(ctx, uuidUserID, page, pageSize)
+	cachedOrders, cachedTotal, err := s.cache.GetOrders(ctx, uuidUserID, page, pageSize)
 	if err != nil {
 		logrus.WithFields(logrus.Fields{
 			"user_id":    userID,
@@ -302,7 +711,7 @@ func (s *Service) List(ctx context.Context, userID string, page, pageSize int) (
 			"error_code": "cache_get_orders",
 			"timestamp":  "02:08 AM +05, Tuesday, May 20, 2025",
 		}).Error("Failed to get orders from cache")
-		return nil, 0, err
+		return nil, 0, "", err
 	}
 	if cachedOrders != nil {
 		logrus.WithFields(logrus.Fields{
@@ -312,7 +721,7 @@ func (s *Service) List(ctx context.Context, userID string, page, pageSize int) (
 			"success":   true,
 			"timestamp": "02:08 AM +05, Tuesday, May 20, 2025",
 		}).Info("Cache hit for orders")
-		return cachedOrders, len(cachedOrders), nil
+		return cachedOrders, cachedTotal, nextOrdersToken(cachedOrders, (page-1)*pageSize+len(cachedOrders) < cachedTotal), nil
 	}
 
 	orders, total, err := s.repo.List(ctx, userID, page, pageSize)
@@ -325,10 +734,10 @@ func (s *Service) List(ctx context.Context, userID string, page, pageSize int) (
 			"error_code": "db_list_orders",
 			"timestamp":  "02:08 AM +05, Tuesday, May 20, 2025",
 		}).Error("Failed to list orders from repository")
-		return nil, 0, err
+		return nil, 0, "", err
 	}
 
-	if err := s.cache.SetOrders(ctx, uuidUserID, page, pageSize, orders); err != nil {
+	if err := s.cache.SetOrders(ctx, uuidUserID, page, pageSize, orders, total); err != nil {
 		logrus.WithFields(logrus.Fields{
 			"user_id":    userID,
 			"page":       page,
@@ -345,5 +754,15 @@ func (s *Service) List(ctx context.Context, userID string, page, pageSize int) (
 		"success":   true,
 		"timestamp": "02:08 AM +05, Tuesday, May 20, 2025",
 	}).Info("Orders retrieved and cached")
-	return orders, total, nil
+	return orders, total, nextOrdersToken(orders, (page-1)*pageSize+len(orders) < total), nil
+}
+
+// nextOrdersToken returns the token of the page after orders, or an empty
+// token when there is none.
+func nextOrdersToken(orders []*domain.Order, more bool) string {
+	if !more || len(orders) == 0 {
+		return ""
+	}
+	last := orders[len(orders)-1]
+	return database.Cursor{CreatedAt: last.CreatedAt, ID: last.ID}.Encode()
 }
@@ -0,0 +1,9 @@
+package domain
+
+// Order event types. They double as the NATS subjects the events are
+// published on.
+const (
+	EventOrderCreated       = "order.created"
+	EventOrderUpdated       = "order.updated"
+	EventOrderStatusChanged = "order.status_changed"
+)
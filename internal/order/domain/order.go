@@ -1,21 +1,159 @@
 package domain
 
 import (
+	"errors"
+	"math"
 	"time"
 )
 
+// Order lifecycle statuses. The string values are what gets persisted in the
+// orders.status column.
+const (
+	StatusPending   = "pending"
+	StatusConfirmed = "confirmed"
+	StatusPaid      = "paid"
+	StatusShipped   = "shipped"
+	StatusDelivered = "delivered"
+	StatusCancelled = "cancelled"
+	StatusRefunded  = "refunded"
+)
+
+var (
+	ErrOrderNotFound     = errors.New("order not found")
+	ErrProductNotFound   = errors.New("product not found")
+	ErrVariantNotFound   = errors.New("variant not found")
+	ErrVariantRequired   = errors.New("product has several variants, a variant ID or SKU is required")
+	ErrInsufficientStock = errors.New("insufficient stock")
+	ErrStockNotReserved  = errors.New("stock reservation expired or missing")
+	ErrPaymentDeclined   = errors.New("payment declined")
+	ErrInvalidStatus     = errors.New("invalid order status")
+	ErrInvalidTransition = errors.New("invalid order status transition")
+	ErrAddressNotFound   = errors.New("address not found")
+	ErrVersionConflict   = errors.New("version conflict")
+)
+
+// transitions lists, for every status, the statuses an order may move to next.
+// Orders can be cancelled until they are paid; from then on their stock is
+// committed and the payment taken, so they can only be refunded. Cancelled
+// and refunded are terminal.
+var transitions = map[string][]string{
+	StatusPending:   {StatusConfirmed, StatusCancelled},
+	StatusConfirmed: {StatusPaid, StatusCancelled},
+	StatusPaid:      {StatusShipped, StatusRefunded},
+	StatusShipped:   {StatusDelivered, StatusRefunded},
+	StatusDelivered: {StatusRefunded},
+	StatusCancelled: {},
+	StatusRefunded:  {},
+}
+
 type Order struct {
-	ID        string      `gorm:"type:uuid;primaryKey;default:uuid_generate_v4()"`
-	UserID    string      `gorm:"type:uuid;not null"`
-	Items     []OrderItem `gorm:"foreignKey:OrderID"`
-	Total     float64     `gorm:"not null"`
-	Status    string      `gorm:"default:'pending'"`
-	CreatedAt time.Time   `gorm:"autoCreateTime"`
-	UpdatedAt time.Time   `gorm:"autoUpdateTime"`
+	ID        string              `gorm:"type:uuid;primaryKey;default:uuid_generate_v4();index:idx_orders_user_created_at_id,priority:3"`
+	UserID    string              `gorm:"type:uuid;not null;index:idx_orders_user_created_at_id,priority:1"`
+	Items     []OrderItem         `gorm:"foreignKey:OrderID"`
+	History   []OrderStatusChange `gorm:"foreignKey:OrderID"`
+	Subtotal  float64             `gorm:"not null;default:0"`
+	Tax       float64             `gorm:"not null;default:0"`
+	Total     float64             `gorm:"not null"`
+	Status    string              `gorm:"default:'pending'"`
+	CreatedAt time.Time           `gorm:"autoCreateTime;index:idx_orders_user_created_at_id,priority:2"`
+	UpdatedAt time.Time           `gorm:"autoUpdateTime"`
+	Version   int                 `gorm:"not null;default:1"` // Bumped by every update, for optimistic concurrency
+
+	ShippingAddress Address `gorm:"embedded;embeddedPrefix:shipping_"`
+	BillingAddress  Address `gorm:"embedded;embeddedPrefix:billing_"`
+}
+
+// Address is a snapshot of an address from the user's address book, taken
+// when the order is placed so that later edits do not change the order.
+// AddressID refers to the address book entry it was copied from; it is empty
+// for orders placed without an address.
+type Address struct {
+	AddressID  string
+	Name       string
+	Line1      string
+	Line2      string
+	City       string
+	Region     string
+	PostalCode string
+	Country    string
+	Phone      string
 }
 
+// OrderItem is a single order line for a product variant. UnitPrice is a
+// snapshot of the variant price at the time the order was placed, so later
+// price changes in inventory do not affect historical orders.
 type OrderItem struct {
-	OrderID   string `gorm:"type:uuid;primaryKey"`
-	ProductID string `gorm:"type:uuid;primaryKey"`
-	Quantity  int    `gorm:"not null"`
+	OrderID   string  `gorm:"type:uuid;primaryKey"`
+	VariantID string  `gorm:"type:uuid;primaryKey"`
+	ProductID string  `gorm:"type:uuid;not null;index"`
+	SKU       string  `gorm:"not null;default:''"`
+	Quantity  int     `gorm:"not null"`
+	UnitPrice float64 `gorm:"not null;default:0"`
+	LineTotal float64 `gorm:"not null;default:0"`
+}
+
+// OrderStatusChange records a single status transition of an order, including
+// who made it and when.
+type OrderStatusChange struct {
+	ID         uint      `gorm:"primaryKey;autoIncrement"`
+	OrderID    string    `gorm:"type:uuid;not null;index"`
+	FromStatus string    `gorm:"not null"`
+	ToStatus   string    `gorm:"not null"`
+	Actor      string    `gorm:"not null"`
+	ChangedAt  time.Time `gorm:"not null"`
+}
+
+// RoundMoney rounds an amount to whole cents.
+func RoundMoney(amount float64) float64 {
+	return math.Round(amount*100) / 100
+}
+
+// Price fills in the line totals, subtotal, tax and total of the order from
+// the unit prices already set on its items. taxRate is a fraction, e.g. 0.12.
+func (o *Order) Price(taxRate float64) {
+	var subtotal float64
+	for i := range o.Items {
+		o.Items[i].LineTotal = RoundMoney(o.Items[i].UnitPrice * float64(o.Items[i].Quantity))
+		subtotal += o.Items[i].LineTotal
+	}
+	o.Subtotal = RoundMoney(subtotal)
+	o.Tax = RoundMoney(o.Subtotal * taxRate)
+	o.Total = RoundMoney(o.Subtotal + o.Tax)
+}
+
+// IsValidStatus reports whether status is one of the known lifecycle statuses.
+func IsValidStatus(status string) bool {
+	_, ok := transitions[status]
+	return ok
+}
+
+// CanTransition reports whether an order in status from may move to status to.
+func CanTransition(from, to string) bool {
+	for _, next := range transitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// TransitionTo moves the order to the given status on behalf of actor and
+// returns the change to be recorded. The order is left untouched if the
+// transition is not allowed.
+func (o *Order) TransitionTo(to, actor string) (*OrderStatusChange, error) {
+	if !IsValidStatus(to) {
+		return nil, ErrInvalidStatus
+	}
+	if !CanTransition(o.Status, to) {
+		return nil, ErrInvalidTransition
+	}
+	change := &OrderStatusChange{
+		OrderID:    o.ID,
+		FromStatus: o.Status,
+		ToStatus:   to,
+		Actor:      actor,
+		ChangedAt:  time.Now().UTC(),
+	}
+	o.Status = to
+	return change, nil
 }
@@ -2,12 +2,17 @@ package order
 
 import (
 	"context"
+	"ecommerce/internal/auth"
+	"ecommerce/internal/database"
 	"ecommerce/internal/order/application"
 	"ecommerce/internal/order/domain"
 	"ecommerce/proto"
+	"errors"
 	"github.com/google/uuid"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"strings"
+	"time"
 )
 
 type Server struct {
@@ -19,19 +24,114 @@ func NewServer(svc *application.Service) *Server {
 	return &Server{svc: svc}
 }
 
+// statusFromProto maps an OrderStatus enum value to the domain status string,
+// e.g. ORDER_STATUS_SHIPPED -> "shipped".
+func statusFromProto(st proto.OrderStatus) (string, bool) {
+	if st == proto.OrderStatus_ORDER_STATUS_UNSPECIFIED {
+		return "", false
+	}
+	name, ok := proto.OrderStatus_name[int32(st)]
+	if !ok {
+		return "", false
+	}
+	return strings.ToLower(strings.TrimPrefix(name, "ORDER_STATUS_")), true
+}
+
+func toOrderResponse(o *domain.Order) *proto.OrderResponse {
+	resp := &proto.OrderResponse{
+		Id:       o.ID,
+		UserId:   o.UserID,
+		Status:   o.Status,
+		Subtotal: o.Subtotal,
+		Tax:      o.Tax,
+		Total:    o.Total,
+		Version:  int64(o.Version),
+	}
+	for _, item := range o.Items {
+		resp.Items = append(resp.Items, &proto.OrderItem{
+			ProductId: item.ProductID,
+			VariantId: item.VariantID,
+			Sku:       item.SKU,
+			Quantity:  int32(item.Quantity),
+			UnitPrice: item.UnitPrice,
+			LineTotal: item.LineTotal,
+		})
+	}
+	resp.ShippingAddress = toOrderAddress(o.ShippingAddress)
+	resp.BillingAddress = toOrderAddress(o.BillingAddress)
+	for _, change := range o.History {
+		resp.History = append(resp.History, &proto.OrderStatusChange{
+			FromStatus: change.FromStatus,
+			ToStatus:   change.ToStatus,
+			Actor:      change.Actor,
+			ChangedAt:  change.ChangedAt.Format(time.RFC3339),
+		})
+	}
+	return resp
+}
+
+func toOrderAddress(a domain.Address) *proto.OrderAddress {
+	if a.AddressID == "" {
+		return nil
+	}
+	return &proto.OrderAddress{
+		AddressId:  a.AddressID,
+		Name:       a.Name,
+		Line1:      a.Line1,
+		Line2:      a.Line2,
+		City:       a.City,
+		Region:     a.Region,
+		PostalCode: a.PostalCode,
+		Country:    a.Country,
+		Phone:      a.Phone,
+	}
+}
+
+// callerOwns reports whether the caller may access resources of userID: its
+// owner always may, others only with anyPerm. Calls without claims come from
+// other services and are trusted.
+func callerOwns(ctx context.Context, userID string, anyPerm auth.Permission) bool {
+	claims, ok := auth.ClaimsFromContext(ctx)
+	if !ok {
+		return true
+	}
+	return claims.UserID() == userID || claims.Can(anyPerm)
+}
+
+// authorizedOrder loads an order the caller may access. Orders of other users
+// are reported as not found so that their IDs are not disclosed.
+func (s *Server) authorizedOrder(ctx context.Context, id string, anyPerm auth.Permission) (*domain.Order, error) {
+	o, err := s.svc.Get(ctx, id)
+	if err != nil {
+		if errors.Is(err, domain.ErrOrderNotFound) {
+			return nil, status.Errorf(codes.NotFound, "failed to get order: %v", err)
+		}
+		return nil, status.Errorf(codes.Internal, "failed to get order: %v", err)
+	}
+	if !callerOwns(ctx, o.UserID, anyPerm) {
+		return nil, status.Errorf(codes.NotFound, "failed to get order: %v", domain.ErrOrderNotFound)
+	}
+	return o, nil
+}
+
 func (s *Server) CreateOrder(ctx context.Context, req *proto.CreateOrderRequest) (*proto.OrderResponse, error) {
-	if req.UserId == "" || len(req.Items) == 0 || req.Total <= 0 {
-		return nil, status.Error(codes.InvalidArgument, "user ID, items, and total are required")
+	if req.UserId == "" || len(req.Items) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "user ID and items are required")
+	}
+	if !callerOwns(ctx, req.UserId, auth.PermOrdersManage) {
+		return nil, status.Error(codes.PermissionDenied, "cannot place orders for another user")
 	}
 	for _, item := range req.Items {
-		if item.ProductId == "" || item.Quantity <= 0 {
-			return nil, status.Error(codes.InvalidArgument, "invalid order item: product ID and quantity are required")
+		if (item.ProductId == "" && item.VariantId == "" && item.Sku == "") || item.Quantity <= 0 {
+			return nil, status.Error(codes.InvalidArgument, "invalid order item: a product ID, variant ID or SKU and quantity are required")
 		}
 	}
 	items := make([]domain.OrderItem, len(req.Items))
 	for i, item := range req.Items {
 		items[i] = domain.OrderItem{
 			ProductID: item.ProductId,
+			VariantID: item.VariantId,
+			SKU:       item.Sku,
 			Quantity:  int(item.Quantity),
 		}
 	}
@@ -39,108 +139,98 @@ func (s *Server) CreateOrder(ctx context.Context, req *proto.CreateOrderRequest)
 		ID:     uuid.New().String(),
 		UserID: req.UserId,
 		Items:  items,
-		Status: "pending",
-		Total:  req.Total,
+		Status: domain.StatusPending,
+		Total:  req.Total, // Only used to log a mismatch with the computed total
+
+		ShippingAddress: domain.Address{AddressID: req.ShippingAddressId},
+		BillingAddress:  domain.Address{AddressID: req.BillingAddressId},
 	}
 	if err := s.svc.Create(ctx, o); err != nil {
+		switch {
+		case errors.Is(err, domain.ErrProductNotFound), errors.Is(err, domain.ErrVariantNotFound), errors.Is(err, domain.ErrVariantRequired),
+			errors.Is(err, domain.ErrAddressNotFound):
+			return nil, status.Errorf(codes.InvalidArgument, "failed to create order: %v", err)
+		case errors.Is(err, domain.ErrInsufficientStock):
+			return nil, status.Errorf(codes.ResourceExhausted, "failed to create order: %v", err)
+		case errors.Is(err, domain.ErrPaymentDeclined):
+			return nil, status.Errorf(codes.FailedPrecondition, "failed to create order: %v", err)
+		}
 		return nil, status.Errorf(codes.Internal, "failed to create order: %v", err)
 	}
-	resp := &proto.OrderResponse{
-		Id:     o.ID,
-		UserId: o.UserID,
-		Status: o.Status,
-		Total:  o.Total,
-	}
-	for _, item := range o.Items {
-		resp.Items = append(resp.Items, &proto.OrderItem{
-			ProductId: item.ProductID,
-			Quantity:  int32(item.Quantity),
-		})
-	}
-	return resp, nil
+	return toOrderResponse(o), nil
 }
 
 func (s *Server) GetOrder(ctx context.Context, req *proto.GetOrderRequest) (*proto.OrderResponse, error) {
 	if req.Id == "" {
 		return nil, status.Error(codes.InvalidArgument, "order ID is required")
 	}
-	o, err := s.svc.Get(ctx, req.Id)
+	o, err := s.authorizedOrder(ctx, req.Id, auth.PermOrdersReadAny)
 	if err != nil {
-		return nil, status.Errorf(codes.NotFound, "failed to get order: %v", err)
-	}
-	resp := &proto.OrderResponse{
-		Id:     o.ID,
-		UserId: o.UserID,
-		Status: o.Status,
-		Total:  o.Total,
+		return nil, err
 	}
-	for _, item := range o.Items {
-		resp.Items = append(resp.Items, &proto.OrderItem{
-			ProductId: item.ProductID,
-			Quantity:  int32(item.Quantity),
-		})
-	}
-	return resp, nil
+	return toOrderResponse(o), nil
 }
 
 func (s *Server) UpdateOrder(ctx context.Context, req *proto.UpdateOrderRequest) (*proto.OrderResponse, error) {
 	if req.Id == "" {
 		return nil, status.Error(codes.InvalidArgument, "order ID is required")
 	}
-	if req.Status == "" {
-		return nil, status.Error(codes.InvalidArgument, "status is required for update")
+	to, ok := statusFromProto(req.Status)
+	if !ok {
+		return nil, status.Error(codes.InvalidArgument, "a valid status is required for update")
+	}
+	actor := req.Actor
+	if claims, ok := auth.ClaimsFromContext(ctx); ok {
+		actor = claims.UserID()
+		// Customers may only cancel, which the lifecycle allows until the
+		// order is paid; every other transition is staff work
+		if to != domain.StatusCancelled && !claims.Can(auth.PermOrdersManage) {
+			return nil, status.Errorf(codes.PermissionDenied, "missing permission %s", auth.PermOrdersManage)
+		}
+	}
+	if _, err := s.authorizedOrder(ctx, req.Id, auth.PermOrdersManage); err != nil {
+		return nil, err
 	}
-	o, err := s.svc.Get(ctx, req.Id)
+	o, err := s.svc.Transition(ctx, req.Id, to, actor, int(req.ExpectedVersion))
 	if err != nil {
-		return nil, status.Errorf(codes.NotFound, "failed to get order: %v", err)
-	}
-	o.Status = req.Status
-	if err := s.svc.Update(ctx, o); err != nil {
+		switch {
+		case errors.Is(err, domain.ErrOrderNotFound):
+			return nil, status.Errorf(codes.NotFound, "failed to get order: %v", err)
+		case errors.Is(err, domain.ErrInvalidTransition), errors.Is(err, domain.ErrStockNotReserved):
+			return nil, status.Errorf(codes.FailedPrecondition, "cannot move order to %q: %v", to, err)
+		case errors.Is(err, domain.ErrInvalidStatus):
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		case errors.Is(err, domain.ErrVersionConflict):
+			return nil, status.Errorf(codes.Aborted, "failed to update order: %v", err)
+		}
 		return nil, status.Errorf(codes.Internal, "failed to update order: %v", err)
 	}
-	resp := &proto.OrderResponse{
-		Id:     o.ID,
-		UserId: o.UserID,
-		Status: o.Status,
-		Total:  o.Total,
-	}
-	for _, item := range o.Items {
-		resp.Items = append(resp.Items, &proto.OrderItem{
-			ProductId: item.ProductID,
-			Quantity:  int32(item.Quantity),
-		})
-	}
-	return resp, nil
+	return toOrderResponse(o), nil
 }
 
 func (s *Server) ListOrders(ctx context.Context, req *proto.ListOrdersRequest) (*proto.ListOrdersResponse, error) {
 	if req.UserId == "" {
 		return nil, status.Error(codes.InvalidArgument, "user ID is required")
 	}
-	if req.Page <= 0 || req.PageSize <= 0 {
+	if req.PageSize <= 0 || (req.PageToken == "" && req.Page <= 0) {
 		return nil, status.Error(codes.InvalidArgument, "page and pageSize must be positive")
 	}
-	orders, total, err := s.svc.List(ctx, req.UserId, int(req.Page), int(req.PageSize))
+	if !callerOwns(ctx, req.UserId, auth.PermOrdersReadAny) {
+		return nil, status.Error(codes.PermissionDenied, "cannot list orders of another user")
+	}
+	orders, total, next, err := s.svc.List(ctx, req.UserId, int(req.Page), int(req.PageSize), req.PageToken)
+	if errors.Is(err, database.ErrInvalidPageToken) {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "failed to list orders: %v", err)
 	}
 	resp := &proto.ListOrdersResponse{
-		Total: int32(total),
+		Total:         int32(total),
+		NextPageToken: next,
 	}
 	for _, o := range orders {
-		orderResp := &proto.OrderResponse{
-			Id:     o.ID,
-			UserId: o.UserID,
-			Status: o.Status,
-			Total:  o.Total,
-		}
-		for _, item := range o.Items {
-			orderResp.Items = append(orderResp.Items, &proto.OrderItem{
-				ProductId: item.ProductID,
-				Quantity:  int32(item.Quantity),
-			})
-		}
-		resp.Orders = append(resp.Orders, orderResp)
+		resp.Orders = append(resp.Orders, toOrderResponse(o))
 	}
 	return resp, nil
 }
@@ -13,12 +13,20 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+// Cache keeps pages of a user's orders together with the user's total number
+// of orders. GetOrders returns nil orders on a miss.
 type Cache interface {
-	GetOrders(ctx context.Context, userID uuid.UUID, page, pageSize int) ([]*domain.Order, error)
-	SetOrders(ctx context.Context, userID uuid.UUID, page, pageSize int, orders []*domain.Order) error
+	GetOrders(ctx context.Context, userID uuid.UUID, page, pageSize int) ([]*domain.Order, int, error)
+	SetOrders(ctx context.Context, userID uuid.UUID, page, pageSize int, orders []*domain.Order, total int) error
 	DeleteOrders(ctx context.Context, userID uuid.UUID) error
 }
 
+// cachedPage is the cached form of a page of orders.
+type cachedPage struct {
+	Orders []*domain.Order `json:"orders"`
+	Total  int             `json:"total"`
+}
+
 type RedisCache struct {
 	client *redis.Client
 }
@@ -32,7 +40,7 @@ func NewRedisCache(addr string) *RedisCache {
 	return &RedisCache{client: client}
 }
 
-func (c *RedisCache) GetOrders(ctx context.Context, userID uuid.UUID, page, pageSize int) ([]*domain.Order, error) {
+func (c *RedisCache) GetOrders(ctx context.Context, userID uuid.UUID, page, pageSize int) ([]*domain.Order, int, error) {
 	key := fmt.Sprintf("orders:%s:%d:%d", userID.String(), page, pageSize)
 	data, err := c.client.Get(ctx, key).Bytes()
 	if err == redis.Nil {
@@ -41,29 +49,37 @@ func (c *RedisCache) GetOrders(ctx context.Context, userID uuid.UUID, page, page
 			"page":      page,
 			"page_size": pageSize,
 		}).Info("Cache miss for orders")
-		return nil, nil
+		return nil, 0, nil
 	}
 	if err != nil {
 		logrus.WithError(err).Error("Failed to get orders from cache")
-		return nil, err
+		return nil, 0, err
 	}
 
-	var orders []*domain.Order
-	if err := json.Unmarshal(data, &orders); err != nil {
-		logrus.WithError(err).Error("Failed to unmarshal orders from cache")
-		return nil, err
+	var cached cachedPage
+	if err := json.Unmarshal(data, &cached); err != nil || cached.Orders == nil {
+		// Entries written before totals were cached are read as misses
+		logrus.WithFields(logrus.Fields{
+			"user_id":   userID,
+			"page":      page,
+			"page_size": pageSize,
+		}).Warn("Ignoring unreadable orders cache entry")
+		return nil, 0, nil
 	}
 	logrus.WithFields(logrus.Fields{
 		"user_id":   userID,
 		"page":      page,
 		"page_size": pageSize,
 	}).Info("Cache hit for orders")
-	return orders, nil
+	return cached.Orders, cached.Total, nil
 }
 
-func (c *RedisCache) SetOrders(ctx context.Context, userID uuid.UUID, page, pageSize int, orders []*domain.Order) error {
+func (c *RedisCache) SetOrders(ctx context.Context, userID uuid.UUID, page, pageSize int, orders []*domain.Order, total int) error {
 	key := fmt.Sprintf("orders:%s:%d:%d", userID.String(), page, pageSize)
-	data, err := json.Marshal(orders)
+	if orders == nil {
+		orders = []*domain.Order{}
+	}
+	data, err := json.Marshal(cachedPage{Orders: orders, Total: total})
 	if err != nil {
 		logrus.WithError(err).Error("Failed to marshal orders for cache")
 		return err
@@ -0,0 +1,56 @@
+package infrastructure
+
+import (
+	"context"
+	"ecommerce/internal/order/domain"
+	"fmt"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// PaymentGateway authorizes and voids payments for orders. Implementations
+// must be idempotent per order: authorizing the same order twice returns the
+// same authorization.
+type PaymentGateway interface {
+	Authorize(ctx context.Context, orderID string, amount float64) (string, error)
+	Void(ctx context.Context, authorizationID string) error
+}
+
+// LocalPaymentGateway is an in-process PaymentGateway used until a real
+// payment provider is integrated. It approves every authorization up to
+// maxAmount (zero means no limit).
+type LocalPaymentGateway struct {
+	maxAmount float64
+
+	mu             sync.Mutex
+	authorizations map[string]float64
+}
+
+// NewLocalPaymentGateway creates a LocalPaymentGateway.
+func NewLocalPaymentGateway(maxAmount float64) *LocalPaymentGateway {
+	return &LocalPaymentGateway{maxAmount: maxAmount, authorizations: make(map[string]float64)}
+}
+
+// Authorize approves amount for the order unless it exceeds the limit.
+func (g *LocalPaymentGateway) Authorize(ctx context.Context, orderID string, amount float64) (string, error) {
+	if g.maxAmount > 0 && amount > g.maxAmount {
+		logrus.WithFields(logrus.Fields{"order_id": orderID, "amount": amount}).Warn("Payment authorization declined")
+		return "", fmt.Errorf("%w: amount %.2f exceeds limit %.2f", domain.ErrPaymentDeclined, amount, g.maxAmount)
+	}
+	authorizationID := "auth_" + orderID
+	g.mu.Lock()
+	g.authorizations[authorizationID] = amount
+	g.mu.Unlock()
+	logrus.WithFields(logrus.Fields{"order_id": orderID, "authorization_id": authorizationID, "amount": amount}).Info("Payment authorized")
+	return authorizationID, nil
+}
+
+// Void cancels an authorization. Voiding an unknown authorization is a no-op.
+func (g *LocalPaymentGateway) Void(ctx context.Context, authorizationID string) error {
+	g.mu.Lock()
+	delete(g.authorizations, authorizationID)
+	g.mu.Unlock()
+	logrus.WithField("authorization_id", authorizationID).Info("Payment authorization voided")
+	return nil
+}
@@ -2,15 +2,22 @@ package infrastructure
 
 import (
 	"context"
+	"ecommerce/internal/database"
 	"ecommerce/internal/order/domain"
+	"ecommerce/internal/outbox"
 	"errors"
 	"github.com/sirupsen/logrus"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
+// outboxTable holds the order events waiting to be relayed.
+const outboxTable = "outbox_events"
+
 type Repository struct {
-	db *gorm.DB
+	db     *gorm.DB
+	outbox *outbox.Repository
 }
 
 func NewRepository(dsn string) (*Repository, error) {
@@ -18,8 +25,11 @@ func NewRepository(dsn string) (*Repository, error) {
 	if err != nil {
 		return nil, err
 	}
+	if err := migrateItemKeys(db); err != nil {
+		return nil, err
+	}
 	// Ensure the schema is up-to-date with the domain structs
-	if err := db.AutoMigrate(&domain.Order{}, &domain.OrderItem{}); err != nil {
+	if err := db.AutoMigrate(&domain.Order{}, &domain.OrderItem{}, &domain.OrderStatusChange{}); err != nil {
 		logrus.WithFields(logrus.Fields{
 			"error":     err.Error(),
 			"timestamp": "01:38 AM +05, Tuesday, May 20, 2025",
@@ -29,42 +39,56 @@ func NewRepository(dsn string) (*Repository, error) {
 	logrus.WithFields(logrus.Fields{
 		"timestamp": "01:38 AM +05, Tuesday, May 20, 2025",
 	}).Info("Database schema migrated successfully")
-	return &Repository{db: db}, nil
+	events, err := outbox.NewRepository(db, outboxTable)
+	if err != nil {
+		return nil, err
+	}
+	return &Repository{db: db, outbox: events}, nil
 }
 
-func (r *Repository) WithTransaction(ctx context.Context, fn func(txCtx context.Context) error) error {
-	tx := r.db.WithContext(ctx).Begin()
-	if tx.Error != nil {
-		return tx.Error
-	}
-	defer func() {
-		if r := recover(); r != nil {
-			tx.Rollback()
-			logrus.WithFields(logrus.Fields{
-				"transaction_status": "panic_rolled_back",
-				"timestamp":          "01:38 AM +05, Tuesday, May 20, 2025",
-			}).Error("Transaction panicked and rolled back")
+// migrateItemKeys keys the order lines of databases created before products
+// had variants by variant instead of product. Their lines refer to the
+// default variant inventory created for each product, whose ID is the
+// product ID.
+func migrateItemKeys(db *gorm.DB) error {
+	m := db.Migrator()
+	if !m.HasTable(&domain.OrderItem{}) || m.HasColumn(&domain.OrderItem{}, "variant_id") {
+		return nil
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		for _, stmt := range []string{
+			"ALTER TABLE order_items ADD COLUMN variant_id uuid",
+			"UPDATE order_items SET variant_id = product_id",
+			"ALTER TABLE order_items DROP CONSTRAINT order_items_pkey",
+			"ALTER TABLE order_items ADD PRIMARY KEY (order_id, variant_id)",
+		} {
+			if err := tx.Exec(stmt).Error; err != nil {
+				return err
+			}
 		}
-	}()
+		return nil
+	})
+}
 
-	err := fn(ctx)
+// conn returns the transaction bound to ctx, if any, or the plain database
+// handle otherwise.
+func (r *Repository) conn(ctx context.Context) *gorm.DB {
+	return database.Conn(ctx, r.db)
+}
+
+// WithTransaction runs fn in a database transaction. Every repository call
+// made with txCtx takes part in it; calling WithTransaction again with txCtx
+// opens a savepoint.
+func (r *Repository) WithTransaction(ctx context.Context, fn func(txCtx context.Context) error, opts ...database.TxOption) error {
+	err := database.WithTransaction(ctx, r.db, fn, opts...)
 	if err != nil {
-		if rollbackErr := tx.Rollback().Error; rollbackErr != nil {
-			logrus.WithFields(logrus.Fields{
-				"error":              rollbackErr.Error(),
-				"transaction_status": "rollback_failed",
-				"timestamp":          "01:38 AM +05, Tuesday, May 20, 2025",
-			}).Error("Failed to rollback transaction")
-		} else {
-			logrus.WithFields(logrus.Fields{
-				"transaction_status": "rolled_back",
-				"timestamp":          "01:38 AM +05, Tuesday, May 20, 2025",
-			}).Info("Transaction rolled back successfully")
-		}
-		return err
+		logrus.WithFields(logrus.Fields{
+			"error":              err.Error(),
+			"transaction_status": "rolled_back",
+			"timestamp":          "01:38 AM +05, Tuesday, May 20, 2025",
+		}).Info("Transaction rolled back")
 	}
-
-	return tx.Commit().Error
+	return err
 }
 
 func (r *Repository) Create(ctx context.Context, o *domain.Order) error {
@@ -72,7 +96,8 @@ func (r *Repository) Create(ctx context.Context, o *domain.Order) error {
 		"order_id_before_create": o.ID,
 		"timestamp":              "01:38 AM +05, Tuesday, May 20, 2025",
 	}).Info("Creating order with ID")
-	result := r.db.WithContext(ctx).Create(o)
+	// Items are written separately by the service, one by one
+	result := r.conn(ctx).Omit(clause.Associations).Create(o)
 	if result.Error != nil {
 		logrus.WithFields(logrus.Fields{
 			"order_id":  o.ID,
@@ -92,11 +117,11 @@ func (r *Repository) Create(ctx context.Context, o *domain.Order) error {
 }
 
 func (r *Repository) CreateItem(ctx context.Context, item *domain.OrderItem) error {
-	result := r.db.WithContext(ctx).Create(item)
+	result := r.conn(ctx).Create(item)
 	if result.Error != nil {
 		logrus.WithFields(logrus.Fields{
 			"order_id":   item.OrderID,
-			"product_id": item.ProductID,
+			"variant_id": item.VariantID,
 			"error":      result.Error.Error(),
 			"timestamp":  "01:38 AM +05, Tuesday, May 20, 2025",
 		}).Error("Failed to create order item")
@@ -108,9 +133,9 @@ func (r *Repository) CreateItem(ctx context.Context, item *domain.OrderItem) err
 	return nil
 }
 
-func (r *Repository) GetItem(ctx context.Context, orderID, productID string) (*domain.OrderItem, error) {
+func (r *Repository) GetItem(ctx context.Context, orderID, variantID string) (*domain.OrderItem, error) {
 	var item domain.OrderItem
-	result := r.db.WithContext(ctx).Where("order_id = ? AND product_id = ?", orderID, productID).First(&item)
+	result := r.conn(ctx).Where("order_id = ? AND variant_id = ?", orderID, variantID).First(&item)
 	if result.Error != nil {
 		return nil, result.Error
 	}
@@ -118,11 +143,11 @@ func (r *Repository) GetItem(ctx context.Context, orderID, productID string) (*d
 }
 
 func (r *Repository) UpdateItem(ctx context.Context, item *domain.OrderItem) error {
-	result := r.db.WithContext(ctx).Model(&domain.OrderItem{}).Where("order_id = ? AND product_id = ?", item.OrderID, item.ProductID).Update("quantity", item.Quantity)
+	result := r.conn(ctx).Model(&domain.OrderItem{}).Where("order_id = ? AND variant_id = ?", item.OrderID, item.VariantID).Update("quantity", item.Quantity)
 	if result.Error != nil {
 		logrus.WithFields(logrus.Fields{
 			"order_id":   item.OrderID,
-			"product_id": item.ProductID,
+			"variant_id": item.VariantID,
 			"error":      result.Error.Error(),
 			"timestamp":  "01:38 AM +05, Tuesday, May 20, 2025",
 		}).Error("Failed to update order item")
@@ -134,41 +159,97 @@ func (r *Repository) UpdateItem(ctx context.Context, item *domain.OrderItem) err
 	return nil
 }
 
+func (r *Repository) CreateStatusChange(ctx context.Context, change *domain.OrderStatusChange) error {
+	result := r.conn(ctx).Create(change)
+	if result.Error != nil {
+		logrus.WithFields(logrus.Fields{
+			"order_id":    change.OrderID,
+			"from_status": change.FromStatus,
+			"to_status":   change.ToStatus,
+			"error":       result.Error.Error(),
+			"timestamp":   "01:38 AM +05, Tuesday, May 20, 2025",
+		}).Error("Failed to record order status change")
+		return result.Error
+	}
+	return nil
+}
+
 func (r *Repository) Get(ctx context.Context, id string) (*domain.Order, error) {
 	var o domain.Order
-	result := r.db.WithContext(ctx).Preload("Items").First(&o, "id = ?", id)
+	result := r.conn(ctx).Preload("Items").Preload("History", func(db *gorm.DB) *gorm.DB {
+		return db.Order("changed_at, id")
+	}).First(&o, "id = ?", id)
 	if result.Error != nil {
 		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
-			return nil, errors.New("order not found")
+			return nil, domain.ErrOrderNotFound
 		}
 		return nil, result.Error
 	}
 	return &o, nil
 }
 
+// Update saves an order and bumps its version. It fails with
+// ErrVersionConflict if the order is no longer at the version it was read at.
 func (r *Repository) Update(ctx context.Context, o *domain.Order) error {
-	result := r.db.WithContext(ctx).Save(o)
-	if result.Error != nil {
-		return result.Error
+	saved, err := database.SaveVersion(r.conn(ctx).Omit(clause.Associations), o, &o.Version)
+	if err != nil || saved {
+		return err
 	}
-	if result.RowsAffected == 0 {
-		return errors.New("failed to update order")
+	var count int64
+	if err := r.conn(ctx).Model(&domain.Order{}).Where("id = ?", o.ID).Count(&count).Error; err != nil {
+		return err
 	}
-	return nil
+	if count == 0 {
+		return domain.ErrOrderNotFound
+	}
+	return domain.ErrVersionConflict
 }
 
+// List lists the orders of a user with pagination, newest first.
 func (r *Repository) List(ctx context.Context, userID string, page, pageSize int) ([]*domain.Order, int, error) {
 	var orders []*domain.Order
 	var total int64
 
-	if err := r.db.WithContext(ctx).Model(&domain.Order{}).Where("user_id = ?", userID).Count(&total).Error; err != nil {
+	if err := r.conn(ctx).Model(&domain.Order{}).Where("user_id = ?", userID).Count(&total).Error; err != nil {
 		return nil, 0, err
 	}
 
 	offset := (page - 1) * pageSize
-	if err := r.db.WithContext(ctx).Preload("Items").Where("user_id = ?", userID).Offset(offset).Limit(pageSize).Find(&orders).Error; err != nil {
+	if err := database.NewestFirst(r.conn(ctx).Preload("Items").Where("user_id = ?", userID), "orders").Offset(offset).Limit(pageSize).Find(&orders).Error; err != nil {
 		return nil, 0, err
 	}
 
 	return orders, int(total), nil
 }
+
+// ListAfter lists up to pageSize orders of a user after the cursor, or from
+// the newest if it is nil, and reports whether more follow.
+func (r *Repository) ListAfter(ctx context.Context, userID string, after *database.Cursor, pageSize int) ([]*domain.Order, bool, error) {
+	var orders []*domain.Order
+	if err := database.After(r.conn(ctx).Preload("Items").Where("user_id = ?", userID), "orders", after, pageSize).Find(&orders).Error; err != nil {
+		return nil, false, err
+	}
+	more := len(orders) > pageSize
+	if more {
+		orders = orders[:pageSize]
+	}
+	return orders, more, nil
+}
+
+func (r *Repository) CreateOutboxEvent(ctx context.Context, aggregateID, eventType string, payload []byte) error {
+	if err := outbox.Create(r.conn(ctx), outboxTable, aggregateID, eventType, payload); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"aggregate_id": aggregateID,
+			"event_type":   eventType,
+			"error":        err.Error(),
+			"timestamp":    "01:38 AM +05, Tuesday, May 20, 2025",
+		}).Error("Failed to write outbox event")
+		return err
+	}
+	return nil
+}
+
+// Outbox returns the order events outbox, for the relay.
+func (r *Repository) Outbox() *outbox.Repository {
+	return r.outbox
+}
@@ -1,13 +1,21 @@
 package order
 
 import (
+	"context"
+	"ecommerce/internal/auth"
 	"ecommerce/internal/config"
+	"ecommerce/internal/idempotency"
 	"ecommerce/internal/order/application"
 	"ecommerce/internal/order/infrastructure"
+	"ecommerce/internal/outbox"
+	"ecommerce/internal/saga"
 	"ecommerce/proto"
+	"github.com/nats-io/nats.go"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
 	"log"
 	"net"
+	"time"
 )
 
 func Run(cfg *config.Config) error {
@@ -16,15 +24,83 @@ func Run(cfg *config.Config) error {
 		return err
 	}
 	cache := infrastructure.NewRedisCache(cfg.RedisAddr)
-	svc := application.NewService(repo, cache)
+
+	// Product prices are looked up from the inventory service. Stock is
+	// reserved there too, which only services holding the service token may do
+	invConn, err := grpc.Dial(cfg.InventoryAddr, grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithUnaryInterceptor(auth.ServiceTokenInterceptor(cfg.ServiceToken)))
+	if err != nil {
+		return err
+	}
+	defer invConn.Close()
+
+	// Shipping and billing addresses are copied from the user service
+	usrConn, err := grpc.Dial(cfg.UserAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return err
+	}
+	defer usrConn.Close()
+	usrClient := proto.NewUserServiceClient(usrConn)
+
+	// Order placement runs as a saga whose state lives in Postgres, so
+	// sagas interrupted by a restart are picked up again by the recovery loop
+	sagaRepo, err := saga.NewRepository(cfg.DSN())
+	if err != nil {
+		return err
+	}
+	sagas := saga.NewOrchestrator(sagaRepo, cfg.SagaLease)
+	payments := infrastructure.NewLocalPaymentGateway(cfg.PaymentMaxAmount)
+
+	svc := application.NewService(repo, cache, proto.NewInventoryServiceClient(invConn), usrClient, payments, sagas, cfg.OrderTaxRate)
 	server := NewServer(svc)
 
+	go sagas.RunRecovery(context.Background(), cfg.SagaRecoveryInterval)
+
+	// Order events are written to the outbox with each change and relayed
+	// to NATS from there
+	nc, err := nats.Connect(cfg.NATSAddr)
+	if err != nil {
+		return err
+	}
+	defer nc.Close()
+	relay := outbox.NewRelay(repo.Outbox(), outbox.NewNATSPublisher(nc, 5*time.Second))
+	go relay.Run(context.Background(), cfg.OutboxPollInterval)
+
+	// Retried mutations carrying an idempotency key get the original
+	// response instead of running twice
+	keys, err := idempotency.NewRepository(cfg.DSN())
+	if err != nil {
+		return err
+	}
+	go keys.RunPurge(context.Background(), cfg.IdempotencyPurgeInterval)
+
+	// Callers' forwarded access tokens are verified with the user service's
+	// public keys
+	verifier, jwks, err := auth.NewConfiguredVerifier(cfg, usrClient)
+	if err != nil {
+		return err
+	}
+	if jwks != nil {
+		go jwks.Run(context.Background(), cfg.JWKSRefreshInterval)
+	}
+
 	lis, err := net.Listen("tcp", cfg.OrderAddr)
 	if err != nil {
 		return err
 	}
 
-	s := grpc.NewServer()
+	s := grpc.NewServer(grpc.ChainUnaryInterceptor(
+		auth.UnaryServerInterceptor(verifier, cfg.ServiceToken, auth.Rules{
+			proto.OrderService_CreateOrder_FullMethodName: auth.PermOrdersCreate,
+			proto.OrderService_GetOrder_FullMethodName:    auth.PermOrdersRead,
+			proto.OrderService_UpdateOrder_FullMethodName: auth.PermOrdersCancel,
+			proto.OrderService_ListOrders_FullMethodName:  auth.PermOrdersRead,
+		}),
+		idempotency.UnaryServerInterceptor(keys, cfg.IdempotencyRetention,
+			proto.OrderService_CreateOrder_FullMethodName,
+			proto.OrderService_UpdateOrder_FullMethodName,
+		),
+	))
 	proto.RegisterOrderServiceServer(s, server)
 	log.Printf("Order service running on %s", cfg.OrderAddr)
 	return s.Serve(lis)
@@ -0,0 +1,33 @@
+package outbox
+
+import (
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Publisher publishes a message on a subject and returns once the broker has
+// accepted it.
+type Publisher interface {
+	Publish(subject string, data []byte) error
+}
+
+// NATSPublisher publishes to NATS and flushes after every message, so a nil
+// error means the server received it.
+type NATSPublisher struct {
+	nc      *nats.Conn
+	timeout time.Duration
+}
+
+// NewNATSPublisher creates a publisher on an existing NATS connection.
+func NewNATSPublisher(nc *nats.Conn, timeout time.Duration) *NATSPublisher {
+	return &NATSPublisher{nc: nc, timeout: timeout}
+}
+
+// Publish sends data on subject and waits for the server to acknowledge it.
+func (p *NATSPublisher) Publish(subject string, data []byte) error {
+	if err := p.nc.Publish(subject, data); err != nil {
+		return err
+	}
+	return p.nc.FlushTimeout(p.timeout)
+}
@@ -0,0 +1,105 @@
+package outbox
+
+import (
+	"context"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Relay publishes pending outbox events to NATS. Delivery is at-least-once:
+// an event is marked sent only after the broker accepted it, and failed
+// events are retried with exponential backoff. Events of the same aggregate
+// are published strictly in the order they were written.
+type Relay struct {
+	repo       *Repository
+	publisher  Publisher
+	batchSize  int
+	claimFor   time.Duration
+	minBackoff time.Duration
+	maxBackoff time.Duration
+}
+
+// NewRelay creates a relay that publishes the events of repo through
+// publisher.
+func NewRelay(repo *Repository, publisher Publisher) *Relay {
+	return &Relay{
+		repo:       repo,
+		publisher:  publisher,
+		batchSize:  100,
+		claimFor:   30 * time.Second,
+		minBackoff: time.Second,
+		maxBackoff: 5 * time.Minute,
+	}
+}
+
+// backoff returns the delay before retrying an event that failed attempts
+// times.
+func (r *Relay) backoff(attempts int) time.Duration {
+	d := r.minBackoff
+	for i := 1; i < attempts && d < r.maxBackoff; i++ {
+		d *= 2
+	}
+	if d > r.maxBackoff {
+		d = r.maxBackoff
+	}
+	return d
+}
+
+// Run polls the outbox every interval until ctx is cancelled.
+func (r *Relay) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		for {
+			published, err := r.publishBatch(ctx)
+			if err != nil {
+				logrus.WithError(err).Error("Failed to relay outbox events")
+				break
+			}
+			if published < r.batchSize {
+				break
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (r *Relay) publishBatch(ctx context.Context) (int, error) {
+	now := time.Now()
+	events, err := r.repo.ClaimOutboxEvents(ctx, now, now.Add(r.claimFor), r.batchSize)
+	if err != nil {
+		return 0, err
+	}
+	for _, e := range events {
+		if err := r.publisher.Publish(e.EventType, []byte(e.Payload)); err != nil {
+			attempts := e.Attempts + 1
+			next := time.Now().Add(r.backoff(attempts))
+			logrus.WithFields(logrus.Fields{
+				"event_id":        e.ID,
+				"event_type":      e.EventType,
+				"aggregate_id":    e.AggregateID,
+				"attempts":        attempts,
+				"next_attempt_at": next,
+				"error":           err.Error(),
+			}).Warn("Failed to publish outbox event, will retry")
+			if err := r.repo.MarkOutboxEventFailed(ctx, e.ID, attempts, next, err.Error()); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		if err := r.repo.MarkOutboxEventSent(ctx, e.ID, time.Now()); err != nil {
+			return 0, err
+		}
+		logrus.WithFields(logrus.Fields{
+			"event_id":     e.ID,
+			"event_type":   e.EventType,
+			"aggregate_id": e.AggregateID,
+		}).Info("Outbox event published")
+	}
+	return len(events), nil
+}
@@ -0,0 +1,104 @@
+package outbox
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"ecommerce/internal/database"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Event statuses.
+const (
+	StatusPending = "pending"
+	StatusSent    = "sent"
+)
+
+// Event is an event written in the same transaction as the change it
+// describes and published to NATS afterwards by the relay. Events of one
+// aggregate are published in ID order.
+type Event struct {
+	ID            uint      `gorm:"primaryKey;autoIncrement"`
+	AggregateID   string    `gorm:"not null;index"`
+	EventType     string    `gorm:"not null"`
+	Payload       string    `gorm:"type:jsonb;not null"`
+	Status        string    `gorm:"not null;index"`
+	Attempts      int       `gorm:"not null;default:0"`
+	NextAttemptAt time.Time `gorm:"not null;index"`
+	LastError     string    `gorm:"type:text"`
+	CreatedAt     time.Time
+	SentAt        *time.Time
+}
+
+// Repository stores the events of one service in its own table, so services
+// sharing a database do not relay each other's events.
+type Repository struct {
+	db    *gorm.DB
+	table string
+}
+
+// NewRepository migrates table and returns a repository for it.
+func NewRepository(db *gorm.DB, table string) (*Repository, error) {
+	if err := db.Table(table).AutoMigrate(&Event{}); err != nil {
+		return nil, err
+	}
+	return &Repository{db: db, table: table}, nil
+}
+
+// Create writes an event to the outbox table in tx, which must be the
+// transaction of the change the event describes.
+func Create(tx *gorm.DB, table, aggregateID, eventType string, payload []byte) error {
+	return tx.Table(table).Create(&Event{
+		AggregateID:   aggregateID,
+		EventType:     eventType,
+		Payload:       string(payload),
+		Status:        StatusPending,
+		NextAttemptAt: time.Now(),
+	}).Error
+}
+
+// ClaimOutboxEvents returns up to limit pending events that are due, at most
+// one per aggregate: an event is only eligible once every earlier event of
+// its aggregate has been sent. Claimed events are hidden from other relays
+// until claimUntil.
+func (r *Repository) ClaimOutboxEvents(ctx context.Context, now, claimUntil time.Time, limit int) ([]*Event, error) {
+	var events []*Event
+	err := database.Conn(ctx, r.db).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Table(r.table).Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("status = ? AND next_attempt_at <= ?", StatusPending, now).
+			Where(fmt.Sprintf("NOT EXISTS (SELECT 1 FROM %[1]s prev WHERE prev.aggregate_id = %[1]s.aggregate_id AND prev.status = ? AND prev.id < %[1]s.id)", r.table), StatusPending).
+			Order("id").Limit(limit).Find(&events).Error; err != nil {
+			return err
+		}
+		if len(events) == 0 {
+			return nil
+		}
+		ids := make([]uint, len(events))
+		for i, e := range events {
+			ids[i] = e.ID
+		}
+		return tx.Table(r.table).Where("id IN ?", ids).Update("next_attempt_at", claimUntil).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+func (r *Repository) MarkOutboxEventSent(ctx context.Context, id uint, sentAt time.Time) error {
+	return database.Conn(ctx, r.db).Table(r.table).Where("id = ?", id).Updates(map[string]interface{}{
+		"status":     StatusSent,
+		"sent_at":    sentAt,
+		"last_error": "",
+	}).Error
+}
+
+func (r *Repository) MarkOutboxEventFailed(ctx context.Context, id uint, attempts int, nextAttemptAt time.Time, lastError string) error {
+	return database.Conn(ctx, r.db).Table(r.table).Where("id = ?", id).Updates(map[string]interface{}{
+		"attempts":        attempts,
+		"next_attempt_at": nextAttemptAt,
+		"last_error":      lastError,
+	}).Error
+}
@@ -0,0 +1,62 @@
+package saga
+
+import (
+	"context"
+	"time"
+
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Repository persists saga state in Postgres.
+type Repository struct {
+	db *gorm.DB
+}
+
+// NewRepository opens the saga store and migrates its table.
+func NewRepository(dsn string) (*Repository, error) {
+	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
+	if err != nil {
+		return nil, err
+	}
+	if err := db.AutoMigrate(&Saga{}); err != nil {
+		return nil, err
+	}
+	return &Repository{db: db}, nil
+}
+
+// Create inserts a new saga.
+func (r *Repository) Create(ctx context.Context, s *Saga) error {
+	return r.db.WithContext(ctx).Create(s).Error
+}
+
+// Save writes the current state of a saga.
+func (r *Repository) Save(ctx context.Context, s *Saga) error {
+	return r.db.WithContext(ctx).Save(s).Error
+}
+
+// ClaimExpired takes over unfinished sagas whose lease ran out by extending
+// their lease to now+lease. Sagas claimed concurrently by another process are
+// skipped.
+func (r *Repository) ClaimExpired(ctx context.Context, now time.Time, lease time.Duration) ([]*Saga, error) {
+	var sagas []*Saga
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("status IN ? AND lease_until < ?", []string{StatusRunning, StatusCompensating}, now).
+			Order("created_at").Limit(50).Find(&sagas).Error; err != nil {
+			return err
+		}
+		for _, s := range sagas {
+			s.LeaseUntil = now.Add(lease)
+			if err := tx.Model(s).Update("lease_until", s.LeaseUntil).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sagas, nil
+}
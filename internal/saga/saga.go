@@ -0,0 +1,261 @@
+package saga
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// Saga statuses. A saga runs its steps forward while running; after a step
+// fails it compensates the completed steps in reverse and ends compensated.
+const (
+	StatusRunning      = "running"
+	StatusCompensating = "compensating"
+	StatusCompleted    = "completed"
+	StatusCompensated  = "compensated"
+)
+
+var ErrUnknownSaga = errors.New("unknown saga type")
+
+// Saga is the persisted state of a single saga instance. CurrentStep is the
+// index of the next step to execute while running, and the number of steps
+// still to compensate while compensating.
+type Saga struct {
+	ID          string    `gorm:"type:uuid;primaryKey"`
+	Type        string    `gorm:"not null;index"`
+	AggregateID string    `gorm:"not null;index"`
+	Status      string    `gorm:"not null;index"`
+	CurrentStep int       `gorm:"not null"`
+	Data        string    `gorm:"type:jsonb;not null"`
+	Error       string    `gorm:"type:text"`
+	LeaseUntil  time.Time `gorm:"not null"`
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+
+	data map[string]string `gorm:"-"`
+}
+
+// Get returns a value stored in the saga data.
+func (s *Saga) Get(key string) string {
+	return s.data[key]
+}
+
+// Set stores a value in the saga data. It is persisted together with the
+// step that set it, so later steps and compensations can read it back after
+// a restart.
+func (s *Saga) Set(key, value string) {
+	if s.data == nil {
+		s.data = make(map[string]string)
+	}
+	s.data[key] = value
+}
+
+func (s *Saga) encode() error {
+	raw, err := json.Marshal(s.data)
+	if err != nil {
+		return err
+	}
+	s.Data = string(raw)
+	return nil
+}
+
+func (s *Saga) decode() error {
+	s.data = make(map[string]string)
+	if s.Data == "" {
+		return nil
+	}
+	return json.Unmarshal([]byte(s.Data), &s.data)
+}
+
+// Step is one unit of work in a saga. Execute and Compensate must be
+// idempotent: a step interrupted by a restart is run again on recovery.
+// Compensate may be nil for steps that need no undo.
+type Step struct {
+	Name       string
+	Execute    func(ctx context.Context, s *Saga) error
+	Compensate func(ctx context.Context, s *Saga) error
+}
+
+// Definition is a named, ordered list of steps.
+type Definition struct {
+	Type  string
+	Steps []Step
+}
+
+// Orchestrator runs sagas and persists their progress after every step.
+type Orchestrator struct {
+	repo        *Repository
+	definitions map[string]*Definition
+	lease       time.Duration
+}
+
+// NewOrchestrator creates an orchestrator. lease is how long a running saga
+// is owned by this process before another process may resume it.
+func NewOrchestrator(repo *Repository, lease time.Duration) *Orchestrator {
+	return &Orchestrator{repo: repo, definitions: make(map[string]*Definition), lease: lease}
+}
+
+// Register makes a saga definition available to Start and Recover.
+func (o *Orchestrator) Register(def *Definition) {
+	o.definitions[def.Type] = def
+}
+
+// Start creates and runs a saga of the given type to completion. If a step
+// fails, the completed steps are compensated and the step's error is
+// returned.
+//
+// Once stored, the saga no longer depends on ctx being cancelled: it runs on
+// a context with ctx's values that expires with its lease, so a caller going
+// away does not leave it half done until recovery picks it up.
+func (o *Orchestrator) Start(ctx context.Context, sagaType, aggregateID string, data map[string]string) (*Saga, error) {
+	def, ok := o.definitions[sagaType]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownSaga, sagaType)
+	}
+	s := &Saga{
+		ID:          uuid.New().String(),
+		Type:        sagaType,
+		AggregateID: aggregateID,
+		Status:      StatusRunning,
+		LeaseUntil:  time.Now().Add(o.lease),
+		data:        data,
+	}
+	if err := s.encode(); err != nil {
+		return nil, err
+	}
+	if err := o.repo.Create(ctx, s); err != nil {
+		return nil, err
+	}
+	logrus.WithFields(logrus.Fields{"saga_id": s.ID, "saga_type": sagaType, "aggregate_id": aggregateID}).Info("Saga started")
+	runCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), o.lease)
+	defer cancel()
+	return s, o.run(runCtx, def, s)
+}
+
+// Recover resumes running or compensating sagas whose lease has expired,
+// e.g. because the process that owned them was restarted.
+func (o *Orchestrator) Recover(ctx context.Context) error {
+	sagas, err := o.repo.ClaimExpired(ctx, time.Now(), o.lease)
+	if err != nil {
+		return err
+	}
+	for _, s := range sagas {
+		def, ok := o.definitions[s.Type]
+		if !ok {
+			logrus.WithFields(logrus.Fields{"saga_id": s.ID, "saga_type": s.Type}).Error("Cannot resume saga of unknown type")
+			continue
+		}
+		if err := s.decode(); err != nil {
+			logrus.WithError(err).WithField("saga_id", s.ID).Error("Cannot decode saga data")
+			continue
+		}
+		logrus.WithFields(logrus.Fields{"saga_id": s.ID, "saga_type": s.Type, "status": s.Status, "step": s.CurrentStep}).Info("Resuming saga")
+		if err := o.run(ctx, def, s); err != nil {
+			logrus.WithError(err).WithField("saga_id", s.ID).Warn("Resumed saga did not complete")
+		}
+	}
+	return nil
+}
+
+// RunRecovery calls Recover every interval until ctx is cancelled.
+func (o *Orchestrator) RunRecovery(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := o.Recover(ctx); err != nil {
+			logrus.WithError(err).Error("Failed to recover sagas")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (o *Orchestrator) save(ctx context.Context, s *Saga) error {
+	if err := s.encode(); err != nil {
+		return err
+	}
+	s.LeaseUntil = time.Now().Add(o.lease)
+	return o.repo.Save(ctx, s)
+}
+
+func (o *Orchestrator) run(ctx context.Context, def *Definition, s *Saga) error {
+	var stepErr error
+	if s.Status == StatusRunning {
+		for s.CurrentStep < len(def.Steps) {
+			step := def.Steps[s.CurrentStep]
+			if err := step.Execute(ctx, s); err != nil {
+				logrus.WithFields(logrus.Fields{"saga_id": s.ID, "step": step.Name, "error": err.Error()}).Warn("Saga step failed, compensating")
+				stepErr = err
+				s.Status = StatusCompensating
+				s.Error = fmt.Sprintf("%s: %v", step.Name, err)
+				break
+			}
+			s.CurrentStep++
+			if err := o.save(ctx, s); err != nil {
+				return err
+			}
+		}
+		if s.Status == StatusRunning {
+			s.Status = StatusCompleted
+			if err := o.save(ctx, s); err != nil {
+				return err
+			}
+			logrus.WithFields(logrus.Fields{"saga_id": s.ID, "saga_type": s.Type}).Info("Saga completed")
+			return nil
+		}
+		if err := o.save(ctx, s); err != nil {
+			return err
+		}
+	}
+	if s.Status != StatusCompensating {
+		return nil
+	}
+
+	if stepErr == nil {
+		stepErr = errors.New(s.Error)
+	}
+	for s.CurrentStep > 0 {
+		step := def.Steps[s.CurrentStep-1]
+		if step.Compensate != nil {
+			if err := compensate(ctx, step, s); err != nil {
+				// Left in compensating state for the recovery loop to retry
+				logrus.WithFields(logrus.Fields{"saga_id": s.ID, "step": step.Name, "error": err.Error()}).Error("Saga compensation failed")
+				if saveErr := o.save(ctx, s); saveErr != nil {
+					return saveErr
+				}
+				return stepErr
+			}
+		}
+		s.CurrentStep--
+		if err := o.save(ctx, s); err != nil {
+			return err
+		}
+	}
+	s.Status = StatusCompensated
+	if err := o.save(ctx, s); err != nil {
+		return err
+	}
+	logrus.WithFields(logrus.Fields{"saga_id": s.ID, "saga_type": s.Type, "error": s.Error}).Info("Saga compensated")
+	return stepErr
+}
+
+// compensate runs a compensation with a few quick retries, since leaving a
+// saga half-compensated is worse than a short delay.
+func compensate(ctx context.Context, step Step, s *Saga) error {
+	var err error
+	for attempt := 0; attempt < 3; attempt++ {
+		if err = step.Compensate(ctx, s); err == nil {
+			return nil
+		}
+		time.Sleep(time.Duration(attempt*200) * time.Millisecond)
+	}
+	return err
+}
@@ -0,0 +1,181 @@
+package application
+
+import (
+	"context"
+	"ecommerce/internal/user/domain"
+	"ecommerce/internal/user/infrastructure"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// MailSettings configure the emails sent for account recovery and
+// verification.
+type MailSettings struct {
+	Mailer           infrastructure.Mailer
+	BaseURL          string // Links in emails point to the frontend at this URL
+	PasswordResetTTL time.Duration
+	VerificationTTL  time.Duration
+}
+
+// issueUserToken invalidates earlier tokens of the user for purpose and
+// stores a new one.
+func (s *Service) issueUserToken(ctx context.Context, userID, purpose string, ttl time.Duration) (string, error) {
+	token, err := newToken()
+	if err != nil {
+		return "", err
+	}
+	err = s.repo.WithTransaction(ctx, func(txCtx context.Context) error {
+		now := time.Now()
+		if err := s.repo.UseUserTokens(txCtx, userID, purpose, now); err != nil {
+			return err
+		}
+		return s.repo.CreateUserToken(txCtx, &domain.UserToken{
+			TokenHash: hashToken(token),
+			UserID:    userID,
+			Purpose:   purpose,
+			ExpiresAt: now.Add(ttl),
+			CreatedAt: now,
+		})
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// consumeUserToken marks a token used and returns the user it was issued to.
+// It must run in a transaction.
+func (s *Service) consumeUserToken(txCtx context.Context, token, purpose string) (*domain.User, error) {
+	t, err := s.repo.LockUserToken(txCtx, hashToken(token), purpose)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if t.UsedAt != nil || !now.Before(t.ExpiresAt) {
+		return nil, domain.ErrInvalidToken
+	}
+	if err := s.repo.UseUserTokens(txCtx, t.UserID, purpose, now); err != nil {
+		return nil, err
+	}
+	return s.repo.Get(txCtx, t.UserID)
+}
+
+func (s *Service) link(path, token string) string {
+	return s.mail.BaseURL + path + "?token=" + url.QueryEscape(token)
+}
+
+// RequestPasswordReset mails a password reset token to the user with email.
+// Unknown addresses are ignored without an error, so the result does not
+// reveal which addresses are registered.
+func (s *Service) RequestPasswordReset(ctx context.Context, email string) error {
+	if email == "" {
+		return errors.New("email is required")
+	}
+	u, err := s.repo.GetByEmail(ctx, email)
+	if errors.Is(err, domain.ErrUserNotFound) {
+		logrus.Info("Password reset requested for unknown email")
+		return nil
+	}
+	if err != nil {
+		logrus.WithError(err).Error("Failed to get user by email")
+		return err
+	}
+	token, err := s.issueUserToken(ctx, u.ID, domain.PurposePasswordReset, s.mail.PasswordResetTTL)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to issue password reset token")
+		return err
+	}
+	body := fmt.Sprintf("Hello %s,\n\nUse the link below to choose a new password. It expires in %s.\n\n%s\n\nIf you did not ask for a password reset, you can ignore this email.\n",
+		u.Username, s.mail.PasswordResetTTL, s.link("/reset-password", token))
+	if err := s.mail.Mailer.Send(ctx, infrastructure.Message{To: u.Email, Subject: "Reset your password", Body: body}); err != nil {
+		return err
+	}
+	logrus.WithField("user_id", u.ID).Info("Password reset requested")
+	return nil
+}
+
+// ResetPassword sets a new password with a reset token. All sessions of the
+// user are ended, since whoever held them may have known the old password.
+func (s *Service) ResetPassword(ctx context.Context, token, newPassword string) error {
+	if len(newPassword) < domain.MinPasswordLength {
+		return domain.ErrWeakPassword
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to hash password")
+		return err
+	}
+	var u *domain.User
+	err = s.repo.WithTransaction(ctx, func(txCtx context.Context) error {
+		var err error
+		u, err = s.consumeUserToken(txCtx, token, domain.PurposePasswordReset)
+		if err != nil {
+			return err
+		}
+		u.Password = string(hash)
+		return s.repo.Update(txCtx, u)
+	})
+	if err != nil {
+		if !errors.Is(err, domain.ErrInvalidToken) {
+			logrus.WithError(err).Error("Failed to reset password")
+		}
+		return err
+	}
+	s.invalidateUser(ctx, u.ID)
+	if _, err := s.LogoutAll(ctx, u.ID); err != nil {
+		logrus.WithError(err).Error("Failed to end sessions after password reset")
+	}
+	logrus.WithField("user_id", u.ID).Info("Password reset")
+	return nil
+}
+
+// SendVerificationEmail mails an email verification token to a user.
+func (s *Service) SendVerificationEmail(ctx context.Context, userID string) error {
+	u, err := s.repo.Get(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if u.Verified {
+		return domain.ErrAlreadyVerified
+	}
+	token, err := s.issueUserToken(ctx, u.ID, domain.PurposeEmailVerification, s.mail.VerificationTTL)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to issue verification token")
+		return err
+	}
+	body := fmt.Sprintf("Hello %s,\n\nPlease confirm your email address with the link below. It expires in %s.\n\n%s\n",
+		u.Username, s.mail.VerificationTTL, s.link("/verify-email", token))
+	if err := s.mail.Mailer.Send(ctx, infrastructure.Message{To: u.Email, Subject: "Verify your email address", Body: body}); err != nil {
+		return err
+	}
+	logrus.WithField("user_id", u.ID).Info("Verification email sent")
+	return nil
+}
+
+// VerifyEmail marks the email of the token's user as verified.
+func (s *Service) VerifyEmail(ctx context.Context, token string) (*domain.User, error) {
+	var u *domain.User
+	err := s.repo.WithTransaction(ctx, func(txCtx context.Context) error {
+		var err error
+		u, err = s.consumeUserToken(txCtx, token, domain.PurposeEmailVerification)
+		if err != nil {
+			return err
+		}
+		u.Verified = true
+		return s.repo.Update(txCtx, u)
+	})
+	if err != nil {
+		if !errors.Is(err, domain.ErrInvalidToken) {
+			logrus.WithError(err).Error("Failed to verify email")
+		}
+		return nil, err
+	}
+	s.invalidateUser(ctx, u.ID)
+	logrus.WithField("user_id", u.ID).Info("Email verified")
+	return u, nil
+}
@@ -0,0 +1,122 @@
+package application
+
+import (
+	"context"
+	"ecommerce/internal/user/domain"
+	"errors"
+
+	"github.com/sirupsen/logrus"
+)
+
+// applyDefaults makes a the only default shipping and/or billing address of
+// its user, as flagged. It must run in a transaction.
+func (s *Service) applyDefaults(txCtx context.Context, a *domain.Address) error {
+	if a.DefaultShipping {
+		if err := s.repo.ClearDefaultAddress(txCtx, a.UserID, "default_shipping", a.ID); err != nil {
+			return err
+		}
+	}
+	if a.DefaultBilling {
+		if err := s.repo.ClearDefaultAddress(txCtx, a.UserID, "default_billing", a.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CreateAddress adds an address to the address book of a.UserID. The first
+// address becomes the default for shipping and billing.
+func (s *Service) CreateAddress(ctx context.Context, a *domain.Address) error {
+	a.ID = ""
+	a.Normalize()
+	if err := a.Validate(); err != nil {
+		return err
+	}
+	err := s.repo.WithTransaction(ctx, func(txCtx context.Context) error {
+		// Locks the user, so concurrent creates cannot exceed the limit
+		if _, err := s.repo.LockUser(txCtx, a.UserID); err != nil {
+			return err
+		}
+		n, err := s.repo.CountAddresses(txCtx, a.UserID)
+		if err != nil {
+			return err
+		}
+		if n >= domain.MaxAddresses {
+			return domain.ErrTooManyAddresses
+		}
+		if n == 0 {
+			a.DefaultShipping = true
+			a.DefaultBilling = true
+		}
+		if err := s.repo.CreateAddress(txCtx, a); err != nil {
+			return err
+		}
+		return s.applyDefaults(txCtx, a)
+	})
+	if err != nil {
+		if !isAddressError(err) {
+			logrus.WithError(err).Error("Failed to create address")
+		}
+		return err
+	}
+	logrus.WithFields(logrus.Fields{"user_id": a.UserID, "address_id": a.ID}).Info("Address created")
+	return nil
+}
+
+// GetAddress returns an address of a user.
+func (s *Service) GetAddress(ctx context.Context, userID, id string) (*domain.Address, error) {
+	return s.repo.GetAddress(ctx, userID, id)
+}
+
+// ListAddresses returns the address book of a user.
+func (s *Service) ListAddresses(ctx context.Context, userID string) ([]*domain.Address, error) {
+	if _, err := s.repo.Get(ctx, userID); err != nil {
+		return nil, err
+	}
+	return s.repo.ListAddresses(ctx, userID)
+}
+
+// UpdateAddress replaces the fields of an existing address with those of a.
+func (s *Service) UpdateAddress(ctx context.Context, a *domain.Address) error {
+	a.Normalize()
+	if err := a.Validate(); err != nil {
+		return err
+	}
+	err := s.repo.WithTransaction(ctx, func(txCtx context.Context) error {
+		existing, err := s.repo.GetAddress(txCtx, a.UserID, a.ID)
+		if err != nil {
+			return err
+		}
+		a.CreatedAt = existing.CreatedAt
+		if err := s.repo.UpdateAddress(txCtx, a); err != nil {
+			return err
+		}
+		return s.applyDefaults(txCtx, a)
+	})
+	if err != nil {
+		if !isAddressError(err) {
+			logrus.WithError(err).Error("Failed to update address")
+		}
+		return err
+	}
+	logrus.WithFields(logrus.Fields{"user_id": a.UserID, "address_id": a.ID}).Info("Address updated")
+	return nil
+}
+
+// DeleteAddress removes an address from the address book of a user. Orders
+// keep their own copy of the address.
+func (s *Service) DeleteAddress(ctx context.Context, userID, id string) error {
+	if err := s.repo.DeleteAddress(ctx, userID, id); err != nil {
+		if !errors.Is(err, domain.ErrAddressNotFound) {
+			logrus.WithError(err).Error("Failed to delete address")
+		}
+		return err
+	}
+	logrus.WithFields(logrus.Fields{"user_id": userID, "address_id": id}).Info("Address deleted")
+	return nil
+}
+
+func isAddressError(err error) bool {
+	return errors.Is(err, domain.ErrInvalidAddress) || errors.Is(err, domain.ErrAddressNotFound) ||
+		errors.Is(err, domain.ErrTooManyAddresses) || errors.Is(err, domain.ErrUserNotFound)
+}
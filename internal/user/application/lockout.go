@@ -0,0 +1,68 @@
+package application
+
+import (
+	"context"
+	"ecommerce/internal/user/domain"
+	"errors"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// dummyHash is compared against when a login names an unknown user, so that
+// it takes as long as a wrong password.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("not a real password"), bcrypt.DefaultCost)
+
+// maxLockouts caps the lockout records returned by ListLockouts.
+const maxLockouts = 500
+
+// loginFailed counts a failed login and records the lockouts it caused.
+func (s *Service) loginFailed(ctx context.Context, username, clientIP string) {
+	logrus.WithFields(logrus.Fields{"username": username, "client_ip": clientIP}).Warn("Failed login attempt")
+	lockouts, err := s.limiter.Fail(ctx, username, clientIP, time.Now())
+	if err != nil {
+		logrus.WithError(err).Error("Failed to count failed login")
+	}
+	for i := range lockouts {
+		l := &lockouts[i]
+		logrus.WithFields(logrus.Fields{"scope": l.Scope, "subject": l.Subject, "attempts": l.Attempts, "locked_until": l.LockedUntil}).Warn("Login locked")
+		if err := s.repo.CreateLockout(ctx, l); err != nil {
+			logrus.WithError(err).Error("Failed to record lockout")
+		}
+	}
+}
+
+// ListLockouts returns up to limit lockout records, newest first, optionally
+// filtered by scope and subject. activeOnly skips cleared and expired ones.
+func (s *Service) ListLockouts(ctx context.Context, scope, subject string, activeOnly bool, limit int) ([]*domain.Lockout, error) {
+	if scope != "" && !domain.ValidLockoutScope(scope) {
+		return nil, domain.ErrInvalidLockoutScope
+	}
+	if limit <= 0 || limit > maxLockouts {
+		limit = maxLockouts
+	}
+	return s.repo.ListLockouts(ctx, scope, subject, activeOnly, time.Now(), limit)
+}
+
+// ClearLockout lifts the lockout of a username or IP address and resets its
+// failed login count. It returns the number of lockout records cleared.
+func (s *Service) ClearLockout(ctx context.Context, scope, subject, clearedBy string) (int, error) {
+	if !domain.ValidLockoutScope(scope) {
+		return 0, domain.ErrInvalidLockoutScope
+	}
+	if subject == "" {
+		return 0, errors.New("subject is required")
+	}
+	if err := s.limiter.Clear(ctx, scope, subject); err != nil {
+		logrus.WithError(err).Error("Failed to clear login lockout")
+		return 0, err
+	}
+	cleared, err := s.repo.ClearLockouts(ctx, scope, subject, clearedBy, time.Now())
+	if err != nil {
+		logrus.WithError(err).Error("Failed to record cleared lockout")
+		return 0, err
+	}
+	logrus.WithFields(logrus.Fields{"scope": scope, "subject": subject, "cleared_by": clearedBy}).Info("Login lockout cleared")
+	return int(cleared), nil
+}
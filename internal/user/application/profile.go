@@ -0,0 +1,167 @@
+package application
+
+import (
+	"context"
+	"ecommerce/internal/user/domain"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// UpdateProfile changes the username and/or email of a user; empty values
+// are left unchanged. A new email address has to be verified again. With
+// expectedVersion set, it fails with ErrVersionConflict unless the user is
+// still at that version.
+func (s *Service) UpdateProfile(ctx context.Context, userID, username, email string, expectedVersion int) (*domain.User, error) {
+	if username == "" && email == "" {
+		return nil, errors.New("username or email is required")
+	}
+	var u *domain.User
+	var emailChanged bool
+	err := s.repo.WithTransaction(ctx, func(txCtx context.Context) error {
+		if _, err := s.repo.LockUser(txCtx, userID); err != nil {
+			return err
+		}
+		var err error
+		if u, err = s.repo.Get(txCtx, userID); err != nil {
+			return err
+		}
+		if expectedVersion != 0 && u.Version != expectedVersion {
+			return fmt.Errorf("%w: user %s is at version %d, not %d", domain.ErrVersionConflict, userID, u.Version, expectedVersion)
+		}
+		emailChanged = email != "" && email != u.Email
+		if username != "" {
+			u.Username = username
+		}
+		if emailChanged {
+			u.Email = email
+			u.Verified = false
+		}
+		return s.repo.Update(txCtx, u)
+	})
+	if err != nil {
+		if !errors.Is(err, domain.ErrUserExists) && !errors.Is(err, domain.ErrUserNotFound) && !errors.Is(err, domain.ErrVersionConflict) {
+			logrus.WithError(err).Error("Failed to update user")
+		}
+		return nil, err
+	}
+	s.invalidateUser(ctx, userID)
+	logrus.WithField("user_id", userID).Info("User profile updated")
+
+	if emailChanged {
+		if err := s.SendVerificationEmail(ctx, userID); err != nil {
+			logrus.WithError(err).Warn("Failed to send verification email")
+		}
+	}
+	return u, nil
+}
+
+// ChangePassword sets a new password after checking the current one. The
+// other sessions of the user are ended; sessionID, the caller's session,
+// stays logged in.
+func (s *Service) ChangePassword(ctx context.Context, userID, sessionID, currentPassword, newPassword string) error {
+	if len(newPassword) < domain.MinPasswordLength {
+		return domain.ErrWeakPassword
+	}
+	u, err := s.repo.Get(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(currentPassword)); err != nil {
+		logrus.WithField("user_id", userID).Warn("Password change with wrong current password")
+		return domain.ErrInvalidPassword
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to hash password")
+		return err
+	}
+	err = s.repo.WithTransaction(ctx, func(txCtx context.Context) error {
+		u.Password = string(hash)
+		if err := s.repo.Update(txCtx, u); err != nil {
+			return err
+		}
+		// Reset links mailed for the old password must not override the new one
+		return s.repo.UseUserTokens(txCtx, userID, domain.PurposePasswordReset, time.Now())
+	})
+	if err != nil {
+		logrus.WithError(err).Error("Failed to change password")
+		return err
+	}
+	s.invalidateUser(ctx, userID)
+	ids, err := s.revokeSessions(ctx, userID, sessionID, domain.RevokedPassword)
+	if err != nil {
+		return err
+	}
+	logrus.WithFields(logrus.Fields{"user_id": userID, "sessions": len(ids)}).Info("Password changed")
+	return nil
+}
+
+// DeleteUser deletes an account. It disappears from lookups and its
+// sessions end immediately, but its personal data is only anonymized by
+// RunAnonymizer once the grace period has passed. Until then the username
+// and email address stay taken.
+func (s *Service) DeleteUser(ctx context.Context, userID string) error {
+	err := s.repo.WithTransaction(ctx, func(txCtx context.Context) error {
+		u, err := s.repo.Get(txCtx, userID)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		u.DeletedAt = &now
+		if err := s.repo.Update(txCtx, u); err != nil {
+			return err
+		}
+		for _, purpose := range []string{domain.PurposePasswordReset, domain.PurposeEmailVerification} {
+			if err := s.repo.UseUserTokens(txCtx, userID, purpose, now); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		if !errors.Is(err, domain.ErrUserNotFound) {
+			logrus.WithError(err).Error("Failed to delete user")
+		}
+		return err
+	}
+	s.invalidateUser(ctx, userID)
+	if _, err := s.revokeSessions(ctx, userID, "", domain.RevokedDeleted); err != nil {
+		return err
+	}
+	logrus.WithField("user_id", userID).Info("User deleted")
+	return nil
+}
+
+// RunAnonymizer anonymizes users deleted more than grace ago every interval
+// until ctx is cancelled.
+func (s *Service) RunAnonymizer(ctx context.Context, grace, interval time.Duration) {
+	const batchSize = 100
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for {
+			now := time.Now()
+			ids, err := s.repo.AnonymizeDeleted(ctx, now.Add(-grace), now, batchSize)
+			if err != nil {
+				logrus.WithError(err).Error("Failed to anonymize deleted users")
+				break
+			}
+			if len(ids) == 0 {
+				break
+			}
+			logrus.WithField("users", len(ids)).Info("Deleted users anonymized")
+			if len(ids) < batchSize {
+				break
+			}
+		}
+	}
+}
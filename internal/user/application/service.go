@@ -2,21 +2,34 @@ package application
 
 import (
 	"context"
+	"ecommerce/internal/auth"
 	"ecommerce/internal/user/domain"
 	"ecommerce/internal/user/infrastructure"
 	"errors"
+	"fmt"
 	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/crypto/bcrypt"
+	"strings"
+	"time"
 )
 
 type Service struct {
-	repo  *infrastructure.Repository
-	cache infrastructure.Cache
+	repo   *infrastructure.Repository
+	cache  infrastructure.Cache
+	keys   *auth.KeySet
+	signer *auth.Signer
+
+	denylist   *auth.Denylist
+	refreshTTL time.Duration
+
+	mail      MailSettings
+	limiter   *infrastructure.LoginLimiter
+	twoFactor TwoFactorSettings
 }
 
-func NewService(repo *infrastructure.Repository, cache infrastructure.Cache) *Service {
-	return &Service{repo: repo, cache: cache}
+func NewService(repo *infrastructure.Repository, cache infrastructure.Cache, keys *auth.KeySet, signer *auth.Signer, denylist *auth.Denylist, refreshTTL time.Duration, mail MailSettings, limiter *infrastructure.LoginLimiter, twoFactor TwoFactorSettings) *Service {
+	return &Service{repo: repo, cache: cache, keys: keys, signer: signer, denylist: denylist, refreshTTL: refreshTTL, mail: mail, limiter: limiter, twoFactor: twoFactor}
 }
 
 func (s *Service) Register(ctx context.Context, u *domain.User) error {
@@ -39,24 +52,70 @@ func (s *Service) Register(ctx context.Context, u *domain.User) error {
 		logrus.WithError(err).Warn("Failed to cache user, proceeding")
 	}
 	logrus.WithField("user_id", u.ID).Info("User registered successfully")
+
+	// Registration succeeds even if the email cannot be sent; the user can
+	// ask for another one
+	if err := s.SendVerificationEmail(ctx, u.ID); err != nil {
+		logrus.WithError(err).Warn("Failed to send verification email")
+	}
 	return nil
 }
 
-func (s *Service) Authenticate(ctx context.Context, username, password string) (string, error) {
+// Authenticate checks the credentials and starts a session with an access
+// and a refresh token, or returns a challenge for VerifyTwoFactorLogin if the
+// user has two-factor authentication enabled. Unknown users, deleted users
+// and wrong passwords all fail with ErrInvalidCredentials after a bcrypt
+// comparison, so neither the error nor the timing reveals which usernames
+// exist. Repeated failures lock the username and the client IP.
+func (s *Service) Authenticate(ctx context.Context, username, password, userAgent, clientIP string) (*LoginResult, error) {
 	if username == "" || password == "" {
-		return "", errors.New("username and password are required")
+		return nil, errors.New("username and password are required")
 	}
-	u, err := s.repo.GetByUsername(ctx, username)
+	locked, err := s.limiter.Locked(ctx, username, clientIP)
 	if err != nil {
+		// Without the counters attempts would be unlimited, so fail closed
+		logrus.WithError(err).Error("Failed to check login lockout")
+		return nil, err
+	}
+	if locked > 0 {
+		logrus.WithFields(logrus.Fields{"username": username, "client_ip": clientIP}).Warn("Login attempt while locked")
+		return nil, fmt.Errorf("%w, try again in %s", domain.ErrLoginLocked, locked.Round(time.Second))
+	}
+
+	hash := dummyHash
+	u, err := s.repo.GetByUsername(ctx, username)
+	switch {
+	case err == nil:
+		hash = []byte(u.Password)
+	case !errors.Is(err, domain.ErrUserNotFound):
 		logrus.WithError(err).Error("Failed to get user by username")
-		return "", err
+		return nil, err
 	}
-	if err := bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(password)); err != nil {
-		logrus.WithField("username", username).Error("Invalid password")
-		return "", errors.New("invalid credentials")
+	if err := bcrypt.CompareHashAndPassword(hash, []byte(password)); err != nil || u == nil {
+		s.loginFailed(ctx, username, clientIP)
+		return nil, domain.ErrInvalidCredentials
 	}
-	logrus.WithField("user_id", u.ID).Info("User authenticated successfully")
-	return u.ID, nil
+	if u.TOTPEnabled {
+		// Failures are only forgotten once the second factor is verified too,
+		// so that codes cannot be guessed without limit
+		return s.challengeTwoFactor(ctx, u)
+	}
+	if err := s.limiter.Succeed(ctx, username); err != nil {
+		logrus.WithError(err).Warn("Failed to reset failed login count")
+	}
+
+	tokens, err := s.startSession(ctx, u, userAgent, clientIP)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to start session")
+		return nil, err
+	}
+	logrus.WithFields(logrus.Fields{"user_id": u.ID, "session_id": tokens.Claims.SessionID}).Info("User authenticated successfully")
+	return &LoginResult{Tokens: tokens}, nil
+}
+
+// JWKS returns the public keys that verify access tokens.
+func (s *Service) JWKS() *auth.JWKS {
+	return s.keys.JWKS()
 }
 
 func (s *Service) GetProfile(ctx context.Context, id string) (*domain.User, error) {
@@ -90,3 +149,72 @@ func (s *Service) GetProfile(ctx context.Context, id string) (*domain.User, erro
 	logrus.WithField("user_id", id).Info("User profile retrieved and cached")
 	return user, nil
 }
+
+// GrantRole grants role to a user. Every user is a customer, so only the
+// elevated roles can be granted. The role is carried in the user's tokens
+// from their next login or refresh.
+func (s *Service) GrantRole(ctx context.Context, userID, role, grantedBy string) (*domain.User, error) {
+	if role == auth.RoleCustomer || !auth.ValidRole(role) {
+		return nil, domain.ErrInvalidRole
+	}
+	if _, err := s.repo.Get(ctx, userID); err != nil {
+		return nil, err
+	}
+	if err := s.repo.AddRole(ctx, &domain.UserRole{UserID: userID, Role: role, GrantedBy: grantedBy}); err != nil {
+		logrus.WithError(err).Error("Failed to grant role")
+		return nil, err
+	}
+	logrus.WithFields(logrus.Fields{"user_id": userID, "role": role, "granted_by": grantedBy}).Info("Role granted")
+	return s.reloadUser(ctx, userID)
+}
+
+// RevokeRole revokes role from a user. Tokens issued before keep the role
+// until they are refreshed; revoke the user's sessions as well to end it
+// immediately.
+func (s *Service) RevokeRole(ctx context.Context, userID, role, revokedBy string) (*domain.User, error) {
+	if role == auth.RoleCustomer || !auth.ValidRole(role) {
+		return nil, domain.ErrInvalidRole
+	}
+	if _, err := s.repo.Get(ctx, userID); err != nil {
+		return nil, err
+	}
+	if err := s.repo.RemoveRole(ctx, userID, role); err != nil {
+		logrus.WithError(err).Error("Failed to revoke role")
+		return nil, err
+	}
+	logrus.WithFields(logrus.Fields{"user_id": userID, "role": role, "revoked_by": revokedBy}).Info("Role revoked")
+	return s.reloadUser(ctx, userID)
+}
+
+// invalidateUser drops the cached copy of a changed user.
+func (s *Service) invalidateUser(ctx context.Context, userID string) {
+	if err := s.cache.DeleteUser(ctx, userID); err != nil {
+		logrus.WithError(err).Warn("Failed to invalidate cached user, proceeding")
+	}
+}
+
+// reloadUser invalidates the cached copy of a changed user and loads it
+// again.
+func (s *Service) reloadUser(ctx context.Context, userID string) (*domain.User, error) {
+	s.invalidateUser(ctx, userID)
+	return s.repo.Get(ctx, userID)
+}
+
+// EnsureAdmins grants the admin role to the given users, so a fresh
+// deployment has someone who can grant roles. Unknown users are skipped.
+func (s *Service) EnsureAdmins(ctx context.Context, usernames []string) {
+	for _, username := range usernames {
+		username = strings.TrimSpace(username)
+		if username == "" {
+			continue
+		}
+		u, err := s.repo.GetByUsername(ctx, username)
+		if err != nil {
+			logrus.WithError(err).WithField("username", username).Warn("Cannot bootstrap admin")
+			continue
+		}
+		if _, err := s.GrantRole(ctx, u.ID, auth.RoleAdmin, "bootstrap"); err != nil {
+			logrus.WithError(err).WithField("username", username).Error("Failed to bootstrap admin")
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package application
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"ecommerce/internal/auth"
+	"ecommerce/internal/user/domain"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Tokens are the credentials issued by a login or a refresh.
+type Tokens struct {
+	AccessToken      string
+	Claims           *auth.Claims
+	RefreshToken     string
+	RefreshExpiresAt time.Time
+}
+
+// hashToken returns the hash under which a refresh token is stored.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// newToken returns a random URL-safe token.
+func newToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// startSession opens a session for u and issues its first tokens.
+func (s *Service) startSession(ctx context.Context, u *domain.User, userAgent, clientIP string) (*Tokens, error) {
+	roles, err := s.effectiveRoles(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	var tokens *Tokens
+	err = s.repo.WithTransaction(ctx, func(txCtx context.Context) error {
+		now := time.Now()
+		sess := &domain.Session{
+			UserID:     u.ID,
+			UserAgent:  userAgent,
+			ClientIP:   clientIP,
+			CreatedAt:  now,
+			LastUsedAt: now,
+			ExpiresAt:  now.Add(s.refreshTTL),
+		}
+		if err := s.repo.CreateSession(txCtx, sess); err != nil {
+			return err
+		}
+		var err error
+		tokens, err = s.issueTokens(txCtx, sess, roles, now)
+		return err
+	})
+	return tokens, err
+}
+
+// issueTokens stores a new refresh token for sess, extends the session to its
+// expiry and signs an access token with roles for it. It must run in a
+// transaction.
+func (s *Service) issueTokens(txCtx context.Context, sess *domain.Session, roles []string, now time.Time) (*Tokens, error) {
+	refresh, err := newToken()
+	if err != nil {
+		return nil, err
+	}
+	expiresAt := now.Add(s.refreshTTL)
+	if err := s.repo.CreateRefreshToken(txCtx, &domain.RefreshToken{
+		TokenHash: hashToken(refresh),
+		SessionID: sess.ID,
+		UserID:    sess.UserID,
+		ExpiresAt: expiresAt,
+		CreatedAt: now,
+	}); err != nil {
+		return nil, err
+	}
+	sess.LastUsedAt = now
+	sess.ExpiresAt = expiresAt
+	if err := s.repo.UpdateSession(txCtx, sess); err != nil {
+		return nil, err
+	}
+	access, claims, err := s.signer.Sign(sess.UserID, sess.ID, roles)
+	if err != nil {
+		return nil, err
+	}
+	return &Tokens{AccessToken: access, Claims: claims, RefreshToken: refresh, RefreshExpiresAt: expiresAt}, nil
+}
+
+// Refresh rotates a refresh token: the token is used up and a new access and
+// refresh token are issued for its session. Presenting a token that was
+// already used means it leaked, so the whole session is revoked.
+func (s *Service) Refresh(ctx context.Context, refreshToken string) (*Tokens, error) {
+	if refreshToken == "" {
+		return nil, domain.ErrInvalidRefreshToken
+	}
+	var tokens *Tokens
+	var reused *domain.Session
+	err := s.repo.WithTransaction(ctx, func(txCtx context.Context) error {
+		hash := hashToken(refreshToken)
+		rt, err := s.repo.LockRefreshToken(txCtx, hash)
+		if err != nil {
+			return err
+		}
+		sess, err := s.repo.LockSession(txCtx, rt.SessionID)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		if !sess.Active(now) || !now.Before(rt.ExpiresAt) {
+			return domain.ErrInvalidRefreshToken
+		}
+		if rt.UsedAt != nil {
+			// The revocation is committed; the error is returned after
+			sess.RevokedAt = &now
+			sess.RevokeReason = domain.RevokedTokenReuse
+			reused = sess
+			return s.repo.UpdateSession(txCtx, sess)
+		}
+		if err := s.repo.MarkRefreshTokenUsed(txCtx, hash, now); err != nil {
+			return err
+		}
+		// Roles are read again so that granted and revoked roles, and
+		// two-factor requirements, take effect with the next refresh
+		u, err := s.repo.Get(txCtx, sess.UserID)
+		if err != nil {
+			return err
+		}
+		roles, err := s.effectiveRoles(txCtx, u)
+		if err != nil {
+			return err
+		}
+		tokens, err = s.issueTokens(txCtx, sess, roles, now)
+		return err
+	})
+	if err != nil {
+		if !errors.Is(err, domain.ErrInvalidRefreshToken) {
+			logrus.WithError(err).Error("Failed to refresh token")
+		}
+		return nil, err
+	}
+	if reused != nil {
+		logrus.WithFields(logrus.Fields{"user_id": reused.UserID, "session_id": reused.ID}).Warn("Refresh token reuse detected, session revoked")
+		if err := s.denylist.RevokeSessions(ctx, s.signer.TTL(), reused.ID); err != nil {
+			logrus.WithError(err).Error("Failed to deny access tokens of revoked session")
+		}
+		return nil, domain.ErrRefreshTokenReused
+	}
+	logrus.WithFields(logrus.Fields{"user_id": tokens.Claims.Subject, "session_id": tokens.Claims.SessionID}).Info("Token refreshed")
+	return tokens, nil
+}
+
+// Logout revokes one session of a user. Its refresh tokens stop working and
+// its access tokens are denied immediately.
+func (s *Service) Logout(ctx context.Context, userID, sessionID string) (int, error) {
+	if userID == "" || sessionID == "" {
+		return 0, errors.New("user ID and session ID are required")
+	}
+	revoked := 0
+	err := s.repo.WithTransaction(ctx, func(txCtx context.Context) error {
+		sess, err := s.repo.GetSession(txCtx, userID, sessionID)
+		if err != nil {
+			return err
+		}
+		if sess.RevokedAt != nil {
+			return nil
+		}
+		now := time.Now()
+		sess.RevokedAt = &now
+		sess.RevokeReason = domain.RevokedLogout
+		revoked = 1
+		return s.repo.UpdateSession(txCtx, sess)
+	})
+	if err != nil {
+		return 0, err
+	}
+	if err := s.denylist.RevokeSessions(ctx, s.signer.TTL(), sessionID); err != nil {
+		logrus.WithError(err).Error("Failed to deny access tokens of revoked session")
+		return revoked, fmt.Errorf("session revoked but access tokens stay valid until they expire: %w", err)
+	}
+	logrus.WithFields(logrus.Fields{"user_id": userID, "session_id": sessionID}).Info("Session logged out")
+	return revoked, nil
+}
+
+// LogoutAll revokes every session of a user, e.g. when the account is
+// compromised.
+func (s *Service) LogoutAll(ctx context.Context, userID string) (int, error) {
+	if userID == "" {
+		return 0, errors.New("user ID is required")
+	}
+	ids, err := s.revokeSessions(ctx, userID, "", domain.RevokedLogoutAll)
+	if err != nil {
+		return len(ids), err
+	}
+	logrus.WithFields(logrus.Fields{"user_id": userID, "sessions": len(ids)}).Info("All sessions logged out")
+	return len(ids), nil
+}
+
+// revokeSessions revokes the sessions of a user except keepID, which may be
+// empty, and denies their access tokens.
+func (s *Service) revokeSessions(ctx context.Context, userID, keepID, reason string) ([]string, error) {
+	ids, err := s.repo.RevokeSessions(ctx, userID, keepID, reason, time.Now())
+	if err != nil {
+		logrus.WithError(err).Error("Failed to revoke sessions")
+		return nil, err
+	}
+	if err := s.denylist.RevokeSessions(ctx, s.signer.TTL(), ids...); err != nil {
+		logrus.WithError(err).Error("Failed to deny access tokens of revoked sessions")
+		return ids, fmt.Errorf("sessions revoked but access tokens stay valid until they expire: %w", err)
+	}
+	return ids, nil
+}
+
+// ListSessions returns the active sessions of a user.
+func (s *Service) ListSessions(ctx context.Context, userID string) ([]*domain.Session, error) {
+	if userID == "" {
+		return nil, errors.New("user ID is required")
+	}
+	return s.repo.ListActiveSessions(ctx, userID, time.Now())
+}
@@ -0,0 +1,308 @@
+package application
+
+import (
+	"context"
+	"crypto/rand"
+	"ecommerce/internal/auth"
+	"ecommerce/internal/user/domain"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// TwoFactorSettings configure TOTP two-factor authentication.
+type TwoFactorSettings struct {
+	Issuer       string // Shown as the account's issuer in authenticator apps
+	ChallengeTTL time.Duration
+}
+
+// LoginResult is the outcome of a password login: tokens, or a challenge to
+// complete with VerifyTwoFactorLogin when the user has two-factor
+// authentication enabled.
+type LoginResult struct {
+	Tokens             *Tokens
+	Challenge          string
+	ChallengeExpiresAt time.Time
+}
+
+var recoveryEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// newRecoveryCodes returns fresh recovery codes for display, formatted as
+// xxxx-xxxx-xxxx-xxxx, and their records.
+func newRecoveryCodes(userID string, now time.Time) ([]string, []*domain.RecoveryCode, error) {
+	codes := make([]string, 0, domain.RecoveryCodeCount)
+	records := make([]*domain.RecoveryCode, 0, domain.RecoveryCodeCount)
+	for i := 0; i < domain.RecoveryCodeCount; i++ {
+		b := make([]byte, 10)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		raw := strings.ToLower(recoveryEncoding.EncodeToString(b))
+		codes = append(codes, raw[0:4]+"-"+raw[4:8]+"-"+raw[8:12]+"-"+raw[12:16])
+		records = append(records, &domain.RecoveryCode{CodeHash: hashToken(raw), UserID: userID, CreatedAt: now})
+	}
+	return codes, records, nil
+}
+
+// normalizeRecoveryCode strips the formatting users may or may not type.
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
+
+// checkSecondFactor reports whether code is a valid TOTP code or unused
+// recovery code of u, and uses it up. It must run in a transaction.
+func (s *Service) checkSecondFactor(txCtx context.Context, u *domain.User, code string, now time.Time) (bool, error) {
+	if !u.TOTPEnabled {
+		return false, nil
+	}
+	code = strings.TrimSpace(code)
+	if counter, ok := auth.ValidateTOTP(u.TOTPSecret, code, now); ok {
+		if counter <= u.TOTPCounter {
+			// Replayed code
+			return false, nil
+		}
+		u.TOTPCounter = counter
+		return true, s.repo.Update(txCtx, u)
+	}
+	return s.repo.UseRecoveryCode(txCtx, u.ID, hashToken(normalizeRecoveryCode(code)), now)
+}
+
+// effectiveRoles returns the roles to put in the tokens of u. Roles that
+// require two-factor authentication are left out until u enables it, so that
+// such users can still log in to enroll.
+func (s *Service) effectiveRoles(ctx context.Context, u *domain.User) ([]string, error) {
+	roles := u.RoleNames()
+	if u.TOTPEnabled {
+		return roles, nil
+	}
+	reqs, err := s.repo.ListTwoFactorRequirements(ctx)
+	if err != nil {
+		return nil, err
+	}
+	required := make(map[string]bool, len(reqs))
+	for _, r := range reqs {
+		required[r.Role] = true
+	}
+	effective := make([]string, 0, len(roles))
+	for _, role := range roles {
+		if required[role] {
+			logrus.WithFields(logrus.Fields{"user_id": u.ID, "role": role}).Warn("Role withheld until two-factor authentication is enabled")
+			continue
+		}
+		effective = append(effective, role)
+	}
+	return effective, nil
+}
+
+// challengeTwoFactor issues the challenge of a two-factor login for u.
+func (s *Service) challengeTwoFactor(ctx context.Context, u *domain.User) (*LoginResult, error) {
+	challenge, err := s.issueUserToken(ctx, u.ID, domain.PurposeTwoFactorLogin, s.twoFactor.ChallengeTTL)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to issue two-factor challenge")
+		return nil, err
+	}
+	logrus.WithField("user_id", u.ID).Info("Password verified, two-factor code required")
+	return &LoginResult{Challenge: challenge, ChallengeExpiresAt: time.Now().Add(s.twoFactor.ChallengeTTL)}, nil
+}
+
+// VerifyTwoFactorLogin completes a two-factor login: the challenge returned
+// by Authenticate and a TOTP or recovery code start a session. Wrong codes
+// count as failed logins of the user; the challenge stays valid until it
+// expires or the login succeeds.
+func (s *Service) VerifyTwoFactorLogin(ctx context.Context, challenge, code, userAgent, clientIP string) (*Tokens, error) {
+	if challenge == "" || code == "" {
+		return nil, errors.New("challenge and code are required")
+	}
+	var u *domain.User
+	valid := false
+	err := s.repo.WithTransaction(ctx, func(txCtx context.Context) error {
+		t, err := s.repo.LockUserToken(txCtx, hashToken(challenge), domain.PurposeTwoFactorLogin)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		if t.UsedAt != nil || !now.Before(t.ExpiresAt) {
+			return domain.ErrInvalidToken
+		}
+		u, err = s.repo.Get(txCtx, t.UserID)
+		if errors.Is(err, domain.ErrUserNotFound) {
+			return domain.ErrInvalidToken
+		}
+		if err != nil {
+			return err
+		}
+		locked, err := s.limiter.Locked(ctx, u.Username, clientIP)
+		if err != nil {
+			return err
+		}
+		if locked > 0 {
+			return fmt.Errorf("%w, try again in %s", domain.ErrLoginLocked, locked.Round(time.Second))
+		}
+		valid, err = s.checkSecondFactor(txCtx, u, code, now)
+		if err != nil || !valid {
+			return err
+		}
+		return s.repo.UseUserTokens(txCtx, u.ID, domain.PurposeTwoFactorLogin, now)
+	})
+	if err != nil {
+		if !errors.Is(err, domain.ErrInvalidToken) && !errors.Is(err, domain.ErrLoginLocked) {
+			logrus.WithError(err).Error("Failed to verify two-factor login")
+		}
+		return nil, err
+	}
+	if !valid {
+		s.loginFailed(ctx, u.Username, clientIP)
+		return nil, domain.ErrInvalidTwoFactorCode
+	}
+	if err := s.limiter.Succeed(ctx, u.Username); err != nil {
+		logrus.WithError(err).Warn("Failed to reset failed login count")
+	}
+	tokens, err := s.startSession(ctx, u, userAgent, clientIP)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to start session")
+		return nil, err
+	}
+	logrus.WithFields(logrus.Fields{"user_id": u.ID, "session_id": tokens.Claims.SessionID}).Info("User authenticated with two factors")
+	return tokens, nil
+}
+
+// EnrollTwoFactor generates a TOTP secret for a user and returns it with its
+// provisioning URI. Two-factor authentication is enabled once
+// ConfirmTwoFactor verifies a first code; enrolling again replaces a pending
+// secret.
+func (s *Service) EnrollTwoFactor(ctx context.Context, userID string) (secret, uri string, err error) {
+	u, err := s.repo.Get(ctx, userID)
+	if err != nil {
+		return "", "", err
+	}
+	if u.TOTPEnabled {
+		return "", "", domain.ErrTwoFactorEnabled
+	}
+	secret, err = auth.GenerateTOTPSecret()
+	if err != nil {
+		return "", "", err
+	}
+	u.TOTPSecret = secret
+	u.TOTPCounter = 0
+	if err := s.repo.Update(ctx, u); err != nil {
+		logrus.WithError(err).Error("Failed to store TOTP secret")
+		return "", "", err
+	}
+	s.invalidateUser(ctx, userID)
+	logrus.WithField("user_id", userID).Info("Two-factor enrollment started")
+	return secret, auth.TOTPURI(s.twoFactor.Issuer, u.Username, secret), nil
+}
+
+// ConfirmTwoFactor enables two-factor authentication with the first code
+// from the authenticator and returns the recovery codes, which are not shown
+// again. The other sessions of the user, started with the password alone,
+// are ended; sessionID stays logged in.
+func (s *Service) ConfirmTwoFactor(ctx context.Context, userID, sessionID, code string) ([]string, error) {
+	var codes []string
+	err := s.repo.WithTransaction(ctx, func(txCtx context.Context) error {
+		u, err := s.repo.Get(txCtx, userID)
+		if err != nil {
+			return err
+		}
+		if u.TOTPEnabled {
+			return domain.ErrTwoFactorEnabled
+		}
+		if u.TOTPSecret == "" {
+			return domain.ErrTwoFactorNotEnrolled
+		}
+		now := time.Now()
+		counter, ok := auth.ValidateTOTP(u.TOTPSecret, strings.TrimSpace(code), now)
+		if !ok {
+			return domain.ErrInvalidTwoFactorCode
+		}
+		u.TOTPEnabled = true
+		u.TOTPCounter = counter
+		if err := s.repo.Update(txCtx, u); err != nil {
+			return err
+		}
+		var records []*domain.RecoveryCode
+		codes, records, err = newRecoveryCodes(userID, now)
+		if err != nil {
+			return err
+		}
+		return s.repo.ReplaceRecoveryCodes(txCtx, userID, records)
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.invalidateUser(ctx, userID)
+	if _, err := s.revokeSessions(ctx, userID, sessionID, domain.RevokedTwoFactor); err != nil {
+		return nil, err
+	}
+	logrus.WithField("user_id", userID).Info("Two-factor authentication enabled")
+	return codes, nil
+}
+
+// DisableTwoFactor turns two-factor authentication off and deletes the
+// recovery codes. Users confirm with a TOTP or recovery code; with force, as
+// used by admins for users who lost both, no code is needed.
+func (s *Service) DisableTwoFactor(ctx context.Context, userID, code string, force bool) error {
+	err := s.repo.WithTransaction(ctx, func(txCtx context.Context) error {
+		u, err := s.repo.Get(txCtx, userID)
+		if err != nil {
+			return err
+		}
+		if !u.TOTPEnabled {
+			return domain.ErrTwoFactorNotEnabled
+		}
+		if !force {
+			valid, err := s.checkSecondFactor(txCtx, u, code, time.Now())
+			if err != nil {
+				return err
+			}
+			if !valid {
+				return domain.ErrInvalidTwoFactorCode
+			}
+		}
+		u.TOTPEnabled = false
+		u.TOTPSecret = ""
+		u.TOTPCounter = 0
+		if err := s.repo.Update(txCtx, u); err != nil {
+			return err
+		}
+		return s.repo.ReplaceRecoveryCodes(txCtx, userID, nil)
+	})
+	if err != nil {
+		return err
+	}
+	s.invalidateUser(ctx, userID)
+	logrus.WithFields(logrus.Fields{"user_id": userID, "forced": force}).Info("Two-factor authentication disabled")
+	return nil
+}
+
+// SetTwoFactorRequirement makes two-factor authentication mandatory or
+// optional for role and returns the roles requiring it. Only the elevated
+// roles qualify, since everyone needs the customer role to enroll.
+func (s *Service) SetTwoFactorRequirement(ctx context.Context, role string, required bool, by string) ([]*domain.TwoFactorRequirement, error) {
+	if role == auth.RoleCustomer || !auth.ValidRole(role) {
+		return nil, domain.ErrInvalidRole
+	}
+	var err error
+	if required {
+		err = s.repo.RequireTwoFactor(ctx, &domain.TwoFactorRequirement{Role: role, CreatedBy: by})
+	} else {
+		err = s.repo.UnrequireTwoFactor(ctx, role)
+	}
+	if err != nil {
+		logrus.WithError(err).Error("Failed to set two-factor requirement")
+		return nil, err
+	}
+	logrus.WithFields(logrus.Fields{"role": role, "required": required, "by": by}).Info("Two-factor requirement changed")
+	return s.repo.ListTwoFactorRequirements(ctx)
+}
+
+// ListTwoFactorRequirements returns the roles that require two-factor
+// authentication.
+func (s *Service) ListTwoFactorRequirements(ctx context.Context) ([]*domain.TwoFactorRequirement, error) {
+	return s.repo.ListTwoFactorRequirements(ctx)
+}
@@ -0,0 +1,96 @@
+package domain
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var (
+	ErrAddressNotFound  = errors.New("address not found")
+	ErrInvalidAddress   = errors.New("invalid address")
+	ErrTooManyAddresses = errors.New("address book is full")
+)
+
+// MaxAddresses is the number of addresses a user can keep.
+const MaxAddresses = 20
+
+// Address is an entry of a user's address book. At most one address of a
+// user is the default for shipping and one for billing.
+type Address struct {
+	ID              string `gorm:"primaryKey;type:uuid"`
+	UserID          string `gorm:"type:uuid;not null;index"`
+	Name            string `gorm:"not null"` // Recipient
+	Line1           string `gorm:"not null"`
+	Line2           string
+	City            string `gorm:"not null"`
+	Region          string // State, province or prefecture
+	PostalCode      string
+	Country         string `gorm:"type:char(2);not null"` // ISO 3166-1 alpha-2
+	Phone           string
+	DefaultShipping bool `gorm:"not null;default:false"`
+	DefaultBilling  bool `gorm:"not null;default:false"`
+	CreatedAt       time.Time
+	UpdatedAt       time.Time
+}
+
+// countryFormat describes the address rules of a country.
+type countryFormat struct {
+	postalCode     *regexp.Regexp
+	requiresRegion bool
+}
+
+// countryFormats lists the countries whose addresses are validated beyond
+// the common required fields. Postal codes are matched after upper-casing.
+var countryFormats = map[string]countryFormat{
+	"US": {regexp.MustCompile(`^\d{5}(-\d{4})?$`), true},
+	"CA": {regexp.MustCompile(`^[A-Z]\d[A-Z] ?\d[A-Z]\d$`), true},
+	"GB": {regexp.MustCompile(`^[A-Z]{1,2}\d[A-Z\d]? ?\d[A-Z]{2}$`), false},
+	"DE": {regexp.MustCompile(`^\d{5}$`), false},
+	"FR": {regexp.MustCompile(`^\d{5}$`), false},
+	"NL": {regexp.MustCompile(`^\d{4} ?[A-Z]{2}$`), false},
+	"AU": {regexp.MustCompile(`^\d{4}$`), true},
+	"BR": {regexp.MustCompile(`^\d{5}-?\d{3}$`), true},
+	"IN": {regexp.MustCompile(`^\d{6}$`), true},
+	"JP": {regexp.MustCompile(`^\d{3}-?\d{4}$`), true},
+	"PK": {regexp.MustCompile(`^\d{5}$`), false},
+}
+
+var countryCode = regexp.MustCompile(`^[A-Z]{2}$`)
+
+// Normalize trims the fields and upper-cases the country and postal code.
+func (a *Address) Normalize() {
+	for _, f := range []*string{&a.Name, &a.Line1, &a.Line2, &a.City, &a.Region, &a.PostalCode, &a.Country, &a.Phone} {
+		*f = strings.TrimSpace(*f)
+	}
+	a.Country = strings.ToUpper(a.Country)
+	a.PostalCode = strings.ToUpper(a.PostalCode)
+}
+
+// Validate checks the required fields and, for known countries, the postal
+// code format and region. Call Normalize first.
+func (a *Address) Validate() error {
+	switch {
+	case a.Name == "":
+		return fmt.Errorf("%w: name is required", ErrInvalidAddress)
+	case a.Line1 == "":
+		return fmt.Errorf("%w: line1 is required", ErrInvalidAddress)
+	case a.City == "":
+		return fmt.Errorf("%w: city is required", ErrInvalidAddress)
+	case !countryCode.MatchString(a.Country):
+		return fmt.Errorf("%w: country must be an ISO 3166-1 alpha-2 code", ErrInvalidAddress)
+	}
+	format, ok := countryFormats[a.Country]
+	if !ok {
+		return nil
+	}
+	if !format.postalCode.MatchString(a.PostalCode) {
+		return fmt.Errorf("%w: invalid postal code %q for %s", ErrInvalidAddress, a.PostalCode, a.Country)
+	}
+	if format.requiresRegion && a.Region == "" {
+		return fmt.Errorf("%w: region is required for %s", ErrInvalidAddress, a.Country)
+	}
+	return nil
+}
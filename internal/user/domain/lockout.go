@@ -0,0 +1,44 @@
+package domain
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	// ErrInvalidCredentials is returned for every failed login, whether the
+	// user does not exist or the password is wrong.
+	ErrInvalidCredentials  = errors.New("invalid credentials")
+	ErrLoginLocked         = errors.New("too many failed login attempts")
+	ErrInvalidLockoutScope = errors.New("invalid lockout scope")
+)
+
+// Lockout scopes: failed logins are counted per username and per client IP.
+const (
+	LockoutScopeUsername = "username"
+	LockoutScopeIP       = "ip"
+)
+
+// ValidLockoutScope reports whether scope is a lockout scope.
+func ValidLockoutScope(scope string) bool {
+	return scope == LockoutScopeUsername || scope == LockoutScopeIP
+}
+
+// Lockout is the audit record of logins for a username or from an IP address
+// being locked after repeated failures. The subject need not be a registered
+// username.
+type Lockout struct {
+	ID          string    `gorm:"primaryKey;type:uuid"`
+	Scope       string    `gorm:"not null;index:idx_lockouts_subject"`
+	Subject     string    `gorm:"not null;index:idx_lockouts_subject"`
+	Attempts    int       `gorm:"not null"`
+	LockedUntil time.Time `gorm:"not null;index"`
+	CreatedAt   time.Time
+	ClearedAt   *time.Time
+	ClearedBy   string
+}
+
+// Active reports whether the lockout still blocks logins at now.
+func (l *Lockout) Active(now time.Time) bool {
+	return l.ClearedAt == nil && now.Before(l.LockedUntil)
+}
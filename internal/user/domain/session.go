@@ -0,0 +1,53 @@
+package domain
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ErrSessionNotFound     = errors.New("session not found")
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+	ErrRefreshTokenReused  = errors.New("refresh token reused")
+)
+
+// Session revocation reasons.
+const (
+	RevokedLogout     = "logout"
+	RevokedLogoutAll  = "logout_all"
+	RevokedTokenReuse = "refresh_token_reuse"
+	RevokedPassword   = "password_changed"
+	RevokedDeleted    = "account_deleted"
+	RevokedTwoFactor  = "two_factor_enabled"
+)
+
+// Session is a login of a user. It lives as long as its refresh tokens are
+// rotated before they expire, and ends when it is revoked.
+type Session struct {
+	ID           string `gorm:"primaryKey;type:uuid"`
+	UserID       string `gorm:"type:uuid;not null;index"`
+	UserAgent    string
+	ClientIP     string
+	CreatedAt    time.Time
+	LastUsedAt   time.Time
+	ExpiresAt    time.Time `gorm:"not null"`
+	RevokedAt    *time.Time
+	RevokeReason string
+}
+
+// Active reports whether the session can still be used at now.
+func (s *Session) Active(now time.Time) bool {
+	return s.RevokedAt == nil && now.Before(s.ExpiresAt)
+}
+
+// RefreshToken is a single-use refresh token of a session. Only the SHA-256
+// hash of the token is stored. Refreshing marks the token used and issues a
+// new one; presenting a used token again revokes the whole session.
+type RefreshToken struct {
+	TokenHash string    `gorm:"primaryKey"`
+	SessionID string    `gorm:"type:uuid;not null;index"`
+	UserID    string    `gorm:"type:uuid;not null"`
+	ExpiresAt time.Time `gorm:"not null"`
+	UsedAt    *time.Time
+	CreatedAt time.Time
+}
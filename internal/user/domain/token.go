@@ -0,0 +1,34 @@
+package domain
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ErrInvalidToken    = errors.New("invalid or expired token")
+	ErrAlreadyVerified = errors.New("email already verified")
+	ErrWeakPassword    = errors.New("password must be at least 8 characters")
+)
+
+// User token purposes.
+const (
+	PurposePasswordReset     = "password_reset"
+	PurposeEmailVerification = "email_verification"
+	PurposeTwoFactorLogin    = "two_factor_login"
+)
+
+// MinPasswordLength is the shortest password accepted when a password is set.
+const MinPasswordLength = 8
+
+// UserToken is a single-use, time-limited token mailed to a user to prove
+// access to their email address, or handed out as the challenge of a
+// two-factor login. Only the SHA-256 hash of the token is stored.
+type UserToken struct {
+	TokenHash string    `gorm:"primaryKey"`
+	UserID    string    `gorm:"type:uuid;not null;index"`
+	Purpose   string    `gorm:"not null"`
+	ExpiresAt time.Time `gorm:"not null"`
+	UsedAt    *time.Time
+	CreatedAt time.Time
+}
@@ -0,0 +1,35 @@
+package domain
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ErrTwoFactorEnabled     = errors.New("two-factor authentication already enabled")
+	ErrTwoFactorNotEnabled  = errors.New("two-factor authentication not enabled")
+	ErrTwoFactorNotEnrolled = errors.New("no two-factor enrollment pending")
+	ErrInvalidTwoFactorCode = errors.New("invalid two-factor code")
+)
+
+// RecoveryCodeCount is the number of recovery codes issued when two-factor
+// authentication is enabled.
+const RecoveryCodeCount = 10
+
+// RecoveryCode is a one-time code that replaces a TOTP code when the
+// authenticator is lost. Only the SHA-256 hash of the code is stored.
+type RecoveryCode struct {
+	CodeHash  string `gorm:"primaryKey"`
+	UserID    string `gorm:"type:uuid;not null;index"`
+	UsedAt    *time.Time
+	CreatedAt time.Time
+}
+
+// TwoFactorRequirement makes two-factor authentication mandatory for a role:
+// users holding it without having enabled two-factor authentication do not
+// get the role in their tokens.
+type TwoFactorRequirement struct {
+	Role      string `gorm:"primaryKey"`
+	CreatedBy string
+	CreatedAt time.Time
+}
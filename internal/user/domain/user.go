@@ -1,12 +1,59 @@
 package domain
 
-import "time"
+import (
+	"ecommerce/internal/auth"
+	"errors"
+	"time"
+)
+
+var (
+	ErrUserNotFound    = errors.New("user not found")
+	ErrInvalidRole     = errors.New("invalid role")
+	ErrUserExists      = errors.New("username or email already in use")
+	ErrInvalidPassword = errors.New("current password is incorrect")
+	ErrVersionConflict = errors.New("version conflict")
+)
 
 type User struct {
-	ID        string    `gorm:"primaryKey;type:uuid"` // CHANGED: Added type:uuid
-	Username  string    `gorm:"unique;not null"`
-	Password  string    `gorm:"not null"`
-	Email     string    `gorm:"unique"` // CHANGED: Added unique to match schema
-	CreatedAt time.Time // ADDED: To match existing created_at column
-	UpdatedAt time.Time // ADDED: To match existing updated_at column
+	ID        string     `gorm:"primaryKey;type:uuid"` // CHANGED: Added type:uuid
+	Username  string     `gorm:"unique;not null"`
+	Password  string     `gorm:"not null"`
+	Email     string     `gorm:"unique"` // CHANGED: Added unique to match schema
+	Verified  bool       `gorm:"not null;default:false"`
+	CreatedAt time.Time  // ADDED: To match existing created_at column
+	UpdatedAt time.Time  // ADDED: To match existing updated_at column
+	Version   int        `gorm:"not null;default:1"` // Bumped by every update, for optimistic concurrency
+	Roles     []UserRole `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE"`
+
+	// TOTPSecret is set on enrollment and TOTPEnabled once the first code is
+	// verified. TOTPCounter is the time step of the last accepted code, so
+	// that a code cannot be used twice.
+	TOTPSecret  string `json:"-"`
+	TOTPEnabled bool   `gorm:"not null;default:false"`
+	TOTPCounter int64  `json:"-"`
+
+	// DeletedAt is set when the account is deleted. Its personal data is
+	// kept for a grace period and then anonymized, which sets AnonymizedAt.
+	DeletedAt    *time.Time `gorm:"index"`
+	AnonymizedAt *time.Time
+}
+
+// UserRole is a role granted to a user on top of the customer role every
+// user has.
+type UserRole struct {
+	UserID    string `gorm:"primaryKey;type:uuid"`
+	Role      string `gorm:"primaryKey"`
+	GrantedBy string
+	CreatedAt time.Time
+}
+
+// RoleNames returns all roles of the user, starting with customer.
+func (u *User) RoleNames() []string {
+	names := []string{auth.RoleCustomer}
+	for _, r := range u.Roles {
+		if r.Role != auth.RoleCustomer {
+			names = append(names, r.Role)
+		}
+	}
+	return names
 }
@@ -2,11 +2,14 @@ package user
 
 import (
 	"context"
+	"ecommerce/internal/auth"
 	"ecommerce/internal/user/application"
 	"ecommerce/internal/user/domain"
 	"ecommerce/proto"
+	"errors"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"time"
 )
 
 type Server struct {
@@ -30,35 +33,589 @@ func (s *Server) RegisterUser(ctx context.Context, req *proto.RegisterUserReques
 	if err := s.svc.Register(ctx, u); err != nil {
 		return nil, status.Errorf(codes.Internal, "failed to register user: %v", err)
 	}
+	return toUserResponse(u), nil
+}
+
+func toUserResponse(u *domain.User) *proto.UserResponse {
 	return &proto.UserResponse{
-		Id:       u.ID,
-		Username: u.Username,
-		Email:    u.Email,
-	}, nil
+		Id:               u.ID,
+		Username:         u.Username,
+		Email:            u.Email,
+		Roles:            u.RoleNames(),
+		Verified:         u.Verified,
+		TwoFactorEnabled: u.TOTPEnabled,
+		Version:          int64(u.Version),
+	}
+}
+
+// authorizeUser allows callers to act on their own account, and on any
+// account if they hold anyPerm.
+func authorizeUser(ctx context.Context, userID string, anyPerm auth.Permission) error {
+	claims, ok := auth.ClaimsFromContext(ctx)
+	if !ok {
+		return status.Errorf(codes.Unauthenticated, "missing token")
+	}
+	if claims.UserID() != userID && !claims.Can(anyPerm) {
+		return status.Errorf(codes.PermissionDenied, "missing permission %s", anyPerm)
+	}
+	return nil
 }
 
 func (s *Server) AuthenticateUser(ctx context.Context, req *proto.AuthenticateUserRequest) (*proto.AuthResponse, error) {
 	if req.Username == "" || req.Password == "" {
 		return nil, status.Errorf(codes.InvalidArgument, "username and password are required")
 	}
-	token, err := s.svc.Authenticate(ctx, req.Username, req.Password)
+	result, err := s.svc.Authenticate(ctx, req.Username, req.Password, req.UserAgent, req.ClientIp)
 	if err != nil {
-		return nil, status.Errorf(codes.Unauthenticated, "authentication failed: %v", err)
+		switch {
+		case errors.Is(err, domain.ErrInvalidCredentials):
+			return nil, status.Errorf(codes.Unauthenticated, "authentication failed: %v", err)
+		case errors.Is(err, domain.ErrLoginLocked):
+			return nil, status.Errorf(codes.ResourceExhausted, "authentication failed: %v", err)
+		}
+		return nil, status.Errorf(codes.Internal, "authentication failed: %v", err)
+	}
+	if result.Tokens == nil {
+		return &proto.AuthResponse{
+			TwoFactorRequired:  true,
+			Challenge:          result.Challenge,
+			ChallengeExpiresIn: int64(time.Until(result.ChallengeExpiresAt).Seconds()),
+		}, nil
+	}
+	return toAuthResponse(result.Tokens), nil
+}
+
+func toAuthResponse(t *application.Tokens) *proto.AuthResponse {
+	return &proto.AuthResponse{
+		Token:            t.AccessToken,
+		TokenType:        "Bearer",
+		ExpiresIn:        int64(time.Until(t.Claims.ExpiresAt.Time).Seconds()),
+		UserId:           t.Claims.Subject,
+		RefreshToken:     t.RefreshToken,
+		RefreshExpiresIn: int64(time.Until(t.RefreshExpiresAt).Seconds()),
+		SessionId:        t.Claims.SessionID,
 	}
-	return &proto.AuthResponse{Token: token}, nil
 }
 
 func (s *Server) GetUserProfile(ctx context.Context, req *proto.GetUserProfileRequest) (*proto.UserResponse, error) {
 	if req.Id == "" {
 		return nil, status.Errorf(codes.InvalidArgument, "user ID is required")
 	}
+	if err := authorizeUser(ctx, req.Id, auth.PermUsersReadAny); err != nil {
+		return nil, err
+	}
 	u, err := s.svc.GetProfile(ctx, req.Id)
 	if err != nil {
 		return nil, status.Errorf(codes.NotFound, "user not found: %v", err)
 	}
-	return &proto.UserResponse{
-		Id:       u.ID,
-		Username: u.Username,
-		Email:    u.Email,
-	}, nil
+	return toUserResponse(u), nil
+}
+
+func (s *Server) GetJWKS(ctx context.Context, req *proto.GetJWKSRequest) (*proto.JWKSResponse, error) {
+	resp := &proto.JWKSResponse{}
+	for _, k := range s.svc.JWKS().Keys {
+		resp.Keys = append(resp.Keys, &proto.JWK{Kty: k.Kty, Kid: k.Kid, Use: k.Use, Alg: k.Alg, N: k.N, E: k.E})
+	}
+	return resp, nil
+}
+
+func (s *Server) RefreshToken(ctx context.Context, req *proto.RefreshTokenRequest) (*proto.AuthResponse, error) {
+	if req.RefreshToken == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "refresh token is required")
+	}
+	tokens, err := s.svc.Refresh(ctx, req.RefreshToken)
+	if err != nil {
+		if errors.Is(err, domain.ErrInvalidRefreshToken) || errors.Is(err, domain.ErrRefreshTokenReused) {
+			return nil, status.Errorf(codes.Unauthenticated, "%v", err)
+		}
+		return nil, status.Errorf(codes.Internal, "failed to refresh token: %v", err)
+	}
+	return toAuthResponse(tokens), nil
+}
+
+func (s *Server) Logout(ctx context.Context, req *proto.LogoutRequest) (*proto.LogoutResponse, error) {
+	if req.UserId == "" || req.SessionId == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "user ID and session ID are required")
+	}
+	if err := authorizeUser(ctx, req.UserId, auth.PermSessionsRevoke); err != nil {
+		return nil, err
+	}
+	revoked, err := s.svc.Logout(ctx, req.UserId, req.SessionId)
+	if err != nil {
+		if errors.Is(err, domain.ErrSessionNotFound) {
+			return nil, status.Errorf(codes.NotFound, "%v", err)
+		}
+		return nil, status.Errorf(codes.Internal, "failed to log out: %v", err)
+	}
+	return &proto.LogoutResponse{RevokedSessions: int32(revoked)}, nil
+}
+
+func (s *Server) LogoutAllSessions(ctx context.Context, req *proto.LogoutAllSessionsRequest) (*proto.LogoutResponse, error) {
+	if req.UserId == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "user ID is required")
+	}
+	if err := authorizeUser(ctx, req.UserId, auth.PermSessionsRevoke); err != nil {
+		return nil, err
+	}
+	revoked, err := s.svc.LogoutAll(ctx, req.UserId)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to log out sessions: %v", err)
+	}
+	return &proto.LogoutResponse{RevokedSessions: int32(revoked)}, nil
+}
+
+func (s *Server) ListSessions(ctx context.Context, req *proto.ListSessionsRequest) (*proto.ListSessionsResponse, error) {
+	if req.UserId == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "user ID is required")
+	}
+	if err := authorizeUser(ctx, req.UserId, auth.PermSessionsRevoke); err != nil {
+		return nil, err
+	}
+	sessions, err := s.svc.ListSessions(ctx, req.UserId)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to list sessions: %v", err)
+	}
+	resp := &proto.ListSessionsResponse{}
+	for _, sess := range sessions {
+		resp.Sessions = append(resp.Sessions, &proto.Session{
+			Id:         sess.ID,
+			UserAgent:  sess.UserAgent,
+			ClientIp:   sess.ClientIP,
+			CreatedAt:  sess.CreatedAt.Format(time.RFC3339),
+			LastUsedAt: sess.LastUsedAt.Format(time.RFC3339),
+			ExpiresAt:  sess.ExpiresAt.Format(time.RFC3339),
+		})
+	}
+	return resp, nil
+}
+
+func (s *Server) GrantRole(ctx context.Context, req *proto.RoleRequest) (*proto.UserResponse, error) {
+	if req.UserId == "" || req.Role == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "user ID and role are required")
+	}
+	claims, _ := auth.ClaimsFromContext(ctx)
+	u, err := s.svc.GrantRole(ctx, req.UserId, req.Role, claims.UserID())
+	if err != nil {
+		return nil, roleError(err)
+	}
+	return toUserResponse(u), nil
+}
+
+func (s *Server) RevokeRole(ctx context.Context, req *proto.RoleRequest) (*proto.UserResponse, error) {
+	if req.UserId == "" || req.Role == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "user ID and role are required")
+	}
+	claims, _ := auth.ClaimsFromContext(ctx)
+	u, err := s.svc.RevokeRole(ctx, req.UserId, req.Role, claims.UserID())
+	if err != nil {
+		return nil, roleError(err)
+	}
+	return toUserResponse(u), nil
+}
+
+func roleError(err error) error {
+	switch {
+	case errors.Is(err, domain.ErrInvalidRole):
+		return status.Errorf(codes.InvalidArgument, "%v", err)
+	case errors.Is(err, domain.ErrUserNotFound):
+		return status.Errorf(codes.NotFound, "%v", err)
+	default:
+		return status.Errorf(codes.Internal, "failed to change role: %v", err)
+	}
+}
+
+func (s *Server) RequestPasswordReset(ctx context.Context, req *proto.RequestPasswordResetRequest) (*proto.UserEmpty, error) {
+	if req.Email == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "email is required")
+	}
+	if err := s.svc.RequestPasswordReset(ctx, req.Email); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to request password reset: %v", err)
+	}
+	return &proto.UserEmpty{}, nil
+}
+
+func (s *Server) ResetPassword(ctx context.Context, req *proto.ResetPasswordRequest) (*proto.UserEmpty, error) {
+	if req.Token == "" || req.NewPassword == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "token and new password are required")
+	}
+	if err := s.svc.ResetPassword(ctx, req.Token, req.NewPassword); err != nil {
+		return nil, accountError(err)
+	}
+	return &proto.UserEmpty{}, nil
+}
+
+func (s *Server) SendVerificationEmail(ctx context.Context, req *proto.SendVerificationEmailRequest) (*proto.UserEmpty, error) {
+	if req.UserId == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "user ID is required")
+	}
+	if err := authorizeUser(ctx, req.UserId, auth.PermUsersReadAny); err != nil {
+		return nil, err
+	}
+	if err := s.svc.SendVerificationEmail(ctx, req.UserId); err != nil {
+		return nil, accountError(err)
+	}
+	return &proto.UserEmpty{}, nil
+}
+
+func (s *Server) VerifyEmail(ctx context.Context, req *proto.VerifyEmailRequest) (*proto.UserResponse, error) {
+	if req.Token == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "token is required")
+	}
+	u, err := s.svc.VerifyEmail(ctx, req.Token)
+	if err != nil {
+		return nil, accountError(err)
+	}
+	return toUserResponse(u), nil
+}
+
+func accountError(err error) error {
+	switch {
+	case errors.Is(err, domain.ErrInvalidToken), errors.Is(err, domain.ErrWeakPassword):
+		return status.Errorf(codes.InvalidArgument, "%v", err)
+	case errors.Is(err, domain.ErrUserExists):
+		return status.Errorf(codes.AlreadyExists, "%v", err)
+	case errors.Is(err, domain.ErrInvalidPassword):
+		return status.Errorf(codes.PermissionDenied, "%v", err)
+	case errors.Is(err, domain.ErrInvalidTwoFactorCode):
+		return status.Errorf(codes.InvalidArgument, "%v", err)
+	case errors.Is(err, domain.ErrAlreadyVerified), errors.Is(err, domain.ErrTwoFactorEnabled),
+		errors.Is(err, domain.ErrTwoFactorNotEnabled), errors.Is(err, domain.ErrTwoFactorNotEnrolled):
+		return status.Errorf(codes.FailedPrecondition, "%v", err)
+	case errors.Is(err, domain.ErrUserNotFound):
+		return status.Errorf(codes.NotFound, "%v", err)
+	case errors.Is(err, domain.ErrVersionConflict):
+		return status.Errorf(codes.Aborted, "%v", err)
+	default:
+		return status.Errorf(codes.Internal, "%v", err)
+	}
+}
+
+func (s *Server) UpdateUserProfile(ctx context.Context, req *proto.UpdateUserProfileRequest) (*proto.UserResponse, error) {
+	if req.UserId == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "user ID is required")
+	}
+	if req.Username == "" && req.Email == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "username or email is required")
+	}
+	if err := authorizeUser(ctx, req.UserId, auth.PermUsersUpdateAny); err != nil {
+		return nil, err
+	}
+	u, err := s.svc.UpdateProfile(ctx, req.UserId, req.Username, req.Email, int(req.ExpectedVersion))
+	if err != nil {
+		return nil, accountError(err)
+	}
+	return toUserResponse(u), nil
+}
+
+// ChangePassword is only open to the account owner, since it needs the
+// current password; others reset it by email.
+func (s *Server) ChangePassword(ctx context.Context, req *proto.ChangePasswordRequest) (*proto.UserEmpty, error) {
+	if req.UserId == "" || req.CurrentPassword == "" || req.NewPassword == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "user ID, current password and new password are required")
+	}
+	claims, ok := auth.ClaimsFromContext(ctx)
+	if !ok {
+		return nil, status.Errorf(codes.Unauthenticated, "missing token")
+	}
+	if claims.UserID() != req.UserId {
+		return nil, status.Errorf(codes.PermissionDenied, "cannot change the password of another user")
+	}
+	if err := s.svc.ChangePassword(ctx, req.UserId, claims.SessionID, req.CurrentPassword, req.NewPassword); err != nil {
+		return nil, accountError(err)
+	}
+	return &proto.UserEmpty{}, nil
+}
+
+func (s *Server) DeleteUser(ctx context.Context, req *proto.DeleteUserRequest) (*proto.UserEmpty, error) {
+	if req.UserId == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "user ID is required")
+	}
+	if err := authorizeUser(ctx, req.UserId, auth.PermUsersUpdateAny); err != nil {
+		return nil, err
+	}
+	if err := s.svc.DeleteUser(ctx, req.UserId); err != nil {
+		return nil, accountError(err)
+	}
+	return &proto.UserEmpty{}, nil
+}
+
+func (s *Server) ListLockouts(ctx context.Context, req *proto.ListLockoutsRequest) (*proto.ListLockoutsResponse, error) {
+	lockouts, err := s.svc.ListLockouts(ctx, req.Scope, req.Subject, req.ActiveOnly, int(req.Limit))
+	if err != nil {
+		if errors.Is(err, domain.ErrInvalidLockoutScope) {
+			return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+		}
+		return nil, status.Errorf(codes.Internal, "failed to list lockouts: %v", err)
+	}
+	now := time.Now()
+	resp := &proto.ListLockoutsResponse{}
+	for _, l := range lockouts {
+		lockout := &proto.Lockout{
+			Id:          l.ID,
+			Scope:       l.Scope,
+			Subject:     l.Subject,
+			Attempts:    int32(l.Attempts),
+			LockedUntil: l.LockedUntil.Format(time.RFC3339),
+			CreatedAt:   l.CreatedAt.Format(time.RFC3339),
+			ClearedBy:   l.ClearedBy,
+			Active:      l.Active(now),
+		}
+		if l.ClearedAt != nil {
+			lockout.ClearedAt = l.ClearedAt.Format(time.RFC3339)
+		}
+		resp.Lockouts = append(resp.Lockouts, lockout)
+	}
+	return resp, nil
+}
+
+func (s *Server) ClearLockout(ctx context.Context, req *proto.ClearLockoutRequest) (*proto.ClearLockoutResponse, error) {
+	if req.Scope == "" || req.Subject == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "scope and subject are required")
+	}
+	clearedBy := ""
+	if claims, ok := auth.ClaimsFromContext(ctx); ok {
+		clearedBy = claims.UserID()
+	}
+	cleared, err := s.svc.ClearLockout(ctx, req.Scope, req.Subject, clearedBy)
+	if err != nil {
+		if errors.Is(err, domain.ErrInvalidLockoutScope) {
+			return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+		}
+		return nil, status.Errorf(codes.Internal, "failed to clear lockout: %v", err)
+	}
+	return &proto.ClearLockoutResponse{Cleared: int32(cleared)}, nil
+}
+
+func (s *Server) VerifyTwoFactorLogin(ctx context.Context, req *proto.VerifyTwoFactorLoginRequest) (*proto.AuthResponse, error) {
+	if req.Challenge == "" || req.Code == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "challenge and code are required")
+	}
+	tokens, err := s.svc.VerifyTwoFactorLogin(ctx, req.Challenge, req.Code, req.UserAgent, req.ClientIp)
+	if err != nil {
+		switch {
+		case errors.Is(err, domain.ErrInvalidToken), errors.Is(err, domain.ErrInvalidTwoFactorCode):
+			return nil, status.Errorf(codes.Unauthenticated, "authentication failed: %v", err)
+		case errors.Is(err, domain.ErrLoginLocked):
+			return nil, status.Errorf(codes.ResourceExhausted, "authentication failed: %v", err)
+		}
+		return nil, status.Errorf(codes.Internal, "authentication failed: %v", err)
+	}
+	return toAuthResponse(tokens), nil
+}
+
+// callerSession returns the session of the caller, who must be the owner of
+// userID's account.
+func callerSession(ctx context.Context, userID string) (string, error) {
+	claims, ok := auth.ClaimsFromContext(ctx)
+	if !ok {
+		return "", status.Errorf(codes.Unauthenticated, "missing token")
+	}
+	if claims.UserID() != userID {
+		return "", status.Errorf(codes.PermissionDenied, "only the account owner can do this")
+	}
+	return claims.SessionID, nil
+}
+
+func (s *Server) EnrollTwoFactor(ctx context.Context, req *proto.EnrollTwoFactorRequest) (*proto.EnrollTwoFactorResponse, error) {
+	if req.UserId == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "user ID is required")
+	}
+	if _, err := callerSession(ctx, req.UserId); err != nil {
+		return nil, err
+	}
+	secret, uri, err := s.svc.EnrollTwoFactor(ctx, req.UserId)
+	if err != nil {
+		return nil, accountError(err)
+	}
+	return &proto.EnrollTwoFactorResponse{Secret: secret, ProvisioningUri: uri}, nil
+}
+
+func (s *Server) ConfirmTwoFactor(ctx context.Context, req *proto.ConfirmTwoFactorRequest) (*proto.ConfirmTwoFactorResponse, error) {
+	if req.UserId == "" || req.Code == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "user ID and code are required")
+	}
+	sessionID, err := callerSession(ctx, req.UserId)
+	if err != nil {
+		return nil, err
+	}
+	recoveryCodes, err := s.svc.ConfirmTwoFactor(ctx, req.UserId, sessionID, req.Code)
+	if err != nil {
+		return nil, accountError(err)
+	}
+	return &proto.ConfirmTwoFactorResponse{RecoveryCodes: recoveryCodes}, nil
+}
+
+// DisableTwoFactor needs a code from the account owner. Admins may disable
+// it for other users without one, e.g. when both the authenticator and the
+// recovery codes are lost.
+func (s *Server) DisableTwoFactor(ctx context.Context, req *proto.DisableTwoFactorRequest) (*proto.UserEmpty, error) {
+	if req.UserId == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "user ID is required")
+	}
+	if err := authorizeUser(ctx, req.UserId, auth.PermUsersUpdateAny); err != nil {
+		return nil, err
+	}
+	claims, _ := auth.ClaimsFromContext(ctx)
+	force := claims.UserID() != req.UserId
+	if !force && req.Code == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "code is required")
+	}
+	if err := s.svc.DisableTwoFactor(ctx, req.UserId, req.Code, force); err != nil {
+		return nil, accountError(err)
+	}
+	return &proto.UserEmpty{}, nil
+}
+
+func toTwoFactorRequirementsResponse(reqs []*domain.TwoFactorRequirement) *proto.TwoFactorRequirementsResponse {
+	resp := &proto.TwoFactorRequirementsResponse{}
+	for _, r := range reqs {
+		resp.Roles = append(resp.Roles, r.Role)
+	}
+	return resp
+}
+
+func (s *Server) SetTwoFactorRequirement(ctx context.Context, req *proto.TwoFactorRequirementRequest) (*proto.TwoFactorRequirementsResponse, error) {
+	if req.Role == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "role is required")
+	}
+	by := ""
+	if claims, ok := auth.ClaimsFromContext(ctx); ok {
+		by = claims.UserID()
+	}
+	reqs, err := s.svc.SetTwoFactorRequirement(ctx, req.Role, req.Required, by)
+	if err != nil {
+		if errors.Is(err, domain.ErrInvalidRole) {
+			return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+		}
+		return nil, status.Errorf(codes.Internal, "failed to set two-factor requirement: %v", err)
+	}
+	return toTwoFactorRequirementsResponse(reqs), nil
+}
+
+func (s *Server) ListTwoFactorRequirements(ctx context.Context, req *proto.UserEmpty) (*proto.TwoFactorRequirementsResponse, error) {
+	reqs, err := s.svc.ListTwoFactorRequirements(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to list two-factor requirements: %v", err)
+	}
+	return toTwoFactorRequirementsResponse(reqs), nil
+}
+
+func toAddress(a *proto.Address) *domain.Address {
+	return &domain.Address{
+		ID:              a.Id,
+		UserID:          a.UserId,
+		Name:            a.Name,
+		Line1:           a.Line1,
+		Line2:           a.Line2,
+		City:            a.City,
+		Region:          a.Region,
+		PostalCode:      a.PostalCode,
+		Country:         a.Country,
+		Phone:           a.Phone,
+		DefaultShipping: a.DefaultShipping,
+		DefaultBilling:  a.DefaultBilling,
+	}
+}
+
+func toAddressResponse(a *domain.Address) *proto.Address {
+	return &proto.Address{
+		Id:              a.ID,
+		UserId:          a.UserID,
+		Name:            a.Name,
+		Line1:           a.Line1,
+		Line2:           a.Line2,
+		City:            a.City,
+		Region:          a.Region,
+		PostalCode:      a.PostalCode,
+		Country:         a.Country,
+		Phone:           a.Phone,
+		DefaultShipping: a.DefaultShipping,
+		DefaultBilling:  a.DefaultBilling,
+	}
+}
+
+func addressError(err error) error {
+	switch {
+	case errors.Is(err, domain.ErrInvalidAddress):
+		return status.Errorf(codes.InvalidArgument, "%v", err)
+	case errors.Is(err, domain.ErrAddressNotFound), errors.Is(err, domain.ErrUserNotFound):
+		return status.Errorf(codes.NotFound, "%v", err)
+	case errors.Is(err, domain.ErrTooManyAddresses):
+		return status.Errorf(codes.FailedPrecondition, "%v", err)
+	default:
+		return status.Errorf(codes.Internal, "%v", err)
+	}
+}
+
+func (s *Server) CreateAddress(ctx context.Context, req *proto.Address) (*proto.Address, error) {
+	if req.UserId == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "user ID is required")
+	}
+	if err := authorizeUser(ctx, req.UserId, auth.PermUsersUpdateAny); err != nil {
+		return nil, err
+	}
+	a := toAddress(req)
+	if err := s.svc.CreateAddress(ctx, a); err != nil {
+		return nil, addressError(err)
+	}
+	return toAddressResponse(a), nil
+}
+
+func (s *Server) GetAddress(ctx context.Context, req *proto.GetAddressRequest) (*proto.Address, error) {
+	if req.UserId == "" || req.Id == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "user ID and address ID are required")
+	}
+	if err := authorizeUser(ctx, req.UserId, auth.PermUsersReadAny); err != nil {
+		return nil, err
+	}
+	a, err := s.svc.GetAddress(ctx, req.UserId, req.Id)
+	if err != nil {
+		return nil, addressError(err)
+	}
+	return toAddressResponse(a), nil
+}
+
+func (s *Server) ListAddresses(ctx context.Context, req *proto.ListAddressesRequest) (*proto.ListAddressesResponse, error) {
+	if req.UserId == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "user ID is required")
+	}
+	if err := authorizeUser(ctx, req.UserId, auth.PermUsersReadAny); err != nil {
+		return nil, err
+	}
+	addresses, err := s.svc.ListAddresses(ctx, req.UserId)
+	if err != nil {
+		return nil, addressError(err)
+	}
+	resp := &proto.ListAddressesResponse{}
+	for _, a := range addresses {
+		resp.Addresses = append(resp.Addresses, toAddressResponse(a))
+	}
+	return resp, nil
+}
+
+func (s *Server) UpdateAddress(ctx context.Context, req *proto.Address) (*proto.Address, error) {
+	if req.UserId == "" || req.Id == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "user ID and address ID are required")
+	}
+	if err := authorizeUser(ctx, req.UserId, auth.PermUsersUpdateAny); err != nil {
+		return nil, err
+	}
+	a := toAddress(req)
+	if err := s.svc.UpdateAddress(ctx, a); err != nil {
+		return nil, addressError(err)
+	}
+	return toAddressResponse(a), nil
+}
+
+func (s *Server) DeleteAddress(ctx context.Context, req *proto.DeleteAddressRequest) (*proto.UserEmpty, error) {
+	if req.UserId == "" || req.Id == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "user ID and address ID are required")
+	}
+	if err := authorizeUser(ctx, req.UserId, auth.PermUsersUpdateAny); err != nil {
+		return nil, err
+	}
+	if err := s.svc.DeleteAddress(ctx, req.UserId, req.Id); err != nil {
+		return nil, addressError(err)
+	}
+	return &proto.UserEmpty{}, nil
 }
@@ -16,6 +16,7 @@ import (
 type Cache interface {
 	GetUser(ctx context.Context, id uuid.UUID) (*domain.User, error)
 	SetUser(ctx context.Context, user *domain.User) error
+	DeleteUser(ctx context.Context, id string) error
 }
 
 // RedisCache implements the Cache interface using Redis.
@@ -73,3 +74,14 @@ func (c *RedisCache) SetUser(ctx context.Context, user *domain.User) error {
 	logrus.WithField("user_id", user.ID).Info("User cached successfully")
 	return nil
 }
+
+// DeleteUser removes a user from Redis, so the next read loads it from the
+// database.
+func (c *RedisCache) DeleteUser(ctx context.Context, id string) error {
+	if err := c.client.Del(ctx, "user:"+id).Err(); err != nil {
+		logrus.WithError(err).Error("Failed to delete user from cache")
+		return err
+	}
+	logrus.WithField("user_id", id).Info("User removed from cache")
+	return nil
+}
@@ -0,0 +1,126 @@
+package infrastructure
+
+import (
+	"context"
+	"time"
+
+	"ecommerce/internal/user/domain"
+	"github.com/go-redis/redis/v8"
+)
+
+// LockoutPolicy configures when failed logins lock a username or client IP.
+// Once a subject reaches its maximum, every further failure doubles the
+// lockout, starting at BaseLockout and capped at MaxLockout. Failures are
+// forgotten Window after the last one.
+type LockoutPolicy struct {
+	MaxUserAttempts int
+	MaxIPAttempts   int
+	BaseLockout     time.Duration
+	MaxLockout      time.Duration
+	Window          time.Duration
+}
+
+// LoginLimiter counts failed logins in Redis, so that every instance of the
+// user service shares the counters.
+type LoginLimiter struct {
+	client *redis.Client
+	policy LockoutPolicy
+}
+
+// NewLoginLimiter connects to the Redis instance holding the counters.
+func NewLoginLimiter(addr string, policy LockoutPolicy) *LoginLimiter {
+	return &LoginLimiter{client: redis.NewClient(&redis.Options{Addr: addr}), policy: policy}
+}
+
+func failuresKey(scope, subject string) string {
+	return "login:failures:" + scope + ":" + subject
+}
+
+func lockKey(scope, subject string) string {
+	return "login:lock:" + scope + ":" + subject
+}
+
+// Locked returns how long logins for username or from ip remain locked, or
+// zero if they are not.
+func (l *LoginLimiter) Locked(ctx context.Context, username, ip string) (time.Duration, error) {
+	pipe := l.client.Pipeline()
+	cmds := []*redis.DurationCmd{pipe.PTTL(ctx, lockKey(domain.LockoutScopeUsername, username))}
+	if ip != "" {
+		cmds = append(cmds, pipe.PTTL(ctx, lockKey(domain.LockoutScopeIP, ip)))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, err
+	}
+	var locked time.Duration
+	for _, cmd := range cmds {
+		// Missing keys have a negative TTL
+		if d := cmd.Val(); d > locked {
+			locked = d
+		}
+	}
+	return locked, nil
+}
+
+// Fail counts a failed login for username and ip and returns the lockouts
+// it caused.
+func (l *LoginLimiter) Fail(ctx context.Context, username, ip string, now time.Time) ([]domain.Lockout, error) {
+	subjects := []struct {
+		scope, subject string
+		max            int
+	}{
+		{domain.LockoutScopeUsername, username, l.policy.MaxUserAttempts},
+		{domain.LockoutScopeIP, ip, l.policy.MaxIPAttempts},
+	}
+	var lockouts []domain.Lockout
+	for _, s := range subjects {
+		if s.subject == "" || s.max <= 0 {
+			continue
+		}
+		key := failuresKey(s.scope, s.subject)
+		pipe := l.client.TxPipeline()
+		incr := pipe.Incr(ctx, key)
+		pipe.Expire(ctx, key, l.policy.Window)
+		if _, err := pipe.Exec(ctx); err != nil {
+			return lockouts, err
+		}
+		attempts := int(incr.Val())
+		if attempts < s.max {
+			continue
+		}
+		d := l.lockoutFor(attempts - s.max)
+		if err := l.client.Set(ctx, lockKey(s.scope, s.subject), attempts, d).Err(); err != nil {
+			return lockouts, err
+		}
+		lockouts = append(lockouts, domain.Lockout{
+			Scope:       s.scope,
+			Subject:     s.subject,
+			Attempts:    attempts,
+			LockedUntil: now.Add(d),
+			CreatedAt:   now,
+		})
+	}
+	return lockouts, nil
+}
+
+// lockoutFor returns the lockout after excess failures beyond the maximum.
+func (l *LoginLimiter) lockoutFor(excess int) time.Duration {
+	d := l.policy.BaseLockout
+	for i := 0; i < excess && d < l.policy.MaxLockout; i++ {
+		d *= 2
+	}
+	if d > l.policy.MaxLockout {
+		d = l.policy.MaxLockout
+	}
+	return d
+}
+
+// Succeed forgets the failed logins for username. Failures from the IP are
+// kept, so that one known password does not reset an attacker's count.
+func (l *LoginLimiter) Succeed(ctx context.Context, username string) error {
+	return l.client.Del(ctx, failuresKey(domain.LockoutScopeUsername, username)).Err()
+}
+
+// Clear lifts the lockout of a subject and forgets its failed logins.
+func (l *LoginLimiter) Clear(ctx context.Context, scope, subject string) error {
+	return l.client.Del(ctx, failuresKey(scope, subject), lockKey(scope, subject)).Err()
+}
@@ -2,11 +2,14 @@ package infrastructure
 
 import (
 	"context"
+	"ecommerce/internal/database"
 	"ecommerce/internal/user/domain"
 	"errors"
 	"github.com/google/uuid"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"time"
 )
 
 type Repository struct {
@@ -14,21 +17,33 @@ type Repository struct {
 }
 
 func NewRepository(dsn string) (*Repository, error) {
-	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
+	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{TranslateError: true})
 	if err != nil {
 		return nil, err
 	}
-	if err := db.AutoMigrate(&domain.User{}); err != nil {
+	if err := db.AutoMigrate(&domain.User{}, &domain.UserRole{}, &domain.Session{}, &domain.RefreshToken{}, &domain.UserToken{}, &domain.Lockout{},
+		&domain.RecoveryCode{}, &domain.TwoFactorRequirement{}, &domain.Address{}); err != nil {
 		return nil, err
 	}
 	return &Repository{db: db}, nil
 }
 
+// conn returns the transaction bound to ctx, if any, or the plain database
+// handle otherwise.
+func (r *Repository) conn(ctx context.Context) *gorm.DB {
+	return database.Conn(ctx, r.db)
+}
+
+// WithTransaction executes fn within a database transaction bound to txCtx.
+func (r *Repository) WithTransaction(ctx context.Context, fn func(txCtx context.Context) error, opts ...database.TxOption) error {
+	return database.WithTransaction(ctx, r.db, fn, opts...)
+}
+
 func (r *Repository) Create(ctx context.Context, u *domain.User) error {
 	if u.ID == "" {
 		u.ID = uuid.New().String()
 	}
-	result := r.db.WithContext(ctx).Create(u)
+	result := r.conn(ctx).Create(u)
 	if result.Error != nil {
 		return result.Error
 	}
@@ -40,10 +55,10 @@ func (r *Repository) Create(ctx context.Context, u *domain.User) error {
 
 func (r *Repository) Get(ctx context.Context, id string) (*domain.User, error) {
 	var u domain.User
-	result := r.db.WithContext(ctx).First(&u, "id = ?", id)
+	result := r.conn(ctx).Preload("Roles").First(&u, "id = ? AND deleted_at IS NULL", id)
 	if result.Error != nil {
 		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
-			return nil, errors.New("user not found")
+			return nil, domain.ErrUserNotFound
 		}
 		return nil, result.Error
 	}
@@ -52,12 +67,376 @@ func (r *Repository) Get(ctx context.Context, id string) (*domain.User, error) {
 
 func (r *Repository) GetByUsername(ctx context.Context, username string) (*domain.User, error) {
 	var u domain.User
-	result := r.db.WithContext(ctx).First(&u, "username = ?", username)
+	result := r.conn(ctx).Preload("Roles").First(&u, "username = ? AND deleted_at IS NULL", username)
 	if result.Error != nil {
 		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
-			return nil, errors.New("user not found")
+			return nil, domain.ErrUserNotFound
 		}
 		return nil, result.Error
 	}
 	return &u, nil
 }
+
+// LockUser retrieves a user for update, without its roles.
+func (r *Repository) LockUser(ctx context.Context, id string) (*domain.User, error) {
+	var u domain.User
+	err := r.conn(ctx).Clauses(clause.Locking{Strength: "UPDATE"}).First(&u, "id = ? AND deleted_at IS NULL", id).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, domain.ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// GetByEmail retrieves a user by email address.
+func (r *Repository) GetByEmail(ctx context.Context, email string) (*domain.User, error) {
+	var u domain.User
+	err := r.conn(ctx).Preload("Roles").First(&u, "email = ? AND deleted_at IS NULL", email).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, domain.ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// Update saves a user without touching its roles and bumps its version. It
+// fails with ErrVersionConflict if the user is no longer at the version it
+// was read at.
+func (r *Repository) Update(ctx context.Context, u *domain.User) error {
+	saved, err := database.SaveVersion(r.conn(ctx).Omit(clause.Associations), u, &u.Version)
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		return domain.ErrUserExists
+	}
+	if err != nil || saved {
+		return err
+	}
+	var count int64
+	if err := r.conn(ctx).Model(&domain.User{}).Where("id = ?", u.ID).Count(&count).Error; err != nil {
+		return err
+	}
+	if count == 0 {
+		return domain.ErrUserNotFound
+	}
+	return domain.ErrVersionConflict
+}
+
+// AnonymizeDeleted replaces the personal data of up to limit users deleted
+// before cutoff and removes their roles, sessions and tokens. It returns the
+// IDs of the anonymized users.
+func (r *Repository) AnonymizeDeleted(ctx context.Context, cutoff, now time.Time, limit int) ([]string, error) {
+	var ids []string
+	err := r.WithTransaction(ctx, func(txCtx context.Context) error {
+		db := r.conn(txCtx)
+		err := db.Model(&domain.User{}).
+			Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("deleted_at < ? AND anonymized_at IS NULL", cutoff).
+			Limit(limit).
+			Pluck("id", &ids).Error
+		if err != nil || len(ids) == 0 {
+			return err
+		}
+		err = db.Model(&domain.User{}).Where("id IN ?", ids).Updates(map[string]interface{}{
+			"username":      gorm.Expr("'deleted-' || id"),
+			"email":         gorm.Expr("'deleted-' || id || '@invalid'"),
+			"password":      "",
+			"verified":      false,
+			"totp_secret":   "",
+			"totp_enabled":  false,
+			"anonymized_at": now,
+			"version":       gorm.Expr("version + 1"),
+		}).Error
+		if err != nil {
+			return err
+		}
+		for _, model := range []interface{}{&domain.UserRole{}, &domain.UserToken{}, &domain.RecoveryCode{}, &domain.Address{}, &domain.RefreshToken{}, &domain.Session{}} {
+			if err := db.Where("user_id IN ?", ids).Delete(model).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return ids, err
+}
+
+// CreateUserToken stores a user token hash.
+func (r *Repository) CreateUserToken(ctx context.Context, t *domain.UserToken) error {
+	return r.conn(ctx).Create(t).Error
+}
+
+// LockUserToken retrieves a user token by hash and purpose for update.
+func (r *Repository) LockUserToken(ctx context.Context, hash, purpose string) (*domain.UserToken, error) {
+	var t domain.UserToken
+	err := r.conn(ctx).Clauses(clause.Locking{Strength: "UPDATE"}).
+		First(&t, "token_hash = ? AND purpose = ?", hash, purpose).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, domain.ErrInvalidToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// UseUserTokens marks every unused token of a user for purpose as used, so
+// that only the most recently mailed token works.
+func (r *Repository) UseUserTokens(ctx context.Context, userID, purpose string, now time.Time) error {
+	return r.conn(ctx).Model(&domain.UserToken{}).
+		Where("user_id = ? AND purpose = ? AND used_at IS NULL", userID, purpose).
+		Update("used_at", now).Error
+}
+
+// AddRole grants a role to a user. Granting a role the user already has is a
+// no-op.
+func (r *Repository) AddRole(ctx context.Context, role *domain.UserRole) error {
+	return r.conn(ctx).Clauses(clause.OnConflict{DoNothing: true}).Create(role).Error
+}
+
+// RemoveRole revokes a role from a user.
+func (r *Repository) RemoveRole(ctx context.Context, userID, role string) error {
+	return r.conn(ctx).Delete(&domain.UserRole{}, "user_id = ? AND role = ?", userID, role).Error
+}
+
+// CreateSession stores a new session.
+func (r *Repository) CreateSession(ctx context.Context, s *domain.Session) error {
+	if s.ID == "" {
+		s.ID = uuid.New().String()
+	}
+	return r.conn(ctx).Create(s).Error
+}
+
+// GetSession retrieves a session of a user.
+func (r *Repository) GetSession(ctx context.Context, userID, id string) (*domain.Session, error) {
+	var s domain.Session
+	err := r.conn(ctx).First(&s, "id = ? AND user_id = ?", id, userID).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, domain.ErrSessionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// LockSession retrieves a session for update.
+func (r *Repository) LockSession(ctx context.Context, id string) (*domain.Session, error) {
+	var s domain.Session
+	err := r.conn(ctx).Clauses(clause.Locking{Strength: "UPDATE"}).First(&s, "id = ?", id).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, domain.ErrSessionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// UpdateSession saves a session.
+func (r *Repository) UpdateSession(ctx context.Context, s *domain.Session) error {
+	return r.conn(ctx).Save(s).Error
+}
+
+// ListActiveSessions returns the sessions of a user that are neither revoked
+// nor expired at now, most recently used first.
+func (r *Repository) ListActiveSessions(ctx context.Context, userID string, now time.Time) ([]*domain.Session, error) {
+	var sessions []*domain.Session
+	err := r.conn(ctx).
+		Where("user_id = ? AND revoked_at IS NULL AND expires_at > ?", userID, now).
+		Order("last_used_at DESC").
+		Find(&sessions).Error
+	return sessions, err
+}
+
+// RevokeSessions revokes all active sessions of a user except keepID, which
+// may be empty, and returns their IDs.
+func (r *Repository) RevokeSessions(ctx context.Context, userID, keepID, reason string, now time.Time) ([]string, error) {
+	var revoked []*domain.Session
+	q := r.conn(ctx).Model(&revoked).
+		Clauses(clause.Returning{Columns: []clause.Column{{Name: "id"}}}).
+		Where("user_id = ? AND revoked_at IS NULL", userID)
+	if keepID != "" {
+		q = q.Where("id <> ?", keepID)
+	}
+	err := q.Updates(map[string]interface{}{"revoked_at": now, "revoke_reason": reason}).Error
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(revoked))
+	for _, s := range revoked {
+		ids = append(ids, s.ID)
+	}
+	return ids, nil
+}
+
+// CreateRefreshToken stores a refresh token hash.
+func (r *Repository) CreateRefreshToken(ctx context.Context, t *domain.RefreshToken) error {
+	return r.conn(ctx).Create(t).Error
+}
+
+// LockRefreshToken retrieves a refresh token by hash for update.
+func (r *Repository) LockRefreshToken(ctx context.Context, hash string) (*domain.RefreshToken, error) {
+	var t domain.RefreshToken
+	err := r.conn(ctx).Clauses(clause.Locking{Strength: "UPDATE"}).First(&t, "token_hash = ?", hash).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, domain.ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// MarkRefreshTokenUsed records that a refresh token was rotated.
+func (r *Repository) MarkRefreshTokenUsed(ctx context.Context, hash string, now time.Time) error {
+	return r.conn(ctx).Model(&domain.RefreshToken{}).
+		Where("token_hash = ?", hash).
+		Update("used_at", now).Error
+}
+
+// CreateLockout stores a lockout record.
+func (r *Repository) CreateLockout(ctx context.Context, l *domain.Lockout) error {
+	if l.ID == "" {
+		l.ID = uuid.New().String()
+	}
+	return r.conn(ctx).Create(l).Error
+}
+
+// ListLockouts returns up to limit lockout records, newest first. Empty scope
+// and subject match all; activeOnly skips cleared and expired lockouts.
+func (r *Repository) ListLockouts(ctx context.Context, scope, subject string, activeOnly bool, now time.Time, limit int) ([]*domain.Lockout, error) {
+	q := r.conn(ctx).Order("created_at DESC").Limit(limit)
+	if scope != "" {
+		q = q.Where("scope = ?", scope)
+	}
+	if subject != "" {
+		q = q.Where("subject = ?", subject)
+	}
+	if activeOnly {
+		q = q.Where("cleared_at IS NULL AND locked_until > ?", now)
+	}
+	var lockouts []*domain.Lockout
+	err := q.Find(&lockouts).Error
+	return lockouts, err
+}
+
+// ClearLockouts marks the uncleared lockout records of a subject as cleared
+// and returns how many there were.
+func (r *Repository) ClearLockouts(ctx context.Context, scope, subject, clearedBy string, now time.Time) (int64, error) {
+	result := r.conn(ctx).Model(&domain.Lockout{}).
+		Where("scope = ? AND subject = ? AND cleared_at IS NULL", scope, subject).
+		Updates(map[string]interface{}{"cleared_at": now, "cleared_by": clearedBy})
+	return result.RowsAffected, result.Error
+}
+
+// ReplaceRecoveryCodes replaces all recovery codes of a user with codes.
+func (r *Repository) ReplaceRecoveryCodes(ctx context.Context, userID string, codes []*domain.RecoveryCode) error {
+	return r.WithTransaction(ctx, func(txCtx context.Context) error {
+		if err := r.conn(txCtx).Delete(&domain.RecoveryCode{}, "user_id = ?", userID).Error; err != nil {
+			return err
+		}
+		if len(codes) == 0 {
+			return nil
+		}
+		return r.conn(txCtx).Create(codes).Error
+	})
+}
+
+// UseRecoveryCode marks an unused recovery code of a user as used and reports
+// whether there was one.
+func (r *Repository) UseRecoveryCode(ctx context.Context, userID, hash string, now time.Time) (bool, error) {
+	result := r.conn(ctx).Model(&domain.RecoveryCode{}).
+		Where("code_hash = ? AND user_id = ? AND used_at IS NULL", hash, userID).
+		Update("used_at", now)
+	return result.RowsAffected == 1, result.Error
+}
+
+// CountRecoveryCodes returns the number of unused recovery codes of a user.
+func (r *Repository) CountRecoveryCodes(ctx context.Context, userID string) (int64, error) {
+	var n int64
+	err := r.conn(ctx).Model(&domain.RecoveryCode{}).
+		Where("user_id = ? AND used_at IS NULL", userID).
+		Count(&n).Error
+	return n, err
+}
+
+// RequireTwoFactor makes two-factor authentication mandatory for a role.
+// Requiring it again is a no-op.
+func (r *Repository) RequireTwoFactor(ctx context.Context, req *domain.TwoFactorRequirement) error {
+	return r.conn(ctx).Clauses(clause.OnConflict{DoNothing: true}).Create(req).Error
+}
+
+// UnrequireTwoFactor makes two-factor authentication optional for a role.
+func (r *Repository) UnrequireTwoFactor(ctx context.Context, role string) error {
+	return r.conn(ctx).Delete(&domain.TwoFactorRequirement{}, "role = ?", role).Error
+}
+
+// ListTwoFactorRequirements returns the roles that require two-factor
+// authentication.
+func (r *Repository) ListTwoFactorRequirements(ctx context.Context) ([]*domain.TwoFactorRequirement, error) {
+	var reqs []*domain.TwoFactorRequirement
+	err := r.conn(ctx).Order("role").Find(&reqs).Error
+	return reqs, err
+}
+
+// CreateAddress stores a new address.
+func (r *Repository) CreateAddress(ctx context.Context, a *domain.Address) error {
+	if a.ID == "" {
+		a.ID = uuid.New().String()
+	}
+	return r.conn(ctx).Create(a).Error
+}
+
+// GetAddress retrieves an address of a user.
+func (r *Repository) GetAddress(ctx context.Context, userID, id string) (*domain.Address, error) {
+	var a domain.Address
+	err := r.conn(ctx).First(&a, "id = ? AND user_id = ?", id, userID).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, domain.ErrAddressNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+// ListAddresses returns the addresses of a user, oldest first.
+func (r *Repository) ListAddresses(ctx context.Context, userID string) ([]*domain.Address, error) {
+	var addresses []*domain.Address
+	err := r.conn(ctx).Where("user_id = ?", userID).Order("created_at").Find(&addresses).Error
+	return addresses, err
+}
+
+// CountAddresses returns the number of addresses of a user.
+func (r *Repository) CountAddresses(ctx context.Context, userID string) (int64, error) {
+	var n int64
+	err := r.conn(ctx).Model(&domain.Address{}).Where("user_id = ?", userID).Count(&n).Error
+	return n, err
+}
+
+// UpdateAddress saves an address.
+func (r *Repository) UpdateAddress(ctx context.Context, a *domain.Address) error {
+	return r.conn(ctx).Save(a).Error
+}
+
+// DeleteAddress deletes an address of a user.
+func (r *Repository) DeleteAddress(ctx context.Context, userID, id string) error {
+	result := r.conn(ctx).Delete(&domain.Address{}, "id = ? AND user_id = ?", id, userID)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return domain.ErrAddressNotFound
+	}
+	return nil
+}
+
+// ClearDefaultAddress unsets the default flag column ("default_shipping" or
+// "default_billing") on the addresses of a user other than exceptID.
+func (r *Repository) ClearDefaultAddress(ctx context.Context, userID, column, exceptID string) error {
+	return r.conn(ctx).Model(&domain.Address{}).
+		Where("user_id = ? AND id <> ? AND "+column, userID, exceptID).
+		Update(column, false).Error
+}
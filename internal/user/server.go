@@ -1,13 +1,18 @@
 package user
 
 import (
+	"context"
+	"ecommerce/internal/auth"
 	"ecommerce/internal/config"
+	"ecommerce/internal/idempotency"
 	"ecommerce/internal/user/application"
 	"ecommerce/internal/user/infrastructure"
 	"ecommerce/proto"
+	"fmt"
 	"google.golang.org/grpc"
 	"log"
 	"net"
+	"strings"
 )
 
 func Run(cfg *config.Config) error {
@@ -16,16 +21,113 @@ func Run(cfg *config.Config) error {
 		return err
 	}
 	cache := infrastructure.NewRedisCache(cfg.RedisAddr)
-	svc := application.NewService(repo, cache)
+
+	// Access tokens are signed with the active key; all public keys are
+	// served through GetJWKS so verifiers pick up rotated keys
+	jwtKeys, err := auth.LoadKeySet(cfg.JWTAlgorithm, cfg.JWTKeys, cfg.JWTActiveKeyID)
+	if err != nil {
+		return err
+	}
+	if cfg.JWTKeys == "" {
+		log.Printf("JWT_KEYS is not set, signing with an ephemeral key")
+	}
+	signer := auth.NewSigner(jwtKeys, cfg.JWTIssuer, cfg.JWTTTL)
+
+	// Revoked sessions are denied through Redis, which the gateway checks
+	// on every request
+	denylist := auth.NewDenylist(cfg.RedisAddr)
+
+	mailer, err := newMailer(cfg)
+	if err != nil {
+		return err
+	}
+	mail := application.MailSettings{
+		Mailer:           mailer,
+		BaseURL:          cfg.AppBaseURL,
+		PasswordResetTTL: cfg.PasswordResetTTL,
+		VerificationTTL:  cfg.EmailVerificationTTL,
+	}
+
+	// Failed logins are counted in Redis and lock the username and client IP
+	limiter := infrastructure.NewLoginLimiter(cfg.RedisAddr, infrastructure.LockoutPolicy{
+		MaxUserAttempts: cfg.LoginMaxAttempts,
+		MaxIPAttempts:   cfg.LoginIPMaxAttempts,
+		BaseLockout:     cfg.LoginLockoutBase,
+		MaxLockout:      cfg.LoginLockoutMax,
+		Window:          cfg.LoginAttemptWindow,
+	})
+
+	twoFactor := application.TwoFactorSettings{Issuer: cfg.TOTPIssuer, ChallengeTTL: cfg.TwoFactorChallengeTTL}
+
+	svc := application.NewService(repo, cache, jwtKeys, signer, denylist, cfg.RefreshTokenTTL, mail, limiter, twoFactor)
 	server := NewServer(svc)
 
+	// Deleted accounts keep their data for a grace period, then it is
+	// anonymized
+	go svc.RunAnonymizer(context.Background(), cfg.UserDeletionGracePeriod, cfg.UserAnonymizeInterval)
+
+	if cfg.BootstrapAdmins != "" {
+		svc.EnsureAdmins(context.Background(), strings.Split(cfg.BootstrapAdmins, ","))
+	}
+
+	// Retried mutations carrying an idempotency key get the original
+	// response instead of running twice
+	keys, err := idempotency.NewRepository(cfg.DSN())
+	if err != nil {
+		return err
+	}
+	go keys.RunPurge(context.Background(), cfg.IdempotencyPurgeInterval)
+
 	lis, err := net.Listen("tcp", cfg.UserAddr)
 	if err != nil {
 		return err
 	}
 
-	s := grpc.NewServer()
+	s := grpc.NewServer(grpc.ChainUnaryInterceptor(
+		auth.UnaryServerInterceptor(auth.NewVerifier(jwtKeys, cfg.JWTIssuer), cfg.ServiceToken, auth.Rules{
+			proto.UserService_GetUserProfile_FullMethodName:            auth.PermUsersRead,
+			proto.UserService_Logout_FullMethodName:                    auth.PermSessionsManage,
+			proto.UserService_LogoutAllSessions_FullMethodName:         auth.PermSessionsManage,
+			proto.UserService_ListSessions_FullMethodName:              auth.PermSessionsManage,
+			proto.UserService_GrantRole_FullMethodName:                 auth.PermUsersManage,
+			proto.UserService_RevokeRole_FullMethodName:                auth.PermUsersManage,
+			proto.UserService_SendVerificationEmail_FullMethodName:     auth.PermUsersRead,
+			proto.UserService_UpdateUserProfile_FullMethodName:         auth.PermUsersUpdate,
+			proto.UserService_ChangePassword_FullMethodName:            auth.PermUsersUpdate,
+			proto.UserService_DeleteUser_FullMethodName:                auth.PermUsersUpdate,
+			proto.UserService_ListLockouts_FullMethodName:              auth.PermLockoutsManage,
+			proto.UserService_ClearLockout_FullMethodName:              auth.PermLockoutsManage,
+			proto.UserService_EnrollTwoFactor_FullMethodName:           auth.PermUsersUpdate,
+			proto.UserService_ConfirmTwoFactor_FullMethodName:          auth.PermUsersUpdate,
+			proto.UserService_DisableTwoFactor_FullMethodName:          auth.PermUsersUpdate,
+			proto.UserService_SetTwoFactorRequirement_FullMethodName:   auth.PermUsersManage,
+			proto.UserService_ListTwoFactorRequirements_FullMethodName: auth.PermUsersManage,
+			proto.UserService_CreateAddress_FullMethodName:             auth.PermUsersUpdate,
+			proto.UserService_GetAddress_FullMethodName:                auth.PermUsersRead,
+			proto.UserService_ListAddresses_FullMethodName:             auth.PermUsersRead,
+			proto.UserService_UpdateAddress_FullMethodName:             auth.PermUsersUpdate,
+			proto.UserService_DeleteAddress_FullMethodName:             auth.PermUsersUpdate,
+		}),
+		idempotency.UnaryServerInterceptor(keys, cfg.IdempotencyRetention,
+			proto.UserService_RegisterUser_FullMethodName,
+			proto.UserService_UpdateUserProfile_FullMethodName,
+			proto.UserService_CreateAddress_FullMethodName,
+		),
+	))
 	proto.RegisterUserServiceServer(s, server)
 	log.Printf("User service running on %s", cfg.UserAddr)
 	return s.Serve(lis)
 }
+
+// newMailer creates the mailer selected by MAILER: smtp, file or memory.
+func newMailer(cfg *config.Config) (infrastructure.Mailer, error) {
+	switch cfg.Mailer {
+	case "smtp":
+		return infrastructure.NewSMTPMailer(cfg.SMTPHost, cfg.SMTPPort, cfg.SMTPUsername, cfg.SMTPPassword, cfg.MailFrom), nil
+	case "file":
+		return infrastructure.NewFileMailer(cfg.MailDir, cfg.MailFrom)
+	case "memory":
+		return infrastructure.NewMemoryMailer(), nil
+	}
+	return nil, fmt.Errorf("unknown mailer %q", cfg.Mailer)
+}